@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+func ageCommand(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman age recipient|identity|encrypt|decrypt")
+	}
+
+	switch args[0] {
+	case "recipient":
+		ageRecipient(args[1:])
+	case "identity":
+		ageIdentity(args[1:])
+	case "encrypt":
+		ageEncrypt(args[1:])
+	case "decrypt":
+		ageDecrypt(args[1:])
+	default:
+		fatalUsage("Unknown age command")
+	}
+}
+
+// ageRecipient prints the age X25519 recipient of each Ed25519 key, as a
+// recipients file with a comment naming each key when there are several.
+func ageRecipient(args []string) {
+	flags := flag.NewFlagSet("age recipient", flag.ExitOnError)
+	args = parseFlags(flags, args)
+	if len(args) == 0 {
+		fatalUsage("Usage: keyman age recipient <key>...")
+	}
+
+	for _, key := range args {
+		keyPath, err := resolveKeyArg(key)
+		if err != nil {
+			fatal(err)
+		}
+		pub, err := keyman.ReadPublicKeyFile(keyPath + keyFileExt)
+		if err != nil {
+			fatal(err)
+		}
+		recipient, err := keyman.AgeRecipient(pub)
+		if errors.Is(err, keyman.ErrNotEd25519) {
+			fatalf("%s: %v, but age encrypt --key can still encrypt to it", key, err)
+		} else if err != nil {
+			fatal(err)
+		}
+		if len(args) > 1 {
+			fmt.Printf("# %s\n", key)
+		}
+		fmt.Println(recipient)
+	}
+}
+
+// ageIdentity prints or writes the age X25519 identity of an Ed25519 key,
+// for tools such as sops that take age keys but not ssh keys.
+func ageIdentity(args []string) {
+	flags := flag.NewFlagSet("age identity", flag.ExitOnError)
+	output := flags.String("o", "", "write the identity to this file, readable only by you, instead of printing it")
+	force := flags.Bool("force", false, "overwrite the -o file if it exists")
+	passphraseFile := flags.String("passphrase-file", "", "read the key's passphrase from a file, or - for stdin")
+	args = parseFlags(flags, args)
+	if len(args) != 1 {
+		fatalUsage("Usage: keyman age identity [-o file] [--force] [--passphrase-file f] <key>")
+	}
+
+	keyPath, err := resolveKeyArg(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		fatal(err)
+	}
+	key, err := keyman.ParsePrivateKey(data)
+	if errors.Is(err, keyman.ErrEncryptedKey) {
+		passphrase, err := getPassphrase(*passphraseFile, fmt.Sprintf("Passphrase for %s: ", keyPath), false)
+		if err != nil {
+			fatal(err)
+		}
+		key, err = readEncryptedKey(keyPath, passphrase)
+		if err != nil {
+			fatalf("Reading %s failed: %v", keyPath, err)
+		}
+	} else if err != nil {
+		fatalf("Reading %s failed: %v", keyPath, err)
+	}
+
+	identity, recipient, err := keyman.AgeIdentity(key)
+	if err != nil {
+		fatalf("%s: %v", args[0], err)
+	}
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n# converted from: %s\n%s\n",
+		time.Now().UTC().Format(time.RFC3339), recipient, keyPath, identity)
+
+	if *output == "" {
+		fmt.Print(content)
+		return
+	}
+	if _, err := os.Stat(*output); err == nil && !*force {
+		fatalf("%s already exists, use --force to replace it", *output)
+	}
+	if dryRun {
+		fmt.Printf("Would write %s\n", *output)
+		return
+	}
+	if err := os.WriteFile(*output, []byte(content), 0600); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("Wrote %s\nPublic key: %s\n", *output, recipient)
+}
+
+// ageEncrypt encrypts a file with the age tool to ssh keys, which age
+// takes as recipients itself, and to any age recipients.
+func ageEncrypt(args []string) {
+	flags := flag.NewFlagSet("age encrypt", flag.ExitOnError)
+	keys := flags.String("key", "", "encrypt to these ssh keys, comma separated")
+	recipients := flags.String("recipient", "", "also encrypt to these age recipients, comma separated")
+	armor := flags.Bool("armor", false, "write PEM armored text instead of binary")
+	output := flags.String("o", "", "write to this file instead of stdout")
+	args = parseFlags(flags, args)
+	if len(args) > 1 || (*keys == "" && *recipients == "") {
+		fatalUsage("Usage: keyman age encrypt --key k,k [--recipient age1...] [--armor] [-o file] [file]")
+	}
+
+	var ageArgs []string
+	for _, key := range splitNames(*keys) {
+		keyPath, err := resolveKeyArg(key)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err := os.Stat(keyPath + keyFileExt); err != nil {
+			fatal(err)
+		}
+		ageArgs = append(ageArgs, "-R", keyPath+keyFileExt)
+	}
+	for _, recipient := range splitNames(*recipients) {
+		ageArgs = append(ageArgs, "-r", recipient)
+	}
+	if *armor {
+		ageArgs = append(ageArgs, "-a")
+	}
+	if err := runAgeStdio(ageArgs, *output, args); err != nil {
+		fatal(err)
+	}
+}
+
+// ageDecrypt decrypts a file with the age tool, using an ssh private key
+// as the identity. age asks for its passphrase itself.
+func ageDecrypt(args []string) {
+	flags := flag.NewFlagSet("age decrypt", flag.ExitOnError)
+	key := flags.String("key", "", "decrypt with this ssh key")
+	identity := flags.String("identity", "", "decrypt with this age identity file instead")
+	output := flags.String("o", "", "write to this file instead of stdout")
+	args = parseFlags(flags, args)
+	if len(args) > 1 || (*key == "") == (*identity == "") {
+		fatalUsage("Usage: keyman age decrypt --key k | --identity file [-o file] [file]")
+	}
+
+	identityPath := *identity
+	if *key != "" {
+		keyPath, err := resolveKeyArg(*key)
+		if err != nil {
+			fatal(err)
+		}
+		identityPath = keyPath
+	}
+	if err := runAgeStdio([]string{"-d", "-i", identityPath}, *output, args); err != nil {
+		fatal(err)
+	}
+}
+
+// runAgeStdio runs the age tool on the file in args, or stdin, writing to
+// output or stdout.
+func runAgeStdio(ageArgs []string, output string, args []string) error {
+	if output != "" {
+		ageArgs = append(ageArgs, "-o", output)
+	}
+	ageArgs = append(ageArgs, args...)
+	cmd := exec.Command("age", ageArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var execErr *exec.Error
+		if errors.As(err, &execErr) {
+			return fmt.Errorf("age not found: install it from https://age-encryption.org")
+		}
+		return err
+	}
+	return nil
+}
+
+// splitNames splits a comma separated flag value, dropping empty names.
+func splitNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
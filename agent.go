@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// agentView is an ssh agent keyman found, through SSH_AUTH_SOCK or an
+// IdentityAgent option, with the keys it holds.
+type agentView struct {
+	Socket     string          `json:"socket"`
+	Kind       string          `json:"kind,omitempty"`
+	Default    bool            `json:"default"`
+	Hosts      []string        `json:"hosts"`
+	Error      string          `json:"error,omitempty"`
+	Identities []agentIdentity `json:"identities"`
+}
+
+// agentIdentity is a key an agent holds. LocalKey names the key in the ssh
+// directory with the same public key, if there is one.
+type agentIdentity struct {
+	Type        string `json:"type"`
+	Algorithm   string `json:"algorithm"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+	LocalKey    string `json:"local_key,omitempty"`
+	PublicKey   string `json:"public_key"`
+	pub         *keyman.PublicKey
+}
+
+// unsafeKeyName matches what cannot go in a key file name made from an
+// agent key's comment.
+var unsafeKeyName = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+func agent(args []string) {
+	if len(args) < 1 {
+		listAgents(args)
+		return
+	}
+
+	switch args[0] {
+	case "list":
+		listAgents(args[1:])
+	case "map":
+		mapAgentKey(args[1:])
+	default:
+		if strings.HasPrefix(args[0], "-") {
+			listAgents(args)
+			return
+		}
+		fatalUsage("Unknown agent command")
+	}
+}
+
+// listAgents shows the agent SSH_AUTH_SOCK points at and those named by
+// IdentityAgent options, telling 1Password and other third-party agents
+// apart from ssh-agent, with the keys each holds and the key in the ssh
+// directory each matches.
+func listAgents(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the agents and their keys as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman agent [list] [--json] [--plain]")
+	}
+
+	agents, err := findAgents("")
+	if err != nil {
+		fatal(err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(agents); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if len(agents) == 0 {
+		fmt.Println("No agent: SSH_AUTH_SOCK is not set and no host has IdentityAgent")
+		return
+	}
+
+	color := useColor(*plain)
+	agentOnly := false
+	for i, view := range agents {
+		if i > 0 {
+			fmt.Println()
+		}
+		var about []string
+		if view.Kind != "" {
+			about = append(about, view.Kind)
+		}
+		if view.Default {
+			about = append(about, "SSH_AUTH_SOCK")
+		}
+		title := "Agent " + view.Socket
+		if len(about) > 0 {
+			title += " (" + strings.Join(about, ", ") + ")"
+		}
+		fmt.Println(paint(title, colorBold, color))
+		if len(view.Hosts) > 0 {
+			fmt.Printf("IdentityAgent for: %s\n", strings.Join(view.Hosts, ", "))
+		}
+		if view.Error != "" {
+			fmt.Println(paint("Cannot list keys: "+view.Error, colorRed, color))
+			continue
+		}
+		if len(view.Identities) == 0 {
+			fmt.Println("No keys")
+			continue
+		}
+
+		var rows [][]tableCell
+		for _, identity := range view.Identities {
+			local := tableCell{text: identity.LocalKey}
+			if identity.LocalKey == "" {
+				local = tableCell{text: "agent only", color: colorYellow}
+				agentOnly = true
+			}
+			rows = append(rows, []tableCell{
+				{text: identity.Type},
+				{text: identity.Fingerprint},
+				{text: identity.Comment},
+				local,
+			})
+		}
+		writeTable(os.Stdout, []string{"type", "fingerprint", "comment", "local key"}, rows, color)
+	}
+	if agentOnly {
+		fmt.Println("\nMap an agent-only key to a host with keyman agent map <fingerprint|comment> <host>.")
+	}
+}
+
+// findAgents lists the keys of the agent at socket, or when socket is
+// empty of the agent SSH_AUTH_SOCK names and of each agent an IdentityAgent
+// option names. An agent that cannot be reached is returned with Error set.
+func findAgents(socket string) ([]agentView, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	identityAgents := config.IdentityAgents()
+	defaultSocket := os.Getenv("SSH_AUTH_SOCK")
+
+	var sockets []string
+	if socket != "" {
+		sockets = append(sockets, socket)
+	} else {
+		if defaultSocket != "" {
+			sockets = append(sockets, defaultSocket)
+		}
+		var configured []string
+		for path := range identityAgents {
+			configured = append(configured, path)
+		}
+		sort.Strings(configured)
+		for _, path := range configured {
+			if !containsString(sockets, path) {
+				sockets = append(sockets, path)
+			}
+		}
+	}
+
+	keys, err := getKeys()
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]string)
+	for _, key := range keys {
+		if key.Public != nil {
+			local[string(key.Public.Blob)] = key.Name
+		}
+	}
+
+	var agents []agentView
+	for _, path := range sockets {
+		view := agentView{
+			Socket:     path,
+			Kind:       keyman.AgentKind(path),
+			Default:    path == defaultSocket,
+			Hosts:      identityAgents[path],
+			Identities: []agentIdentity{},
+		}
+		if view.Hosts == nil {
+			view.Hosts = []string{}
+		}
+		loaded, err := agentKeysAt(path)
+		if err != nil {
+			view.Error = err.Error()
+		}
+		for _, pub := range loaded {
+			view.Identities = append(view.Identities, agentIdentity{
+				Type:        fmt.Sprintf("%s %d", pub.TypeName(), pub.Bits()),
+				Algorithm:   pub.Algorithm,
+				Fingerprint: pub.FingerprintSHA256(),
+				Comment:     pub.Comment,
+				LocalKey:    local[string(pub.Blob)],
+				PublicKey:   pub.String(),
+				pub:         pub,
+			})
+		}
+		agents = append(agents, view)
+	}
+	return agents, nil
+}
+
+// mapAgentKey maps a key that only an agent holds, such as one kept in
+// 1Password, to a host. ssh picks agent keys by their public key, so the
+// public key is saved in the ssh directory and mapped with IdentitiesOnly,
+// along with IdentityAgent when the key is not in the SSH_AUTH_SOCK agent
+// or that agent is a third-party one the user's shell may not point at.
+func mapAgentKey(args []string) {
+	flags := flag.NewFlagSet("agent map", flag.ExitOnError)
+	socket := flags.String("agent", "", "agent socket to take the key from (default SSH_AUTH_SOCK, then each IdentityAgent)")
+	name := flags.String("name", "", "name to save the public key under in the ssh directory (default from its comment)")
+	add := flags.Bool("add", false, "add the key after the host's existing keys instead of refusing")
+	args = parseFlags(flags, args)
+	if len(args) != 2 {
+		fatalUsage("Usage: keyman agent map [--agent socket] [--name n] [--add] <fingerprint|comment> <host>")
+	}
+	query, host := args[0], args[1]
+
+	if *socket != "" {
+		expanded, err := keyman.ExpandPath(*socket)
+		if err != nil {
+			fatal(err)
+		}
+		*socket = expanded
+	}
+	agents, err := findAgents(*socket)
+	if err != nil {
+		fatal(err)
+	}
+	var found *agentIdentity
+	var from agentView
+	for _, view := range agents {
+		if view.Error != "" {
+			fmt.Fprintf(os.Stderr, "Warning: cannot list the keys of %s: %s\n", view.Socket, view.Error)
+		}
+		for i, identity := range view.Identities {
+			if !keyman.FingerprintMatches(identity.pub, query) && identity.Comment != query {
+				continue
+			}
+			if found != nil && !bytes.Equal(found.pub.Blob, identity.pub.Blob) {
+				fatalf("More than one agent key matches %s, give its fingerprint instead", query)
+			}
+			if found == nil {
+				found, from = &view.Identities[i], view
+			}
+		}
+	}
+	if found == nil {
+		fatalf("No agent holds a key matching %s", query)
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+	keyName := found.LocalKey
+	if keyName == "" {
+		keyName = *name
+	}
+	if keyName == "" {
+		keyName = agentKeyName(found.pub)
+	}
+	pubPath := filepath.Join(sshPath, keyName+keyFileExt)
+	if err := saveAgentPublicKey(pubPath, found.pub); err != nil {
+		fatal(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	block := config.FindHost(host)
+	created := block == nil
+	if created {
+		block = config.AppendHost(host)
+	}
+	if !mapKeyToBlock(block, pubPath, configKeyPath(pubPath), mapOptions{add: *add, identitiesOnly: true}) {
+		return
+	}
+	if !from.Default || (from.Kind != "" && from.Kind != "ssh-agent") {
+		block.SetOption("IdentityAgent", homeRelative(from.Socket))
+	}
+
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	journal("map", host, "", keyName)
+
+	if !dryRun {
+		if created {
+			fmt.Printf("Added host %s\n", host)
+		}
+		fmt.Printf("Mapped agent key %s (%s) to host %s\n", keyName, found.Fingerprint, host)
+	}
+}
+
+// agentKeyName makes a key file name from an agent key's comment, which
+// for 1Password is the item's title, or from its fingerprint.
+func agentKeyName(pub *keyman.PublicKey) string {
+	name := pub.Comment
+	if name == "" {
+		name = strings.TrimPrefix(pub.FingerprintSHA256(), "SHA256:")[:8]
+	}
+	return "agent-" + strings.Trim(unsafeKeyName.ReplaceAllString(strings.ToLower(name), "-"), "-.")
+}
+
+// saveAgentPublicKey writes pub to path unless it already holds it.
+func saveAgentPublicKey(path string, pub *keyman.PublicKey) error {
+	if existing, err := keyman.ReadPublicKeyFile(path); err == nil {
+		if bytes.Equal(existing.Blob, pub.Blob) {
+			return nil
+		}
+		return fmt.Errorf("%s holds another key, use --name to save this one under another name", path)
+	} else if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s exists but is not a public key, use --name to save the key under another name", path)
+	}
+
+	if dryRun {
+		fmt.Printf("Would write %s\n", path)
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(pub.String()+"\n"), 0644); err != nil {
+		return err
+	}
+	journal("pubkey", path, "", pub.TypeName()+" "+pub.FingerprintSHA256())
+	fmt.Printf("Wrote %s\n", path)
+	return nil
+}
+
+// homeRelative writes path under the home directory with ~, as ssh
+// configs usually name agent sockets.
+func homeRelative(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || !strings.HasPrefix(path, home+string(filepath.Separator)) {
+		return path
+	}
+	return "~" + path[len(home):]
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// Where --all-users looks for homes.
+const (
+	rootHome = "/root"
+	homesDir = "/home"
+)
+
+// allUsers is set by the global --all-users flag.
+var allUsers bool
+
+// userHome is a user whose ~/.ssh --all-users audits.
+type userHome struct {
+	user string
+	home string
+}
+
+// userAudit is the inventory and audit of one user's ~/.ssh.
+type userAudit struct {
+	User           string              `json:"user"`
+	SSHDir         string              `json:"ssh_dir"`
+	Keys           []userKey           `json:"keys"`
+	AuthorizedKeys []userAuthorizedKey `json:"authorized_keys"`
+	Hosts          []string            `json:"hosts"`
+	Findings       []findingJSON       `json:"findings"`
+	findings       []keyman.Finding
+}
+
+type userKey struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Fingerprint string    `json:"fingerprint"`
+	Created     time.Time `json:"created"`
+	InUse       bool      `json:"in_use"`
+}
+
+type userAuthorizedKey struct {
+	Line        int    `json:"line"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+	Options     string `json:"options,omitempty"`
+}
+
+// userHomes returns root and the users with a home under /home, for those
+// of them that have a .ssh directory.
+func userHomes() []userHome {
+	homes := []userHome{{user: "root", home: rootHome}}
+	entries, err := os.ReadDir(homesDir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Warning: reading %s: %v\n", homesDir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			homes = append(homes, userHome{user: entry.Name(), home: filepath.Join(homesDir, entry.Name())})
+		}
+	}
+
+	var withSSH []userHome
+	for _, home := range homes {
+		if info, err := os.Stat(filepath.Join(home.home, sshDir)); err == nil && info.IsDir() {
+			withSSH = append(withSSH, home)
+		}
+	}
+	return withSSH
+}
+
+// useUserHome points keyman at a user's ~/.ssh and their keyman metadata,
+// the way --ssh-dir would for that home.
+func useUserHome(home userHome) {
+	sshPathOverride = filepath.Join(home.home, sshDir)
+	configPathOverride, knownHostsPath = "", ""
+	keyman.HomeDir = home.home
+	metadataHome = home.home
+}
+
+// auditAllUsers audits the ~/.ssh of root and of every user under /home,
+// as an administrator taking over a shared machine needs to: each user's
+// keys, authorized_keys and Host blocks, with the findings audit would
+// report for them, followed by a summary. The policy and settings are
+// those of the user running keyman.
+func auditAllUsers(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	policyPath := flags.String("policy", "", "policy file to evaluate (default ~/.config/keyman/policy.yaml if present)")
+	defaultWindow := "30d"
+	if settings.ExpiryWindow > 0 {
+		defaultWindow = settings.ExpiryWindow.String()
+	}
+	expiryWindowFlag := flags.String("expiry-window", defaultWindow, "warn about keys expiring within this long")
+	unusedAfterFlag := flags.String("unused-after", "90d", "count keys with a recorded last use as unused when not used for this long")
+	failOnFlag := flags.String("fail-on", "error", "exit non-zero on findings of this severity or worse: info, warning or error")
+	asJSON := flags.Bool("json", settings.Output == "json", "print the inventory and findings as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman --all-users audit [--policy file] [--expiry-window d] [--unused-after d] [--fail-on severity] [--json] [--plain]")
+	}
+	expiryWindow, err := keyman.ParseAge(*expiryWindowFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+	unusedAfter, err := keyman.ParseAge(*unusedAfterFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+	failOn, err := keyman.ParseSeverity(*failOnFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+	policy, err := auditPolicy(*policyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintln(os.Stderr, "Warning: not running as root, so other users' files may be unreadable")
+	}
+	homes := userHomes()
+	if len(homes) == 0 {
+		fatalf("No .ssh directories in %s or under %s", rootHome, homesDir)
+	}
+
+	var audits []userAudit
+	failed, unreadable := false, 0
+	for _, home := range homes {
+		useUserHome(home)
+		result, err := auditUser(home, expiryWindow, unusedAfter, policy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not audit %s: %v\n", home.user, err)
+			unreadable++
+			continue
+		}
+		for _, finding := range result.findings {
+			if finding.Severity >= failOn {
+				failed = true
+			}
+		}
+		audits = append(audits, result)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(audits); err != nil {
+			fatal(err)
+		}
+	} else {
+		for _, result := range audits {
+			printUserAudit(result, useColor(*plain))
+		}
+		printUserSummary(audits, useColor(*plain))
+	}
+
+	if unreadable > 0 {
+		fatalf("Could not audit %d user(s)", unreadable)
+	}
+	if failed {
+		os.Exit(exitFindings)
+	}
+}
+
+// auditUser takes the inventory of the ~/.ssh keyman currently points at
+// and audits it. Git signing is left out, since keyman can only see the
+// git config of the user running it.
+func auditUser(home userHome, expiryWindow, unusedAfter time.Duration, policy *keyman.Policy) (userAudit, error) {
+	result := userAudit{User: home.user, SSHDir: sshPathOverride}
+	keys, err := getKeys()
+	if err != nil {
+		return result, err
+	}
+	sshConfig, err := loadConfig()
+	if err != nil {
+		return result, err
+	}
+	mappings, err := sshConfig.Mappings()
+	if err != nil {
+		return result, err
+	}
+	report := keyman.Audit(keys, mappings, unusedAfter)
+
+	var policyFindings []keyman.Finding
+	if policy != nil {
+		policyFindings = policy.Evaluate(keys)
+	}
+	findings, err := auditFindings(report, sshConfig, expiryWindow, false, keyman.CheckStrength(keys), policyFindings)
+	if err != nil {
+		return result, err
+	}
+	for _, finding := range findings {
+		if finding.Rule != ruleGitSigning {
+			result.findings = append(result.findings, finding)
+		}
+	}
+
+	for _, key := range report.Keys {
+		result.Keys = append(result.Keys, userKey{
+			Name:        key.Name,
+			Type:        reportKeyType(key),
+			Fingerprint: reportFingerprint(key),
+			Created:     key.Created,
+			InUse:       key.InUse,
+		})
+	}
+
+	lines, err := readLines(filepath.Join(sshPathOverride, authorizedKeysFile))
+	if err != nil {
+		return result, err
+	}
+	var authorizedKeys []keyman.Key
+	for _, entry := range parseAuthorizedKeys(lines) {
+		result.AuthorizedKeys = append(result.AuthorizedKeys, userAuthorizedKey{
+			Line:        entry.line,
+			Type:        fmt.Sprintf("%s %d", entry.pub.TypeName(), entry.pub.Bits()),
+			Fingerprint: entry.pub.FingerprintSHA256(),
+			Comment:     entry.pub.Comment,
+			Options:     entry.options,
+		})
+		authorizedKeys = append(authorizedKeys, keyman.Key{Name: authorizedKeysFile + ":" + strconv.Itoa(entry.line), Public: entry.pub})
+	}
+	// Weak keys others log in with matter as much as the user's own.
+	result.findings = append(result.findings, keyman.CheckStrength(authorizedKeys)...)
+	sort.SliceStable(result.findings, func(i, j int) bool {
+		return result.findings[i].Severity > result.findings[j].Severity
+	})
+
+	for _, block := range sshConfig.AllBlocks() {
+		if !block.Match && !block.IsDefaults() {
+			result.Hosts = append(result.Hosts, block.Name())
+		}
+	}
+	result.Findings = []findingJSON{}
+	for _, finding := range result.findings {
+		result.Findings = append(result.Findings, findingJSON{
+			Severity: finding.Severity.String(),
+			Rule:     finding.Rule,
+			Subject:  finding.Subject,
+			Message:  finding.Message,
+		})
+	}
+	return result, nil
+}
+
+func printUserAudit(result userAudit, color bool) {
+	fmt.Println(paint(fmt.Sprintf("=== %s: %s ===", result.User, result.SSHDir), colorBold, color))
+
+	if len(result.Keys) == 0 {
+		fmt.Println("No keys")
+	} else {
+		var rows [][]tableCell
+		for _, key := range result.Keys {
+			rows = append(rows, []tableCell{
+				{text: key.Name},
+				{text: key.Type},
+				{text: key.Fingerprint},
+				{text: key.Created.Format("2006-01-02")},
+				{text: strconv.FormatBool(key.InUse)},
+			})
+		}
+		writeTable(os.Stdout, []string{"key", "type", "fingerprint", "created", "in use"}, rows, color)
+	}
+
+	fmt.Println()
+	if len(result.AuthorizedKeys) == 0 {
+		fmt.Println("No authorized_keys entries")
+	} else {
+		var rows [][]tableCell
+		for _, entry := range result.AuthorizedKeys {
+			rows = append(rows, []tableCell{
+				{text: strconv.Itoa(entry.Line)},
+				{text: entry.Type},
+				{text: entry.Fingerprint},
+				{text: entry.Comment},
+				{text: entry.Options},
+			})
+		}
+		writeTable(os.Stdout, []string{"line", "type", "fingerprint", "comment", "options"}, rows, color)
+	}
+
+	fmt.Println()
+	if len(result.Hosts) == 0 {
+		fmt.Println("Hosts: none")
+	} else {
+		fmt.Printf("Hosts: %s\n", strings.Join(result.Hosts, ", "))
+	}
+
+	fmt.Println()
+	if len(result.findings) == 0 {
+		fmt.Println("No findings")
+	}
+	for _, finding := range result.findings {
+		printFinding(finding, color)
+	}
+	fmt.Println()
+}
+
+func printUserSummary(audits []userAudit, color bool) {
+	var rows [][]tableCell
+	for _, result := range audits {
+		errors := countFindings(result.findings, keyman.SeverityError)
+		warnings := countFindings(result.findings, keyman.SeverityWarning)
+		errorCell := tableCell{text: strconv.Itoa(errors)}
+		if errors > 0 {
+			errorCell.color = colorRed
+		}
+		warningCell := tableCell{text: strconv.Itoa(warnings)}
+		if warnings > 0 {
+			warningCell.color = colorYellow
+		}
+		rows = append(rows, []tableCell{
+			{text: result.User},
+			{text: strconv.Itoa(len(result.Keys))},
+			{text: strconv.Itoa(len(result.AuthorizedKeys))},
+			{text: strconv.Itoa(len(result.Hosts))},
+			errorCell,
+			warningCell,
+		})
+	}
+	fmt.Println(paint("=== Summary ===", colorBold, color))
+	writeTable(os.Stdout, []string{"user", "keys", "authorized", "hosts", "errors", "warnings"}, rows, color)
+}
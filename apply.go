@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/textdiff"
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// planStep is one change apply will make.
+type planStep struct {
+	action  string
+	subject string
+}
+
+// apply converges the ssh directory on a manifest: it creates and deletes
+// keys and adds, edits and removes Host blocks so that running it again
+// changes nothing.
+func apply(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman [--dry-run] apply <manifest.yaml>")
+	}
+
+	manifest, err := keyman.LoadManifest(args[0])
+	if err != nil {
+		fatal(err)
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	original := make(map[string][]byte)
+	for _, file := range config.Files() {
+		original[file.Path] = file.Bytes()
+	}
+
+	var plan []planStep
+	var create []keyman.ManifestKey
+	var remove []string
+	for _, key := range manifest.Keys {
+		keyPath := filepath.Join(sshPath, key.Name)
+		_, err := os.Stat(keyPath)
+		exists := err == nil
+
+		switch {
+		case key.Absent && exists:
+			plan = append(plan, planStep{"delete", "key " + key.Name})
+			remove = append(remove, keyPath)
+		case !key.Absent && !exists:
+			plan = append(plan, planStep{"create", fmt.Sprintf("key %s (%s)", key.Name, key.Type)})
+			create = append(create, key)
+		case !key.Absent:
+			pub, err := keyman.ReadPublicKeyFile(keyPath + keyFileExt)
+			if err == nil && sshKeyType(pub.Algorithm) != key.Type {
+				fmt.Printf("Warning: key %s is %s, not %s; rotate it to change its type\n", key.Name, sshKeyType(pub.Algorithm), key.Type)
+			}
+		}
+	}
+
+	for _, host := range manifest.Hosts {
+		block := config.FindHost(host.Host)
+		if host.Absent {
+			if block != nil {
+				block.Remove()
+				plan = append(plan, planStep{"delete", "host " + host.Host})
+			}
+			continue
+		}
+
+		created := block == nil
+		if created {
+			block = config.AppendHost(host.Host)
+			plan = append(plan, planStep{"create", "host " + host.Host})
+		}
+		if applyHost(block, host) && !created {
+			plan = append(plan, planStep{"modify", "host " + host.Host})
+		}
+	}
+
+	if len(plan) == 0 {
+		fmt.Println("Nothing to do, everything matches the manifest")
+		return
+	}
+
+	fmt.Println("Plan:")
+	symbols := map[string]string{"create": "+", "modify": "~", "delete": "-"}
+	for _, step := range plan {
+		fmt.Printf("  %s %s %s\n", symbols[step.action], step.action, step.subject)
+	}
+	for _, file := range config.Files() {
+		if diff := textdiff.Unified(file.Path, file.Path, original[file.Path], file.Bytes()); diff != "" {
+			fmt.Println()
+			fmt.Print(diff)
+		}
+	}
+
+	if dryRun {
+		return
+	}
+	fmt.Println()
+
+	for _, key := range create {
+		spec := keySpec{keyType: key.Type, name: key.Name, comment: key.Comment, bits: key.Bits}
+		if key.PassphraseFile != "" {
+			passphrase, err := readPassphraseFile(key.PassphraseFile)
+			if err != nil {
+				fatal(err)
+			}
+			spec.passphrase = &passphrase
+		}
+
+		_, err := createKey(spec)
+		if err != nil {
+			fatalf("Creating key %s failed: %v", key.Name, err)
+		}
+		fmt.Printf("Generated key %s\n", key.Name)
+	}
+
+	err = snapshotConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+	err = config.SaveAll()
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, keyPath := range remove {
+		deleteKey(keyPath, deleteOptions{})
+	}
+
+	journal("apply", args[0], "", fmt.Sprintf("%d change(s)", len(plan)))
+	fmt.Printf("Applied %d change(s)\n", len(plan))
+}
+
+// applyHost sets the options and identities a manifest declares on block
+// and reports whether anything changed. Options the manifest does not
+// mention are left alone.
+func applyHost(block *keyman.HostBlock, host keyman.ManifestHost) bool {
+	changed := false
+	for _, option := range host.Options {
+		if block.Option(option[0]) != option[1] {
+			block.SetOption(option[0], option[1])
+			changed = true
+		}
+	}
+
+	if len(host.Identities) == 0 {
+		return changed
+	}
+
+	var want []string
+	for _, identity := range host.Identities {
+		if !strings.ContainsRune(identity, '/') {
+			identity = identityReference(identity)
+		}
+		want = append(want, identity)
+	}
+
+	current := block.Options("IdentityFile")
+	same := len(current) == len(want)
+	for i := 0; same && i < len(want); i++ {
+		wantPath, _ := keyman.ExpandPath(want[i])
+		same = containsPath(current[i:i+1], wantPath)
+	}
+	if same {
+		return changed
+	}
+
+	block.RemoveOption("IdentityFile", func(string) bool { return true })
+	for _, identity := range want {
+		block.AddOption("IdentityFile", identity)
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// askpassEnv marks keyman being run by ssh-keygen as its SSH_ASKPASS
+// program, with the passphrases to answer with in the two variables after
+// it.
+const (
+	askpassEnv    = "KEYMAN_ASKPASS"
+	askpassOldEnv = "KEYMAN_ASKPASS_OLD"
+	askpassNewEnv = "KEYMAN_ASKPASS_NEW"
+)
+
+// sshKeygenCommand returns an ssh-keygen command that is given a key's
+// current and new passphrases by running keyman as its SSH_ASKPASS
+// program, so they are never put on the command line where any user can
+// read them from ps. The environment they go through instead can only be
+// read by the user running keyman.
+func sshKeygenCommand(oldPassphrase, newPassphrase string, args ...string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(toolPath("ssh-keygen"), args...)
+	cmd.Env = append(os.Environ(),
+		"SSH_ASKPASS="+self,
+		"SSH_ASKPASS_REQUIRE=force",
+		askpassEnv+"=1",
+		askpassOldEnv+"="+oldPassphrase,
+		askpassNewEnv+"="+newPassphrase,
+	)
+	return cmd, nil
+}
+
+// runKeygen runs ssh-keygen like runCommand, giving it the passphrases as
+// sshKeygenCommand does.
+func runKeygen(oldPassphrase, newPassphrase string, args ...string) error {
+	cmd, err := sshKeygenCommand(oldPassphrase, newPassphrase, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// runAskpass answers a prompt from ssh-keygen when keyman is run as its
+// SSH_ASKPASS program, and reports whether it was. Prompts for the current
+// passphrase get the old one and prompts for a passphrase to set get the
+// new one. Anything else, like a security key PIN, is asked of the user on
+// the terminal, and notices that only want showing are written to stderr.
+func runAskpass() bool {
+	if os.Getenv(askpassEnv) == "" {
+		return false
+	}
+	prompt := ""
+	if len(os.Args) > 1 {
+		prompt = os.Args[1]
+	}
+
+	lower := strings.ToLower(prompt)
+	switch {
+	case os.Getenv("SSH_ASKPASS_PROMPT") == "none":
+		fmt.Fprintln(os.Stderr, prompt)
+	case strings.Contains(lower, "old passphrase"):
+		fmt.Println(os.Getenv(askpassOldEnv))
+	case strings.Contains(lower, "new passphrase"), strings.Contains(lower, "empty for no passphrase"),
+		strings.Contains(lower, "same passphrase again"):
+		fmt.Println(os.Getenv(askpassNewEnv))
+	default:
+		answer, err := askTerminal(prompt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(answer)
+	}
+	return true
+}
+
+// askTerminal reads a line from the controlling terminal with echo turned
+// off, as stdout belongs to ssh-keygen.
+func askTerminal(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		cmd.Run()
+	}
+	stty("-echo")
+	defer func() {
+		stty("echo")
+		fmt.Fprintln(tty)
+	}()
+
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
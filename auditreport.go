@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// Rules for the audit checks that are not part of a policy, as they appear
+// in reports.
+const (
+	ruleIncompletePair    = "incomplete_pair"
+	ruleUnusedKey         = "unused_key"
+	ruleDuplicateKey      = "duplicate_key"
+	ruleSameKeyHost       = "same_key_host"
+	ruleIdentitiesOnly    = "identities_only"
+	ruleKeyExpiry         = "key_expiry"
+	ruleCertificateExpiry = "certificate_expiry"
+	ruleGitSigning        = "git_signing"
+	rulePermissions       = "permissions"
+)
+
+// auditDocument is what an exported audit report shows. Server audits
+// report on the sshd_config at ConfigPath and have no keys.
+type auditDocument struct {
+	Generated  time.Time
+	Host       string
+	SSHDir     string
+	ConfigPath string
+	Server     bool
+	Keys       []keyman.KeyStatus
+	Findings   []keyman.Finding
+}
+
+// auditFindings turns the results of every audit check into findings,
+// most severe first, with weak and policy holding the findings of the
+// checks that already produce them.
+func auditFindings(report keyman.AuditReport, sshConfig *keyman.Config, expiryWindow time.Duration, expiredOnly bool, weak, policy []keyman.Finding) ([]keyman.Finding, error) {
+	var findings []keyman.Finding
+	add := func(severity keyman.Severity, rule, subject, format string, args ...interface{}) {
+		findings = append(findings, keyman.Finding{
+			Severity: severity,
+			Rule:     rule,
+			Subject:  subject,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	now := time.Now()
+	for _, key := range report.Keys {
+		if key.MissingPublic {
+			add(keyman.SeverityWarning, ruleIncompletePair, key.Name, "private key without a public key, run keyman pubkey %s", key.Name)
+		}
+		if key.MissingPrivate {
+			add(keyman.SeverityWarning, ruleIncompletePair, key.Name, "public key without a private key")
+		}
+		if !key.InUse {
+			add(keyman.SeverityInfo, ruleUnusedKey, key.Name, "key is not in use")
+		}
+
+		if meta := key.Metadata; meta.Expired(now) {
+			add(keyman.SeverityError, ruleKeyExpiry, key.Name, "key expired %s", expiryString(meta))
+		} else if !expiredOnly && meta.ExpiresWithin(now, expiryWindow) {
+			add(keyman.SeverityWarning, ruleKeyExpiry, key.Name, "key expires %s", expiryString(meta))
+		}
+		if cert := key.Certificate; cert != nil {
+			if cert.Expired(now) {
+				add(keyman.SeverityError, ruleCertificateExpiry, key.Name, "certificate expired, valid %s", validityString(cert))
+			} else if !expiredOnly && cert.ExpiresWithin(now, expiryWindow) {
+				add(keyman.SeverityWarning, ruleCertificateExpiry, key.Name, "certificate expires soon, valid %s", validityString(cert))
+			}
+		}
+	}
+
+	for _, group := range report.Duplicates {
+		var names []string
+		for _, key := range group {
+			names = append(names, key.Name)
+		}
+		add(keyman.SeverityWarning, ruleDuplicateKey, strings.Join(names, ", "), "files hold the same key %s", group[0].Public.FingerprintSHA256())
+	}
+	for host, paths := range report.SameKeyHosts {
+		add(keyman.SeverityInfo, ruleSameKeyHost, host, "IdentityFiles %s hold the same key", strings.Join(paths, ", "))
+	}
+	for _, block := range sshConfig.WithoutIdentitiesOnly() {
+		add(keyman.SeverityInfo, ruleIdentitiesOnly, block.Name(), "IdentitiesOnly is not set, so ssh-agent keys are offered first")
+	}
+	findings = append(findings, sshConfig.CheckJumpChains()...)
+
+	signingProblem, err := checkGitSigning()
+	if err != nil {
+		return nil, err
+	}
+	if signingProblem != "" {
+		add(keyman.SeverityWarning, ruleGitSigning, "git", "%s", signingProblem)
+	}
+
+	problems, err := checkPermissions()
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range problems {
+		add(keyman.SeverityError, rulePermissions, problem.Path, "mode is %04o, want %04o: %s", problem.Mode, problem.Want, problem.Message)
+	}
+
+	hostKeys, err := checkHostKeys(sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	findings = append(findings, hostKeys...)
+
+	findings = append(findings, weak...)
+	findings = append(findings, policy...)
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+	return findings, nil
+}
+
+// writeAuditReport writes doc as a Markdown, HTML or SARIF report to path,
+// or to stdout when path is empty.
+func writeAuditReport(format, path string, doc auditDocument) error {
+	switch format {
+	case "md", "markdown", "html", "sarif":
+	default:
+		return fmt.Errorf("unknown report format %q, use md, html or sarif", format)
+	}
+
+	var out io.Writer = os.Stdout
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	switch format {
+	case "html":
+		return auditHTMLTemplate.Execute(out, doc)
+	case "sarif":
+		return writeSARIFReport(out, doc)
+	}
+	return writeMarkdownReport(out, doc)
+}
+
+// countFindings returns how many findings have the given severity.
+func countFindings(findings []keyman.Finding, severity keyman.Severity) int {
+	count := 0
+	for _, finding := range findings {
+		if finding.Severity == severity {
+			count++
+		}
+	}
+	return count
+}
+
+func severityTitle(severity keyman.Severity) string {
+	name := severity.String()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// reportKeyType describes a key's algorithm and size for a report.
+func reportKeyType(key keyman.KeyStatus) string {
+	if key.Public == nil {
+		return "unknown"
+	}
+	keyType := fmt.Sprintf("%s %d", key.Public.TypeName(), key.Public.Bits())
+	if key.Public.IsSecurityKey() {
+		keyType += " (security key)"
+	}
+	return keyType
+}
+
+func reportFingerprint(key keyman.KeyStatus) string {
+	if key.Public == nil {
+		return ""
+	}
+	return key.Public.FingerprintSHA256()
+}
+
+// markdownCell escapes text for a Markdown table cell, including the
+// characters that would start inline HTML.
+func markdownCell(text string) string {
+	return strings.NewReplacer("|", `\|`, "<", "&lt;", ">", "&gt;", "\n", " ").Replace(text)
+}
+
+func writeMarkdownReport(w io.Writer, doc auditDocument) error {
+	var b strings.Builder
+	if doc.Server {
+		b.WriteString("# SSH Server Audit\n\n")
+		fmt.Fprintf(&b, "Generated %s on %s for %s.\n\n", doc.Generated.Format(time.RFC3339), markdownCell(doc.Host), markdownCell(doc.ConfigPath))
+	} else {
+		b.WriteString("# SSH Key Audit\n\n")
+		fmt.Fprintf(&b, "Generated %s on %s for %s.\n\n", doc.Generated.Format(time.RFC3339), markdownCell(doc.Host), markdownCell(doc.SSHDir))
+	}
+
+	b.WriteString("## Summary\n\n")
+	b.WriteString("| | Count |\n|---|---|\n")
+	if !doc.Server {
+		fmt.Fprintf(&b, "| Keys | %d |\n", len(doc.Keys))
+	}
+	for _, severity := range []keyman.Severity{keyman.SeverityError, keyman.SeverityWarning, keyman.SeverityInfo} {
+		fmt.Fprintf(&b, "| %s findings | %d |\n", severityTitle(severity), countFindings(doc.Findings, severity))
+	}
+
+	b.WriteString("\n## Findings\n\n")
+	if len(doc.Findings) == 0 {
+		b.WriteString("No findings.\n")
+	}
+	for _, severity := range []keyman.Severity{keyman.SeverityError, keyman.SeverityWarning, keyman.SeverityInfo} {
+		if countFindings(doc.Findings, severity) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "### %s\n\n", severityTitle(severity))
+		b.WriteString("| Subject | Finding | Rule |\n|---|---|---|\n")
+		for _, finding := range doc.Findings {
+			if finding.Severity == severity {
+				fmt.Fprintf(&b, "| %s | %s | `%s` |\n", markdownCell(finding.Subject), markdownCell(finding.Message), finding.Rule)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	if doc.Server {
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+	b.WriteString("## Keys\n\n")
+	b.WriteString("| Key | Type | Fingerprint | Created | Last Used | In Use | Comment |\n|---|---|---|---|---|---|---|\n")
+	for _, key := range doc.Keys {
+		fmt.Fprintf(&b, "| %s | %s | `%s` | %s | %s | %t | %s |\n",
+			markdownCell(key.Name), reportKeyType(key), reportFingerprint(key), key.Created.Format("2006-01-02"),
+			markdownCell(lastUsedString(key.Metadata)), key.InUse, markdownCell(key.Comment))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var auditHTMLTemplate = template.Must(template.New("audit").Funcs(template.FuncMap{
+	"count": func(findings []keyman.Finding, severity string) int {
+		parsed, _ := keyman.ParseSeverity(severity)
+		return countFindings(findings, parsed)
+	},
+	"keyType":     reportKeyType,
+	"fingerprint": reportFingerprint,
+	"lastUsed":    lastUsedString,
+	"date":        func(t time.Time) string { return t.Format("2006-01-02") },
+	"timestamp":   func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Server}}SSH Server Audit{{else}}SSH Key Audit{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #f3f3f3; }
+code { font-size: 0.9em; }
+.error { color: #b00020; font-weight: bold; }
+.warning { color: #a66000; font-weight: bold; }
+.info { color: #555; }
+</style>
+</head>
+<body>
+<h1>{{if .Server}}SSH Server Audit{{else}}SSH Key Audit{{end}}</h1>
+<p>Generated {{timestamp .Generated}} on {{.Host}} for {{if .Server}}{{.ConfigPath}}{{else}}{{.SSHDir}}{{end}}.</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th></th><th>Count</th></tr>
+{{if not .Server}}<tr><td>Keys</td><td>{{len .Keys}}</td></tr>
+{{end}}
+<tr><td class="error">Error findings</td><td>{{count .Findings "error"}}</td></tr>
+<tr><td class="warning">Warning findings</td><td>{{count .Findings "warning"}}</td></tr>
+<tr><td class="info">Info findings</td><td>{{count .Findings "info"}}</td></tr>
+</table>
+
+<h2>Findings</h2>
+{{if .Findings}}<table>
+<tr><th>Severity</th><th>Subject</th><th>Finding</th><th>Rule</th></tr>
+{{range .Findings}}<tr><td class="{{.Severity}}">{{.Severity}}</td><td>{{.Subject}}</td><td>{{.Message}}</td><td><code>{{.Rule}}</code></td></tr>
+{{end}}</table>
+{{else}}<p>No findings.</p>
+{{end}}{{if not .Server}}
+<h2>Keys</h2>
+<table>
+<tr><th>Key</th><th>Type</th><th>Fingerprint</th><th>Created</th><th>Last Used</th><th>In Use</th><th>Comment</th></tr>
+{{range .Keys}}<tr><td>{{.Name}}</td><td>{{keyType .}}</td><td><code>{{fingerprint .}}</code></td><td>{{date .Created}}</td><td>{{lastUsed .Metadata}}</td><td>{{.InUse}}</td><td>{{.Comment}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const authorizedKeysFile = "authorized_keys"
+
+// authorizedKey is one key entry of an authorized_keys file.
+type authorizedKey struct {
+	line    int
+	options string
+	pub     *keyman.PublicKey
+}
+
+func authorized(args []string) {
+	flags := flag.NewFlagSet("authorized", flag.ExitOnError)
+	file := flags.String("file", "", "authorized_keys file to manage (default ~/.ssh/authorized_keys)")
+	options := flags.String("options", "", "restriction options for added keys, e.g. from=\"10.0.0.0/8\",no-pty")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman authorized list|add|remove")
+	}
+
+	path := *file
+	if path == "" {
+		sshPath, err := getSSHPath()
+		if err != nil {
+			fatal(err)
+		}
+		path = filepath.Join(sshPath, authorizedKeysFile)
+	}
+
+	switch args[0] {
+	case "list":
+		listAuthorizedKeys(path)
+	case "add":
+		if len(args) < 2 {
+			fatalUsage("Usage: keyman authorized add [--options o] <key|pubfile|pubkey>")
+		}
+		addAuthorizedKey(path, strings.Join(args[1:], " "), *options)
+	case "remove":
+		if len(args) < 2 {
+			fatalUsage("Usage: keyman authorized remove <fingerprint|comment>")
+		}
+		removeAuthorizedKey(path, strings.Join(args[1:], " "))
+	default:
+		fatalUsage("Unknown authorized command")
+	}
+}
+
+func listAuthorizedKeys(path string) {
+	lines, err := readLines(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, entry := range parseAuthorizedKeys(lines) {
+		printAuthorizedKey(entry)
+	}
+}
+
+func printAuthorizedKey(entry authorizedKey) {
+	fmt.Printf("Line: %d\nType: %s %d\nFingerprint: %s\n", entry.line, entry.pub.TypeName(), entry.pub.Bits(), entry.pub.FingerprintSHA256())
+	if entry.pub.Comment != "" {
+		fmt.Printf("Comment: %s\n", entry.pub.Comment)
+	}
+	if entry.options != "" {
+		fmt.Printf("Options: %s\n", entry.options)
+	}
+	fmt.Println()
+}
+
+func addAuthorizedKey(path, key, options string) {
+	pubKey, err := resolvePublicKey(key)
+	if err != nil {
+		fatal(err)
+	}
+
+	pub, err := keyman.ParsePublicKey(pubKey)
+	if err != nil {
+		fatal(err)
+	}
+
+	lines, err := readLines(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, entry := range parseAuthorizedKeys(lines) {
+		if entry.pub.FingerprintSHA256() == pub.FingerprintSHA256() {
+			fmt.Printf("Key %s is already authorized on line %d\n", pub.FingerprintSHA256(), entry.line)
+			return
+		}
+	}
+
+	line := pubKey
+	if options != "" {
+		line = options + " " + pubKey
+	}
+	lines = append(lines, line)
+
+	err = writeLines(path, lines)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("authorize", path, "", pub.FingerprintSHA256())
+	fmt.Printf("Authorized key %s\n", pub.FingerprintSHA256())
+}
+
+func removeAuthorizedKey(path, query string) {
+	lines, err := readLines(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	remove := make(map[int]bool)
+	var removed []string
+	for _, entry := range parseAuthorizedKeys(lines) {
+		if entry.pub.Comment == query || keyman.FingerprintMatches(entry.pub, query) {
+			remove[entry.line] = true
+			removed = append(removed, entry.pub.FingerprintSHA256())
+			fmt.Printf("Removing %s %s\n", entry.pub.FingerprintSHA256(), entry.pub.Comment)
+		}
+	}
+
+	if len(remove) == 0 {
+		fatalf("No authorized key matches %s", query)
+	}
+
+	var kept []string
+	for i, line := range lines {
+		if !remove[i+1] {
+			kept = append(kept, line)
+		}
+	}
+
+	err = writeLines(path, kept)
+	if err != nil {
+		fatal(err)
+	}
+	for _, fingerprint := range removed {
+		journal("unauthorize", path, fingerprint, "")
+	}
+}
+
+// resolvePublicKey turns a local key name, a path to a .pub file, or a
+// literal public key line into a public key line.
+func resolvePublicKey(key string) (string, error) {
+	if _, err := keyman.ParsePublicKey(key); err == nil {
+		return strings.TrimSpace(key), nil
+	}
+
+	if _, err := os.Stat(key); err == nil && strings.HasSuffix(key, keyFileExt) {
+		content, err := os.ReadFile(key)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(key, keyFileExt))
+	if err != nil {
+		return "", err
+	}
+	return readPublicKey(keyPath)
+}
+
+// parseAuthorizedKeys returns the key entries in lines, skipping blank
+// lines, comments and lines that fail to parse. Line numbers are 1-based.
+func parseAuthorizedKeys(lines []string) []authorizedKey {
+	var entries []authorizedKey
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		options, rest := "", line
+		if !isKeyAlgorithm(strings.Fields(line)[0]) {
+			options, rest = splitAuthorizedOptions(line)
+		}
+
+		pub, err := keyman.ParsePublicKey(rest)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, authorizedKey{line: i + 1, options: options, pub: pub})
+	}
+	return entries
+}
+
+// splitAuthorizedOptions splits the leading options field, which may
+// contain quoted spaces, from the rest of an authorized_keys line.
+func splitAuthorizedOptions(line string) (string, string) {
+	quoted := false
+	for i, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case (r == ' ' || r == '\t') && !quoted:
+			return line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+	return line, ""
+}
+
+func isKeyAlgorithm(field string) bool {
+	return strings.HasPrefix(field, "ssh-") || strings.HasPrefix(field, "ecdsa-") || strings.HasPrefix(field, "sk-")
+}
+
+// readLines returns the lines of path, or nothing if it does not exist.
+func readLines(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	text := strings.TrimSuffix(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+func writeLines(path string, lines []string) error {
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	return os.WriteFile(path, []byte(content), 0600)
+}
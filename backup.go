@@ -0,0 +1,489 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// keymanDir holds keyman's own state inside the ssh directory.
+	keymanDir = ".keyman"
+
+	backupMagic      = "KEYMAN-BACKUP-1\n"
+	ageMagic         = "age-encryption.org/v1"
+	backupIterations = 600000
+	backupSaltSize   = 16
+)
+
+func backup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	passphraseFile := flags.String("passphrase-file", "", "read the passphrase from a file, or - for stdin")
+	recipient := flags.String("recipient", "", "encrypt to an age recipient with the age tool instead of a passphrase")
+	key := flags.String("key", "", "encrypt to an ssh key with the age tool instead of a passphrase")
+	backend := flags.String("backend", "", "store the backup in a secrets manager instead of a file: aws-sm, gcp-sm, vault or a secrets plugin")
+	name := flags.String("name", "", "with --backend, the secret to store the backup as (default keyman-<hostname>)")
+	vaultMount := flags.String("vault-mount", "secret", "with --backend vault, the KV mount to store the backup in")
+	args = parseFlags(flags, args)
+	if (*backend == "" && len(args) != 1) || (*backend != "" && len(args) != 0) {
+		fatalUsage("Usage: keyman backup [--passphrase-file f | --recipient age1... | --key k] <file> | --backend aws-sm|gcp-sm|vault|plugin [--name secret] [--vault-mount m]")
+	}
+	if *recipient != "" && *key != "" {
+		fatalUsage("Pass only one of --recipient and --key")
+	}
+	if *backend != "" {
+		if err := checkBackend(*backend); err != nil {
+			fatalUsage(err)
+		}
+		if *name == "" {
+			*name = defaultSecretName()
+		}
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+
+	archive, count, err := archiveDir(sshPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	var sealed []byte
+	if *recipient != "" {
+		sealed, err = runAge(archive, "-r", *recipient)
+	} else if *key != "" {
+		var keyPath string
+		if keyPath, err = resolveKeyArg(*key); err != nil {
+			fatal(err)
+		}
+		sealed, err = runAge(archive, "-R", keyPath+keyFileExt)
+	} else {
+		var passphrase string
+		passphrase, err = getPassphrase(*passphraseFile, "Backup passphrase: ", true)
+		if err != nil {
+			fatal(err)
+		}
+		sealed, err = encryptBackup(archive, passphrase)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	destination := ""
+	if *backend != "" {
+		err = storeBackup(*backend, *vaultMount, *name, sealed)
+		destination = *backend + " secret " + *name
+	} else {
+		err = os.WriteFile(args[0], sealed, 0600)
+		destination = args[0]
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("Backed up %d files from %s to %s\n", count, sshPath, destination)
+}
+
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	passphraseFile := flags.String("passphrase-file", "", "read the passphrase from a file, or - for stdin")
+	identity := flags.String("identity", "", "age identity file for backups made with --recipient")
+	key := flags.String("key", "", "ssh key for backups made with --key, or with --recipient set to its age recipient")
+	force := flags.Bool("force", false, "overwrite existing files without asking")
+	backend := flags.String("backend", "", "restore the backup stored as the named secret in a secrets manager: aws-sm, gcp-sm, vault or a secrets plugin")
+	vaultMount := flags.String("vault-mount", "secret", "with --backend vault, the KV mount the backup is in")
+	args = parseFlags(flags, args)
+	if len(args) != 1 {
+		fatalUsage("Usage: keyman restore [--passphrase-file f | --identity file | --key k] [--force] <file> | --backend aws-sm|gcp-sm|vault|plugin [--vault-mount m] <secret>")
+	}
+
+	var sealed []byte
+	var err error
+	source := args[0]
+	if *backend != "" {
+		if err := checkBackend(*backend); err != nil {
+			fatalUsage(err)
+		}
+		sealed, err = fetchBackup(*backend, *vaultMount, args[0])
+		source = *backend + " secret " + args[0]
+	} else {
+		sealed, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	var archive []byte
+	if bytes.HasPrefix(sealed, []byte(ageMagic)) {
+		if *key != "" {
+			if *identity, err = resolveKeyArg(*key); err != nil {
+				fatal(err)
+			}
+		}
+		if *identity == "" {
+			fatal("This backup was encrypted with age, pass --identity or --key")
+		}
+		archive, err = runAge(sealed, "-d", "-i", *identity)
+	} else {
+		var passphrase string
+		passphrase, err = getPassphrase(*passphraseFile, "Backup passphrase: ", false)
+		if err != nil {
+			fatal(err)
+		}
+		archive, err = decryptBackup(sealed, passphrase)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+
+	count, err := extractArchive(archive, sshPath, *force)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("restore", sshPath, "", source)
+	fmt.Printf("Restored %d files to %s\n", count, sshPath)
+}
+
+// archiveDir returns a gzipped tar of every regular file under dir.
+func archiveDir(dir string) ([]byte, int, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	archive, err := archiveFiles(dir, paths)
+	return archive, len(paths), err
+}
+
+// archiveFiles returns a gzipped tar of paths, named relative to dir.
+func archiveFiles(dir string, paths []string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		header := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    int64(info.Mode().Perm()),
+			Size:    int64(len(content)),
+			ModTime: info.ModTime(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// archiveKey saves an encrypted copy of a key pair under the trash
+// directory, in the same format as backup so restore can recover it.
+func archiveKey(keyPath, passphraseFile string) (string, error) {
+	paths := []string{keyPath}
+	for _, suffix := range []string{keyFileExt, certFileSuffix} {
+		if _, err := os.Stat(keyPath + suffix); err == nil {
+			paths = append(paths, keyPath+suffix)
+		}
+	}
+
+	archive, err := archiveFiles(filepath.Dir(keyPath), paths)
+	if err != nil {
+		return "", err
+	}
+
+	passphrase, err := getPassphrase(passphraseFile, "Archive passphrase: ", true)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := encryptBackup(archive, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		return "", err
+	}
+
+	trashDir := filepath.Join(sshPath, keymanDir, "trash")
+	if err := os.MkdirAll(trashDir, 0700); err != nil {
+		return "", err
+	}
+
+	archivePath := filepath.Join(trashDir, fmt.Sprintf("%s-%d.kmb", filepath.Base(keyPath), time.Now().Unix()))
+	return archivePath, os.WriteFile(archivePath, sealed, 0600)
+}
+
+// shredFile overwrites a file with random bytes and syncs it to disk before
+// removing it. Journaling and copy-on-write filesystems may still keep the
+// old contents elsewhere, so this is a best effort.
+func shredFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(file, rand.Reader, info.Size())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// extractArchive writes the files in a gzipped tar into dir, asking before
+// replacing files whose contents differ unless force is set.
+func extractArchive(archive []byte, dir string, force bool) (int, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+	count := 0
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		name := filepath.FromSlash(header.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return count, fmt.Errorf("refusing to restore %s outside %s", header.Name, dir)
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return count, err
+		}
+
+		target := filepath.Join(dir, name)
+		if existing, err := os.ReadFile(target); err == nil {
+			if bytes.Equal(existing, content) {
+				continue
+			}
+			if !force {
+				fmt.Printf("%s already exists and differs. Overwrite? [y/N]: ", target)
+				answer, _ := stdin.ReadString('\n')
+				if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+					continue
+				}
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return count, err
+		}
+		if err := os.WriteFile(target, content, os.FileMode(header.Mode).Perm()); err != nil {
+			return count, err
+		}
+		if err := os.Chmod(target, os.FileMode(header.Mode).Perm()); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// encryptBackup seals data with AES-256-GCM under a key derived from the
+// passphrase with PBKDF2-HMAC-SHA256.
+func encryptBackup(data []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(backupMagic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, []byte(backupMagic)), nil
+}
+
+func decryptBackup(sealed []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, []byte(backupMagic)) {
+		return nil, errors.New("not a keyman backup")
+	}
+	sealed = sealed[len(backupMagic):]
+	if len(sealed) < backupSaltSize {
+		return nil, errors.New("backup is truncated")
+	}
+
+	salt, sealed := sealed[:backupSaltSize], sealed[backupSaltSize:]
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("backup is truncated")
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, sealed, []byte(backupMagic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted backup")
+	}
+	return data, nil
+}
+
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := pbkdf2SHA256([]byte(passphrase), salt, backupIterations, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// getPassphrase reads a passphrase from file if given, otherwise prompts
+// on the terminal without echo, asking twice when confirm is set.
+func getPassphrase(file, prompt string, confirm bool) (string, error) {
+	if file != "" {
+		return readPassphraseFile(file)
+	}
+
+	passphrase, err := readSecret(prompt)
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		again, err := readSecret("Confirm passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", errors.New("passphrases do not match")
+		}
+	}
+	if passphrase == "" {
+		return "", errors.New("passphrase must not be empty")
+	}
+	return passphrase, nil
+}
+
+// readSecret prompts for a line from the terminal with echo turned off.
+func readSecret(prompt string) (string, error) {
+	fmt.Print(prompt)
+	setEcho(false)
+	defer func() {
+		setEcho(true)
+		fmt.Println()
+	}()
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// runAge runs the age tool on input and returns its output. age asks for
+// the passphrase of an encrypted identity on the terminal itself.
+func runAge(input []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("age", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultBitbucketAPI = "https://api.bitbucket.org/2.0"
+
+// bitbucketClient talks to Bitbucket Cloud, which keys a user's SSH keys
+// by their username and logs in with an app password or API token.
+type bitbucketClient struct {
+	api      string
+	username string
+	token    string
+}
+
+// bitbucketKey is a key as Bitbucket returns it, with the comment split
+// off and a label in place of a title.
+type bitbucketKey struct {
+	UUID      keyID     `json:"uuid"`
+	Label     string    `json:"label"`
+	Key       string    `json:"key"`
+	Comment   string    `json:"comment"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+func openBitbucket(string) forge {
+	if settings.BitbucketUsername == "" || settings.BitbucketToken == "" {
+		fatal("Set BITBUCKET_USERNAME and BITBUCKET_TOKEN, or bitbucket.username and bitbucket.token in config.toml, to your\nusername and an app password with the account:write scope")
+	}
+	return &bitbucketClient{api: defaultBitbucketAPI, username: settings.BitbucketUsername, token: settings.BitbucketToken}
+}
+
+func (c *bitbucketClient) name() string { return "Bitbucket" }
+
+func (c *bitbucketClient) host() string { return "bitbucket.org" }
+
+func (c *bitbucketClient) listKeys() ([]remoteKey, error) {
+	var keys []remoteKey
+	path := c.keysPath() + "?pagelen=100"
+	for path != "" {
+		var page struct {
+			Values []bitbucketKey `json:"values"`
+			Next   string         `json:"next"`
+		}
+		if err := c.do("GET", path, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, key := range page.Values {
+			keys = append(keys, key.remote())
+		}
+		path = strings.TrimPrefix(page.Next, c.api)
+	}
+	return keys, nil
+}
+
+func (c *bitbucketClient) addKey(title, key string, _ *time.Time) (remoteKey, error) {
+	var created bitbucketKey
+	body := map[string]string{"label": title, "key": key}
+	err := c.do("POST", c.keysPath(), body, &created)
+	return created.remote(), err
+}
+
+func (c *bitbucketClient) keysPath() string {
+	return "/users/" + url.PathEscape(c.username) + "/ssh-keys"
+}
+
+func (c *bitbucketClient) do(method, path string, body, out interface{}) error {
+	req, err := newJSONRequest(method, c.api+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.token)
+	return doJSON(req, out)
+}
+
+func (k bitbucketKey) remote() remoteKey {
+	title := k.Label
+	if title == "" {
+		title = k.Comment
+	}
+	return remoteKey{ID: k.UUID, Title: title, Key: strings.TrimSpace(k.Key + " " + k.Comment), CreatedAt: k.CreatedOn}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const (
+	caKeyFile   = "ca"
+	caIndexFile = "index.json"
+)
+
+// getCADir returns the directory holding the local CA key and its index.
+func getCADir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "keyman", "ca"), nil
+}
+
+func loadCAIndex() (*keyman.CAIndex, error) {
+	caDir, err := getCADir()
+	if err != nil {
+		return nil, err
+	}
+
+	return keyman.LoadCAIndex(filepath.Join(caDir, caIndexFile))
+}
+
+func ca(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman ca init|sign|list")
+	}
+
+	switch args[0] {
+	case "init":
+		initCA(args[1:])
+	case "sign":
+		signKey(args[1:])
+	case "list":
+		listCertificates()
+	default:
+		fatalUsage("Unknown ca command")
+	}
+}
+
+// initCA creates the CA key pair.
+func initCA(args []string) {
+	flags := flag.NewFlagSet("ca init", flag.ExitOnError)
+	keyType := flags.String("type", "ed25519", "CA key type: ed25519, rsa or ecdsa")
+	comment := flags.String("comment", "keyman CA", "CA key comment")
+	passphraseFile := flags.String("passphrase-file", "", "read the CA passphrase from a file, or - for stdin")
+	parseFlagSet(flags, args)
+
+	caDir, err := getCADir()
+	if err != nil {
+		fatal(err)
+	}
+
+	caKeyPath := filepath.Join(caDir, caKeyFile)
+	if _, err := os.Stat(caKeyPath); err == nil {
+		fatalf("A CA already exists at %s", caKeyPath)
+	}
+
+	err = os.MkdirAll(caDir, 0700)
+	if err != nil {
+		fatal(err)
+	}
+
+	sshArgs := []string{"-q", "-t", *keyType, "-f", caKeyPath, "-C", *comment}
+	if *passphraseFile != "" {
+		var passphrase string
+		passphrase, err = readPassphraseFile(*passphraseFile)
+		if err != nil {
+			fatal(err)
+		}
+		err = runKeygen("", passphrase, sshArgs...)
+	} else {
+		err = runCommand("ssh-keygen", sshArgs...)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	pubKey, err := readPublicKey(caKeyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("ca init", caKeyPath, "", keyFingerprint(caKeyPath))
+	fmt.Printf("Created CA %s\n", caKeyPath)
+	fmt.Printf("Trust it on servers with TrustedUserCAKeys, or for hosts in known_hosts as:\n@cert-authority * %s\n", pubKey)
+}
+
+// signKey signs a public key with the CA and records the certificate in
+// the index.
+func signKey(args []string) {
+	flags := flag.NewFlagSet("ca sign", flag.ExitOnError)
+	principals := flags.String("principals", "", "comma separated user or host names the certificate is valid for")
+	validity := flags.String("validity", "+52w", "validity period in ssh-keygen -V syntax, e.g. +4w or 20250101:20260101")
+	identity := flags.String("id", "", "certificate key ID (default the key's comment or name)")
+	hostCert := flags.Bool("host", false, "issue a host certificate instead of a user certificate")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman ca sign --principals p[,p] [--validity v] [--id id] [--host] <key|pubfile>")
+	}
+	if *principals == "" {
+		fatal("At least one principal is required")
+	}
+
+	caDir, err := getCADir()
+	if err != nil {
+		fatal(err)
+	}
+	caKeyPath := filepath.Join(caDir, caKeyFile)
+	if _, err := os.Stat(caKeyPath); err != nil {
+		fatal("No CA found, run keyman ca init first")
+	}
+
+	pubPath := args[0]
+	if _, err := os.Stat(pubPath); err != nil || !strings.HasSuffix(pubPath, keyFileExt) {
+		keyPath, err := getFullKeyPath(strings.TrimSuffix(args[0], keyFileExt))
+		if err != nil {
+			fatal(err)
+		}
+		pubPath = keyPath + keyFileExt
+	}
+
+	pub, err := keyman.ReadPublicKeyFile(pubPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	keyID := *identity
+	if keyID == "" {
+		keyID = pub.Comment
+	}
+	if keyID == "" {
+		keyID = strings.TrimSuffix(filepath.Base(pubPath), keyFileExt)
+	}
+
+	index, err := loadCAIndex()
+	if err != nil {
+		fatal(err)
+	}
+
+	sshArgs := []string{"-q", "-s", caKeyPath, "-I", keyID, "-n", *principals, "-V", *validity, "-z", strconv.FormatUint(index.NextSerial, 10)}
+	if *hostCert {
+		sshArgs = append(sshArgs, "-h")
+	}
+	err = runCommand("ssh-keygen", append(sshArgs, pubPath)...)
+	if err != nil {
+		fatal(err)
+	}
+
+	certPath := strings.TrimSuffix(pubPath, keyFileExt) + certFileSuffix
+	cert, err := keyman.ReadCertificateFile(certPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	entry := index.Record(cert, certPath, time.Now())
+	err = index.Save()
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("ca sign", certPath, "", fmt.Sprintf("serial %d, principals %s", entry.Serial, strings.Join(entry.Principals, ",")))
+	fmt.Printf("Signed %s as %s, serial %d\n", filepath.Base(pubPath), certPath, entry.Serial)
+	fmt.Printf("Valid: %s\n", validityString(cert))
+}
+
+// listCertificates prints every certificate the CA has issued.
+func listCertificates() {
+	index, err := loadCAIndex()
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(index.Certificates) == 0 {
+		fmt.Println("No certificates issued")
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range index.Certificates {
+		fmt.Printf("Serial: %d\nKey ID: %s\nType: %s\nPrincipals: %s\nFingerprint: %s\nPath: %s\nIssued: %s\n",
+			entry.Serial, entry.KeyID, entry.Type, strings.Join(entry.Principals, ", "), entry.Fingerprint, entry.Path, entry.Issued.Format(time.RFC3339))
+
+		status := "valid"
+		switch {
+		case entry.Revoked != nil:
+			status = "revoked " + entry.Revoked.Format(time.RFC3339)
+		case entry.ValidBefore == nil:
+			status = "valid forever"
+		case entry.ValidBefore.Before(now):
+			status = "expired " + entry.ValidBefore.Format(time.RFC3339)
+		default:
+			status = "valid until " + entry.ValidBefore.Format(time.RFC3339)
+		}
+		fmt.Printf("Status: %s\n\n", status)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// printCertificate prints the details of a key's certificate, if it has one.
+func printCertificate(cert *keyman.Certificate) {
+	if cert == nil {
+		return
+	}
+	fmt.Printf("Certificate: %s certificate %q, serial %d\n", cert.TypeName(), cert.KeyID, cert.Serial)
+	principals := "(any)"
+	if len(cert.Principals) > 0 {
+		principals = strings.Join(cert.Principals, ", ")
+	}
+	fmt.Printf("Principals: %s\n", principals)
+	fmt.Printf("Valid: %s\n", validityString(cert))
+	fmt.Printf("Signed By: %s %s\n", cert.SignatureKey.TypeName(), cert.SignatureKey.FingerprintSHA256())
+}
+
+// validityString describes a certificate's validity window, flagging
+// certificates that have expired or are close to it.
+func validityString(cert *keyman.Certificate) string {
+	now := time.Now()
+	from := "always"
+	if !cert.ValidAfter.IsZero() {
+		from = cert.ValidAfter.Format(time.RFC3339)
+	}
+	if cert.Forever() {
+		return "from " + from + " forever"
+	}
+
+	window := fmt.Sprintf("from %s to %s", from, cert.ValidBefore.Format(time.RFC3339))
+	switch {
+	case cert.Expired(now):
+		return window + " (EXPIRED)"
+	case now.Before(cert.ValidAfter):
+		return window + " (not yet valid)"
+	case cert.ExpiresWithin(now, expiryWarningWindow):
+		return fmt.Sprintf("%s (expires in %.0f days)", window, cert.ValidBefore.Sub(now).Hours()/24)
+	default:
+		return window
+	}
+}
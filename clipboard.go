@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// clipboardCommands are tried in order on each platform; the first one found
+// in PATH receives the text on stdin.
+var clipboardCommands = map[string][][]string{
+	"darwin":  {{"pbcopy"}},
+	"windows": {{"clip.exe"}, {"clip"}},
+	"linux": {
+		{"wl-copy"},
+		{"xclip", "-selection", "clipboard"},
+		{"xsel", "--clipboard", "--input"},
+	},
+}
+
+// copyKey puts a key's public key line on the clipboard.
+func copyKey(args []string) {
+	flags := flag.NewFlagSet("copy", flag.ExitOnError)
+	osc52 := flags.Bool("osc52", false, "always copy through the terminal with an OSC 52 escape sequence")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		args = []string{pickOrUsage("Usage: keyman copy [--osc52] <key>", "Key", keyNames(), false)}
+	}
+
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(args[0], keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	pubKey, err := readPublicKey(keyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	method := "terminal (OSC 52)"
+	if *osc52 || os.Getenv("SSH_TTY") != "" {
+		err = copyOSC52(pubKey)
+	} else if method, err = copyClipboard(pubKey); err != nil {
+		// No clipboard tool; the terminal may still support OSC 52.
+		method = "terminal (OSC 52)"
+		err = copyOSC52(pubKey)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("Copied %s to the clipboard via %s\n", filepath.Base(keyPath)+keyFileExt, method)
+}
+
+// copyClipboard pipes text into the first available clipboard tool and
+// returns its name.
+func copyClipboard(text string) (string, error) {
+	for _, command := range clipboardCommands[runtime.GOOS] {
+		if _, err := exec.LookPath(command[0]); err != nil {
+			continue
+		}
+
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("%s: %w", command[0], err)
+		}
+		return command[0], nil
+	}
+	return "", fmt.Errorf("no clipboard tool found")
+}
+
+// copyOSC52 asks the terminal to set the clipboard, which works over ssh as
+// long as the terminal emulator supports OSC 52.
+func copyOSC52(text string) error {
+	out := os.Stdout
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		defer tty.Close()
+		out = tty
+	}
+
+	sequence := "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\a"
+	if os.Getenv("TMUX") != "" {
+		// tmux only forwards escape sequences wrapped in a passthrough.
+		sequence = "\x1bPtmux;" + strings.ReplaceAll(sequence, "\x1b", "\x1b\x1b") + "\x1b\\"
+	}
+
+	_, err := out.WriteString(sequence)
+	return err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const (
+	defaultDigitalOceanAPI = "https://api.digitalocean.com/v2"
+	defaultHetznerAPI      = "https://api.hetzner.cloud/v1"
+)
+
+// cloudKeyClient talks to a cloud provider's SSH key API. DigitalOcean's
+// and Hetzner Cloud's are alike: keys live under one path, are wrapped in
+// ssh_keys when listed and ssh_key when created, and are deleted by id.
+type cloudKeyClient struct {
+	service string
+	api     string
+	path    string
+	token   string
+	perPage int
+}
+
+// cloudKey is a key as DigitalOcean and Hetzner Cloud return it.
+// DigitalOcean leaves Created out.
+type cloudKey struct {
+	ID        keyID     `json:"id"`
+	Name      string    `json:"name"`
+	PublicKey string    `json:"public_key"`
+	Created   time.Time `json:"created"`
+}
+
+func digitalocean(args []string) {
+	if settings.DigitalOceanToken == "" {
+		fatal("Set DIGITALOCEAN_TOKEN or digitalocean.token in config.toml to a token with read and write access")
+	}
+	cloudKeys("digitalocean", &cloudKeyClient{
+		service: "DigitalOcean",
+		api:     defaultDigitalOceanAPI,
+		path:    "/account/keys",
+		token:   settings.DigitalOceanToken,
+		perPage: 200,
+	}, args)
+}
+
+func hetzner(args []string) {
+	if settings.HetznerToken == "" {
+		fatal("Set HCLOUD_TOKEN or hetzner.token in config.toml to a project API token with read and write access")
+	}
+	cloudKeys("hetzner", &cloudKeyClient{
+		service: "Hetzner",
+		api:     defaultHetznerAPI,
+		path:    "/ssh_keys",
+		token:   settings.HetznerToken,
+		perPage: 50,
+	}, args)
+}
+
+// cloudKeys runs the digitalocean and hetzner subcommands.
+func cloudKeys(command string, client *cloudKeyClient, args []string) {
+	if len(args) < 1 {
+		fatalUsagef("Usage: keyman %s push|list|audit|prune", command)
+	}
+
+	switch args[0] {
+	case "push":
+		flags := flag.NewFlagSet(command+" push", flag.ExitOnError)
+		name := flags.String("name", "", "name for the key on "+client.service+" (default the key name)")
+		rest := parseFlags(flags, args[1:])
+		if len(rest) != 1 {
+			fatalUsagef("Usage: keyman %s push [--name n] <key>", command)
+		}
+		cloudPush(command, client, rest[0], *name)
+	case "list":
+		keys, err := client.listKeys()
+		if err != nil {
+			fatal(err)
+		}
+		printRemoteKeys(keys)
+	case "audit":
+		keys, err := client.listKeys()
+		if err != nil {
+			fatal(err)
+		}
+		auditRemoteKeys(client.service, keys)
+	case "prune":
+		flags := flag.NewFlagSet(command+" prune", flag.ExitOnError)
+		yes := flags.Bool("yes", false, "delete without asking")
+		if rest := parseFlags(flags, args[1:]); len(rest) != 0 {
+			fatalUsagef("Usage: keyman %s prune [--yes]", command)
+		}
+		cloudPrune(command, client, *yes)
+	default:
+		fatalUsagef("Unknown %s command", command)
+	}
+}
+
+func (c *cloudKeyClient) listKeys() ([]remoteKey, error) {
+	var keys []remoteKey
+	for page := 1; ; page++ {
+		var batch struct {
+			SSHKeys []cloudKey `json:"ssh_keys"`
+		}
+		err := c.do("GET", fmt.Sprintf("%s?per_page=%d&page=%d", c.path, c.perPage, page), nil, &batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range batch.SSHKeys {
+			keys = append(keys, key.remote())
+		}
+		if len(batch.SSHKeys) < c.perPage {
+			return keys, nil
+		}
+	}
+}
+
+func (c *cloudKeyClient) addKey(name, key string) (remoteKey, error) {
+	var created struct {
+		SSHKey cloudKey `json:"ssh_key"`
+	}
+	body := map[string]string{"name": name, "public_key": key}
+	err := c.do("POST", c.path, body, &created)
+	return created.SSHKey.remote(), err
+}
+
+func (c *cloudKeyClient) deleteKey(id keyID) error {
+	return c.do("DELETE", fmt.Sprintf("%s/%s", c.path, id), nil, nil)
+}
+
+func (c *cloudKeyClient) do(method, path string, body, out interface{}) error {
+	req, err := newJSONRequest(method, c.api+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return doJSON(req, out)
+}
+
+func (k cloudKey) remote() remoteKey {
+	return remoteKey{ID: k.ID, Title: k.Name, Key: k.PublicKey, CreatedAt: k.Created}
+}
+
+func cloudPush(command string, client *cloudKeyClient, key, name string) {
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(key, keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	pubKey, err := readPublicKey(keyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	if name == "" {
+		name = key
+	}
+
+	created, err := client.addKey(name, pubKey)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal(command+" push", keyPath, "", fmt.Sprintf("id %s", created.ID))
+	fmt.Printf("Added key %s to %s with id %s\n", key, client.service, created.ID)
+}
+
+// cloudPrune deletes the keys registered with a cloud provider that match
+// no local key, which pile up from machines and people long gone.
+func cloudPrune(command string, client *cloudKeyClient, yes bool) {
+	remote, err := client.listKeys()
+	if err != nil {
+		fatal(err)
+	}
+	keys, err := getKeys()
+	if err != nil {
+		fatal(err)
+	}
+	local := make(map[string]bool)
+	for _, key := range keys {
+		if key.Public != nil {
+			local[key.Public.FingerprintSHA256()] = true
+		}
+	}
+
+	var stale []remoteKey
+	for _, key := range remote {
+		pub, err := keyman.ParsePublicKey(key.Key)
+		if err != nil || local[pub.FingerprintSHA256()] {
+			continue
+		}
+		fmt.Printf("Title: %s\nID: %s\nFingerprint: %s\n\n", key.Title, key.ID, pub.FingerprintSHA256())
+		stale = append(stale, key)
+	}
+	if len(stale) == 0 {
+		fmt.Printf("All %s keys exist locally\n", client.service)
+		return
+	}
+	if !yes && !dryRun {
+		fmt.Printf("Delete these %d key(s) from %s? [y/N]: ", len(stale), client.service)
+		answer, _ := stdin.ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			fmt.Println("Nothing deleted")
+			return
+		}
+	}
+
+	failed := 0
+	for _, key := range stale {
+		if dryRun {
+			fmt.Printf("Would delete %s (id %s) from %s\n", key.Title, key.ID, client.service)
+			continue
+		}
+		if err := client.deleteKey(key.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: deleting %s: %v\n", key.Title, err)
+			failed++
+			continue
+		}
+		journal(command+" prune", key.Title, fmt.Sprintf("id %s", key.ID), "")
+		fmt.Printf("Deleted %s (id %s) from %s\n", key.Title, key.ID, client.service)
+	}
+	if failed > 0 {
+		fatalf("%d key(s) could not be deleted", failed)
+	}
+}
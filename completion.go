@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of argument the completion knows how to fill in. A kind ending in
+// ... repeats for every following argument.
+const (
+	completeKey  = "key"
+	completeHost = "host"
+	completeFile = "file"
+)
+
+// completionArgs lists what each command's positional arguments are, and
+// for commands with subcommands, the subcommand words first. Commands
+// missing here complete nothing after their name.
+var completionArgs = map[string][]string{
+	"map":         {completeKey, completeHost},
+	"unmap":       {completeKey, completeHost},
+	"delete":      {completeKey},
+	"rotate":      {completeKey},
+	"copy":        {completeKey},
+	"qr":          {completeKey},
+	"show":        {completeKey},
+	"fingerprint": {completeKey},
+	"passphrase":  {completeKey},
+	"convert":     {completeKey, completeFile},
+	"pubkey":      {completeKey + "..."},
+	"tag":         {completeKey},
+	"note":        {completeKey},
+	"rename":      {completeKey},
+	"copy-id":     {completeKey, completeHost},
+	"ssh":         {completeHost},
+	"which":       {completeHost},
+	"sign":        {completeFile + "..."},
+	"verify":      {completeFile},
+	"apply":       {completeFile},
+	"backup":      {completeFile},
+	"restore":     {completeFile},
+	"usage":       {"import", completeFile + "..."},
+	"config":      {"lint|fmt|edit|dedupe|split|diff"},
+	"config diff": {completeFile, completeFile},
+	"completion":  {"bash|zsh|fish"},
+
+	"host":                {"add|edit|rm|list|tag"},
+	"host edit":           {completeHost},
+	"forward":             {"add|list|rm"},
+	"forward add":         {completeHost},
+	"forward list":        {completeHost + "..."},
+	"forward rm":          {completeHost},
+	"fleet":               {"push|test"},
+	"fleet push":          {completeKey},
+	"fleet test":          {completeKey},
+	"known-hosts":         {"scan|replace"},
+	"known-hosts scan":    {completeHost + "..."},
+	"known-hosts replace": {completeHost},
+	"sshfp":               {completeHost},
+	"server":              {"audit|hostkeys"},
+	"server hostkeys":     {"list|rotate"},
+	"scan":                {completeFile + "..."},
+	"agent":               {"list|map"},
+	"agent map":           {"", completeHost},
+	"age":                 {"recipient|identity|encrypt|decrypt"},
+	"age recipient":       {completeKey + "..."},
+	"age identity":        {completeKey},
+	"age encrypt":         {completeFile},
+	"age decrypt":         {completeFile},
+	"oslogin":             {"push|list|remove|prune"},
+	"oslogin push":        {completeKey},
+	"oslogin remove":      {completeKey},
+	"sync":                {"init|push|pull|status"},
+	"mux":                 {"enable|disable|status|close"},
+	"mux enable":          {completeHost},
+	"mux disable":         {completeHost},
+	"mux close":           {completeHost + "..."},
+	"host rm":             {completeHost},
+	"host tag":            {completeHost},
+	"defaults":            {"show|set|unset"},
+	"expire":              {"set|clear|list"},
+	"expire set":          {completeKey},
+	"expire clear":        {completeKey},
+	"ca":                  {"init|sign|list"},
+	"ca sign":             {completeKey},
+	"krl":                 {"add|list|check"},
+	"krl add":             {completeKey + "..."},
+	"krl check":           {completeKey},
+	"authorized":          {"list|add|remove"},
+	"authorized add":      {completeKey},
+	"signers":             {"list|add|remove"},
+	"git-signing":         {"setup|status"},
+	"git-signing setup":   {completeKey},
+	"github":              {"push|list|audit"},
+	"github push":         {completeKey},
+	"gitlab":              {"push|list|audit"},
+	"gitlab push":         {completeKey},
+	"gitea":               {"push|list|audit"},
+	"gitea push":          {completeKey},
+	"forgejo":             {"push|list|audit"},
+	"forgejo push":        {completeKey},
+	"bitbucket":           {"push|list|audit"},
+	"bitbucket push":      {completeKey},
+	"digitalocean":        {"push|list|audit|prune"},
+	"digitalocean push":   {completeKey},
+	"hetzner":             {"push|list|audit|prune"},
+	"hetzner push":        {completeKey},
+}
+
+// globalFlagValues are the global flags that take a value, which the
+// completion skips over along with the value.
+var globalFlagValues = []string{"--ssh-dir", "--profile", "--errors"}
+
+// completion prints a script that has the shell ask keyman itself for
+// completions, so key names and hosts come from the ssh directory and
+// config as they are when Tab is pressed.
+func completion(args []string) {
+	if len(args) != 1 {
+		fatalUsage("Usage: keyman completion bash|zsh|fish")
+	}
+
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	case "fish":
+		fmt.Print(fishCompletion)
+	default:
+		fatalUsagef("Unknown shell %q, use bash, zsh or fish", args[0])
+	}
+}
+
+// complete prints the candidates for the last of words, the arguments
+// typed after keyman so far. It prints nothing when the shell should fall
+// back to completing file names.
+func complete(words []string) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current := words[len(words)-1]
+
+	var positional []string
+	for i := 0; i < len(words)-1; i++ {
+		word := words[i]
+		if !strings.HasPrefix(word, "-") {
+			positional = append(positional, word)
+			continue
+		}
+		if !strings.Contains(word, "=") && containsString(globalFlagValues, word) {
+			i++
+		}
+	}
+
+	var candidates []string
+	previous := ""
+	if len(words) > 1 {
+		previous = words[len(words)-2]
+	}
+	switch {
+	case previous == "--profile":
+		candidates = profileNames()
+	case previous == "--errors":
+		candidates = []string{"text", "json"}
+	case previous == "--ssh-dir":
+		return
+	case strings.HasPrefix(current, "-"):
+		candidates = []string{"--dry-run", "--diff", "--ssh-dir", "--profile", "--errors", "--help"}
+	case len(positional) == 0:
+		candidates = commandNames()
+	default:
+		candidates = argumentCandidates(positional)
+	}
+
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, current) {
+			fmt.Println(candidate)
+		}
+	}
+}
+
+// argumentCandidates works out what kind of argument comes after the
+// positional arguments already typed and lists its values.
+func argumentCandidates(positional []string) []string {
+	command, rest := positional[0], positional[1:]
+	kinds, ok := completionArgs[command]
+	if !ok {
+		return nil
+	}
+	if len(rest) > 0 && len(kinds) > 0 && strings.Contains(kinds[0], "|") {
+		sub, ok := completionArgs[command+" "+rest[0]]
+		if !ok {
+			return nil
+		}
+		kinds, rest = sub, rest[1:]
+	}
+
+	kind := ""
+	switch {
+	case len(rest) < len(kinds):
+		kind = kinds[len(rest)]
+	case len(kinds) > 0 && strings.HasSuffix(kinds[len(kinds)-1], "..."):
+		kind = kinds[len(kinds)-1]
+	}
+
+	kind = strings.TrimSuffix(kind, "...")
+	switch kind {
+	case completeKey:
+		return keyNames()
+	case completeHost:
+		return hostNames()
+	case "", completeFile:
+		return nil
+	}
+	return strings.Split(kind, "|")
+}
+
+// commandNames lists the commands for completion, leaving out the hidden
+// one the scripts call.
+func commandNames() []string {
+	names := []string{
+		"list", "config", "unused", "map", "unmap", "generate", "delete", "rotate", "copy", "qr",
+		"ca", "krl", "sign", "verify", "git-signing", "signers", "import", "apply", "history", "undo",
+		"log", "profiles", "settings", "convert", "pubkey", "usage", "ssh", "defaults", "metrics", "daemon",
+		"serve", "completion", "copy-id", "fingerprint", "find", "github", "gitlab", "gitea", "forgejo", "bitbucket", "digitalocean", "hetzner", "oslogin", "plugins", "authorized", "backup",
+		"restore", "sync", "passphrase", "fix-perms", "host", "hosts", "graph", "forward", "mux", "fleet", "known-hosts", "sshfp", "server", "scan", "tokens", "agent", "age", "which", "tag", "note", "expire", "rename", "show", "audit", "help",
+	}
+	sort.Strings(names)
+	return names
+}
+
+func keyNames() []string {
+	keys, err := getKeys()
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, key := range keys {
+		names = append(names, key.Name)
+	}
+	return names
+}
+
+// hostNames lists the host aliases in the ssh config that name a single
+// host.
+func hostNames() []string {
+	config, err := loadConfig()
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, block := range config.AllBlocks() {
+		if block.Match {
+			continue
+		}
+		for _, pattern := range block.Patterns {
+			if !strings.ContainsAny(pattern, "*?!") && !containsString(names, pattern) {
+				names = append(names, pattern)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func profileNames() []string {
+	profiles, err := loadProfiles()
+	if err != nil || profiles == nil {
+		return nil
+	}
+	return profiles.Names()
+}
+
+const bashCompletion = `# keyman bash completion. Load it with:
+#   source <(keyman completion bash)
+_keyman() {
+    local IFS=$'\n'
+    COMPREPLY=($(keyman __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _keyman keyman
+`
+
+const zshCompletion = `#compdef keyman
+# keyman zsh completion. Load it with:
+#   source <(keyman completion zsh)
+# or save it as _keyman in a directory on $fpath.
+_keyman() {
+    local -a candidates
+    candidates=("${(@f)$(keyman __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [[ -n "${candidates[1]}" ]]; then
+        compadd -a candidates
+    else
+        _files
+    fi
+}
+if [[ "$funcstack[1]" = "_keyman" ]]; then
+    _keyman "$@"
+else
+    compdef _keyman keyman
+fi
+`
+
+const fishCompletion = `# keyman fish completion. Load it with:
+#   keyman completion fish | source
+function __keyman_complete
+    set -l words (commandline -opc) (commandline -ct)
+    keyman __complete $words[2..-1] 2>/dev/null
+end
+complete -c keyman -a '(__keyman_complete)'
+`
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/textdiff"
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// editConfig opens a copy of the ssh config in the user's editor and
+// installs it only once config lint finds no errors in it, so a typo
+// cannot leave ssh refusing to start. The config it replaces is kept in
+// the history for keyman undo.
+func editConfig(args []string) {
+	flags := flag.NewFlagSet("config edit", flag.ExitOnError)
+	force := flags.Bool("force", false, "install the config even if lint finds errors")
+	parseFlagSet(flags, args)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		fatal(err)
+	}
+	original, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		fatal(err)
+	}
+
+	tmp, err := os.CreateTemp("", "ssh_config-*")
+	if err != nil {
+		fatal(err)
+	}
+	tmpPath := tmp.Name()
+	_, err = tmp.Write(original)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		fatal(err)
+	}
+
+	var edited []byte
+	for {
+		if err := runEditor(tmpPath); err != nil {
+			fatalf("Editor failed: %v, your edits are in %s", err, tmpPath)
+		}
+		edited, err = os.ReadFile(tmpPath)
+		if err != nil {
+			fatal(err)
+		}
+		if bytes.Equal(edited, original) {
+			os.Remove(tmpPath)
+			fmt.Println("No changes")
+			return
+		}
+
+		// Lint the copy with Include paths resolved as they would be
+		// from the real config.
+		config, err := keyman.LoadConfig(tmpPath, filepath.Dir(configPath))
+		if err != nil {
+			fatalf("%v, your edits are in %s", err, tmpPath)
+		}
+		broken := 0
+		for _, finding := range config.Lint() {
+			printFinding(finding, useColor(false))
+			if finding.Severity == keyman.SeverityError {
+				broken++
+			}
+		}
+		if broken == 0 || *force {
+			break
+		}
+
+		if !isTerminal(os.Stdin) {
+			fatalf("%d error(s) would stop ssh from starting, config not installed, your edits are in %s", broken, tmpPath)
+		}
+		fmt.Printf("%d error(s) would stop ssh from starting. Edit again? [Y/n]: ", broken)
+		answer, err := stdin.ReadString('\n')
+		if answer = strings.TrimSpace(answer); err != nil || (answer != "" && !strings.EqualFold(answer, "y")) {
+			fatalf("Config not installed, your edits are in %s", tmpPath)
+		}
+	}
+
+	config := keyman.ParseConfigBytes(configPath, edited)
+	if dryRun || showDiff {
+		fmt.Print(textdiff.Unified(configPath, configPath, original, edited))
+	}
+	if dryRun {
+		fmt.Printf("Would install the edited config at %s\n", configPath)
+		os.Remove(tmpPath)
+		return
+	}
+
+	if err := snapshotConfig(config); err != nil {
+		fatalf("%v, your edits are in %s", err, tmpPath)
+	}
+	if err := os.WriteFile(configPath, edited, 0600); err != nil {
+		fatalf("%v, your edits are in %s", err, tmpPath)
+	}
+	os.Remove(tmpPath)
+	journal("config edit", configPath, "", "")
+	fmt.Printf("Installed %s, keyman undo restores the previous config\n", configPath)
+}
+
+// runEditor opens path in $VISUAL or $EDITOR, falling back to vi, or
+// notepad on Windows, and waits for it to exit.
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], path)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// lintConfig checks the ssh config and the files it includes, printing
+// each problem with its file and line. It exits non-zero when it finds
+// warnings or errors.
+func lintConfig(args []string) {
+	flags := flag.NewFlagSet("config lint", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the findings as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	parseFlagSet(flags, args)
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	findings := config.Lint()
+
+	failed := false
+	for _, finding := range findings {
+		if finding.Severity >= keyman.SeverityWarning {
+			failed = true
+		}
+	}
+
+	if *asJSON {
+		out := []findingJSON{}
+		for _, finding := range findings {
+			out = append(out, findingJSON{
+				Severity: finding.Severity.String(),
+				Rule:     finding.Rule,
+				Subject:  finding.Subject,
+				Message:  finding.Message,
+			})
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(out); err != nil {
+			fatal(err)
+		}
+	} else {
+		if len(findings) == 0 {
+			fmt.Println("No problems found in", config.Path)
+		}
+		for _, finding := range findings {
+			printFinding(finding, useColor(*plain))
+		}
+	}
+
+	if failed {
+		os.Exit(exitFindings)
+	}
+}
+
+// formatConfig normalizes the layout of the ssh config and the files it
+// includes, as gofmt does for Go.
+func formatConfig(args []string) {
+	flags := flag.NewFlagSet("config fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "list the files that need formatting and exit non-zero, without changing them")
+	indent := flags.Int("indent", len(keyman.Indent), "spaces to indent the options of a block by")
+	parseFlagSet(flags, args)
+	if *indent < 0 {
+		fatalUsage("--indent cannot be negative")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	var changed []string
+	for _, file := range config.Files() {
+		if file.Format(strings.Repeat(" ", *indent)) {
+			changed = append(changed, file.Path)
+		}
+	}
+
+	if *check {
+		for _, path := range changed {
+			fmt.Println(path)
+		}
+		if len(changed) > 0 {
+			os.Exit(exitFindings)
+		}
+		return
+	}
+	if len(changed) == 0 {
+		fmt.Println("Config is already formatted")
+		return
+	}
+
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	for _, path := range changed {
+		if dryRun {
+			fmt.Printf("Would format %s\n", path)
+		} else {
+			fmt.Printf("Formatted %s\n", path)
+			journal("config fmt", path, "", "")
+		}
+	}
+}
+
+// dedupeConfig finds hosts with more than one Host block, shows which of
+// their options ssh uses, and offers to merge each into one block.
+func dedupeConfig(args []string) {
+	flags := flag.NewFlagSet("config dedupe", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "merge without asking")
+	parseFlagSet(flags, args)
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	found, merged := 0, 0
+	for {
+		var duplicate *keyman.DuplicateHost
+		for _, d := range config.FindDuplicateHosts() {
+			if !seen[d.Host] {
+				duplicate = &d
+				break
+			}
+		}
+		if duplicate == nil {
+			break
+		}
+		seen[duplicate.Host] = true
+		found++
+
+		var lines []string
+		for _, block := range duplicate.Blocks {
+			lines = append(lines, fmt.Sprintf("%s:%d", block.File.Path, block.Line()))
+		}
+		fmt.Printf("Host %s is in %d blocks, at %s\n", duplicate.Host, len(duplicate.Blocks), strings.Join(lines, ", "))
+		for _, option := range duplicate.Options {
+			note := ""
+			if option.Ignored {
+				note = " (ignored, set earlier)"
+			}
+			fmt.Printf("    %s %s, %s:%d%s\n", option.Keyword, option.Value, option.Block.File.Path, option.Line, note)
+		}
+
+		if !*yes && !dryRun {
+			fmt.Print("Merge these blocks into the first? [y/N]: ")
+			answer, _ := stdin.ReadString('\n')
+			if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+				fmt.Println()
+				continue
+			}
+		}
+		if err := config.MergeDuplicate(*duplicate); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		} else {
+			merged++
+		}
+		fmt.Println()
+	}
+
+	if found == 0 {
+		fmt.Println("No duplicate Host blocks found")
+		return
+	}
+	if merged == 0 {
+		return
+	}
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	if dryRun {
+		fmt.Printf("Would merge the blocks of %d host(s)\n", merged)
+		return
+	}
+	journal("config dedupe", config.Path, "", fmt.Sprintf("%d host(s) merged", merged))
+	fmt.Printf("Merged the blocks of %d host(s)\n", merged)
+}
+
+// splitConfig moves the hosts of the ssh config into a file each under
+// config.d, where map, host add and the rest then add new hosts too.
+func splitConfig(args []string) {
+	flags := flag.NewFlagSet("config split", flag.ExitOnError)
+	parseFlagSet(flags, args)
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	written, err := config.Split()
+	if err != nil {
+		fatal(err)
+	}
+	if len(written) == 0 {
+		fmt.Println("No hosts to split out")
+		return
+	}
+
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	verb := "Moved"
+	if dryRun {
+		verb = "Would move"
+	}
+	for _, path := range written {
+		fmt.Printf("%s hosts to %s\n", verb, path)
+	}
+	journal("config split", config.Path, "", fmt.Sprintf("%d file(s)", len(written)))
+}
+
+// diffConfig shows what changed between two versions of the ssh config,
+// host by host and option by option. Each side is a config file or a
+// snapshot from keyman history; the current config is the second side
+// unless two are given, and the latest snapshot the first if none is.
+func diffConfig(args []string) {
+	flags := flag.NewFlagSet("config diff", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the changes as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	args = parseFlags(flags, args)
+	if len(args) > 2 {
+		fatalUsage("Usage: keyman config diff [file|snapshot] [file|snapshot]")
+	}
+
+	current, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	snaps, err := loadSnapshots()
+	if err != nil {
+		fatal(err)
+	}
+
+	// side loads the config files a file or snapshot argument names.
+	side := func(arg string) ([]*keyman.Config, string) {
+		for i, snap := range snaps {
+			if snap.ID == arg {
+				files, err := snapshotConfigFiles(snaps, i, current)
+				if err != nil {
+					fatal(err)
+				}
+				return files, fmt.Sprintf("before keyman %s (%s)", snap.Command, snap.ID)
+			}
+		}
+		path, err := keyman.ExpandPath(arg)
+		if err != nil {
+			fatal(err)
+		}
+		config, err := keyman.LoadConfig(path, filepath.Dir(path))
+		if err != nil {
+			fatal(err)
+		}
+		return config.Files(), path
+	}
+
+	oldFiles, newFiles := []*keyman.Config(nil), current.Files()
+	oldLabel, newLabel := "", current.Path
+	switch len(args) {
+	case 0:
+		if len(snaps) == 0 {
+			fatal("No snapshots to compare with, give a file or see keyman history")
+		}
+		oldFiles, oldLabel = side(snaps[0].ID)
+	case 1:
+		oldFiles, oldLabel = side(args[0])
+	case 2:
+		oldFiles, oldLabel = side(args[0])
+		newFiles, newLabel = side(args[1])
+	}
+
+	changes := keyman.DiffConfigs(oldFiles, newFiles)
+	if *asJSON {
+		printConfigChangesJSON(changes)
+	} else {
+		printConfigChanges(changes, oldLabel, newLabel, useColor(*plain))
+	}
+	if len(changes) > 0 {
+		os.Exit(exitFindings)
+	}
+}
+
+// snapshotConfigFiles rebuilds the config files as they were before the
+// command of snaps[target] ran, from the snapshots and current.
+func snapshotConfigFiles(snaps []*snapshot, target int, current *keyman.Config) ([]*keyman.Config, error) {
+	restore, missing, paths, err := snapshotFiles(snaps, target)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*keyman.Config
+	seen := make(map[string]bool)
+	for _, file := range current.Files() {
+		seen[file.Path] = true
+		switch {
+		case missing[file.Path]:
+		case restore[file.Path] != nil:
+			files = append(files, keyman.ParseConfigBytes(file.Path, restore[file.Path]))
+		default:
+			files = append(files, file)
+		}
+	}
+	for _, path := range paths {
+		if !seen[path] && !missing[path] {
+			files = append(files, keyman.ParseConfigBytes(path, restore[path]))
+		}
+	}
+	return files, nil
+}
+
+func printConfigChanges(changes []keyman.ConfigChange, oldLabel, newLabel string, color bool) {
+	if len(changes) == 0 {
+		fmt.Println("No differences")
+		return
+	}
+	fmt.Println(paint("--- "+oldLabel, colorRed, color))
+	fmt.Println(paint("+++ "+newLabel, colorGreen, color))
+
+	host := ""
+	for _, change := range changes {
+		if change.Keyword == "" {
+			mark, markColor := "-", colorRed
+			if change.Kind == keyman.ChangeAdded {
+				mark, markColor = "+", colorGreen
+			}
+			fmt.Println(paint(mark+" "+change.Host, markColor, color))
+			host = change.Host
+			continue
+		}
+		if change.Host != host {
+			fmt.Println("~ " + change.Host)
+			host = change.Host
+		}
+		switch change.Kind {
+		case keyman.ChangeAdded:
+			fmt.Println(paint(fmt.Sprintf("    + %s %s", change.Keyword, change.New), colorGreen, color))
+		case keyman.ChangeRemoved:
+			fmt.Println(paint(fmt.Sprintf("    - %s %s", change.Keyword, change.Old), colorRed, color))
+		default:
+			fmt.Println(paint(fmt.Sprintf("    ~ %s %s -> %s", change.Keyword, change.Old, change.New), colorYellow, color))
+		}
+	}
+}
+
+func printConfigChangesJSON(changes []keyman.ConfigChange) {
+	type changeJSON struct {
+		Host    string `json:"host"`
+		Kind    string `json:"kind"`
+		Keyword string `json:"keyword,omitempty"`
+		Old     string `json:"old,omitempty"`
+		New     string `json:"new,omitempty"`
+	}
+	out := []changeJSON{}
+	for _, change := range changes {
+		out = append(out, changeJSON(change))
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(out); err != nil {
+		fatal(err)
+	}
+}
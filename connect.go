@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// connect runs ssh to a host with only the keys it is mapped to, so the
+// agent cannot offer a different one first, and records the login.
+// Arguments after the host are passed on to ssh.
+func connect(args []string) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fatalUsage("Usage: keyman ssh <host> [ssh arguments...]")
+	}
+	target := args[0]
+	_, host := splitTarget(target)
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	keyPaths, err := mappedKeys(config, host)
+	if err != nil {
+		fatal(err)
+	}
+
+	sshArgs, err := sshClientArgs()
+	if err != nil {
+		fatal(err)
+	}
+	for _, keyPath := range keyPaths {
+		if _, err := os.Stat(keyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: the key mapped to %s is missing: %v\n", host, err)
+		} else if loaded, err := agentHasKey(keyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not check ssh-agent for %s: %v\n", keyPath, err)
+		} else if !loaded {
+			fmt.Fprintf(os.Stderr, "Warning: %s is not loaded in ssh-agent\n", keyPath)
+		}
+		sshArgs = append(sshArgs, "-i", keyPath)
+	}
+	sshArgs = append(append(sshArgs, "-o", "IdentitiesOnly=yes"), args...)
+
+	if dryRun {
+		fmt.Printf("Would run: ssh %s\n", strings.Join(sshArgs, " "))
+		return
+	}
+
+	cmd := exec.Command(toolPath("ssh"), sshArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+
+	// ssh exits with 255 for its own errors and otherwise with the status
+	// of the remote command, which still means a key logged in. Which one
+	// is only known when there is a single key to try.
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		if len(keyPaths) == 1 {
+			recordKeyUse(keyPaths[0], host)
+		}
+	case errors.As(err, &exitErr):
+		if exitErr.ExitCode() != 255 && len(keyPaths) == 1 {
+			recordKeyUse(keyPaths[0], host)
+		}
+		os.Exit(exitErr.ExitCode())
+	default:
+		fatal(err)
+	}
+}
+
+// mappedKeys returns the IdentityFile paths the Host blocks matching host
+// give it, in the order ssh tries them.
+func mappedKeys(config *keyman.Config, host string) ([]string, error) {
+	var keyPaths []string
+	for _, block := range config.MatchingBlocks(host) {
+		for _, identity := range block.Options("IdentityFile") {
+			keyPath, err := keyman.ExpandPath(identity)
+			if err != nil {
+				return nil, err
+			}
+			if !containsPath(keyPaths, keyPath) {
+				keyPaths = append(keyPaths, keyPath)
+			}
+		}
+	}
+	if len(keyPaths) == 0 {
+		return nil, fmt.Errorf("no key is mapped to %s", host)
+	}
+	return keyPaths, nil
+}
+
+// agentHasKey reports whether the running ssh-agent holds the key at
+// keyPath.
+func agentHasKey(keyPath string) (bool, error) {
+	if !agentAvailable() {
+		return false, fmt.Errorf("no ssh-agent is running")
+	}
+	pub, err := keyman.ReadPublicKeyFile(keyPath + keyFileExt)
+	if err != nil {
+		return false, err
+	}
+
+	loaded, err := agentPublicKeys()
+	if err != nil {
+		return false, err
+	}
+	for _, key := range loaded {
+		if bytes.Equal(key.Blob, pub.Blob) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// agentPublicKeys returns the keys the running ssh-agent holds.
+func agentPublicKeys() ([]*keyman.PublicKey, error) {
+	return agentKeysAt("")
+}
+
+// agentKeysAt returns the keys held by the agent listening on socket, or
+// by the one SSH_AUTH_SOCK names when socket is empty.
+func agentKeysAt(socket string) ([]*keyman.PublicKey, error) {
+	cmd := exec.Command(toolPath("ssh-add"), "-L")
+	if socket != "" {
+		cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+socket)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		// The agent is running but holds no keys.
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var keys []*keyman.PublicKey
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if key, err := keyman.ParsePublicKey(scanner.Text()); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const ppkFileExt = ".ppk"
+
+// Key formats. ppk is only for private keys and rfc4716 only for public
+// keys; the others cover both.
+const (
+	formatOpenSSH = "openssh"
+	formatPPK     = "ppk"
+	formatPEM     = "pem"
+	formatPKCS8   = "pkcs8"
+	formatRFC4716 = "rfc4716"
+)
+
+// sshKeygenFormats are the -m names ssh-keygen uses for the formats it can
+// convert to and from.
+var sshKeygenFormats = map[string]string{
+	formatPEM:     "PEM",
+	formatPKCS8:   "PKCS8",
+	formatRFC4716: "RFC4716",
+}
+
+// convertKey converts a private key between OpenSSH, PuTTY's PPK, PEM and
+// PKCS#8, keeping its passphrase unless told otherwise, or a public key
+// between OpenSSH, RFC 4716, PEM and PKCS#8.
+func convertKey(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := flags.String("to", "", "format to write: openssh, ppk, pem, pkcs8 or rfc4716 (default: ppk for OpenSSH keys, openssh otherwise)")
+	ppkVersion := flags.Int("ppk-version", 3, "PPK format version to write; 2 for PuTTY before 0.75 and older WinSCP")
+	passphraseFile := flags.String("passphrase-file", "", "read the key's passphrase from a file, or - for stdin")
+	noPassphrase := flags.Bool("no-passphrase", false, "write the converted key without a passphrase")
+	rounds := flags.Int("rounds", 0, "bcrypt KDF rounds for an OpenSSH key with a passphrase (default: ssh-keygen's 16)")
+	args = parseFlags(flags, args)
+	if len(args) < 1 || len(args) > 2 {
+		fatalUsage("Usage: keyman convert [--to openssh|ppk|pem|pkcs8|rfc4716] [--ppk-version 2|3] [--rounds n] [--passphrase-file f] [--no-passphrase] <key|file> [output]")
+	}
+
+	inPath := args[0]
+	if _, err := os.Stat(inPath); err != nil {
+		var pathErr error
+		inPath, pathErr = getFullKeyPath(args[0])
+		if pathErr != nil {
+			fatal(pathErr)
+		}
+	}
+	data, err := os.ReadFile(inPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	outPath := ""
+	if len(args) > 1 {
+		outPath = args[1]
+	}
+
+	if from := publicKeyFormat(data); from != "" {
+		convertPublicKey(inPath, from, *to, outPath)
+		return
+	}
+
+	fromPPK := keyman.IsPPK(data)
+	if *to == "" {
+		*to = formatPPK
+		if fromPPK {
+			*to = formatOpenSSH
+		}
+	}
+	switch *to {
+	case formatOpenSSH, formatPPK, formatPEM, formatPKCS8:
+	case formatRFC4716:
+		fatalf("%s holds public keys only, convert %s%s instead", formatRFC4716, inPath, keyFileExt)
+	default:
+		fatalUsagef("Unknown format %q, use openssh, ppk, pem, pkcs8 or rfc4716", *to)
+	}
+
+	var key *keyman.PrivateKey
+	var passphrase string
+	if fromPPK {
+		if keyman.PPKEncrypted(data) {
+			passphrase, err = getPassphrase(*passphraseFile, fmt.Sprintf("Passphrase for %s: ", inPath), false)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		key, err = keyman.ParsePPK(data, passphrase)
+	} else {
+		key, err = keyman.ParsePrivateKey(data)
+		if errors.Is(err, keyman.ErrEncryptedKey) {
+			passphrase, err = getPassphrase(*passphraseFile, fmt.Sprintf("Passphrase for %s: ", inPath), false)
+			if err != nil {
+				fatal(err)
+			}
+			key, err = readEncryptedKey(inPath, passphrase)
+		}
+	}
+	if err != nil {
+		fatalf("Reading %s failed: %v", inPath, err)
+	}
+	if *noPassphrase {
+		passphrase = ""
+	}
+
+	if _, ok := key.Key.(ed25519.PrivateKey); ok && (*to == formatPEM || *to == formatPKCS8) {
+		fatalf("ssh-keygen cannot write Ed25519 keys as %s, use openssh or ppk", *to)
+	}
+	if *rounds > 0 && (*to != formatOpenSSH || passphrase == "") {
+		fatal("--rounds only applies to OpenSSH keys with a passphrase")
+	}
+
+	// Without an output, .ppk files are imported into the ssh directory,
+	// keys are exported to a .ppk here, and otherwise rewritten in place,
+	// as ssh-keygen -p -m does.
+	if outPath == "" {
+		switch {
+		case *to == formatPPK:
+			outPath = filepath.Base(inPath) + ppkFileExt
+		case fromPPK:
+			outPath, err = getFullKeyPath(strings.TrimSuffix(filepath.Base(inPath), ppkFileExt))
+			if err != nil {
+				fatal(err)
+			}
+		default:
+			outPath = inPath
+		}
+	}
+	if _, err := os.Stat(outPath); err == nil && outPath != inPath {
+		fatalf("%s already exists", outPath)
+	}
+
+	if dryRun {
+		fmt.Printf("Would convert %s to %s as %s\n", inPath, outPath, *to)
+		return
+	}
+
+	if *to == formatPPK {
+		err = writePPK(outPath, key, passphrase, *ppkVersion)
+	} else {
+		err = writePrivateKey(outPath, key, passphrase, *to, *rounds)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	pub := key.PublicKey()
+	journal("convert", outPath, inPath, pub.TypeName()+" "+pub.FingerprintSHA256())
+	fmt.Printf("Converted %s to %s\n", inPath, outPath)
+	fmt.Printf("Fingerprint: %s\n", pub.FingerprintSHA256())
+}
+
+// publicKeyFormat returns the format of data if it is a public key, or ""
+// if it is not.
+func publicKeyFormat(data []byte) string {
+	switch {
+	case keyman.IsRFC4716(data):
+		return formatRFC4716
+	case bytes.HasPrefix(data, []byte("-----BEGIN RSA PUBLIC KEY-----")):
+		return formatPEM
+	case bytes.HasPrefix(data, []byte("-----BEGIN PUBLIC KEY-----")):
+		return formatPKCS8
+	}
+	if _, err := keyman.ParsePublicKey(string(bytes.TrimSpace(data))); err == nil {
+		return formatOpenSSH
+	}
+	return ""
+}
+
+// convertPublicKey re-encodes a public key, printing it unless outPath is
+// given.
+func convertPublicKey(inPath, from, to, outPath string) {
+	if to == "" {
+		to = formatOpenSSH
+		if from == formatOpenSSH {
+			to = formatRFC4716
+		}
+	}
+	switch to {
+	case formatOpenSSH, formatRFC4716, formatPEM, formatPKCS8:
+	case formatPPK:
+		fatalf("%s holds private keys only, convert the private key instead", formatPPK)
+	default:
+		fatalUsagef("Unknown format %q, use openssh, ppk, pem, pkcs8 or rfc4716", to)
+	}
+
+	var pub *keyman.PublicKey
+	var err error
+	switch from {
+	case formatOpenSSH:
+		pub, err = keyman.ReadPublicKeyFile(inPath)
+	case formatRFC4716:
+		var data []byte
+		data, err = os.ReadFile(inPath)
+		if err == nil {
+			pub, err = keyman.ParseRFC4716(data)
+		}
+	default:
+		var line []byte
+		line, err = exec.Command(toolPath("ssh-keygen"), "-i", "-m", sshKeygenFormats[from], "-f", inPath).Output()
+		if err == nil {
+			pub, err = keyman.ParsePublicKey(string(line))
+		}
+	}
+	if err != nil {
+		fatalf("Reading %s failed: %v", inPath, err)
+	}
+
+	var out []byte
+	switch to {
+	case formatOpenSSH:
+		out = []byte(pub.String() + "\n")
+	case formatRFC4716:
+		out = pub.MarshalRFC4716()
+	default:
+		out, err = exportPublicKey(pub, to)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if outPath == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	if _, err := os.Stat(outPath); err == nil {
+		fatalf("%s already exists", outPath)
+	}
+	if dryRun {
+		fmt.Printf("Would convert %s to %s as %s\n", inPath, outPath, to)
+		return
+	}
+	if err := os.WriteFile(outPath, out, 0644); err != nil {
+		fatal(err)
+	}
+	journal("convert", outPath, inPath, pub.TypeName()+" "+pub.FingerprintSHA256())
+	fmt.Printf("Converted %s to %s\n", inPath, outPath)
+}
+
+// exportPublicKey has ssh-keygen -e encode a public key as PEM or PKCS#8.
+func exportPublicKey(pub *keyman.PublicKey, format string) ([]byte, error) {
+	file, err := os.CreateTemp("", "keyman-convert-*.pub")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(pub.String() + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := exec.Command(toolPath("ssh-keygen"), "-e", "-m", sshKeygenFormats[format], "-f", file.Name()).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ssh-keygen cannot write %s keys as %s: %s", pub.TypeName(), format, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// readEncryptedKey decrypts a passphrase protected OpenSSH or PEM key by
+// having ssh-keygen remove the passphrase from a temporary copy.
+func readEncryptedKey(keyPath, passphrase string) (*keyman.PrivateKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "keyman-convert-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "key")
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return nil, err
+	}
+	cmd, err := sshKeygenCommand(passphrase, "", "-q", "-p", "-N", "", "-f", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	data, err = os.ReadFile(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	return keyman.ParsePrivateKey(data)
+}
+
+func writePPK(path string, key *keyman.PrivateKey, passphrase string, version int) error {
+	data, err := keyman.MarshalPPK(key, passphrase, version)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// writePrivateKey writes the key in OpenSSH, PEM or PKCS#8 format, letting
+// ssh-keygen re-encode it and add the passphrase so the file is exactly
+// what ssh-keygen would write. The key goes to a temporary file first, so
+// converting in place never leaves a half written key, and the .pub file
+// is written if it is missing.
+func writePrivateKey(path string, key *keyman.PrivateKey, passphrase, format string, rounds int) error {
+	data, err := key.MarshalOpenSSH()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".keyman-convert-")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if passphrase != "" || format != formatOpenSSH {
+		args := []string{"-q", "-p", "-P", "", "-f", tmpPath}
+		if format != formatOpenSSH {
+			args = append(args, "-m", sshKeygenFormats[format])
+		}
+		if rounds > 0 {
+			args = append(args, "-a", fmt.Sprint(rounds))
+		}
+		cmd, err := sshKeygenCommand("", passphrase, args...)
+		if err != nil {
+			return err
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("ssh-keygen failed: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path + keyFileExt); os.IsNotExist(err) {
+		return os.WriteFile(path+keyFileExt, []byte(key.PublicKey().String()+"\n"), 0644)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// daemonState is what the daemon remembers between checks, so each new key
+// and each finding is only reported once.
+type daemonState struct {
+	keys     map[string]bool
+	findings map[string]bool
+	started  bool
+}
+
+// daemon watches the ssh directory and audits it on a schedule, reporting
+// new keys, permission drift, changed host keys and keys past the expiry or
+// policy thresholds. The directory is polled for changes rather than
+// watched, which works the same on every platform.
+func daemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	intervalFlag := flags.String("interval", "1h", "run a full audit this often")
+	pollFlag := flags.String("poll", "5s", "check the ssh directory for changes this often")
+	policyPath := flags.String("policy", "", "policy file to evaluate (default ~/.config/keyman/policy.yaml if present)")
+	defaultWindow := "30d"
+	if settings.ExpiryWindow > 0 {
+		defaultWindow = settings.ExpiryWindow.String()
+	}
+	expiryWindowFlag := flags.String("expiry-window", defaultWindow, "report keys expiring within this long")
+	unusedAfterFlag := flags.String("unused-after", "90d", "count keys with a recorded last use as unused when not used for this long")
+	minSeverityFlag := flags.String("min-severity", orDefault(settings.NotifyMinSeverity, "warning"), "report findings of this severity or worse: info, warning or error")
+	webhook := flags.String("webhook", "", "post each event to this URL (default notify.webhook from the settings)")
+	webhookFormat := flags.String("webhook-format", "", "post events as json, slack or discord messages (default notify.format from the settings)")
+	noNotify := flags.Bool("no-notify", false, "do not show desktop notifications")
+	parseFlagSet(flags, args)
+
+	interval, err := keyman.ParseAge(*intervalFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+	poll, err := keyman.ParseAge(*pollFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+	expiryWindow, err := keyman.ParseAge(*expiryWindowFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+	unusedAfter, err := keyman.ParseAge(*unusedAfterFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+	minSeverity, err := keyman.ParseSeverity(*minSeverityFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+	if interval <= 0 || poll <= 0 {
+		fatalUsage("--interval and --poll must be greater than zero")
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+	hostname, _ := os.Hostname()
+
+	var hook *notifier
+	if *webhook != "" || settings.NotifyWebhook != "" {
+		hook, err = newNotifier(*webhook, *webhookFormat, *minSeverityFlag)
+		if err != nil {
+			fatalUsage(err)
+		}
+	}
+
+	report := func(event notification) {
+		event.Time = time.Now()
+		event.Host = hostname
+		fmt.Printf("%s %s %s: %s\n", event.Time.Format(time.RFC3339), event.Severity, event.Subject, event.Message)
+		if !*noNotify {
+			if err := desktopNotify("keyman: "+event.Subject, event.Message); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: desktop notification failed: %v\n", err)
+			}
+		}
+		if hook != nil {
+			if err := hook.notify(event); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: webhook failed: %v\n", err)
+			}
+		}
+	}
+
+	state := &daemonState{keys: make(map[string]bool), findings: make(map[string]bool)}
+	check := func() {
+		events, err := state.check(*policyPath, expiryWindow, unusedAfter, minSeverity)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			return
+		}
+		for _, event := range events {
+			report(event)
+		}
+	}
+
+	fmt.Printf("Watching %s, auditing every %s\n", sshPath, interval)
+	check()
+	snapshot := dirSnapshot(sshPath)
+	lastAudit := time.Now()
+
+	for range time.Tick(poll) {
+		current := dirSnapshot(sshPath)
+		if current != snapshot || time.Since(lastAudit) >= interval {
+			snapshot = current
+			lastAudit = time.Now()
+			check()
+		}
+	}
+}
+
+// check audits the keys and returns events for keys and findings that were
+// not there on the previous check. Keys present on the first check are
+// taken as known.
+func (s *daemonState) check(policyPath string, expiryWindow, unusedAfter time.Duration, minSeverity keyman.Severity) ([]notification, error) {
+	keys, err := getKeys()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := auditPolicy(policyPath)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	config, err := sshConfig.Mappings()
+	if err != nil {
+		return nil, err
+	}
+
+	report := keyman.Audit(keys, config, unusedAfter)
+	var policyFindings []keyman.Finding
+	if policy != nil {
+		policyFindings = policy.Evaluate(keys)
+	}
+	findings, err := auditFindings(report, sshConfig, expiryWindow, false, keyman.CheckStrength(keys), policyFindings)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []notification
+	currentKeys := make(map[string]bool)
+	for _, key := range report.Keys {
+		currentKeys[key.Name] = true
+		if s.started && !s.keys[key.Name] {
+			message := "new key " + reportKeyType(key)
+			if fingerprint := reportFingerprint(key); fingerprint != "" {
+				message += " " + fingerprint
+			}
+			events = append(events, notification{Event: "new_key", Severity: keyman.SeverityWarning.String(), Subject: key.Name, Message: message})
+		}
+	}
+	s.keys = currentKeys
+	s.started = true
+
+	// Findings that went away are forgotten, so they are reported again
+	// if they come back.
+	currentFindings := make(map[string]bool)
+	for _, finding := range findings {
+		if finding.Severity < minSeverity {
+			continue
+		}
+		id := finding.Rule + "\x00" + finding.Subject
+		currentFindings[id] = true
+		if !s.findings[id] {
+			events = append(events, findingNotification(finding))
+		}
+	}
+	s.findings = currentFindings
+	return events, nil
+}
+
+// dirSnapshot summarizes the names, sizes, modes and modification times of
+// the files in dir, so comparing two snapshots shows whether it changed.
+func dirSnapshot(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %o %d", entry.Name(), info.Size(), info.Mode(), info.ModTime().UnixNano()))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// desktopNotify shows a notification with notify-send on Linux and the BSDs
+// or osascript on macOS. Elsewhere, or when the tool is missing, it does
+// nothing.
+func desktopNotify(title, message string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+		script := fmt.Sprintf(`display notification "%s" with title "%s"`, quote.Replace(message), quote.Replace(title))
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		return nil
+	default:
+		if _, err := exec.LookPath("notify-send"); err != nil {
+			return nil
+		}
+		cmd = exec.Command("notify-send", title, message)
+	}
+	return cmd.Run()
+}
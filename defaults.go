@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// defaults manages the Host * block, which holds the options every host
+// gets unless a block above it sets them first.
+func defaults(args []string) {
+	if len(args) == 0 {
+		args = []string{"show"}
+	}
+
+	switch args[0] {
+	case "show":
+		showDefaults()
+	case "set":
+		if len(args) < 3 {
+			fatalUsage("Usage: keyman defaults set <option> <value>")
+		}
+		setDefault(args[1], strings.Join(args[2:], " "))
+	case "unset":
+		if len(args) != 2 {
+			fatalUsage("Usage: keyman defaults unset <option>")
+		}
+		unsetDefault(args[1])
+	default:
+		fatalUsage("Usage: keyman defaults show|set|unset")
+	}
+}
+
+func showDefaults() {
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	block := config.Defaults()
+	if block == nil {
+		fmt.Println("No Host * defaults set")
+		return
+	}
+
+	fmt.Printf("Defaults (Host * in %s):\n", block.File.Path)
+	for _, line := range block.Lines() {
+		fmt.Println(strings.TrimSpace(line.Text))
+	}
+	warnDefaultsOrder(config)
+}
+
+func setDefault(option, value string) {
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	block := config.Defaults()
+	if block == nil {
+		block = config.AppendHost(keyman.DefaultsHost)
+	}
+	old := block.Option(option)
+	block.SetOption(option, value)
+
+	err = saveConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+	journal("defaults set", option, old, value)
+
+	if !dryRun {
+		fmt.Printf("Set %s %s for all hosts\n", option, value)
+		warnDefaultsOrder(config)
+	}
+}
+
+func unsetDefault(option string) {
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	block := config.Defaults()
+	if block == nil || block.Option(option) == "" {
+		fatalf("%s is not set in the Host * defaults", option)
+	}
+	old := block.Option(option)
+	block.RemoveOption(option, func(string) bool { return true })
+	if block.IsEmpty() {
+		block.Remove()
+	}
+
+	err = saveConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+	journal("defaults unset", option, old, "")
+
+	if !dryRun {
+		fmt.Printf("Unset %s for all hosts\n", option)
+	}
+}
+
+// warnDefaultsOrder points out Host blocks that come after Host *, whose
+// options the defaults override since ssh uses the first value it finds.
+func warnDefaultsOrder(config *keyman.Config) {
+	var later []string
+	seenDefaults := false
+	for _, block := range config.AllBlocks() {
+		switch {
+		case block.IsDefaults():
+			seenDefaults = true
+		case seenDefaults && !block.Match:
+			later = append(later, block.Name())
+		}
+	}
+	if len(later) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: Host * comes before %s, so its options override theirs. Move it to the end of the config.\n", strings.Join(later, ", "))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/textdiff"
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// dryRun and showDiff are set by the global --dry-run and --diff flags.
+// A dry run reports the file operations and config diff a command would
+// make without making them.
+var (
+	dryRun   bool
+	showDiff bool
+)
+
+// dryRunCommands are the commands that honour --dry-run, as a command or,
+// where only some of its subcommands do, as "command subcommand". Commands
+// that only read, like list and audit, have nothing to hold back and are
+// among them. main refuses --dry-run for any other command rather than
+// let it make the changes it was only asked to show.
+var dryRunCommands = map[string]bool{
+	"map": true, "unmap": true, "generate": true, "delete": true, "rotate": true, "rename": true, "apply": true,
+	"undo": true, "convert": true, "pubkey": true, "copy-id": true, "ssh": true, "serve": true,
+	"config": true, "defaults": true, "forward": true, "mux": true, "fleet": true, "known-hosts": true,
+	"server": true, "agent": true, "oslogin": true, "sync": true, "usage": true,
+	"host add": true, "host edit": true, "host rm": true, "host list": true,
+	"age recipient": true, "age identity": true,
+	"digitalocean list": true, "digitalocean audit": true, "digitalocean prune": true,
+	"hetzner list": true, "hetzner audit": true, "hetzner prune": true,
+
+	"list": true, "unused": true, "show": true, "hosts": true, "graph": true, "which": true, "find": true,
+	"fingerprint": true, "audit": true, "qr": true, "verify": true, "scan": true, "sshfp": true,
+	"metrics": true, "log": true, "history": true, "profiles": true, "settings": true, "plugins": true,
+	"completion": true, "__complete": true, "help": true,
+}
+
+// dryRunCommand returns the command in args, with its subcommand when
+// that decides it, and whether it honours --dry-run.
+func dryRunCommand(args []string) (string, bool) {
+	if len(args) == 0 {
+		return "", true
+	}
+	if dryRunCommands[args[0]] {
+		return args[0], true
+	}
+	if len(args) > 1 {
+		name := args[0] + " " + args[1]
+		for command := range dryRunCommands {
+			if strings.HasPrefix(command, args[0]+" ") {
+				return name, dryRunCommands[name]
+			}
+		}
+	}
+	return args[0], false
+}
+
+// saveConfig writes back every changed config file, printing a unified diff
+// of each first if asked to and snapshotting the old contents for keyman
+// undo. In a dry run only the diff is printed.
+func saveConfig(config *keyman.Config) error {
+	if dryRun || showDiff {
+		if err := printConfigDiff(config); err != nil {
+			return err
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	err := snapshotConfig(config)
+	if err != nil {
+		return err
+	}
+	return config.SaveAll()
+}
+
+// printConfigDiff prints a unified diff of the changes to each config file
+// since it was read.
+func printConfigDiff(config *keyman.Config) error {
+	for _, file := range config.Files() {
+		before, err := os.ReadFile(file.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Print(textdiff.Unified(file.Path, file.Path, before, file.Bytes()))
+	}
+	return nil
+}
+
+// removeFile deletes path, or reports that it would in a dry run.
+func removeFile(path string) error {
+	if dryRun {
+		fmt.Printf("Would remove %s\n", path)
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// renameFile moves a file, or reports that it would in a dry run.
+func renameFile(from, to string) error {
+	if dryRun {
+		if _, err := os.Stat(from); err != nil {
+			return err
+		}
+		fmt.Printf("Would rename %s to %s\n", from, to)
+		return nil
+	}
+	return os.Rename(from, to)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Exit codes, so scripts can tell a check that found problems from keyman
+// failing to run.
+const (
+	exitOK       = 0
+	exitFindings = 1 // audit, krl check and the like found problems, or find found no key
+	exitUsage    = 2 // bad command line, as the flag package reports it
+	exitError    = 3 // keyman could not finish, such as on an I/O error
+)
+
+// errorsJSON is set by --errors json to report fatal errors as a JSON
+// object on stderr instead of a log line.
+var errorsJSON bool
+
+// fatal reports an error keyman cannot continue after and exits with
+// exitError.
+func fatal(v ...interface{}) {
+	exitWithError(exitError, fmt.Sprint(v...))
+}
+
+func fatalf(format string, v ...interface{}) {
+	exitWithError(exitError, fmt.Sprintf(format, v...))
+}
+
+// fatalUsage reports a mistake in how keyman was invoked and exits with
+// exitUsage.
+func fatalUsage(v ...interface{}) {
+	exitWithError(exitUsage, fmt.Sprint(v...))
+}
+
+func fatalUsagef(format string, v ...interface{}) {
+	exitWithError(exitUsage, fmt.Sprintf(format, v...))
+}
+
+// parseFlagSet parses args with flags. The flag package prints its own
+// errors, so with --errors json they are reported through fatalUsage.
+func parseFlagSet(flags *flag.FlagSet, args []string) {
+	if !errorsJSON {
+		flags.Parse(args)
+		return
+	}
+	flags.Init(flags.Name(), flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		fatalUsage(err)
+	}
+}
+
+func exitWithError(code int, message string) {
+	if !errorsJSON {
+		log.Print(message)
+		os.Exit(code)
+	}
+
+	kind := "error"
+	if code == exitUsage {
+		kind = "usage"
+	}
+	json.NewEncoder(os.Stderr).Encode(struct {
+		Error    string `json:"error"`
+		Kind     string `json:"kind"`
+		ExitCode int    `json:"exit_code"`
+	}{message, kind, code})
+	os.Exit(code)
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// fleetOptions are the flags shared by the fleet commands: where the hosts
+// come from and how to connect to them.
+type fleetOptions struct {
+	hostsFile   *string
+	fleetName   *string
+	inventory   *string
+	limit       *string
+	concurrency *int
+	retries     *int
+	timeout     *int
+	identity    *string
+	asJSON      *bool
+	plain       *bool
+}
+
+// fleetTarget is a host to connect to: its name as the hosts file,
+// fleet or inventory gives it, and the destination to give ssh.
+type fleetTarget struct {
+	name   string
+	target string
+}
+
+// fleetStep is one script runFleet runs on every host, such as installing
+// the new key or removing the old one.
+type fleetStep struct {
+	action  string
+	key     string
+	script  string
+	input   string
+	sshArgs []string
+
+	// onlyKey, when set, is the key the step logs in with and no other,
+	// with the host's settings from onlyIdentityArgs.
+	onlyKey string
+}
+
+// fleetResult is how running the steps on one host went.
+type fleetResult struct {
+	Host     string `json:"host"`
+	Target   string `json:"target,omitempty"`
+	OK       bool   `json:"ok"`
+	Attempts int    `json:"attempts"`
+	Removed  int    `json:"removed,omitempty"`
+	Warning  string `json:"warning,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+const fleetUsageFlags = "[--hosts file | --fleet name | --inventory file [--limit pattern]] [--concurrency n] [--retries n] [--timeout s] [-i identity] [--json]"
+
+func fleet(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman fleet push|test")
+	}
+
+	switch args[0] {
+	case "push":
+		pushFleet(args[1:])
+	case "test":
+		testFleet(args[1:])
+	default:
+		fatalUsage("Unknown fleet command")
+	}
+}
+
+func addFleetFlags(flags *flag.FlagSet) fleetOptions {
+	return fleetOptions{
+		hostsFile:   flags.String("hosts", "", "read the hosts from this file, one user@host or Host alias per line, or - for stdin"),
+		fleetName:   flags.String("fleet", "", "use the hosts of this fleet from the [fleets] section of config.toml"),
+		inventory:   flags.String("inventory", "", "use the hosts of this Ansible inventory, INI or YAML (default $ANSIBLE_INVENTORY with --limit)"),
+		limit:       flags.String("limit", "", "only use the inventory hosts this Ansible pattern selects, such as webservers or 'prod,!db*'"),
+		concurrency: flags.Int("concurrency", 10, "how many hosts to connect to at once"),
+		retries:     flags.Int("retries", 2, "how many more times to try a host that fails"),
+		timeout:     flags.Int("timeout", 10, "seconds to wait for each host to connect"),
+		identity:    flags.String("i", "", "identity to authenticate with"),
+		asJSON:      flags.Bool("json", settings.Output == "json", "print the results as JSON"),
+		plain:       flags.Bool("plain", false, "print without color"),
+	}
+}
+
+// targets returns the hosts the options select, checking the options that
+// apply to every fleet command along the way.
+func (o fleetOptions) targets() []fleetTarget {
+	if *o.concurrency < 1 || *o.retries < 0 || *o.timeout < 1 {
+		fatalUsage("--concurrency and --timeout must be at least 1 and --retries at least 0")
+	}
+	if *o.limit != "" && *o.inventory == "" {
+		*o.inventory = os.Getenv("ANSIBLE_INVENTORY")
+		if *o.inventory == "" {
+			fatalUsage("--limit selects hosts from an Ansible inventory, give it with --inventory")
+		}
+	}
+
+	targets, err := fleetHosts(*o.hostsFile, *o.fleetName, *o.inventory, *o.limit)
+	if err != nil {
+		fatal(err)
+	}
+	if len(targets) == 0 {
+		fatalUsage("No hosts to connect to, give them with --hosts file, --fleet name or --inventory file")
+	}
+	return targets
+}
+
+// sshArgs returns the ssh arguments every connection uses: no prompts, a
+// connect timeout and -i if given.
+func (o fleetOptions) sshArgs() []string {
+	args := o.connectArgs()
+	if *o.identity != "" {
+		identityPath, err := getFullKeyPath(*o.identity)
+		if err != nil {
+			fatal(err)
+		}
+		args = append(args, identityArgs(identityPath)...)
+	}
+	return args
+}
+
+// connectArgs returns the arguments of sshArgs without -i.
+func (o fleetOptions) connectArgs() []string {
+	return []string{"-o", "BatchMode=yes", "-o", fmt.Sprintf("ConnectTimeout=%d", *o.timeout)}
+}
+
+// pushFleet installs a public key on many hosts at once, removing an old
+// one too with --remove, and reports how each host went.
+func pushFleet(args []string) {
+	flags := flag.NewFlagSet("fleet push", flag.ExitOnError)
+	opts := addFleetFlags(flags)
+	remove := flags.String("remove", "", "remove this key from authorized_keys, after installing <key> if one is given")
+	args = parseFlags(flags, args)
+	if len(args) > 1 || (len(args) == 0 && *remove == "") {
+		fatalUsage("Usage: keyman fleet push " + fleetUsageFlags + " [--remove old-key] [<key>]")
+	}
+	targets := opts.targets()
+	sshArgs := opts.sshArgs()
+
+	var steps []fleetStep
+	var keyPath, oldPath string
+	var err error
+	if len(args) == 1 {
+		keyPath, err = getFullKeyPath(strings.TrimSuffix(args[0], keyFileExt))
+		if err != nil {
+			fatal(err)
+		}
+		pubKey, err := readPublicKey(keyPath)
+		if err != nil {
+			fatal(err)
+		}
+		steps = append(steps, fleetStep{action: "install", key: args[0], script: installKeyScript, input: pubKey, sshArgs: sshArgs})
+	}
+	if *remove != "" {
+		oldPath, err = getFullKeyPath(strings.TrimSuffix(*remove, keyFileExt))
+		if err != nil {
+			fatal(err)
+		}
+		if oldPath == keyPath {
+			fatalUsage("--remove names the key being pushed")
+		}
+		oldPubKey, err := readPublicKey(oldPath)
+		if err != nil {
+			fatal(err)
+		}
+		// Removing the old key logs in with only the new one, when there is
+		// one, so a host the new key does not work on keeps the old key.
+		step := fleetStep{action: "remove", key: *remove, script: removeKeyScript, input: oldPubKey, sshArgs: sshArgs}
+		if keyPath != "" {
+			step.sshArgs, step.onlyKey = opts.connectArgs(), keyPath
+		}
+		steps = append(steps, step)
+	}
+
+	if dryRun {
+		for _, target := range targets {
+			for _, step := range steps {
+				fmt.Printf("Would %s key %s on %s\n", step.action, step.key, target.name)
+			}
+		}
+		return
+	}
+
+	results := runFleet(targets, steps, opts)
+	for _, result := range results {
+		if !result.OK {
+			continue
+		}
+		if keyPath != "" {
+			journal("fleet push", result.Host, "", keyFingerprint(keyPath))
+			recordKeyUse(keyPath, result.Host)
+		}
+		if oldPath != "" {
+			journal("fleet remove", result.Host, keyFingerprint(oldPath), "")
+		}
+	}
+	reportFleet(results, opts)
+}
+
+// testFleet checks that every host can be logged in to, with the key given
+// or as ssh would by default, without changing anything on them.
+func testFleet(args []string) {
+	flags := flag.NewFlagSet("fleet test", flag.ExitOnError)
+	opts := addFleetFlags(flags)
+	args = parseFlags(flags, args)
+	if len(args) > 1 || (len(args) == 1 && *opts.identity != "") {
+		fatalUsage("Usage: keyman fleet test " + fleetUsageFlags + " [<key>]")
+	}
+	targets := opts.targets()
+	sshArgs := opts.sshArgs()
+
+	var keyPath string
+	if len(args) == 1 {
+		var err error
+		keyPath, err = getFullKeyPath(strings.TrimSuffix(args[0], keyFileExt))
+		if err != nil {
+			fatal(err)
+		}
+		sshArgs = append(sshArgs, identityArgs(keyPath)...)
+	}
+	sshArgs = append(sshArgs, "-o", "PasswordAuthentication=no", "-o", "KbdInteractiveAuthentication=no")
+
+	if dryRun {
+		for _, target := range targets {
+			fmt.Printf("Would log in to %s\n", target.name)
+		}
+		return
+	}
+
+	results := runFleet(targets, []fleetStep{{action: "login", script: "true", sshArgs: sshArgs}}, opts)
+	if keyPath != "" {
+		for _, result := range results {
+			if result.OK {
+				recordKeyUse(keyPath, result.Host)
+			}
+		}
+	}
+	reportFleet(results, opts)
+}
+
+// runFleet runs steps on every target, at most --concurrency at a time,
+// trying a target again up to --retries more times when a step fails. Each
+// result is printed as it comes in, unless the results are to be printed
+// as JSON; they are returned in the order of targets.
+func runFleet(targets []fleetTarget, steps []fleetStep, opts fleetOptions) []fleetResult {
+	color := useColor(*opts.plain)
+	results := make([]fleetResult, len(targets))
+	queue := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for worker := 0; worker < *opts.concurrency && worker < len(targets); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				result := runFleetHost(targets[i], steps, *opts.retries)
+				mu.Lock()
+				results[i] = result
+				if !*opts.asJSON {
+					printFleetResult(result, color)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range targets {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// runFleetHost runs steps on target in order. A failed attempt starts over
+// from the first step, which is safe as each step leaves authorized_keys
+// the same when run twice.
+func runFleetHost(target fleetTarget, steps []fleetStep, retries int) fleetResult {
+	result := fleetResult{Host: target.name}
+	if target.target != target.name {
+		result.Target = target.target
+	}
+	for result.Attempts <= retries {
+		if result.Attempts > 0 {
+			time.Sleep(time.Duration(result.Attempts) * time.Second)
+		}
+		result.Attempts++
+		result.Error = ""
+		for _, step := range steps {
+			output, err := runFleetStep(target.target, step)
+			if err == nil && step.script == removeKeyScript {
+				result.Removed, err = parseRemovedCount(output)
+				result.Warning = ""
+				if err == nil && result.Removed == 0 {
+					result.Warning = "the key was not in authorized_keys"
+				}
+			}
+			if err != nil {
+				result.Error = fmt.Sprintf("%s: %v", step.action, err)
+				break
+			}
+		}
+		if result.Error == "" {
+			result.OK = true
+			break
+		}
+	}
+	return result
+}
+
+// runFleetStep runs step on target and returns what it printed, or the
+// last line ssh printed to stderr as the error when it fails.
+func runFleetStep(target string, step fleetStep) ([]byte, error) {
+	sshArgs := step.sshArgs
+	if step.onlyKey != "" {
+		only, err := onlyIdentityArgs(target, step.onlyKey)
+		if err != nil {
+			return nil, err
+		}
+		sshArgs = append(append([]string{}, sshArgs...), only...)
+	}
+	cmd, err := remoteCommand(target, step.script, step.input, sshArgs...)
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err == nil {
+		return output, nil
+	}
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return nil, fmt.Errorf("%s", last)
+	}
+	return nil, err
+}
+
+func printFleetResult(result fleetResult, color bool) {
+	if result.OK && result.Warning != "" {
+		fmt.Printf("%s  %s: %s\n", paint("ok    ", colorYellow, color), result.Host, result.Warning)
+		return
+	}
+	if result.OK && result.Removed > 0 {
+		fmt.Printf("%s  %s: removed %d line(s)\n", paint("ok    ", colorGreen, color), result.Host, result.Removed)
+		return
+	}
+	if result.OK {
+		fmt.Printf("%s  %s\n", paint("ok    ", colorGreen, color), result.Host)
+		return
+	}
+	fmt.Printf("%s  %s: %s (%d attempt(s))\n", paint("failed", colorRed, color), result.Host, result.Error, result.Attempts)
+}
+
+// reportFleet prints the results as JSON, or how many hosts went well, and
+// exits with an error if any failed.
+func reportFleet(results []fleetResult, opts fleetOptions) {
+	failed := 0
+	for _, result := range results {
+		if !result.OK {
+			failed++
+		}
+	}
+
+	if *opts.asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			fatal(err)
+		}
+	} else {
+		fmt.Printf("%d of %d host(s) done\n", len(results)-failed, len(results))
+	}
+	if failed > 0 {
+		fatalf("%d host(s) failed", failed)
+	}
+}
+
+// fleetHosts returns the hosts read from file, or stdin for -, followed by
+// those of the named fleet and those limit selects from an Ansible
+// inventory, without repeats. Blank lines and # comments in the file are
+// skipped.
+func fleetHosts(file, fleetName, inventoryPath, limit string) ([]fleetTarget, error) {
+	var hosts []string
+	if file != "" {
+		var r io.Reader = stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r = f
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				hosts = append(hosts, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if fleetName != "" {
+		members, ok := settings.Fleets[fleetName]
+		if !ok {
+			return nil, fmt.Errorf("no fleet %s in the [fleets] section of config.toml", fleetName)
+		}
+		hosts = append(hosts, members...)
+	}
+
+	var targets []fleetTarget
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		if strings.HasPrefix(host, "-") {
+			return nil, fmt.Errorf("host %q starts with -, which ssh would take for an option", host)
+		}
+		if !seen[host] {
+			seen[host] = true
+			targets = append(targets, fleetTarget{name: host, target: host})
+		}
+	}
+
+	if inventoryPath != "" {
+		inventory, err := keyman.LoadInventory(inventoryPath)
+		if err != nil {
+			return nil, err
+		}
+		selected, err := inventory.Select(limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range selected {
+			if !seen[host] {
+				seen[host] = true
+				targets = append(targets, fleetTarget{name: host, target: inventory.Target(host)})
+			}
+		}
+	}
+	return targets, nil
+}
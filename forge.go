@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// forge is a git host that keeps SSH keys for its users. Adding a forge
+// takes a client that implements it and an entry in forgeProviders.
+type forge interface {
+	// name is the forge's name as the user knows it, such as GitHub.
+	name() string
+	// host is the forge's host name, for telling instances apart.
+	host() string
+	listKeys() ([]remoteKey, error)
+	// addKey registers a key. expires is nil for forges whose keys cannot
+	// expire.
+	addKey(title, key string, expires *time.Time) (remoteKey, error)
+}
+
+// forgeProvider is how a forge command reaches its forge.
+type forgeProvider struct {
+	// selfHosted forges take --url, passed to open, which falls back to
+	// the forge's setting or public instance when it is empty.
+	selfHosted bool
+	// expires is whether keys on the forge can be given an expiry date.
+	expires bool
+	// open returns a client for the forge, exiting when it is not set up.
+	open func(baseURL string) forge
+}
+
+var forgeProviders = map[string]forgeProvider{
+	"github":    {open: openGitHub},
+	"gitlab":    {selfHosted: true, expires: true, open: openGitLab},
+	"gitea":     {selfHosted: true, open: openGitea},
+	"forgejo":   {selfHosted: true, open: openGitea},
+	"bitbucket": {open: openBitbucket},
+}
+
+// forgeNames lists the forge commands, sorted.
+func forgeNames() []string {
+	var names []string
+	for name := range forgeProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forgeCommand runs a forge command: push, list or audit.
+func forgeCommand(command string, args []string) {
+	provider := forgeProviders[command]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	baseURL, urlUsage := new(string), ""
+	if provider.selfHosted {
+		baseURL, urlUsage = flags.String("url", "", "instance URL (default from the settings)"), "[--url u] "
+	}
+	title := flags.String("title", "", "title for the key (default the key name)")
+	expires := new(string)
+	if provider.expires {
+		expires = flags.String("expires", "", "expiry date for the key, as YYYY-MM-DD")
+	}
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsagef("Usage: keyman %s %spush|list|audit", command, urlUsage)
+	}
+
+	f := provider.open(*baseURL)
+
+	switch args[0] {
+	case "push":
+		if len(args) < 2 {
+			pushUsage := "[--title t] "
+			if provider.expires {
+				pushUsage += "[--expires YYYY-MM-DD] "
+			}
+			fatalUsagef("Usage: keyman %s push %s<key>", command, pushUsage)
+		}
+		forgePush(command, f, args[1], *title, *expires)
+	case "list":
+		keys, err := f.listKeys()
+		if err != nil {
+			fatal(err)
+		}
+		printRemoteKeys(keys)
+	case "audit":
+		keys, err := f.listKeys()
+		if err != nil {
+			fatal(err)
+		}
+		auditRemoteKeys(f.name(), keys)
+	default:
+		fatalUsagef("Unknown %s command", command)
+	}
+}
+
+func forgePush(command string, f forge, key, title, expires string) {
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(key, keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	pubKey, err := readPublicKey(keyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	if title == "" {
+		title = key
+	}
+
+	var expiresAt *time.Time
+	if expires != "" {
+		t, err := time.Parse("2006-01-02", expires)
+		if err != nil {
+			fatalf("Invalid expiry date %q, expected YYYY-MM-DD", expires)
+		}
+		expiresAt = &t
+	}
+
+	created, err := f.addKey(title, pubKey, expiresAt)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal(command+" push", keyPath, "", fmt.Sprintf("%s id %s", f.host(), created.ID))
+	fmt.Printf("Added key %s to %s (%s) with id %s\n", key, f.name(), f.host(), created.ID)
+}
+
+// hostOf returns the host name of a URL, or the URL itself if it cannot be
+// parsed.
+func hostOf(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return rawURL
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// keyView is what a --format template sees for each key: the fields of
+// list --json plus where the key is used and how it stands.
+type keyView struct {
+	keyJSON
+	Hosts    []string
+	Status   string
+	InUse    bool
+	Age      time.Duration
+	LastUsed *time.Time
+	Findings []findingJSON
+}
+
+var formatFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"date":  func(t time.Time) string { return t.Format("2006-01-02") },
+	"days":  func(d time.Duration) int { return int(d.Hours() / 24) },
+}
+
+// parseFormat parses a --format template, exiting with usage if it is
+// invalid.
+func parseFormat(format string) *template.Template {
+	tmpl, err := template.New("format").Funcs(formatFuncs).Parse(format)
+	if err != nil {
+		fatalUsage(err)
+	}
+	return tmpl
+}
+
+// printKeysFormat prints each key through tmpl, one line per key. findings
+// are attached to the keys they are about.
+func printKeysFormat(tmpl *template.Template, keys []keyman.KeyStatus, weak, findings []keyman.Finding) {
+	hosts, err := keyHosts()
+	if err != nil {
+		fatal(err)
+	}
+
+	weakKeys := make(map[string]bool)
+	for _, finding := range weak {
+		weakKeys[finding.Subject] = true
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		view := keyView{
+			keyJSON:  keysJSON([]keyman.Key{key.Key})[0],
+			Hosts:    hosts[key.Name],
+			Status:   keyStatus(key, weakKeys, now).text,
+			InUse:    key.InUse,
+			Age:      key.Age,
+			Findings: []findingJSON{},
+		}
+		sort.Strings(view.Hosts)
+		if key.Metadata != nil {
+			view.LastUsed = key.Metadata.LastUsed
+		}
+		for _, finding := range findings {
+			if finding.Subject == key.Name {
+				view.Findings = append(view.Findings, findingJSON{
+					Severity: finding.Severity.String(),
+					Rule:     finding.Rule,
+					Subject:  finding.Subject,
+					Message:  finding.Message,
+				})
+			}
+		}
+
+		if err := tmpl.Execute(os.Stdout, view); err != nil {
+			fatal(err)
+		}
+		os.Stdout.WriteString("\n")
+	}
+}
+
+// keyHosts returns the hosts each key is mapped to in the ssh config, by
+// key name.
+func keyHosts() (map[string][]string, error) {
+	config, err := parseConfig()
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string][]string)
+	for host, keyPaths := range config {
+		for _, keyPath := range keyPaths {
+			name := filepath.Base(keyPath)
+			hosts[name] = append(hosts[name], host)
+		}
+	}
+	return hosts, nil
+}
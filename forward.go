@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// forwardKinds maps the words forward list prints and forward rm --type
+// takes to the options they stand for.
+var forwardKinds = map[string]string{
+	"local":   keyman.LocalForward,
+	"remote":  keyman.RemoteForward,
+	"dynamic": keyman.DynamicForward,
+}
+
+type forwardJSON struct {
+	Host     string `json:"host"`
+	Type     string `json:"type"`
+	Bind     string `json:"bind,omitempty"`
+	Listen   string `json:"listen"`
+	Target   string `json:"target,omitempty"`
+	Conflict bool   `json:"conflict"`
+}
+
+func forward(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman forward add|list|rm")
+	}
+
+	switch args[0] {
+	case "add":
+		addForward(args[1:])
+	case "list":
+		listForwards(args[1:])
+	case "rm":
+		removeForward(args[1:])
+	default:
+		fatalUsage("Unknown forward command")
+	}
+}
+
+// addForward adds a LocalForward, RemoteForward or DynamicForward to a
+// host, refusing ports another forward already listens on.
+func addForward(args []string) {
+	flags := flag.NewFlagSet("forward add", flag.ExitOnError)
+	local := flags.String("L", "", "forward a local port to host:hostport from the server, as [bind:]port:host:hostport")
+	remote := flags.String("R", "", "forward a port on the server to host:hostport from here, as [bind:]port:host:hostport, or [bind:]port for a SOCKS proxy")
+	dynamic := flags.String("D", "", "run a SOCKS proxy on a local port, as [bind:]port")
+	force := flags.Bool("force", false, "add the forward even if another host already forwards the port")
+	args = parseFlags(flags, args)
+
+	var specs [][2]string
+	for keyword, spec := range map[string]string{keyman.LocalForward: *local, keyman.RemoteForward: *remote, keyman.DynamicForward: *dynamic} {
+		if spec != "" {
+			specs = append(specs, [2]string{keyword, spec})
+		}
+	}
+	if len(args) != 1 || len(specs) != 1 {
+		fatalUsage("Usage: keyman forward add [--force] -L|-R|-D spec <host>")
+	}
+	name := args[0]
+	if name == keyman.DefaultsHost {
+		fatal("Forwards in Host * would open on every connection, add them to a specific host")
+	}
+
+	f, err := keyman.ParseForwardSpec(specs[0][0], specs[0][1])
+	if err != nil {
+		fatalUsage(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	block := config.FindHost(name)
+	if block == nil {
+		fatalf("Host %s not found in config, add it with keyman host add", name)
+	}
+
+	for _, conflict := range config.ForwardConflicts(name, f) {
+		if conflict.Host == name {
+			fatalf("Host %s already has %s %s on that port", name, conflict.Keyword, conflict.Value())
+		}
+		if !*force {
+			fatalf("Host %s already has %s %s on that port, so the two cannot be connected at once; use --force to add it anyway", conflict.Host, conflict.Keyword, conflict.Value())
+		}
+		fmt.Fprintf(os.Stderr, "Warning: host %s already has %s %s on that port\n", conflict.Host, conflict.Keyword, conflict.Value())
+	}
+
+	block.AddForward(f)
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+
+	journal("forward add", name, "", f.Keyword+" "+f.Value())
+	fmt.Printf("Added %s %s to host %s\n", f.Keyword, f.Value(), name)
+}
+
+// listForwards prints the forwards of every host, or of the hosts named,
+// marking those that listen on a port another forward also takes.
+func listForwards(args []string) {
+	flags := flag.NewFlagSet("forward list", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the forwards as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	hosts := parseFlags(flags, args)
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	forwards := []forwardJSON{}
+	for _, f := range config.Forwards() {
+		if len(hosts) > 0 && !containsString(hosts, f.Host) {
+			continue
+		}
+		view := forwardJSON{
+			Host:     f.Host,
+			Type:     forwardKind(f.Keyword),
+			Bind:     f.Bind,
+			Listen:   f.Listen,
+			Target:   f.Target,
+			Conflict: len(config.ForwardConflicts(f.Host, f.Forward)) > 1,
+		}
+		forwards = append(forwards, view)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(forwards); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if len(forwards) == 0 {
+		fmt.Println("No forwards found")
+		return
+	}
+
+	var rows [][]tableCell
+	for _, f := range forwards {
+		listen := tableCell{text: f.Listen}
+		if strings.Contains(f.Bind, ":") {
+			listen.text = "[" + f.Bind + "]:" + f.Listen
+		} else if f.Bind != "" {
+			listen.text = f.Bind + ":" + f.Listen
+		}
+		if f.Conflict {
+			listen.color = colorRed
+		}
+		target := f.Target
+		if target == "" {
+			target = "SOCKS proxy"
+		}
+		rows = append(rows, []tableCell{{text: f.Host}, {text: f.Type}, listen, {text: target}})
+	}
+	writeTable(os.Stdout, []string{"host", "type", "listen", "target"}, rows, useColor(*plain))
+}
+
+// removeForward removes the forwards of a host that listen on a port.
+func removeForward(args []string) {
+	flags := flag.NewFlagSet("forward rm", flag.ExitOnError)
+	kind := flags.String("type", "", "only remove forwards of this type: local, remote or dynamic")
+	args = parseFlags(flags, args)
+	if len(args) != 2 {
+		fatalUsage("Usage: keyman forward rm [--type local|remote|dynamic] <host> <[bind:]port>")
+	}
+	name := args[0]
+	bind, port := "", args[1]
+	if i := strings.LastIndex(port, ":"); i >= 0 {
+		bind, port = strings.Trim(port[:i], "[]"), port[i+1:]
+	}
+
+	keywords := []string{keyman.LocalForward, keyman.RemoteForward, keyman.DynamicForward}
+	if *kind != "" {
+		keyword, ok := forwardKinds[*kind]
+		if !ok {
+			fatalUsagef("Unknown forward type %q, use local, remote or dynamic", *kind)
+		}
+		keywords = []string{keyword}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	block := config.FindHost(name)
+	if block == nil {
+		fatalf("Host %s not found in config", name)
+	}
+
+	var removed []string
+	for _, keyword := range keywords {
+		block.RemoveOption(keyword, func(value string) bool {
+			f, err := keyman.ParseForward(keyword, value)
+			if err != nil || f.Listen != port || (bind != "" && f.Bind != bind) {
+				return false
+			}
+			removed = append(removed, keyword+" "+value)
+			return true
+		})
+	}
+	if len(removed) == 0 {
+		fatalf("Host %s has no forward on port %s", name, args[1])
+	}
+
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	for _, line := range removed {
+		journal("forward remove", name, line, "")
+		fmt.Printf("Removed %s from host %s\n", line, name)
+	}
+}
+
+func forwardKind(keyword string) string {
+	for kind, k := range forwardKinds {
+		if k == keyword {
+			return kind
+		}
+	}
+	return keyword
+}
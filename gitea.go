@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// giteaClient talks to a Gitea instance or to Forgejo, which keeps
+// Gitea's API.
+type giteaClient struct {
+	api   string
+	token string
+}
+
+// openGitea returns a client for the Gitea or Forgejo instance at baseURL,
+// by default the one from the settings. There is no public instance to
+// fall back to.
+func openGitea(baseURL string) forge {
+	token := settings.GiteaToken
+	if token == "" {
+		fatal("Set GITEA_TOKEN or gitea.token in config.toml to an access token with the write:user scope")
+	}
+
+	if baseURL == "" {
+		baseURL = settings.GiteaURL
+	}
+	if baseURL == "" {
+		fatal("Pass --url or set GITEA_URL or gitea.url in config.toml to the Gitea or Forgejo instance")
+	}
+	return &giteaClient{api: strings.TrimSuffix(baseURL, "/") + "/api/v1", token: token}
+}
+
+func (c *giteaClient) name() string { return "Gitea" }
+
+func (c *giteaClient) host() string { return hostOf(c.api) }
+
+func (c *giteaClient) listKeys() ([]remoteKey, error) {
+	var keys []remoteKey
+	for page := 1; ; page++ {
+		var batch []remoteKey
+		err := c.do("GET", fmt.Sprintf("/user/keys?limit=50&page=%d", page), nil, &batch)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if len(batch) < 50 {
+			return keys, nil
+		}
+	}
+}
+
+func (c *giteaClient) addKey(title, key string, _ *time.Time) (remoteKey, error) {
+	var created remoteKey
+	body := map[string]string{"title": title, "key": key}
+	err := c.do("POST", "/user/keys", body, &created)
+	return created, err
+}
+
+func (c *giteaClient) do(method, path string, body, out interface{}) error {
+	req, err := newJSONRequest(method, c.api+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+c.token)
+	return doJSON(req, out)
+}
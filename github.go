@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const (
+	defaultGitHubAPI = "https://api.github.com"
+	defaultGitHubURL = "https://github.com"
+)
+
+// remoteKey is a public key registered with a hosted service.
+type remoteKey struct {
+	ID        keyID      `json:"id"`
+	Title     string     `json:"title"`
+	Key       string     `json:"key"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// keyID is the id a service gives a key: a number on most services and a
+// UUID on Bitbucket.
+type keyID string
+
+func (id *keyID) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = keyID(s)
+		return nil
+	}
+	if string(data) != "null" {
+		*id = keyID(data)
+	}
+	return nil
+}
+
+type gitHubClient struct {
+	api   string
+	token string
+}
+
+// newGitHubClient returns a client for the configured API, using the token
+// from the settings or environment if there is one.
+func newGitHubClient() *gitHubClient {
+	api := orDefault(settings.GitHubAPIURL, defaultGitHubAPI)
+	return &gitHubClient{api: strings.TrimSuffix(api, "/"), token: settings.GitHubToken}
+}
+
+func openGitHub(string) forge {
+	client := newGitHubClient()
+	if client.token == "" {
+		fatal("Set GITHUB_TOKEN or github.token in config.toml to a token with the admin:public_key scope")
+	}
+	return client
+}
+
+func (c *gitHubClient) name() string { return "GitHub" }
+
+func (c *gitHubClient) host() string {
+	if c.api == defaultGitHubAPI {
+		return "github.com"
+	}
+	return hostOf(c.api)
+}
+
+func (c *gitHubClient) listKeys() ([]remoteKey, error) {
+	var keys []remoteKey
+	for page := 1; ; page++ {
+		var batch []remoteKey
+		err := c.do("GET", fmt.Sprintf("/user/keys?per_page=100&page=%d", page), nil, &batch)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if len(batch) < 100 {
+			return keys, nil
+		}
+	}
+}
+
+func (c *gitHubClient) addKey(title, key string, _ *time.Time) (remoteKey, error) {
+	var created remoteKey
+	body := map[string]string{"title": title, "key": key}
+	err := c.do("POST", "/user/keys", body, &created)
+	return created, err
+}
+
+func (c *gitHubClient) do(method, path string, body, out interface{}) error {
+	req, err := newJSONRequest(method, c.api+path, body)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	return doJSON(req, out)
+}
+
+func printRemoteKeys(keys []remoteKey) {
+	for _, key := range keys {
+		fmt.Printf("Title: %s\nID: %s\n", key.Title, key.ID)
+		if pub, err := keyman.ParsePublicKey(key.Key); err == nil {
+			fmt.Printf("Type: %s %d\nFingerprint: %s\n", pub.TypeName(), pub.Bits(), pub.FingerprintSHA256())
+		}
+		if !key.CreatedAt.IsZero() {
+			fmt.Printf("Created: %s\n", key.CreatedAt.Format(time.RFC3339))
+		}
+		if key.ExpiresAt != nil {
+			fmt.Printf("Expires: %s\n", key.ExpiresAt.Format(time.RFC3339))
+		}
+		fmt.Println()
+	}
+}
+
+// auditRemoteKeys compares the keys registered with a service against the
+// local keys, flagging remote keys with no local counterpart.
+func auditRemoteKeys(service string, remote []remoteKey) {
+	keys, err := getKeys()
+	if err != nil {
+		fatal(err)
+	}
+
+	local := make(map[string]keyman.Key)
+	for _, key := range keys {
+		if key.Public != nil {
+			local[key.Public.FingerprintSHA256()] = key
+		}
+	}
+
+	title := service + " Key Audit:"
+	fmt.Println(title)
+	fmt.Println(strings.Repeat("=", len(title)))
+
+	fmt.Println("\n--- Keys Not Found Locally ---")
+	onRemote := make(map[string]bool)
+	missing := 0
+	for _, key := range remote {
+		pub, err := keyman.ParsePublicKey(key.Key)
+		if err != nil {
+			continue
+		}
+		fingerprint := pub.FingerprintSHA256()
+		onRemote[fingerprint] = true
+		if _, ok := local[fingerprint]; !ok {
+			fmt.Printf("Title: %s\nID: %s\nFingerprint: %s\n\n", key.Title, key.ID, fingerprint)
+			missing++
+		}
+	}
+	if missing == 0 {
+		fmt.Println("All remote keys exist locally")
+	}
+
+	fmt.Printf("\n--- Local Keys Not On %s ---\n", service)
+	absent := 0
+	for _, key := range keys {
+		if key.Public != nil && !onRemote[key.Public.FingerprintSHA256()] {
+			fmt.Printf("Key: %s\nFingerprint: %s\n\n", key.Name, key.Public.FingerprintSHA256())
+			absent++
+		}
+	}
+	if absent == 0 {
+		fmt.Printf("All local keys are on %s\n", service)
+	}
+}
+
+func newJSONRequest(method, url string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// doJSON sends req and decodes a JSON response into out, turning non-2xx
+// responses into errors.
+func doJSON(req *http.Request, out interface{}) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
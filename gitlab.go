@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultGitLabURL = "https://gitlab.com"
+
+// openGitLab returns a client for the GitLab instance at baseURL, by
+// default the one from the settings or gitlab.com.
+func openGitLab(baseURL string) forge {
+	token := settings.GitLabToken
+	if token == "" {
+		fatal("Set GITLAB_TOKEN or gitlab.token in config.toml to a personal access token with the api scope")
+	}
+
+	if baseURL == "" {
+		baseURL = orDefault(settings.GitLabURL, defaultGitLabURL)
+	}
+	return &gitLabClient{api: strings.TrimSuffix(baseURL, "/") + "/api/v4", token: token}
+}
+
+type gitLabClient struct {
+	api   string
+	token string
+}
+
+func (c *gitLabClient) name() string { return "GitLab" }
+
+func (c *gitLabClient) host() string { return hostOf(c.api) }
+
+func (c *gitLabClient) listKeys() ([]remoteKey, error) {
+	var keys []remoteKey
+	for page := 1; ; page++ {
+		var batch []remoteKey
+		err := c.do("GET", fmt.Sprintf("/user/keys?per_page=100&page=%d", page), nil, &batch)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if len(batch) < 100 {
+			return keys, nil
+		}
+	}
+}
+
+func (c *gitLabClient) addKey(title, key string, expires *time.Time) (remoteKey, error) {
+	var created remoteKey
+	body := map[string]interface{}{"title": title, "key": key}
+	if expires != nil {
+		body["expires_at"] = expires.Format(time.RFC3339)
+	}
+	err := c.do("POST", "/user/keys", body, &created)
+	return created, err
+}
+
+func (c *gitLabClient) do(method, path string, body, out interface{}) error {
+	req, err := newJSONRequest(method, c.api+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+	return doJSON(req, out)
+}
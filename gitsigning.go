@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+func gitSigning(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman git-signing setup|status")
+	}
+
+	switch args[0] {
+	case "setup":
+		setupGitSigning(args[1:])
+	case "status":
+		problem, err := checkGitSigning()
+		if err != nil {
+			fatal(err)
+		}
+		if problem != "" {
+			fatal(problem)
+		}
+		fmt.Println("Git commit signing is set up")
+	default:
+		fatalUsage("Unknown git-signing command")
+	}
+}
+
+// setupGitSigning points git at an SSH key for signing commits and tags and
+// adds the key to the allowed_signers file so git can verify them.
+func setupGitSigning(args []string) {
+	flags := flag.NewFlagSet("git-signing setup", flag.ExitOnError)
+	local := flags.Bool("local", false, "configure the current repository instead of the global git config")
+	email := flags.String("email", "", "identity for allowed_signers (default git's user.email)")
+	noAutoSign := flags.Bool("no-auto-sign", false, "do not turn on commit.gpgsign and tag.gpgsign")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman git-signing setup [--local] [--email e] [--no-auto-sign] <key>")
+	}
+
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(args[0], keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	pubKey, err := readPublicKey(keyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	scope := "--global"
+	if *local {
+		scope = "--local"
+	}
+
+	if *email == "" {
+		*email, err = gitConfig("user.email")
+		if err != nil || *email == "" {
+			fatal("No --email given and git has no user.email")
+		}
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+	signersPath := filepath.Join(sshPath, allowedSignersFile)
+
+	settings := [][2]string{
+		{"gpg.format", "ssh"},
+		{"user.signingKey", keyPath},
+		{"gpg.ssh.allowedSignersFile", signersPath},
+	}
+	if !*noAutoSign {
+		settings = append(settings, [2]string{"commit.gpgsign", "true"}, [2]string{"tag.gpgsign", "true"})
+	}
+	for _, setting := range settings {
+		err = runCommand("git", "config", scope, setting[0], setting[1])
+		if err != nil {
+			fatalf("Setting %s failed: %v", setting[0], err)
+		}
+		journal("git config", setting[0], "", setting[1])
+		fmt.Printf("Set %s = %s\n", setting[0], setting[1])
+	}
+
+	added, err := addAllowedSigner(signersPath, *email, `namespaces="git"`, pubKey)
+	if err != nil {
+		fatal(err)
+	}
+	if added {
+		journal("allow signer", *email, "", keyFingerprint(keyPath))
+		fmt.Printf("Added %s to %s\n", *email, signersPath)
+	}
+
+	fmt.Printf("Git will sign with %s\n", filepath.Base(keyPath))
+}
+
+// checkGitSigning returns a description of what is wrong with git's SSH
+// signing setup, or "" if it is fine or git does not sign with SSH.
+func checkGitSigning() (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", nil
+	}
+
+	format, _ := gitConfig("gpg.format")
+	if format != "ssh" {
+		return "", nil
+	}
+
+	signingKey, _ := gitConfig("user.signingKey")
+	switch {
+	case signingKey == "":
+		return "git signs with SSH but user.signingKey is not set", nil
+	case strings.HasPrefix(signingKey, "key::"), strings.HasPrefix(signingKey, "ssh-"):
+		// A literal public key, which must be in ssh-agent.
+		return "", nil
+	}
+
+	keyPath, err := keyman.ExpandPath(signingKey)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(keyPath); err != nil {
+		return fmt.Sprintf("git's signing key %s does not exist", signingKey), nil
+	}
+	return "", nil
+}
+
+// gitConfig returns the effective value of a git setting.
+func gitConfig(name string) (string, error) {
+	output, err := exec.Command("git", "config", "--get", name).Output()
+	return strings.TrimSpace(string(output)), err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// graphNode is a key or host in keyman graph.
+type graphNode struct {
+	id      string
+	label   string
+	host    bool
+	missing bool
+}
+
+// graphEdge links a key to a host it is mapped to, or a jump host to the
+// next hop, which the edge is marked as.
+type graphEdge struct {
+	from, to string
+	jump     bool
+}
+
+// graph prints the keys, the hosts they are mapped to and the ProxyJump
+// chains between hosts as a Graphviz or Mermaid graph.
+func graph(args []string) {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := flags.String("format", "dot", "graph format: dot or mermaid")
+	unused := flags.Bool("unused", false, "include keys that are not mapped to any host")
+	parseFlagSet(flags, args)
+	if *format != "dot" && *format != "mermaid" {
+		fatalUsagef("Unknown graph format %q, use dot or mermaid", *format)
+	}
+
+	keys, err := getKeys()
+	if err != nil {
+		fatal(err)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	var nodes []*graphNode
+	var edges []graphEdge
+	byID := make(map[string]*graphNode)
+	node := func(id, label string, host bool) *graphNode {
+		if n, ok := byID[id]; ok {
+			return n
+		}
+		n := &graphNode{id: id, label: label, host: host}
+		byID[id] = n
+		nodes = append(nodes, n)
+		return n
+	}
+	keyLabels := make(map[string]string)
+	for _, key := range keys {
+		label := key.Name
+		if key.Public != nil {
+			label += "\n" + key.Public.TypeName()
+		}
+		keyLabels[key.PrivatePath()] = label
+	}
+
+	// Jump hosts are drawn as the Host block that names them, if any.
+	hostIDs := make(map[string]string)
+	for _, block := range config.AllBlocks() {
+		for _, pattern := range block.Patterns {
+			if _, ok := hostIDs[pattern]; !ok && !block.Match {
+				hostIDs[pattern] = "host:" + block.Name()
+			}
+		}
+	}
+	hostID := func(host string) string {
+		if id, ok := hostIDs[host]; ok {
+			return id
+		}
+		return "host:" + host
+	}
+
+	for _, block := range config.AllBlocks() {
+		if block.Match || block.IsDefaults() {
+			continue
+		}
+		view := resolveHostView(config, block)
+		id := "host:" + view.Host
+		node(id, view.Host, true)
+
+		for _, identity := range view.Identities {
+			label, ok := keyLabels[identity.Path]
+			if !ok {
+				label = filepath.Base(identity.Path)
+			}
+			key := node("key:"+identity.Path, label, false)
+			key.missing = identity.Missing
+			edges = append(edges, graphEdge{from: key.id, to: id})
+		}
+
+		hops := view.JumpChain
+		for i, hop := range hops {
+			from, to := hostID(hop), id
+			if i+1 < len(hops) {
+				to = hostID(hops[i+1])
+			}
+			node(from, strings.TrimPrefix(from, "host:"), true)
+			node(to, strings.TrimPrefix(to, "host:"), true)
+			edges = append(edges, graphEdge{from: from, to: to, jump: true})
+		}
+	}
+
+	if *unused {
+		for _, key := range keys {
+			node("key:"+key.PrivatePath(), keyLabels[key.PrivatePath()], false)
+		}
+	}
+	edges = uniqueEdges(edges)
+
+	if *format == "mermaid" {
+		printMermaid(nodes, edges)
+	} else {
+		printDot(nodes, edges)
+	}
+}
+
+// uniqueEdges drops repeated edges, such as a jump shared by several hosts
+// behind the same bastion.
+func uniqueEdges(edges []graphEdge) []graphEdge {
+	seen := make(map[graphEdge]bool)
+	var unique []graphEdge
+	for _, edge := range edges {
+		if !seen[edge] {
+			seen[edge] = true
+			unique = append(unique, edge)
+		}
+	}
+	sort.SliceStable(unique, func(i, j int) bool { return !unique[i].jump && unique[j].jump })
+	return unique
+}
+
+func printDot(nodes []*graphNode, edges []graphEdge) {
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+	}
+
+	fmt.Println("digraph keyman {")
+	fmt.Println("  rankdir=LR;")
+	fmt.Println("  node [fontname=\"Helvetica\"];")
+	for _, n := range nodes {
+		attrs := `shape=box, style="rounded"`
+		if n.host {
+			attrs = "shape=ellipse"
+		}
+		if n.missing {
+			attrs = `shape=box, style="rounded,dashed", color=red, fontcolor=red`
+		}
+		fmt.Printf("  %s [label=%s, %s];\n", quote(n.id), quote(n.label), attrs)
+	}
+	for _, e := range edges {
+		if e.jump {
+			fmt.Printf("  %s -> %s [style=dashed, label=\"jump\"];\n", quote(e.from), quote(e.to))
+		} else {
+			fmt.Printf("  %s -> %s;\n", quote(e.from), quote(e.to))
+		}
+	}
+	fmt.Println("}")
+}
+
+func printMermaid(nodes []*graphNode, edges []graphEdge) {
+	// Mermaid IDs cannot hold most punctuation, so number the nodes.
+	ids := make(map[string]string)
+	for i, n := range nodes {
+		prefix := "k"
+		if n.host {
+			prefix = "h"
+		}
+		ids[n.id] = fmt.Sprintf("%s%d", prefix, i)
+	}
+	label := func(s string) string {
+		s = strings.NewReplacer(`"`, "#quot;", "\n", "<br/>").Replace(s)
+		return `"` + s + `"`
+	}
+
+	fmt.Println("flowchart LR")
+	var missing []string
+	for _, n := range nodes {
+		if n.host {
+			fmt.Printf("  %s([%s])\n", ids[n.id], label(n.label))
+		} else {
+			fmt.Printf("  %s[%s]\n", ids[n.id], label(n.label))
+		}
+		if n.missing {
+			missing = append(missing, ids[n.id])
+		}
+	}
+	for _, e := range edges {
+		if e.jump {
+			fmt.Printf("  %s -. jump .-> %s\n", ids[e.from], ids[e.to])
+		} else {
+			fmt.Printf("  %s --> %s\n", ids[e.from], ids[e.to])
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Println("  classDef missing stroke:#b00020,color:#b00020,stroke-dasharray:5 5")
+		fmt.Printf("  class %s missing\n", strings.Join(missing, ","))
+	}
+}
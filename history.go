@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/internal/textdiff"
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const (
+	backupsDir   = "backups"
+	snapshotFile = "snapshot.json"
+
+	// maxSnapshots is how many config snapshots are kept; older ones are
+	// pruned whenever a new one is taken.
+	maxSnapshots = 50
+)
+
+// snapshot is a copy of the ssh config files a command was about to
+// change, taken so the change can be undone.
+type snapshot struct {
+	ID      string          `json:"-"`
+	Time    time.Time       `json:"time"`
+	Command string          `json:"command"`
+	Files   []snapshotEntry `json:"files"`
+
+	dir string
+}
+
+// snapshotEntry is one saved file. Copy names the file holding its old
+// contents inside the snapshot, and is empty if the file did not exist.
+type snapshotEntry struct {
+	Path string `json:"path"`
+	Copy string `json:"copy,omitempty"`
+}
+
+func getBackupsDir() (string, error) {
+	sshPath, err := getSSHPath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(sshPath, keymanDir, backupsDir), nil
+}
+
+// snapshotConfig saves the on-disk contents of every config file that
+// differs from what config would write.
+func snapshotConfig(config *keyman.Config) error {
+	return snapshotConfigs(config.Files())
+}
+
+// snapshotConfigs is snapshotConfig for a list of files.
+func snapshotConfigs(files []*keyman.Config) error {
+	var changed []string
+	for _, file := range files {
+		before, err := os.ReadFile(file.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || !bytes.Equal(before, file.Bytes()) {
+			changed = append(changed, file.Path)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	root, err := getBackupsDir()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	id := now.Format("20060102-150405.000000")
+	dir := filepath.Join(root, id)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	snap := snapshot{Time: now, Command: strings.Join(os.Args[1:], " ")}
+	for i, path := range changed {
+		entry := snapshotEntry{Path: path}
+		content, err := os.ReadFile(path)
+		if err == nil {
+			entry.Copy = strconv.Itoa(i)
+			err = os.WriteFile(filepath.Join(dir, entry.Copy), content, 0600)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		snap.Files = append(snap.Files, entry)
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, snapshotFile), data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return pruneSnapshots()
+}
+
+// loadSnapshots returns the saved snapshots, newest first.
+func loadSnapshots() ([]*snapshot, error) {
+	root, err := getBackupsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var snaps []*snapshot
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+		if err != nil {
+			continue
+		}
+		snap := &snapshot{ID: entry.Name(), dir: dir}
+		if err := json.Unmarshal(data, snap); err != nil {
+			return nil, fmt.Errorf("%s: %v", dir, err)
+		}
+		snaps = append(snaps, snap)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].ID > snaps[j].ID
+	})
+	return snaps, nil
+}
+
+func pruneSnapshots() error {
+	snaps, err := loadSnapshots()
+	if err != nil {
+		return err
+	}
+	for len(snaps) > maxSnapshots {
+		err = os.RemoveAll(snaps[len(snaps)-1].dir)
+		if err != nil {
+			return err
+		}
+		snaps = snaps[:len(snaps)-1]
+	}
+	return nil
+}
+
+func history() {
+	snaps, err := loadSnapshots()
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(snaps) == 0 {
+		fmt.Println("No config changes recorded")
+		return
+	}
+
+	for _, snap := range snaps {
+		fmt.Printf("%s  %s  keyman %s\n", snap.ID, snap.Time.Format("2006-01-02 15:04:05"), snap.Command)
+		for _, entry := range snap.Files {
+			fmt.Printf("    %s\n", entry.Path)
+		}
+	}
+}
+
+// undo rolls the config back to the latest snapshot, or to the one given,
+// undoing every change made since. The snapshots it rolls back past are
+// discarded so that running undo again steps further back.
+func undo(args []string) {
+	snaps, err := loadSnapshots()
+	if err != nil {
+		fatal(err)
+	}
+	if len(snaps) == 0 {
+		fatal("No config changes to undo")
+	}
+
+	target := 0
+	if len(args) > 0 {
+		target = -1
+		for i, snap := range snaps {
+			if snap.ID == args[0] {
+				target = i
+			}
+		}
+		if target < 0 {
+			fatalf("Snapshot %s not found, see keyman history", args[0])
+		}
+	}
+
+	restore, missing, paths, err := snapshotFiles(snaps, target)
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, path := range paths {
+		current, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			fatal(err)
+		}
+		fmt.Print(textdiff.Unified(path, path, current, restore[path]))
+		if dryRun {
+			continue
+		}
+
+		if missing[path] {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = os.WriteFile(path, restore[path], 0600)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if dryRun {
+		return
+	}
+
+	for i := target; i >= 0; i-- {
+		err = os.RemoveAll(snaps[i].dir)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	journal("undo", snaps[target].ID, "", "")
+	fmt.Printf("Undid %d change(s), back to before keyman %s\n", target+1, snaps[target].Command)
+}
+
+// snapshotFiles returns the contents the config files had before the
+// command of snaps[target] ran, for the files it or any later command
+// changed, and which of them did not exist yet. Files saved by several
+// snapshots are taken from the oldest one.
+func snapshotFiles(snaps []*snapshot, target int) (map[string][]byte, map[string]bool, []string, error) {
+	restore := make(map[string][]byte)
+	missing := make(map[string]bool)
+	var paths []string
+	for i := target; i >= 0; i-- {
+		for _, entry := range snaps[i].Files {
+			if _, ok := restore[entry.Path]; ok || missing[entry.Path] {
+				continue
+			}
+			paths = append(paths, entry.Path)
+			if entry.Copy == "" {
+				missing[entry.Path] = true
+				continue
+			}
+			content, err := os.ReadFile(filepath.Join(snaps[i].dir, entry.Copy))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			restore[entry.Path] = content
+		}
+	}
+	return restore, missing, paths, nil
+}
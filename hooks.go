@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// hookContext is what a hook is told about the command it runs around, as
+// JSON on its stdin and as KEYMAN_* environment variables.
+type hookContext struct {
+	Hook       string   `json:"hook"`
+	Command    string   `json:"command"`
+	Key        string   `json:"key,omitempty"`
+	NewKey     string   `json:"new_key,omitempty"`
+	Hosts      []string `json:"hosts,omitempty"`
+	SSHDir     string   `json:"ssh_dir"`
+	ConfigPath string   `json:"config_path"`
+}
+
+// runHooks runs the hooks set for when ("pre" or "post") command, in order.
+// A pre hook that fails stops the command before it changes anything; a
+// post hook that fails is only warned about, as the change is already made.
+func runHooks(when, command string, context hookContext) {
+	context.Hook = when + "_" + command
+	commands := settings.Hooks[context.Hook]
+	if len(commands) == 0 {
+		return
+	}
+
+	var err error
+	context.Command = command
+	context.SSHDir, err = getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+	context.ConfigPath, err = getConfigPath()
+	if err != nil {
+		fatal(err)
+	}
+	input, err := json.Marshal(context)
+	if err != nil {
+		fatal(err)
+	}
+	env := append(os.Environ(),
+		"KEYMAN_HOOK="+context.Hook,
+		"KEYMAN_COMMAND="+command,
+		"KEYMAN_KEY="+context.Key,
+		"KEYMAN_NEW_KEY="+context.NewKey,
+		"KEYMAN_HOSTS="+strings.Join(context.Hosts, " "),
+		"KEYMAN_SSH_DIR="+context.SSHDir,
+		"KEYMAN_SSH_CONFIG="+context.ConfigPath,
+	)
+
+	for _, line := range commands {
+		if dryRun {
+			fmt.Printf("Would run %s hook: %s\n", context.Hook, line)
+			continue
+		}
+		err := runHook(line, env, input)
+		if err == nil {
+			continue
+		}
+		if when == "pre" {
+			fatalf("%s hook %q failed, %s stopped: %v", context.Hook, line, command, err)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s hook %q failed: %v\n", context.Hook, line, err)
+	}
+}
+
+// runHook runs one hook command with the shell.
+func runHook(line string, env []string, input []byte) error {
+	cmd := exec.Command("sh", "-c", line)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", line)
+	}
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// hostOptions are the options host add and host edit manage, in the order
+// they are written to a block.
+var hostOptions = []struct {
+	flag    string
+	keyword string
+	usage   string
+}{
+	{"hostname", "HostName", "real host name or address to connect to"},
+	{"user", "User", "user to log in as"},
+	{"port", "Port", "port to connect to"},
+	{"identity", "IdentityFile", "key to authenticate with"},
+	{"proxy-jump", "ProxyJump", "jump host to connect through"},
+}
+
+func host(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman host add|edit|rm|list|tag")
+	}
+
+	switch args[0] {
+	case "add", "edit":
+		editHost(args[0], args[1:])
+	case "rm":
+		if len(args) < 2 {
+			fatalUsage("Usage: keyman host rm <host>")
+		}
+		removeHost(args[1])
+	case "list":
+		listHosts()
+	case "tag":
+		tagHost(args[1:])
+	default:
+		fatalUsage("Unknown host command")
+	}
+}
+
+func editHost(command string, args []string) {
+	flags := flag.NewFlagSet("host "+command, flag.ExitOnError)
+	values := make(map[string]*string)
+	for _, option := range hostOptions {
+		values[option.flag] = flags.String(option.flag, "", option.usage)
+	}
+	templateName := flags.String("template", "", "fill in the new block from this template in the settings, flags overriding it")
+	selector := flags.String("hosts", "", "edit every host this selects instead: tag:<tag> or a pattern such as '*.prod.example.com', comma separated")
+	yes := flags.Bool("yes", false, "with --hosts, make the change without showing it and asking first")
+	args = parseFlags(flags, args)
+	if *selector != "" {
+		if command != "edit" || len(args) > 0 {
+			fatalUsage("Usage: keyman host edit --hosts selector [--yes] [--hostname h] [--user u] [--port p] [--identity key] [--proxy-jump j]")
+		}
+		editHosts(flags, values, *selector, *yes)
+		return
+	}
+	if len(args) < 1 || (*templateName == "" && len(args) > 1) {
+		fatalUsagef("Usage: keyman host %s [--template t] [--hostname h] [--user u] [--port p] [--identity key] [--proxy-jump j] <host> [template args]", command)
+	}
+	if *templateName != "" && command != "add" {
+		fatalUsage("--template only applies to keyman host add")
+	}
+	name := args[0]
+
+	var templateOptions []keyman.TemplateOption
+	if *templateName != "" {
+		template, ok := settings.Templates[*templateName]
+		if !ok {
+			fatalf("No template %s in the settings, the templates are: %s", *templateName, orDefault(strings.Join(settings.TemplateNames(), ", "), "none"))
+		}
+		var err error
+		templateOptions, err = template.Expand(name, args[1:])
+		if err != nil {
+			fatalUsage(err)
+		}
+	}
+	if name == keyman.DefaultsHost {
+		fatal("Host * holds the defaults for every host, manage it with keyman defaults")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	block := config.FindHost(name)
+	switch {
+	case command == "add" && block != nil:
+		fatalf("Host %s already exists, use keyman host edit", name)
+	case command == "edit" && block == nil:
+		fatalf("Host %s not found in config", name)
+	case block == nil:
+		block = config.AppendHost(name)
+	}
+
+	block.AddOptions(templateOptions)
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// With no flags, ask for each option, offering the current value.
+	if len(set) == 0 {
+		for _, option := range hostOptions {
+			current := block.Option(option.keyword)
+			*values[option.flag] = prompt(option.keyword, current)
+			set[option.flag] = *values[option.flag] != current
+		}
+	}
+
+	setHostOptions(block, values, set)
+
+	err = saveConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("host "+command, name, "", "")
+	if command == "add" {
+		fmt.Printf("Added host %s\n", name)
+	} else {
+		fmt.Printf("Updated host %s\n", name)
+	}
+}
+
+// setHostOptions sets the options whose flags are in set on block.
+func setHostOptions(block *keyman.HostBlock, values map[string]*string, set map[string]bool) {
+	for _, option := range hostOptions {
+		if !set[option.flag] {
+			continue
+		}
+		value := *values[option.flag]
+		if option.keyword == "IdentityFile" && value != "" {
+			var err error
+			value, err = getFullKeyPath(value)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		setHostOption(block, option.keyword, value)
+	}
+}
+
+// setHostOption sets keyword on block, removing it when value is empty.
+func setHostOption(block *keyman.HostBlock, keyword, value string) {
+	if value == "" {
+		block.RemoveOption(keyword, func(string) bool { return true })
+		return
+	}
+	block.SetOption(keyword, value)
+}
+
+func removeHost(name string) {
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	block := config.FindHost(name)
+	if block == nil {
+		fatalf("Host %s not found in config", name)
+	}
+	block.Remove()
+
+	err = saveConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("host remove", name, "", "")
+	fmt.Printf("Removed host %s\n", name)
+}
+
+func listHosts() {
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	tags := hostTags()
+	for _, block := range config.AllBlocks() {
+		if block.Match || block.IsDefaults() {
+			continue
+		}
+		fmt.Printf("Host: %s\n", block.Name())
+		for _, option := range hostOptions {
+			for _, value := range block.Options(option.keyword) {
+				fmt.Printf("%s: %s\n", option.keyword, value)
+			}
+		}
+		if len(tags[block.Name()]) > 0 {
+			fmt.Printf("Tags: %s\n", strings.Join(tags[block.Name()], ", "))
+		}
+		fmt.Println()
+	}
+}
+
+// prompt asks for a value, returning current if the answer is empty.
+func prompt(label, current string) string {
+	if current != "" {
+		fmt.Printf("%s (default is %s): ", label, current)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return current
+	}
+	return answer
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// selectHosts returns the Host blocks a --hosts selector picks, last first
+// so that editing a block does not move the ones still to come. The
+// selector is a comma separated list of tag:<tag>, for hosts tagged with
+// keyman host tag, and patterns such as '*.prod.example.com', matched
+// against each name on a Host line. Host * and Match blocks are never
+// picked.
+func selectHosts(config *keyman.Config, selector string) ([]*keyman.HostBlock, error) {
+	var tags, patterns []string
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+		case strings.HasPrefix(part, "tag:"):
+			tags = append(tags, strings.TrimPrefix(part, "tag:"))
+		default:
+			patterns = append(patterns, part)
+		}
+	}
+	if len(tags) == 0 && len(patterns) == 0 {
+		return nil, fmt.Errorf("--hosts needs tag:<tag> or a host pattern")
+	}
+
+	metadata, err := loadMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []*keyman.HostBlock
+	for _, block := range config.AllBlocks() {
+		if block.Match || block.IsDefaults() {
+			continue
+		}
+		picked := false
+		for _, tag := range tags {
+			picked = picked || metadata.Hosts[block.Name()].HasTag(tag)
+		}
+		for _, name := range block.Patterns {
+			if !strings.HasPrefix(name, "!") && keyman.MatchPatterns(patterns, name) {
+				picked = true
+			}
+		}
+		if picked {
+			selected = append([]*keyman.HostBlock{block}, selected...)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no hosts match %s", selector)
+	}
+	return selected, nil
+}
+
+// confirmBulk shows the diff of a change made across several hosts and asks
+// once whether to go ahead, unless yes is set. In a dry run saveConfig
+// prints the diff instead, and nothing is asked.
+func confirmBulk(config *keyman.Config, question string, yes bool) bool {
+	if dryRun || yes {
+		return true
+	}
+	if err := printConfigDiff(config); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("%s [y/N]: ", question)
+	answer, _ := stdin.ReadString('\n')
+	return strings.EqualFold(strings.TrimSpace(answer), "y")
+}
+
+// editHosts sets the options given as flags on every host selector picks,
+// showing the whole change and asking once before saving it.
+func editHosts(flags *flag.FlagSet, values map[string]*string, selector string, yes bool) {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	delete(set, "hosts")
+	delete(set, "yes")
+	if len(set) == 0 {
+		fatalUsage("host edit --hosts needs the options to set as flags, such as --user deploy")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	blocks, err := selectHosts(config, selector)
+	if err != nil {
+		fatal(err)
+	}
+	var names []string
+	for _, block := range blocks {
+		setHostOptions(block, values, set)
+		names = append([]string{block.Name()}, names...)
+	}
+	if !confirmBulk(config, fmt.Sprintf("Update %d host(s)?", len(names)), yes) {
+		return
+	}
+
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	for _, name := range names {
+		journal("host edit", name, "", "")
+	}
+	if !dryRun {
+		fmt.Printf("Updated %d host(s): %s\n", len(names), strings.Join(names, ", "))
+	}
+}
+
+// tagHost adds tags to a host, or removes them, for --hosts tag:<tag> to
+// select it by.
+func tagHost(args []string) {
+	flags := flag.NewFlagSet("host tag", flag.ExitOnError)
+	remove := flags.Bool("remove", false, "remove the tags instead of adding them")
+	args = parseFlags(flags, args)
+	if len(args) < 2 {
+		fatalUsage("Usage: keyman host tag [--remove] <host> <tag>...")
+	}
+	name := args[0]
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	if config.FindHost(name) == nil {
+		fatalf("Host %s not found in config", name)
+	}
+
+	metadata, err := loadMetadata()
+	if err != nil {
+		fatal(err)
+	}
+	meta := metadata.Host(name)
+	oldTags := strings.Join(meta.Tags, ", ")
+	if *remove {
+		meta.RemoveTags(args[1:]...)
+	} else {
+		meta.AddTags(args[1:]...)
+	}
+	if len(meta.Tags) == 0 {
+		delete(metadata.Hosts, name)
+	}
+
+	if err := metadata.Save(); err != nil {
+		fatal(err)
+	}
+	journal("host tag", name, oldTags, strings.Join(meta.Tags, ", "))
+	fmt.Printf("Tags for host %s: %s\n", name, strings.Join(meta.Tags, ", "))
+}
+
+// hostTags returns the tags of every host that has some.
+func hostTags() map[string][]string {
+	tags := make(map[string][]string)
+	metadata, err := loadMetadata()
+	if err != nil {
+		return tags
+	}
+	for name, meta := range metadata.Hosts {
+		tags[name] = meta.Tags
+	}
+	return tags
+}
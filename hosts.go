@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// hostView is one Host block as keyman hosts shows it, with the options
+// that apply to it from every matching block, as ssh resolves them: the
+// first value of HostName, User, Port, ProxyJump and ProxyCommand wins and
+// IdentityFiles add up. JumpChain lists the hosts ssh goes through to reach
+// it, first hop first, and Tags are those set with keyman host tag.
+type hostView struct {
+	Host         string         `json:"host"`
+	HostName     string         `json:"hostname,omitempty"`
+	User         string         `json:"user,omitempty"`
+	Port         string         `json:"port,omitempty"`
+	ProxyJump    string         `json:"proxy_jump,omitempty"`
+	ProxyCommand string         `json:"proxy_command,omitempty"`
+	JumpChain    []string       `json:"jump_chain,omitempty"`
+	JumpError    string         `json:"jump_error,omitempty"`
+	Identities   []identityView `json:"identities"`
+	Tags         []string       `json:"tags,omitempty"`
+}
+
+type identityView struct {
+	File    string `json:"file"`
+	Path    string `json:"path"`
+	Missing bool   `json:"missing"`
+}
+
+// listHostViews prints every Host block with where it connects and the keys
+// it offers, marking identity files that are missing on disk.
+func listHostViews(args []string) {
+	flags := flag.NewFlagSet("hosts", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the hosts as JSON")
+	missingOnly := flags.Bool("missing", false, "only list hosts with an identity file that is missing")
+	plain := flags.Bool("plain", false, "print without color")
+	parseFlagSet(flags, args)
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	tags := hostTags()
+	hosts := []hostView{}
+	for _, block := range config.AllBlocks() {
+		if block.Match || block.IsDefaults() {
+			continue
+		}
+		view := resolveHostView(config, block)
+		view.Tags = tags[view.Host]
+		if *missingOnly && !view.hasMissing() {
+			continue
+		}
+		hosts = append(hosts, view)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(hosts); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	var rows [][]tableCell
+	for _, host := range hosts {
+		var identities []string
+		color := ""
+		for _, identity := range host.Identities {
+			if identity.Missing {
+				identities = append(identities, identity.File+" (missing)")
+				color = colorRed
+			} else {
+				identities = append(identities, identity.File)
+			}
+		}
+		via := tableCell{text: strings.Join(host.JumpChain, " -> ")}
+		if host.JumpError != "" {
+			via = tableCell{text: "loops", color: colorRed}
+		}
+		rows = append(rows, []tableCell{
+			{text: host.Host},
+			{text: host.HostName},
+			{text: host.User},
+			{text: host.Port},
+			via,
+			{text: strings.Join(identities, ", "), color: color},
+		})
+	}
+	writeTable(os.Stdout, []string{"host", "hostname", "user", "port", "via", "identities"}, rows, useColor(*plain))
+}
+
+// resolveHostView gathers the options that apply to block's host from
+// every block matching it, in file order.
+func resolveHostView(config *keyman.Config, block *keyman.HostBlock) hostView {
+	view := hostView{Host: block.Name(), Identities: []identityView{}}
+	host := block.Patterns[0]
+	for _, pattern := range block.Patterns {
+		if !strings.HasPrefix(pattern, "!") {
+			host = pattern
+			break
+		}
+	}
+	for _, match := range config.MatchingBlocks(host) {
+		view.HostName = orDefault(view.HostName, match.Option("HostName"))
+		view.User = orDefault(view.User, match.Option("User"))
+		view.Port = orDefault(view.Port, match.Option("Port"))
+		view.ProxyJump = orDefault(view.ProxyJump, match.Option("ProxyJump"))
+		view.ProxyCommand = orDefault(view.ProxyCommand, match.Option("ProxyCommand"))
+		for _, file := range match.Options("IdentityFile") {
+			path, err := keyman.ExpandPath(file)
+			if err != nil {
+				path = file
+			}
+			_, err = os.Stat(path)
+			view.Identities = append(view.Identities, identityView{File: file, Path: path, Missing: err != nil})
+		}
+	}
+
+	chain, err := config.JumpChain(host)
+	if err != nil {
+		view.JumpError = err.Error()
+	}
+	for _, hop := range chain {
+		view.JumpChain = append(view.JumpChain, hop.Host)
+	}
+	return view
+}
+
+func (v hostView) hasMissing() bool {
+	for _, identity := range v.Identities {
+		if identity.Missing {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// importKeys authorizes every key found at the given sources, such as a
+// teammate's GitHub account, for logging in to this machine.
+func importKeys(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	file := flags.String("file", "", "authorized_keys file to add to (default ~/.ssh/authorized_keys)")
+	options := flags.String("options", "", "restriction options for the imported keys, e.g. no-port-forwarding")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman import [--file f] [--options o] <github:user|gitlab:user|url|pubfile>...")
+	}
+
+	path := *file
+	if path == "" {
+		sshPath, err := getSSHPath()
+		if err != nil {
+			fatal(err)
+		}
+		path = filepath.Join(sshPath, authorizedKeysFile)
+	}
+
+	lines, err := readLines(path)
+	if err != nil {
+		fatal(err)
+	}
+	existing := make(map[string]bool)
+	for _, entry := range parseAuthorizedKeys(lines) {
+		existing[entry.pub.FingerprintSHA256()] = true
+	}
+
+	var imported []string
+	for _, source := range args {
+		keys, err := fetchPublicKeys(source)
+		if err != nil {
+			fatal(err)
+		}
+		if len(keys) == 0 {
+			fmt.Printf("No public keys found at %s\n", source)
+		}
+
+		for _, key := range keys {
+			pub, err := keyman.ParsePublicKey(key)
+			if err != nil {
+				fatal(err)
+			}
+			fingerprint := pub.FingerprintSHA256()
+			if existing[fingerprint] {
+				fmt.Printf("Key %s from %s is already authorized\n", fingerprint, source)
+				continue
+			}
+
+			// Hosted .keys lists carry no comments, so record where the
+			// key came from to make it recognisable later.
+			comment := pub.Comment
+			if comment == "" {
+				comment = source
+			}
+			line := strings.Join(strings.Fields(key)[:2], " ") + " " + comment
+			if *options != "" {
+				line = *options + " " + line
+			}
+
+			lines = append(lines, line)
+			existing[fingerprint] = true
+			imported = append(imported, fingerprint+" from "+source)
+			fmt.Printf("Imported %s from %s\n", fingerprint, source)
+		}
+	}
+
+	if len(imported) == 0 {
+		return
+	}
+
+	err = writeLines(path, lines)
+	if err != nil {
+		fatal(err)
+	}
+	for _, key := range imported {
+		journal("authorize", path, "", key)
+	}
+	fmt.Printf("Added %d key(s) to %s\n", len(imported), path)
+}
@@ -0,0 +1,292 @@
+// Package argon2 implements the Argon2 password hash (RFC 9106, version
+// 1.3) in its d, i and id variants, enough to derive the keys that protect
+// PuTTY's PPK version 3 files.
+package argon2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Variant selects how Argon2 picks the blocks it mixes in.
+type Variant int
+
+const (
+	Argon2d Variant = iota
+	Argon2i
+	Argon2id
+)
+
+// ParseVariant parses Argon2d, Argon2i or Argon2id.
+func ParseVariant(name string) (Variant, error) {
+	switch name {
+	case "Argon2d":
+		return Argon2d, nil
+	case "Argon2i":
+		return Argon2i, nil
+	case "Argon2id":
+		return Argon2id, nil
+	}
+	return 0, fmt.Errorf("unknown Argon2 variant %q", name)
+}
+
+func (v Variant) String() string {
+	return [...]string{"Argon2d", "Argon2i", "Argon2id"}[v]
+}
+
+const (
+	version       = 0x13
+	blockWords    = 128
+	syncPoints    = 4
+	addressesSize = blockWords
+)
+
+type block [blockWords]uint64
+
+// Params are the Argon2 cost parameters. Memory is in KiB.
+type Params struct {
+	Variant     Variant
+	Memory      uint32
+	Passes      uint32
+	Parallelism uint32
+}
+
+// Key derives size bytes from password and salt, with optional secret and
+// associated data.
+func Key(params Params, password, salt, secret, data []byte, size uint32) ([]byte, error) {
+	if params.Parallelism < 1 || params.Passes < 1 {
+		return nil, fmt.Errorf("argon2: passes and parallelism must be at least 1")
+	}
+	if params.Memory < 8*params.Parallelism {
+		return nil, fmt.Errorf("argon2: memory must be at least 8 KiB per lane")
+	}
+	if size < 4 {
+		return nil, fmt.Errorf("argon2: output must be at least 4 bytes")
+	}
+
+	h0 := blake2b(64,
+		le32(params.Parallelism), le32(size), le32(params.Memory), le32(params.Passes),
+		le32(version), le32(uint32(params.Variant)),
+		le32(uint32(len(password))), password,
+		le32(uint32(len(salt))), salt,
+		le32(uint32(len(secret))), secret,
+		le32(uint32(len(data))), data,
+	)
+
+	lanes := params.Parallelism
+	segment := params.Memory / (syncPoints * lanes)
+	laneLength := segment * syncPoints
+	memory := make([]block, laneLength*lanes)
+
+	for lane := uint32(0); lane < lanes; lane++ {
+		for i := uint32(0); i < 2; i++ {
+			memory[lane*laneLength+i].setBytes(hashLong(blockWords*8, h0, le32(i), le32(lane)))
+		}
+	}
+
+	f := &filler{params: params, memory: memory, lanes: lanes, laneLength: laneLength, segment: segment}
+	for pass := uint32(0); pass < params.Passes; pass++ {
+		for slice := uint32(0); slice < syncPoints; slice++ {
+			for lane := uint32(0); lane < lanes; lane++ {
+				f.fillSegment(pass, slice, lane)
+			}
+		}
+	}
+
+	final := memory[laneLength-1]
+	for lane := uint32(1); lane < lanes; lane++ {
+		last := &memory[lane*laneLength+laneLength-1]
+		for i := range final {
+			final[i] ^= last[i]
+		}
+	}
+	return hashLong(size, final.bytes()), nil
+}
+
+type filler struct {
+	params     Params
+	memory     []block
+	lanes      uint32
+	laneLength uint32
+	segment    uint32
+}
+
+func (f *filler) fillSegment(pass, slice, lane uint32) {
+	independent := f.params.Variant == Argon2i || (f.params.Variant == Argon2id && pass == 0 && slice < syncPoints/2)
+
+	var input, addresses, zero block
+	if independent {
+		input[0] = uint64(pass)
+		input[1] = uint64(lane)
+		input[2] = uint64(slice)
+		input[3] = uint64(len(f.memory))
+		input[4] = uint64(f.params.Passes)
+		input[5] = uint64(f.params.Variant)
+	}
+	nextAddresses := func() {
+		input[6]++
+		compress(&addresses, &zero, &input, false)
+		compress(&addresses, &zero, &addresses, false)
+	}
+
+	start := uint32(0)
+	if pass == 0 && slice == 0 {
+		start = 2
+		if independent {
+			nextAddresses()
+		}
+	}
+
+	offset := lane*f.laneLength + slice*f.segment + start
+	prev := offset - 1
+	if offset%f.laneLength == 0 {
+		prev = offset + f.laneLength - 1
+	}
+
+	for i := start; i < f.segment; i, offset, prev = i+1, offset+1, offset {
+		if offset%f.laneLength == 1 {
+			prev = offset - 1
+		}
+
+		var random uint64
+		if independent {
+			if i%addressesSize == 0 {
+				nextAddresses()
+			}
+			random = addresses[i%addressesSize]
+		} else {
+			random = f.memory[prev][0]
+		}
+
+		refLane := uint32(random>>32) % f.lanes
+		if pass == 0 && slice == 0 {
+			refLane = lane
+		}
+		ref := f.indexAlpha(pass, slice, i, uint32(random), refLane == lane)
+
+		compress(&f.memory[offset], &f.memory[prev], &f.memory[refLane*f.laneLength+ref], pass > 0)
+	}
+}
+
+// indexAlpha maps a pseudo-random value to a block in the reference lane,
+// skewed towards recent blocks.
+func (f *filler) indexAlpha(pass, slice, index, random uint32, sameLane bool) uint32 {
+	var area uint32
+	switch {
+	case pass == 0 && slice == 0:
+		area = index - 1
+	case pass == 0 && sameLane:
+		area = slice*f.segment + index - 1
+	case pass == 0:
+		area = slice * f.segment
+		if index == 0 {
+			area--
+		}
+	case sameLane:
+		area = f.laneLength - f.segment + index - 1
+	default:
+		area = f.laneLength - f.segment
+		if index == 0 {
+			area--
+		}
+	}
+
+	x := uint64(random) * uint64(random) >> 32
+	relative := uint64(area) - 1 - (uint64(area) * x >> 32)
+
+	startPosition := uint64(0)
+	if pass != 0 && slice != syncPoints-1 {
+		startPosition = uint64(slice+1) * uint64(f.segment)
+	}
+	return uint32((startPosition + relative) % uint64(f.laneLength))
+}
+
+// compress sets out to G(prev, ref), XORed with its previous contents when
+// xor is set, as Argon2 1.3 does on every pass after the first.
+func compress(out, prev, ref *block, xor bool) {
+	var r, tmp block
+	for i := range r {
+		r[i] = prev[i] ^ ref[i]
+	}
+	tmp = r
+	if xor {
+		for i := range tmp {
+			tmp[i] ^= out[i]
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		permute(&r, 16*i, 16*i+1, 16*i+2, 16*i+3, 16*i+4, 16*i+5, 16*i+6, 16*i+7,
+			16*i+8, 16*i+9, 16*i+10, 16*i+11, 16*i+12, 16*i+13, 16*i+14, 16*i+15)
+	}
+	for i := 0; i < 8; i++ {
+		permute(&r, 2*i, 2*i+1, 2*i+16, 2*i+17, 2*i+32, 2*i+33, 2*i+48, 2*i+49,
+			2*i+64, 2*i+65, 2*i+80, 2*i+81, 2*i+96, 2*i+97, 2*i+112, 2*i+113)
+	}
+
+	for i := range out {
+		out[i] = tmp[i] ^ r[i]
+	}
+}
+
+func permute(b *block, v0, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10, v11, v12, v13, v14, v15 int) {
+	gb(b, v0, v4, v8, v12)
+	gb(b, v1, v5, v9, v13)
+	gb(b, v2, v6, v10, v14)
+	gb(b, v3, v7, v11, v15)
+	gb(b, v0, v5, v10, v15)
+	gb(b, v1, v6, v11, v12)
+	gb(b, v2, v7, v8, v13)
+	gb(b, v3, v4, v9, v14)
+}
+
+// gb is BLAKE2b's G with the additions replaced by the multiplication
+// hardened BlaMka function.
+func gb(v *block, a, b, c, d int) {
+	blamka := func(x, y uint64) uint64 {
+		return x + y + 2*uint64(uint32(x))*uint64(uint32(y))
+	}
+	v[a] = blamka(v[a], v[b])
+	v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+	v[c] = blamka(v[c], v[d])
+	v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+	v[a] = blamka(v[a], v[b])
+	v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+	v[c] = blamka(v[c], v[d])
+	v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+}
+
+// hashLong is Argon2's variable length hash H'.
+func hashLong(size uint32, inputs ...[]byte) []byte {
+	inputs = append([][]byte{le32(size)}, inputs...)
+	if size <= 64 {
+		return blake2b(int(size), inputs...)
+	}
+
+	v := blake2b(64, inputs...)
+	out := append(make([]byte, 0, size), v[:32]...)
+	for size-uint32(len(out)) > 64 {
+		v = blake2b(64, v)
+		out = append(out, v[:32]...)
+	}
+	return append(out, blake2b(int(size)-len(out), v)...)
+}
+
+func (b *block) setBytes(data []byte) {
+	for i := range b {
+		b[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+}
+
+func (b *block) bytes() []byte {
+	out := make([]byte, blockWords*8)
+	for i, v := range b {
+		binary.LittleEndian.PutUint64(out[8*i:], v)
+	}
+	return out
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
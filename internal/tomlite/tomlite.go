@@ -0,0 +1,354 @@
+// Package tomlite reads the subset of TOML used by keyman's settings file:
+// tables, dotted and quoted keys, basic and literal strings, arrays, inline
+// tables and comments. Numbers, booleans and dates are returned as their
+// literal text, so every scalar is a string.
+package tomlite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type parser struct {
+	text string
+	pos  int
+	line int
+}
+
+// Parse decodes data into nested map[string]interface{}, []interface{} and
+// string values.
+func Parse(data []byte) (map[string]interface{}, error) {
+	p := &parser{text: string(data), line: 1}
+	root := map[string]interface{}{}
+	current := root
+
+	for {
+		p.skipBlank(true)
+		if p.eof() {
+			return root, nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			if p.peek() == '[' {
+				return nil, p.errorf("arrays of tables are not supported")
+			}
+			p.skipBlank(false)
+			path, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipBlank(false)
+			if p.peek() != ']' {
+				return nil, p.errorf("expected ] after table name")
+			}
+			p.pos++
+			current, err = p.table(root, path)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			path, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipBlank(false)
+			if p.peek() != '=' {
+				return nil, p.errorf("expected = after key %s", strings.Join(path, "."))
+			}
+			p.pos++
+			p.skipBlank(false)
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.set(current, path, value); err != nil {
+				return nil, err
+			}
+		}
+
+		p.skipBlank(false)
+		if !p.eof() && p.peek() != '\n' {
+			return nil, p.errorf("unexpected %q", p.peek())
+		}
+	}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.text)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skipBlank skips spaces, tabs and comments, and newlines too if asked.
+func (p *parser) skipBlank(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+// table returns the table at path below root, creating it if needed.
+func (p *parser) table(root map[string]interface{}, path []string) (map[string]interface{}, error) {
+	current := root
+	for _, name := range path {
+		switch next := current[name].(type) {
+		case nil:
+			table := map[string]interface{}{}
+			current[name] = table
+			current = table
+		case map[string]interface{}:
+			current = next
+		default:
+			return nil, p.errorf("%s is not a table", strings.Join(path, "."))
+		}
+	}
+	return current, nil
+}
+
+func (p *parser) set(table map[string]interface{}, path []string, value interface{}) error {
+	parent, err := p.table(table, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	name := path[len(path)-1]
+	if _, ok := parent[name]; ok {
+		return p.errorf("duplicate key %s", strings.Join(path, "."))
+	}
+	parent[name] = value
+	return nil
+}
+
+// parseKey parses a possibly dotted key into its parts.
+func (p *parser) parseKey() ([]string, error) {
+	var path []string
+	for {
+		p.skipBlank(false)
+		var part string
+		switch p.peek() {
+		case '"', '\'':
+			var err error
+			part, err = p.parseString()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, p.errorf("expected a key")
+			}
+			part = p.text[start:p.pos]
+		}
+		path = append(path, part)
+
+		p.skipBlank(false)
+		if p.peek() != '.' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+	switch p.peek() {
+	case '"', '\'':
+		return p.parseString()
+	case '[':
+		return p.parseArray()
+	case '{':
+		return p.parseInlineTable()
+	}
+
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", rune(p.peek())) {
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, p.errorf("expected a value")
+	}
+	return p.text[start:p.pos], nil
+}
+
+func (p *parser) parseString() (string, error) {
+	quote := p.peek()
+	if strings.HasPrefix(p.text[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	p.pos++
+
+	var out strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == quote:
+			return out.String(), nil
+		case c == '\\' && quote == '"':
+			if p.eof() {
+				return "", p.errorf("unterminated string")
+			}
+			escape := p.peek()
+			p.pos++
+			switch escape {
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			case 'r':
+				out.WriteByte('\r')
+			case '"', '\\':
+				out.WriteByte(escape)
+			case 'u', 'U':
+				size := 4
+				if escape == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.text) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(p.text[p.pos:p.pos+size], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				out.WriteRune(rune(code))
+				p.pos += size
+			default:
+				return "", p.errorf("invalid escape \\%c", escape)
+			}
+		default:
+			out.WriteByte(c)
+		}
+	}
+}
+
+func (p *parser) parseArray() (interface{}, error) {
+	p.pos++
+	items := []interface{}{}
+	for {
+		p.skipBlank(true)
+		if p.peek() == ']' {
+			p.pos++
+			return items, nil
+		}
+		if p.eof() {
+			return nil, p.errorf("unterminated array")
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+
+		p.skipBlank(true)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *parser) parseInlineTable() (interface{}, error) {
+	p.pos++
+	table := map[string]interface{}{}
+	p.skipBlank(false)
+	if p.peek() == '}' {
+		p.pos++
+		return table, nil
+	}
+
+	for {
+		path, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		p.skipBlank(false)
+		if p.peek() != '=' {
+			return nil, p.errorf("expected = after key %s", strings.Join(path, "."))
+		}
+		p.pos++
+		p.skipBlank(false)
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.set(table, path, value); err != nil {
+			return nil, err
+		}
+
+		p.skipBlank(false)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return table, nil
+		default:
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// String returns v if it is a scalar, or "".
+func String(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// Strings returns the scalars in an array, or a single scalar as a
+// one-element slice.
+func Strings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Map returns v if it is a table, or nil.
+func Map(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
@@ -0,0 +1,287 @@
+// Package yamlite reads the small subset of YAML used by keyman's policy,
+// manifest and inventory files: block mappings and sequences, flow
+// sequences of scalars, quoted and plain scalars, and comments. Every
+// scalar is returned as a string.
+package yamlite
+
+import (
+	"fmt"
+	"strings"
+)
+
+type line struct {
+	indent int
+	text   string
+	num    int
+}
+
+type parser struct {
+	lines []line
+	pos   int
+}
+
+// Parse decodes data into nested map[string]interface{},
+// []interface{} and string values. An empty document is an empty map.
+func Parse(data []byte) (interface{}, error) {
+	p := &parser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(stripComment(raw), " \t\r")
+		text := strings.TrimLeft(raw, " ")
+		if text == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		p.lines = append(p.lines, line{indent: len(raw) - len(text), text: text, num: i + 1})
+	}
+
+	if len(p.lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	value, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return value, nil
+}
+
+func (p *parser) parseBlock(indent int) (interface{}, error) {
+	if isSequenceItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *parser) parseSequence(indent int) (interface{}, error) {
+	var items []interface{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || !isSequenceItem(l.text) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+
+		rest := strings.TrimLeft(l.text[1:], " ")
+		switch {
+		case rest == "":
+			p.pos++
+			var value interface{}
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				var err error
+				value, err = p.parseBlock(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+			}
+			items = append(items, value)
+		case isMappingEntry(rest):
+			// "- key: value" starts a mapping indented to where key begins.
+			offset := len(l.text) - len(rest)
+			p.lines[p.pos] = line{indent: indent + offset, text: rest, num: l.num}
+			value, err := p.parseMapping(indent + offset)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		default:
+			value, err := parseScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.num, err)
+			}
+			items = append(items, value)
+			p.pos++
+		}
+	}
+	return items, nil
+}
+
+func (p *parser) parseMapping(indent int) (interface{}, error) {
+	mapping := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+
+		key, rest, ok := splitMappingEntry(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", l.num)
+		}
+		p.pos++
+
+		var value interface{}
+		if rest != "" {
+			var err error
+			value, err = parseScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.num, err)
+			}
+		} else if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || (next.indent == indent && isSequenceItem(next.text)) {
+				var err error
+				value, err = p.parseBlock(next.indent)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		mapping[key] = value
+	}
+	return mapping, nil
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func isMappingEntry(text string) bool {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return false
+	}
+	_, _, ok := splitMappingEntry(text)
+	return ok
+}
+
+// splitMappingEntry splits "key: value" outside of quotes.
+func splitMappingEntry(text string) (string, string, bool) {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key := unquote(strings.TrimSpace(text[:i]))
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+func parseScalar(text string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated flow sequence")
+		}
+		inner := strings.TrimSpace(text[1 : len(text)-1])
+		items := []interface{}{}
+		if inner == "" {
+			return items, nil
+		}
+		for _, item := range splitFlow(inner) {
+			items = append(items, unquote(strings.TrimSpace(item)))
+		}
+		return items, nil
+	case text == "{}":
+		return map[string]interface{}{}, nil
+	case text == "~" || text == "null":
+		return nil, nil
+	}
+	return unquote(text), nil
+}
+
+// splitFlow splits a flow sequence body on commas outside quotes.
+func splitFlow(text string) []string {
+	var parts []string
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
+
+func unquote(text string) string {
+	if len(text) >= 2 {
+		switch {
+		case text[0] == '"' && text[len(text)-1] == '"':
+			return strings.ReplaceAll(text[1:len(text)-1], `\"`, `"`)
+		case text[0] == '\'' && text[len(text)-1] == '\'':
+			return strings.ReplaceAll(text[1:len(text)-1], "''", "'")
+		}
+	}
+	return text
+}
+
+// stripComment removes a trailing comment that starts with # at the
+// beginning of the line or after whitespace, outside of quotes.
+func stripComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// String returns v if it is a scalar, or "".
+func String(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// Strings returns the scalars in a sequence, or a single scalar as a
+// one-element slice.
+func Strings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Map returns v if it is a mapping, or nil.
+func Map(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+// List returns v if it is a sequence, or nil.
+func List(v interface{}) []interface{} {
+	l, _ := v.([]interface{})
+	return l
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const journalFile = "journal.jsonl"
+
+func getJournalPath() (string, error) {
+	sshPath, err := getSSHPath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(sshPath, keymanDir, journalFile), nil
+}
+
+// journal records a change in the journal. Failing to record it is only
+// reported, since the change itself has already been made.
+func journal(action, subject, old, new string) {
+	if dryRun {
+		return
+	}
+
+	entry := keyman.JournalEntry{
+		Time:    time.Now(),
+		User:    os.Getenv("USER"),
+		Command: strings.Join(os.Args[1:], " "),
+		Action:  action,
+		Subject: subject,
+		Old:     old,
+		New:     new,
+	}
+	if current, err := user.Current(); err == nil {
+		entry.User = current.Username
+	}
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && sudoUser != entry.User {
+		entry.User = sudoUser + " as " + entry.User
+	}
+	entry.Hostname, _ = os.Hostname()
+
+	path, err := getJournalPath()
+	if err == nil {
+		err = keyman.AppendJournal(path, entry)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not record %s in the journal: %v\n", action, err)
+	}
+}
+
+// keyFingerprint describes the key at keyPath for the journal, or returns
+// "" if its public key cannot be read.
+func keyFingerprint(keyPath string) string {
+	pub, err := keyman.ReadPublicKeyFile(strings.TrimSuffix(keyPath, keyFileExt) + keyFileExt)
+	if err != nil {
+		return ""
+	}
+	return pub.TypeName() + " " + pub.FingerprintSHA256()
+}
+
+func showLog(args []string) {
+	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", settings.Output == "json", "print the entries as JSON lines, for export")
+	parseFlags(flags, args)
+
+	path, err := getJournalPath()
+	if err != nil {
+		fatal(err)
+	}
+
+	entries, err := keyman.ReadJournal(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				fatal(err)
+			}
+		}
+		return
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No changes recorded")
+		return
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s  %s@%s  %s %s\n", entry.Time.Format("2006-01-02 15:04:05"), entry.User, entry.Hostname, entry.Action, entry.Subject)
+		if entry.Old != "" {
+			fmt.Printf("    - %s\n", entry.Old)
+		}
+		if entry.New != "" {
+			fmt.Printf("    + %s\n", entry.New)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+func showFingerprint(key string) {
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(key, keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	pub, err := keyman.ReadPublicKeyFile(keyPath + keyFileExt)
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("Key: %s\n", filepath.Base(keyPath))
+	fmt.Printf("Type: %s %d\n", pub.TypeName(), pub.Bits())
+	fmt.Printf("Algorithm: %s (%d bytes encoded)\n", pub.Algorithm, len(pub.Blob))
+	fmt.Printf("Fingerprint: %s\n", pub.FingerprintSHA256())
+	fmt.Printf("Fingerprint: %s\n", pub.FingerprintMD5())
+	if pub.Comment != "" {
+		fmt.Printf("Comment: %s\n", pub.Comment)
+	}
+	fmt.Print(pub.RandomArt())
+}
+
+// writePublicKeys derives public keys from their private keys and writes
+// the .pub files that have gone missing.
+func writePublicKeys(args []string) {
+	flags := flag.NewFlagSet("pubkey", flag.ExitOnError)
+	all := flags.Bool("all", false, "write the .pub file of every private key that has lost it")
+	force := flags.Bool("force", false, "replace a .pub file that does not match its private key")
+	args = parseFlags(flags, args)
+	if len(args) < 1 && !*all {
+		fatalUsage("Usage: keyman pubkey [--force] <key>... | --all")
+	}
+
+	var keyPaths []string
+	for _, arg := range args {
+		keyPath, err := getFullKeyPath(strings.TrimSuffix(arg, keyFileExt))
+		if err != nil {
+			fatal(err)
+		}
+		keyPaths = append(keyPaths, keyPath)
+	}
+	if *all {
+		keys, err := getKeys()
+		if err != nil {
+			fatal(err)
+		}
+		for _, key := range keys {
+			if key.MissingPublic {
+				keyPaths = append(keyPaths, key.Path)
+			}
+		}
+		if len(keyPaths) == 0 {
+			fmt.Println("No private keys without a public key found")
+			return
+		}
+	}
+
+	for _, keyPath := range keyPaths {
+		if err := writePublicKey(keyPath, *force); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func writePublicKey(keyPath string, force bool) error {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+
+	pub, err := keyman.PublicKeyFromPrivate(data)
+	if err != nil {
+		// Encrypted PEM keys and types keyman cannot parse are left to
+		// ssh-keygen, which asks for the passphrase itself.
+		cmd := exec.Command(toolPath("ssh-keygen"), "-y", "-f", keyPath)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		line, keygenErr := cmd.Output()
+		if keygenErr != nil {
+			return fmt.Errorf("deriving the public key of %s failed: %v", keyPath, err)
+		}
+		pub, err = keyman.ParsePublicKey(string(line))
+		if err != nil {
+			return err
+		}
+	}
+
+	pubPath := keyPath + keyFileExt
+	if existing, err := keyman.ReadPublicKeyFile(pubPath); err == nil {
+		if existing.FingerprintSHA256() == pub.FingerprintSHA256() {
+			fmt.Printf("%s already matches its private key\n", pubPath)
+			return nil
+		}
+		if !force {
+			return fmt.Errorf("%s does not match its private key, use --force to replace it", pubPath)
+		}
+	} else if _, err := os.Stat(pubPath); err == nil && !force {
+		return fmt.Errorf("%s exists but is not a public key, use --force to replace it", pubPath)
+	}
+
+	if dryRun {
+		fmt.Printf("Would write %s\n", pubPath)
+		return nil
+	}
+	if err := os.WriteFile(pubPath, []byte(pub.String()+"\n"), 0644); err != nil {
+		return err
+	}
+
+	journal("pubkey", pubPath, "", pub.TypeName()+" "+pub.FingerprintSHA256())
+	fmt.Printf("Wrote %s\n", pubPath)
+	fmt.Printf("Fingerprint: %s\n", pub.FingerprintSHA256())
+	return nil
+}
+
+// findKey reports which local keys match a fingerprint or public key line.
+func findKey(query string) {
+	query = strings.TrimSpace(query)
+	var match func(pub *keyman.PublicKey) bool
+	if target, err := keyman.ParsePublicKey(query); err == nil {
+		match = func(pub *keyman.PublicKey) bool {
+			return pub.FingerprintSHA256() == target.FingerprintSHA256()
+		}
+	} else {
+		match = func(pub *keyman.PublicKey) bool {
+			return keyman.FingerprintMatches(pub, query)
+		}
+	}
+
+	keys, err := getKeys()
+	if err != nil {
+		fatal(err)
+	}
+
+	found := false
+	for _, key := range keys {
+		if key.Public != nil && match(key.Public) {
+			fmt.Printf("Key: %s\nPath: %s\nFingerprint: %s\n\n", key.Name, key.Path, key.Public.FingerprintSHA256())
+			found = true
+		}
+	}
+
+	// Like grep, finding nothing is an answer rather than an error.
+	if !found {
+		fmt.Fprintln(os.Stderr, "No matching key found")
+		os.Exit(exitFindings)
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const knownHostsFile = "known_hosts"
+
+// Statuses of a scanned host key against known_hosts.
+const (
+	hostKeyNew     = "new"
+	hostKeyKnown   = "known"
+	hostKeyChanged = "changed"
+	hostKeySkipped = "not the key asked for"
+)
+
+// scannedKey is a host key fetched with ssh-keyscan from host, named as
+// known_hosts names it.
+type scannedKey struct {
+	host   string
+	name   string
+	key    *keyman.PublicKey
+	status string
+	line   int
+}
+
+func knownHosts(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman known-hosts scan|replace")
+	}
+
+	switch args[0] {
+	case "scan":
+		scanKnownHosts(args[1:])
+	case "replace":
+		replaceKnownHost(args[1:])
+	default:
+		fatalUsage("Unknown known-hosts command")
+	}
+}
+
+// getKnownHostsPath returns the known_hosts file of the active profile, or
+// the one in the ssh directory.
+func getKnownHostsPath() (string, error) {
+	if knownHostsPath != "" {
+		return knownHostsPath, nil
+	}
+	sshPath, err := getSSHPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(sshPath, knownHostsFile), nil
+}
+
+// scanKnownHosts fetches the host keys of hosts, shows their fingerprints
+// and, once they are confirmed or match --fingerprint, adds the ones not
+// yet known to known_hosts. Keys that differ from the known ones are never
+// added.
+func scanKnownHosts(args []string) {
+	flags := flag.NewFlagSet("known-hosts scan", flag.ExitOnError)
+	port := flags.String("port", "", "port to connect to (default from the ssh config, or 22)")
+	types := flags.String("type", "", "comma separated key types to fetch, such as ed25519,ecdsa,rsa (default all)")
+	hash := flags.Bool("hash", false, "hash the host names, as HashKnownHosts yes does (default from the ssh config)")
+	fingerprint := flags.String("fingerprint", "", "add only the host key with this fingerprint, failing if the host does not offer it")
+	yes := flags.Bool("yes", false, "add the keys without asking")
+	timeout := flags.Int("timeout", 5, "seconds to wait for each host")
+	file := flags.String("file", "", "known_hosts file to add to (default ~/.ssh/known_hosts)")
+	plain := flags.Bool("plain", false, "print without color")
+	args = parseFlags(flags, args)
+	if len(args) == 0 {
+		fatalUsage("Usage: keyman known-hosts scan [--port p] [--type t] [--hash] [--fingerprint f] [--yes] [--timeout s] [--file path] <host>...")
+	}
+	if *fingerprint != "" && len(args) > 1 {
+		fatalUsage("--fingerprint checks the key of a single host")
+	}
+	hashSet := false
+	flags.Visit(func(f *flag.Flag) { hashSet = hashSet || f.Name == "hash" })
+
+	path := *file
+	if path == "" {
+		var err error
+		if path, err = getKnownHostsPath(); err != nil {
+			fatal(err)
+		}
+	}
+	known, err := keyman.LoadKnownHosts(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	var scanned []scannedKey
+	failed := 0
+	hashNames := *hash
+	for _, host := range args {
+		target := resolveHostKeyTarget(host, *port)
+		if !hashSet && target.hash {
+			hashNames = true
+		}
+
+		keys, err := keyscan(target.address, target.port, *types, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not scan %s: %v\n", host, err)
+			failed++
+			continue
+		}
+		for _, key := range keys {
+			s := checkHostKey(known, target.name, key, *fingerprint)
+			s.host = host
+			scanned = append(scanned, s)
+		}
+	}
+	if len(scanned) == 0 {
+		fatalf("No host keys found")
+	}
+
+	var rows [][]tableCell
+	var added []scannedKey
+	changed := 0
+	for _, s := range scanned {
+		status := tableCell{text: s.status}
+		switch s.status {
+		case hostKeyNew:
+			status.color = colorGreen
+			added = append(added, s)
+		case hostKeyChanged:
+			status = tableCell{text: fmt.Sprintf("changed (line %d)", s.line), color: colorRed}
+			changed++
+		case hostKeyKnown:
+			status.text = fmt.Sprintf("known (line %d)", s.line)
+		}
+		rows = append(rows, []tableCell{
+			{text: s.name},
+			{text: fmt.Sprintf("%s %d", s.key.TypeName(), s.key.Bits())},
+			{text: s.key.FingerprintSHA256()},
+			status,
+		})
+	}
+	writeTable(os.Stdout, []string{"host", "type", "fingerprint", "status"}, rows, useColor(*plain))
+
+	if *fingerprint != "" && !offered(scanned, *fingerprint) {
+		fatalf("%s offered no host key with fingerprint %s", args[0], *fingerprint)
+	}
+	for _, s := range scanned {
+		if s.status == hostKeyChanged {
+			fmt.Fprintf(os.Stderr, "Warning: the %s host key of %s differs from the one on line %d of %s and was not added; verify it and replace the entry with keyman known-hosts replace %s\n", s.key.TypeName(), s.name, s.line, path, s.host)
+		}
+	}
+
+	if len(added) > 0 && (*fingerprint != "" || confirmHostKeys(len(added), path, *yes)) {
+		if err := appendKnownHosts(path, added, hashNames); err != nil {
+			fatal(err)
+		}
+	}
+
+	if failed > 0 {
+		fatalf("Could not scan %d host(s)", failed)
+	}
+	if changed > 0 {
+		os.Exit(exitFindings)
+	}
+}
+
+// hostKeyTarget is where to fetch a host's keys from and what known_hosts
+// calls it.
+type hostKeyTarget struct {
+	address string
+	port    string
+	name    string
+	hash    bool
+}
+
+// resolveHostKeyTarget looks host up in the ssh config, as ssh would when
+// checking its key: the HostName and Port it connects to, the HostKeyAlias
+// it checks the key under and whether it hashes new known_hosts entries.
+// A port given overrides the config's.
+func resolveHostKeyTarget(host, port string) hostKeyTarget {
+	target := hostKeyTarget{address: host, port: port, name: host}
+	if resolved, err := resolveHost(host); err == nil {
+		target.address = orDefault(first(resolved["hostname"]), host)
+		if target.port == "" {
+			target.port = first(resolved["port"])
+		}
+		target.name = orDefault(first(resolved["hostkeyalias"]), target.address)
+		target.hash = first(resolved["hashknownhosts"]) == "yes"
+	}
+	target.name = keyman.KnownHostName(target.name, target.port)
+	return target
+}
+
+// keyscan fetches the host keys of address with ssh-keyscan.
+func keyscan(address, port, types string, timeout int) ([]*keyman.PublicKey, error) {
+	args := []string{"-T", strconv.Itoa(timeout)}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if types != "" {
+		args = append(args, "-t", types)
+	}
+	cmd := exec.Command(toolPath("ssh-keyscan"), append(args, "--", address)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ssh-keyscan: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var keys []*keyman.PublicKey
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := keyman.ParsePublicKey(strings.Join(fields[1:], " "))
+		if err == nil {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if last := lines[len(lines)-1]; last != "" && !strings.HasPrefix(last, "#") {
+			return nil, fmt.Errorf("%s", last)
+		}
+		return nil, fmt.Errorf("no host keys offered")
+	}
+	return keys, scanner.Err()
+}
+
+// checkHostKey compares a scanned key with the known_hosts entries for
+// name. With fingerprint set, other keys are skipped.
+func checkHostKey(known []keyman.KnownHost, name string, key *keyman.PublicKey, fingerprint string) scannedKey {
+	s := scannedKey{name: name, key: key, status: hostKeyNew}
+	for _, entry := range known {
+		if entry.Marker != "" || entry.Key.Algorithm != key.Algorithm || !entry.Matches(name) {
+			continue
+		}
+		s.line = entry.Line
+		if bytes.Equal(entry.Key.Blob, key.Blob) {
+			s.status = hostKeyKnown
+			return s
+		}
+		s.status = hostKeyChanged
+	}
+	if s.status == hostKeyNew && fingerprint != "" && !keyman.FingerprintMatches(key, fingerprint) {
+		s.status = hostKeySkipped
+	}
+	return s
+}
+
+// offered reports whether any of the scanned keys has fingerprint.
+func offered(scanned []scannedKey, fingerprint string) bool {
+	for _, s := range scanned {
+		if keyman.FingerprintMatches(s.key, fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmHostKeys asks whether the fingerprints shown are the right ones,
+// unless yes is set or this is a dry run.
+func confirmHostKeys(count int, path string, yes bool) bool {
+	if yes || dryRun {
+		return true
+	}
+	fmt.Printf("Check the fingerprints above against the servers'. Add %d key(s) to %s? [y/N]: ", count, path)
+	answer, _ := stdin.ReadString('\n')
+	return strings.EqualFold(strings.TrimSpace(answer), "y")
+}
+
+// appendKnownHosts adds the keys to the known_hosts file at path, creating
+// it if needed.
+func appendKnownHosts(path string, keys []scannedKey, hash bool) error {
+	var lines []string
+	for _, s := range keys {
+		line, err := keyman.KnownHostLine([]string{s.name}, s.key, hash)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+
+	if dryRun {
+		fmt.Printf("Would add to %s:\n%s\n", path, strings.Join(lines, "\n"))
+		return nil
+	}
+
+	existing, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := writeLines(path, append(existing, lines...)); err != nil {
+		return err
+	}
+	for _, s := range keys {
+		journal("known-hosts add", s.name, "", s.key.FingerprintSHA256())
+	}
+	recordHostKeys(keys)
+	fmt.Printf("Added %d host key(s) to %s\n", len(keys), path)
+	return nil
+}
+
+// checkHostKeys compares the keys in known_hosts with the fingerprints
+// keyman recorded for them, recording those of hosts it has not seen
+// before, unless it is auditing another user's files for --all-users.
+func checkHostKeys(sshConfig *keyman.Config) ([]keyman.Finding, error) {
+	path, err := getKnownHostsPath()
+	if err != nil {
+		return nil, err
+	}
+	known, err := keyman.LoadKnownHosts(path)
+	if err != nil || len(known) == 0 {
+		return nil, err
+	}
+	metadata, err := loadMetadata()
+	if err != nil {
+		return nil, err
+	}
+	findings, recorded := metadata.CheckHostKeys(known, hostKeyNames(sshConfig), time.Now())
+	if recorded && !dryRun && metadataHome == "" {
+		if err := metadata.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return findings, nil
+}
+
+// hostKeyNames returns the names known_hosts may hold the hosts of the ssh
+// config under, to match hashed entries against.
+func hostKeyNames(sshConfig *keyman.Config) []string {
+	var names []string
+	for _, block := range sshConfig.AllBlocks() {
+		if block.Match {
+			continue
+		}
+		candidates := append([]string{block.Option("HostKeyAlias"), block.Option("HostName")}, block.Patterns...)
+		for _, candidate := range candidates {
+			if candidate == "" || strings.ContainsAny(candidate, "*?!%") {
+				continue
+			}
+			if name := keyman.KnownHostName(strings.ToLower(candidate), block.Option("Port")); !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// replaceKnownHost walks through accepting a host's new key after it
+// changed: it shows the keys known_hosts has, the ones recorded and the
+// ones the server offers, and only replaces the known_hosts entry once
+// the fingerprint of the new key, checked with the server's administrator
+// or on its console, is given back.
+func replaceKnownHost(args []string) {
+	flags := flag.NewFlagSet("known-hosts replace", flag.ExitOnError)
+	port := flags.String("port", "", "port to connect to (default from the ssh config, or 22)")
+	fingerprint := flags.String("fingerprint", "", "the verified fingerprint of the new key, instead of entering it when asked")
+	timeout := flags.Int("timeout", 5, "seconds to wait for the host")
+	file := flags.String("file", "", "known_hosts file to update (default ~/.ssh/known_hosts)")
+	plain := flags.Bool("plain", false, "print without color")
+	args = parseFlags(flags, args)
+	if len(args) != 1 {
+		fatalUsage("Usage: keyman known-hosts replace [--port p] [--fingerprint f] [--timeout s] [--file path] <host>")
+	}
+	target := resolveHostKeyTarget(args[0], *port)
+
+	path := *file
+	if path == "" {
+		var err error
+		if path, err = getKnownHostsPath(); err != nil {
+			fatal(err)
+		}
+	}
+	known, err := keyman.LoadKnownHosts(path)
+	if err != nil {
+		fatal(err)
+	}
+	metadata, err := loadMetadata()
+	if err != nil {
+		fatal(err)
+	}
+	keys, err := keyscan(target.address, target.port, "", *timeout)
+	if err != nil {
+		fatalf("Scanning %s: %v", target.address, err)
+	}
+
+	// A key needs replacing if it is not the one known_hosts has or not the
+	// one recorded; keys of a type the host had none of are left to scan.
+	var rows [][]tableCell
+	var changed []*keyman.PublicKey
+	for _, key := range keys {
+		s := checkHostKey(known, target.name, key, "")
+		knownFingerprint := knownHostFingerprint(known, target.name, key.Algorithm)
+		recordedFingerprint := ""
+		if record := metadata.RecordedHostKey(target.name, key.Algorithm); record != nil {
+			recordedFingerprint = record.Fingerprint
+		}
+		status := tableCell{text: "unchanged", color: colorGreen}
+		switch {
+		case s.status == hostKeyChanged || recordedFingerprint != "" && recordedFingerprint != key.FingerprintSHA256():
+			status = tableCell{text: "changed", color: colorRed}
+			changed = append(changed, key)
+		case s.status == hostKeyNew && recordedFingerprint == "":
+			status = tableCell{text: "not known"}
+		}
+		rows = append(rows, []tableCell{
+			{text: key.TypeName()},
+			{text: orDefault(knownFingerprint, "-")},
+			{text: orDefault(recordedFingerprint, "-")},
+			{text: key.FingerprintSHA256()},
+			status,
+		})
+	}
+	writeTable(os.Stdout, []string{"type", "known_hosts", "recorded", "server", "status"}, rows, useColor(*plain))
+
+	if len(changed) == 0 {
+		fmt.Printf("The host keys %s offers match known_hosts and the recorded fingerprints, nothing to replace\n", target.name)
+		return
+	}
+
+	given := *fingerprint
+	if given == "" {
+		fmt.Println("\nA changed host key means the server was reinstalled or its keys were rotated, or that someone is")
+		fmt.Println("intercepting the connection. Check the new fingerprint with the server's administrator, or on its")
+		fmt.Println("console with ssh-keygen -lf /etc/ssh/ssh_host_<type>_key.pub, before accepting it.")
+		fmt.Print("Fingerprint you verified (empty to cancel): ")
+		answer, _ := stdin.ReadString('\n')
+		if given = strings.TrimSpace(answer); given == "" {
+			fmt.Println("Nothing replaced")
+			return
+		}
+	}
+	var key *keyman.PublicKey
+	for _, candidate := range changed {
+		if keyman.FingerprintMatches(candidate, given) {
+			key = candidate
+		}
+	}
+	if key == nil {
+		fatalf("%s is not the fingerprint of a changed host key of %s; nothing was replaced", given, target.name)
+	}
+
+	oldFingerprint := knownHostFingerprint(known, target.name, key.Algorithm)
+	if record := metadata.RecordedHostKey(target.name, key.Algorithm); oldFingerprint == key.FingerprintSHA256() && record != nil {
+		oldFingerprint = record.Fingerprint
+	}
+	if dryRun {
+		fmt.Printf("Would replace the %s host key of %s in %s with %s\n", key.TypeName(), target.name, path, key.FingerprintSHA256())
+		return
+	}
+
+	if checkHostKey(known, target.name, key, "").status != hostKeyKnown {
+		if err := replaceKnownHostKey(path, target, key); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Replaced the %s host key of %s in %s, keeping the old file as %s.old\n", key.TypeName(), target.name, path, path)
+	} else {
+		fmt.Printf("known_hosts already has this %s key of %s\n", key.TypeName(), target.name)
+	}
+	metadata.RecordHostKey(target.name, key, time.Now())
+	if err := metadata.Save(); err != nil {
+		fatal(err)
+	}
+	journal("known-hosts replace", target.name, oldFingerprint, key.FingerprintSHA256())
+
+	if len(changed) > 1 {
+		fmt.Printf("%d other host key(s) of %s changed too; verify and replace each with its own fingerprint\n", len(changed)-1, target.name)
+	}
+}
+
+// knownHostFingerprint returns the fingerprint of the first key of
+// algorithm known_hosts has for name, or "" if it has none.
+func knownHostFingerprint(known []keyman.KnownHost, name, algorithm string) string {
+	for _, entry := range known {
+		if entry.Marker == "" && entry.Key.Algorithm == algorithm && entry.Matches(name) {
+			return entry.Key.FingerprintSHA256()
+		}
+	}
+	return ""
+}
+
+// replaceKnownHostKey removes the known_hosts entries for the target's
+// keys of key's type and adds key, hashed if the old entries or the ssh
+// config hash names. The file as it was is kept with an .old suffix, as
+// ssh-keygen -R does.
+func replaceKnownHostKey(path string, target hostKeyTarget, key *keyman.PublicKey) error {
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	hash := target.hash
+	for _, entry := range keyman.ParseKnownHosts([]byte(strings.Join(lines, "\n"))) {
+		if entry.Key.Algorithm == key.Algorithm && entry.Matches(target.name) && entry.Hashed() {
+			hash = true
+		}
+	}
+	kept, _ := keyman.RemoveKnownHost(lines, target.name, key.Algorithm)
+	line, err := keyman.KnownHostLine([]string{target.name}, key, hash)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := writeLines(path+".old", lines); err != nil {
+		return err
+	}
+	return writeLines(path, append(kept, line))
+}
+
+// recordHostKeys records the fingerprints of keys just added to
+// known_hosts, so audit notices if they change. Failing to record them is
+// only reported.
+func recordHostKeys(keys []scannedKey) {
+	metadata, err := loadMetadata()
+	if err == nil {
+		now := time.Now()
+		for _, s := range keys {
+			metadata.RecordHostKey(s.name, s.key, now)
+		}
+		err = metadata.Save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not record the host key fingerprints: %v\n", err)
+	}
+}
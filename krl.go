@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// krlFile is the default KRL, kept next to the CA so sshd can be pointed
+// at it with RevokedKeys.
+const krlFile = "revoked_keys"
+
+func krl(args []string) {
+	flags := flag.NewFlagSet("krl", flag.ExitOnError)
+	file := flags.String("file", "", "KRL file to manage (default ~/.config/keyman/ca/revoked_keys)")
+	serial := flags.String("serial", "", "revoke certificates issued by the keyman CA by serial, e.g. 5 or 5-9")
+	keyID := flags.String("id", "", "revoke certificates issued by the keyman CA by key ID")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman krl add|list|check")
+	}
+
+	path := *file
+	if path == "" {
+		caDir, err := getCADir()
+		if err != nil {
+			fatal(err)
+		}
+		path = filepath.Join(caDir, krlFile)
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) < 2 && *serial == "" && *keyID == "" {
+			fatalUsage("Usage: keyman krl add [--serial n] [--id id] [key|pubfile|fingerprint]...")
+		}
+		addRevocations(path, args[1:], *serial, *keyID)
+	case "list":
+		err := runCommand("ssh-keygen", "-Q", "-l", "-f", path)
+		if err != nil {
+			fatal(err)
+		}
+	case "check":
+		if len(args) < 2 {
+			fatalUsage("Usage: keyman krl check <key|pubfile|fingerprint>")
+		}
+		checkRevoked(path, args[1])
+	default:
+		fatalUsage("Unknown krl command")
+	}
+}
+
+// addRevocations writes a KRL specification for the given keys, serials
+// and key IDs and merges it into the KRL, creating it if needed.
+func addRevocations(path string, keys []string, serial, keyID string) {
+	var spec []string
+	var fingerprints []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, "SHA256:") {
+			spec = append(spec, "hash: "+key)
+			fingerprints = append(fingerprints, key)
+			continue
+		}
+
+		pubKey, err := resolvePublicKey(key)
+		if err != nil {
+			fatal(err)
+		}
+		pub, err := keyman.ParsePublicKey(pubKey)
+		if err != nil {
+			fatal(err)
+		}
+		spec = append(spec, "key: "+pubKey)
+		fingerprints = append(fingerprints, pub.FingerprintSHA256())
+	}
+
+	sshArgs := []string{"-q", "-k", "-f", path}
+	if serial != "" || keyID != "" {
+		caDir, err := getCADir()
+		if err != nil {
+			fatal(err)
+		}
+		sshArgs = append(sshArgs, "-s", filepath.Join(caDir, caKeyFile+keyFileExt))
+		if serial != "" {
+			spec = append(spec, "serial: "+serial)
+		}
+		if keyID != "" {
+			spec = append(spec, "id: "+keyID)
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		sshArgs = append(sshArgs, "-u")
+	}
+
+	specFile, err := os.CreateTemp("", "keyman-krl-*")
+	if err != nil {
+		fatal(err)
+	}
+	defer os.Remove(specFile.Name())
+	_, err = specFile.WriteString(strings.Join(spec, "\n") + "\n")
+	if closeErr := specFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		fatal(err)
+	}
+	err = runCommand("ssh-keygen", append(sshArgs, specFile.Name())...)
+	if err != nil {
+		fatal(err)
+	}
+
+	marked, err := markRevoked(fingerprints, serial, keyID)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("revoke", path, "", strings.Join(spec, "; "))
+	fmt.Printf("Added %d revocation(s) to %s\n", len(spec), path)
+	if marked > 0 {
+		fmt.Printf("Marked %d certificate(s) revoked in the CA index\n", marked)
+	}
+}
+
+// markRevoked flags matching certificates in the CA index as revoked.
+func markRevoked(fingerprints []string, serial, keyID string) (int, error) {
+	index, err := loadCAIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	low, high, hasSerial := serialRange(serial)
+	now := time.Now()
+	marked := 0
+	for _, entry := range index.Certificates {
+		match := containsString(fingerprints, entry.Fingerprint) ||
+			(hasSerial && entry.Serial >= low && entry.Serial <= high) ||
+			(keyID != "" && entry.KeyID == keyID)
+		if match && entry.Revoked == nil {
+			entry.Revoked = &now
+			marked++
+		}
+	}
+
+	if marked == 0 {
+		return 0, nil
+	}
+	return marked, index.Save()
+}
+
+// serialRange parses a KRL serial specification, a number or low-high.
+func serialRange(serial string) (uint64, uint64, bool) {
+	lowText, highText, isRange := strings.Cut(serial, "-")
+	low, err := strconv.ParseUint(lowText, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !isRange {
+		return low, low, true
+	}
+	high, err := strconv.ParseUint(highText, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return low, high, true
+}
+
+// checkRevoked reports whether a key is in the KRL and exits non-zero if it
+// is. A fingerprint of a local key is checked as that key, as ssh-keygen
+// does, since a key revoked by its blob is not listed by its hash; only
+// other fingerprints are looked up in the KRL's listing.
+func checkRevoked(path, key string) {
+	pubPath := ""
+	if strings.HasPrefix(key, "SHA256:") {
+		pubPath = localKeyWithFingerprint(key)
+	}
+	if strings.HasPrefix(key, "SHA256:") && pubPath == "" {
+		output, err := exec.Command(toolPath("ssh-keygen"), "-Q", "-l", "-f", path).Output()
+		if err != nil {
+			fatal(err)
+		}
+		if krlListsHash(string(output), key) {
+			fmt.Printf("%s: REVOKED\n", key)
+			os.Exit(exitFindings)
+		}
+		fmt.Printf("%s: ok\n", key)
+		return
+	}
+
+	if pubPath == "" {
+		pubPath = key
+	}
+	if _, err := os.Stat(pubPath); err != nil || !strings.HasSuffix(pubPath, keyFileExt) {
+		keyPath, err := getFullKeyPath(strings.TrimSuffix(key, keyFileExt))
+		if err != nil {
+			fatal(err)
+		}
+		pubPath = keyPath + keyFileExt
+	}
+
+	// ssh-keygen -Q exits 1 when a key is revoked, after printing which.
+	err := runCommand("ssh-keygen", "-Q", "-f", path, pubPath)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		os.Exit(exitFindings)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// krlListsHash looks for a SHA256 fingerprint in ssh-keygen -Q -l output,
+// which prints revoked hashes either as a fingerprint or in hex, and keys
+// revoked by their blob as the key itself.
+func krlListsHash(listing, fingerprint string) bool {
+	hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fingerprint, "SHA256:"))
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2 && fields[0] == "hash:":
+			if fields[1] == fingerprint || strings.EqualFold(fields[1], "SHA256:"+hex.EncodeToString(hash)) {
+				return true
+			}
+		case len(fields) >= 3 && fields[0] == "key:":
+			pub, err := keyman.ParsePublicKey(fields[1] + " " + fields[2])
+			if err == nil && pub.FingerprintSHA256() == fingerprint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// localKeyWithFingerprint returns the public key file of the local key with
+// a SHA256 fingerprint, or "" if there is none.
+func localKeyWithFingerprint(fingerprint string) string {
+	keys, err := getKeys()
+	if err != nil {
+		fatal(err)
+	}
+	for _, key := range keys {
+		if key.Token == "" && !key.MissingPublic && key.Public != nil && key.Public.FingerprintSHA256() == fingerprint {
+			return key.Path
+		}
+	}
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
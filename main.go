@@ -2,190 +2,777 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
-	"os/user"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
 )
 
 const (
-	sshDir      = ".ssh"
-	configFile  = "config"
-	keyFileExt  = ".pub"
-	commentLine = "Comment: "
+	sshDir     = ".ssh"
+	configFile = "config"
+	keyFileExt = keyman.PublicKeyExt
+
+	certFileSuffix = keyman.CertificateSuffix
 )
 
 func main() {
+	if runAskpass() {
+		return
+	}
+	os.Args = append(os.Args[:1], parseGlobalFlags(os.Args[1:])...)
+
+	var err error
+	settings, err = loadSettings()
+	if err != nil {
+		fatal(err)
+	}
 	if len(os.Args) < 2 {
 		printHelp()
 		return
 	}
+	if allUsers && os.Args[1] != "audit" {
+		fatalUsage("--all-users only works with audit")
+	}
+	if command, ok := dryRunCommand(os.Args[1:]); dryRun && !ok {
+		fatalUsagef("--dry-run does not work with keyman %s, which would make its changes anyway", command)
+	}
 
 	switch os.Args[1] {
 	case "list":
-		listKeys()
+		listKeys(os.Args[2:])
 	case "config":
-		showConfig()
+		showConfig(os.Args[2:])
 	case "unused":
-		listUnusedKeys()
+		listUnusedKeys(os.Args[2:])
 	case "map":
-		if len(os.Args) < 4 {
-			log.Fatal("Usage: sshkeymanager map <key> <host>")
-		}
-		mapKey(os.Args[2], os.Args[3])
+		mapKeyCommand(os.Args[2:])
 	case "unmap":
-		if len(os.Args) < 4 {
-			log.Fatal("Usage: sshkeymanager unmap <key> <host>")
-		}
-		unmapKey(os.Args[2], os.Args[3])
+		unmapKeyCommand(os.Args[2:])
 	case "generate":
-		generateKey()
+		generateKey(os.Args[2:])
 	case "delete":
+		deleteKeyCommand(os.Args[2:])
+	case "rotate":
+		rotateKey(os.Args[2:])
+	case "copy":
+		copyKey(os.Args[2:])
+	case "qr":
+		showQR(os.Args[2:])
+	case "ca":
+		ca(os.Args[2:])
+	case "krl":
+		krl(os.Args[2:])
+	case "sign":
+		signFile(os.Args[2:])
+	case "verify":
+		verifyFile(os.Args[2:])
+	case "git-signing":
+		gitSigning(os.Args[2:])
+	case "signers":
+		signers(os.Args[2:])
+	case "import":
+		importKeys(os.Args[2:])
+	case "apply":
+		apply(os.Args[2:])
+	case "history":
+		history()
+	case "undo":
+		undo(os.Args[2:])
+	case "log":
+		showLog(os.Args[2:])
+	case "profiles":
+		listProfiles()
+	case "settings":
+		showSettings()
+	case "convert":
+		convertKey(os.Args[2:])
+	case "pubkey":
+		writePublicKeys(os.Args[2:])
+	case "usage":
+		keyUsage(os.Args[2:])
+	case "ssh":
+		connect(os.Args[2:])
+	case "defaults":
+		defaults(os.Args[2:])
+	case "metrics":
+		metrics(os.Args[2:])
+	case "daemon":
+		daemon(os.Args[2:])
+	case "serve":
+		serve(os.Args[2:])
+	case "completion":
+		completion(os.Args[2:])
+	case "__complete":
+		complete(os.Args[2:])
+	case "show":
+		showKey(os.Args[2:])
+	case "hosts":
+		listHostViews(os.Args[2:])
+	case "graph":
+		graph(os.Args[2:])
+	case "forward":
+		forward(os.Args[2:])
+	case "mux":
+		mux(os.Args[2:])
+	case "fleet":
+		fleet(os.Args[2:])
+	case "known-hosts":
+		knownHosts(os.Args[2:])
+	case "sshfp":
+		sshfp(os.Args[2:])
+	case "server":
+		server(os.Args[2:])
+	case "scan":
+		scanStrayKeys(os.Args[2:])
+	case "tokens":
+		listTokens(os.Args[2:])
+	case "agent":
+		agent(os.Args[2:])
+	case "age":
+		ageCommand(os.Args[2:])
+	case "oslogin":
+		oslogin(os.Args[2:])
+	case "plugins":
+		listPlugins(os.Args[2:])
+	case "copy-id":
+		copyID(os.Args[2:])
+	case "fingerprint":
 		if len(os.Args) < 3 {
-			log.Fatal("Usage: sshkeymanager delete <key>")
+			fatalUsage("Usage: keyman fingerprint <key>")
 		}
-		deleteKey(os.Args[2])
+		showFingerprint(os.Args[2])
+	case "find":
+		if len(os.Args) < 3 {
+			fatalUsage("Usage: keyman find <fingerprint-or-pubkey>")
+		}
+		findKey(strings.Join(os.Args[2:], " "))
+	case "github", "gitlab", "gitea", "forgejo", "bitbucket":
+		forgeCommand(os.Args[1], os.Args[2:])
+	case "digitalocean":
+		digitalocean(os.Args[2:])
+	case "hetzner":
+		hetzner(os.Args[2:])
+	case "authorized":
+		authorized(os.Args[2:])
+	case "backup":
+		backup(os.Args[2:])
+	case "restore":
+		restore(os.Args[2:])
+	case "sync":
+		syncCommand(os.Args[2:])
+	case "passphrase":
+		changePassphrase(os.Args[2:])
+	case "fix-perms":
+		fixPerms(os.Args[2:])
+	case "host":
+		host(os.Args[2:])
+	case "which":
+		if len(os.Args) < 3 {
+			fatalUsage("Usage: keyman which <host>")
+		}
+		which(os.Args[2])
+	case "tag":
+		tagKey(os.Args[2:])
+	case "note":
+		noteKey(os.Args[2:])
+	case "expire":
+		expireKey(os.Args[2:])
+	case "rename":
+		if len(os.Args) < 4 {
+			fatalUsage("Usage: keyman rename <old> <new>")
+		}
+		renameKey(os.Args[2], os.Args[3])
 	case "audit":
-		audit()
+		if allUsers {
+			auditAllUsers(os.Args[2:])
+		} else {
+			audit(os.Args[2:])
+		}
 	case "help":
 		printHelp()
 	default:
-		log.Fatal("Unknown command")
+		if !runPluginCommand(os.Args[1], os.Args[2:]) {
+			fatalUsage("Unknown command")
+		}
 	}
 }
 
 func printHelp() {
 	fmt.Println("Available commands:")
-	fmt.Println(" - list:\n\tLists all SSH keys found in the ~/.ssh directory, along with their creation dates and comments if available.")
-	fmt.Println("\n - config:\n\tShows a summary of the SSH configuration from ~/.ssh/config including mappings of keys to hosts.")
-	fmt.Println("\n - unused:\n\tIdentifies and lists SSH keys that are not mapped to any hosts in the SSH configuration.")
-	fmt.Println("\n - map <key> <host>:\n\tMaps an SSH key to a host in the SSH configuration.")
-	fmt.Println("\n - unmap <key> <host>:\n\tRemoves a mapping of an SSH key from a host in the SSH configuration.")
-	fmt.Println("\n - generate:\n\tGenerates a new SSH key using a guided interactive process.")
-	fmt.Println("\n - delete <key>:\n\tDeletes an SSH key and removes it from any mappings in the SSH configuration.")
-	fmt.Println("\n - audit:\n\tPerforms an audit of SSH keys and configuration, providing information like key age, unused keys, keys mapped to multiple hosts, etc.")
+	fmt.Println(" - list [--md5] [--json] [--expired-only] [--type t] [--older-than age] [--unused] [--tag t] [--host pattern] [--tokens] [--long] [--plain] [--sort col] [--columns c,c] [--format tmpl]:\n\tLists all SSH keys found in the ~/.ssh directory as a table with their type, fingerprint, creation date, last use,\n\tstatus and comment; --md5 adds MD5 fingerprints.\n\tStatus is colored: ok in green, unused, incomplete or expiring in yellow, weak or expired in red. --plain, NO_COLOR or color = \"never\" turn color off.\n\t--sort orders by name, type, age, created, last-used, status or expires (prefix - to reverse); --columns picks from name, type, fingerprint,\n\tmd5, created, modified, age, last-used, status, comment, tags, owner, expires and cert, which shows a certificate's\n\tprincipals, end of validity and CA. --long prints every detail of each key instead.\n\t--format prints each key through a Go template with the list --json fields plus Hosts, Status, InUse, Age, LastUsed and Findings,\n\tsuch as '{{.Name}} {{.Fingerprint}} {{join .Hosts \",\"}}'. join, upper, lower, date and days are available.\n\t--type, --older-than (such as 365d), --unused, --tag and --host (a pattern such as 'prod-*' matched against mapped hosts)\n\tnarrow the keys listed and combine, as in list --type rsa --older-than 1y --host 'prod-*'.\n\t--tokens adds the keys on PKCS#11 tokens and FIDO security keys that tokens lists, named pkcs11:<label> and fido:<application>.")
+	fmt.Println("\n - config [--mappings]:\n\tShows a summary of the SSH configuration from ~/.ssh/config including mappings of keys to hosts.\n\t--mappings lists each host with its keys in the order ssh tries them.")
+	fmt.Println("\n - config lint [--json] [--plain]:\n\tChecks the SSH config and the files it includes for unknown or misspelled options, options without a value,\n\tIdentityFiles missing on disk, hosts in more than one Host block, options an earlier Host * or Match all block\n\talready sets so ssh never uses them, and deprecated options, each with its file, line and severity.\n\tExits non-zero on warnings or errors.")
+	fmt.Println("\n - config fmt [--check] [--indent n]:\n\tNormalizes the layout of the SSH config and the files it includes without changing what it means: options are\n\tspelled as the manual spells them, indented by --indent spaces (default 4) inside blocks and written as Keyword value,\n\tand blocks are separated by one blank line with their comments kept above them. --check lists the files that need\n\tformatting and exits non-zero instead. Use --diff or --dry-run to see the changes first.")
+	fmt.Println("\n - config edit [--force]:\n\tOpens a copy of the SSH config in $VISUAL or $EDITOR and installs it once config lint finds no errors in it,\n\tprinting any warnings. With errors it offers to edit again, and otherwise leaves the config alone and keeps the\n\tedited copy. --force installs it regardless. The previous config is kept for keyman undo.")
+	fmt.Println("\n - config dedupe [--yes]:\n\tFinds hosts with more than one Host block and shows each option of theirs the way ssh resolves it, the first\n\tvalue winning, then offers to merge the blocks into the first. Options ssh ignores are dropped, and hosts whose merge\n\tcould change what ssh does, such as a Host * in between setting the same option, are left to merge by hand.")
+	fmt.Println("\n - config split:\n\tMoves each Host block that names its hosts outright, with the comments above it, into its own file under\n\t~/.ssh/config.d and adds an Include config.d/*.conf line in its place. Host *, wildcard and Match blocks stay, since\n\ttheir position decides which options win. Afterwards map, host add and the like put new hosts in config.d too,\n\tand edit existing ones in the file they are in.")
+	fmt.Println("\n - config diff [--json] [--plain] [file|snapshot] [file|snapshot]:\n\tShows which hosts were added or removed and which options changed between two versions of the SSH config,\n\tignoring order, formatting and which file a host is in. Each side is a config file, such as one in a dotfiles repo,\n\tor a snapshot ID from keyman history. The current config is the second side unless two are given, and the latest\n\tsnapshot the first if none is. Exits non-zero when they differ.")
+	fmt.Println("\n - unused [--long] [--plain] [--sort col] [--columns c,c] [--format tmpl]:\n\tIdentifies and lists SSH keys that are not mapped to any hosts in the SSH configuration, in the same table as list.")
+	fmt.Println("\n - map [--add] [--hostname h] [--user u] [--port p] [--prompt] [--identities-only] [--add-keys-to-agent] [--use-keychain] [--security-key-provider lib] <key> <host>:\n\tMaps an SSH key to a host in the SSH configuration. --add maps another key to a host that already has one, tried after the existing keys.\n\tA Host block is created for hosts not in the config yet, with the given options, or asking for them with --prompt.\n\t--identities-only, --add-keys-to-agent and --use-keychain (macOS) set those options to yes, defaulting to the [map] section of config.toml.\n\tmap --hosts selector <key> maps the key to every host selected by tag:<tag> or a pattern such as '*.prod.example.com',\n\tseveral comma separated, showing the whole change and asking once before saving it unless --yes is given.\n\tmap --pkcs11 lib <host> sets the host's PKCS11Provider so ssh offers the keys on that library's tokens, and\n\t--security-key-provider sets SecurityKeyProvider for FIDO keys reached through a middleware library.")
+	fmt.Println("\n - tokens [--provider lib,lib] [--resident] [--json] [--plain]:\n\tLists keys that live only on hardware: those on the tokens of each PKCS#11 library named by --provider or a\n\tPKCS11Provider option, read with ssh-keygen -D, and FIDO security keys in ssh-agent, such as resident keys loaded\n\twith ssh-add -K. --resident reads the resident keys of attached FIDO tokens too, asking for the PIN. Each is shown\n\twith the hosts that use it; list --tokens shows them in the key table instead.")
+	fmt.Println("\n - agent [list] [--json] [--plain] | map [--agent socket] [--name n] [--add] <fingerprint|comment> <host>:\n\tLists the agent SSH_AUTH_SOCK points at and each named by an IdentityAgent option, telling 1Password, Secretive,\n\tBitwarden, gpg-agent and GNOME Keyring apart from ssh-agent, with the keys each holds and the key in the ssh\n\tdirectory each matches. map saves the public key of an agent-only key to the ssh directory and maps it to the host\n\twith IdentitiesOnly, so ssh asks the agent for that key, adding IdentityAgent for a third-party agent.")
+	fmt.Println("\n - unmap [--hosts selector] [--yes] <key> <host>:\n\tRemoves a mapping of an SSH key from a host in the SSH configuration. A bare key name matches however the config refers to the key.\n\tWith --hosts, removes it from every host selected, as for map --hosts, in one change.")
+	fmt.Println("\n   In a terminal, map, unmap, delete and copy show a picker for a key or host left out: type to narrow it, arrows to move, Enter to choose.")
+	fmt.Println("\n - generate [--type t] [--name n] [--comment c] [--bits b] [--passphrase-file f] [--resident] [--verify-required] [--application a]:\n\tGenerates a new SSH key using a guided interactive process, or unattended when any flag is given.\n\tThe ed25519-sk and ecdsa-sk types are backed by a FIDO2 security key; --resident stores the key on the device.")
+	fmt.Println("\n - delete [--force] [--archive] [--shred] [--agent] [--remote] <key>:\n\tDeletes an SSH key and removes it from any mappings in the SSH configuration, after asking for confirmation.\n\t--archive keeps an encrypted copy that keyman restore can bring back, --shred overwrites the private key first.\n\t--agent unloads the key from ssh-agent, --remote removes it from authorized_keys on the mapped hosts.")
+	fmt.Println("\n - copy-id [--alias name] [-i identity] <key> <user@host>:\n\tAppends a public key to authorized_keys on a remote host, optionally creating a Host block for it.")
+	fmt.Println("\n - rotate [--name n] [--passphrase-file f] [--keep-old] <key>:\n\tReplaces a key with a new one on every host it is mapped to, verifies the new key works, then retires the old one.")
+	fmt.Println("\n - fingerprint <key>:\n\tShows the SHA256 and MD5 fingerprints, type, size and randomart of a key.")
+	fmt.Println("\n - find <fingerprint-or-pubkey>:\n\tFinds the local key matching a SHA256 or MD5 fingerprint or a pasted public key line.")
+	fmt.Println("\n - github push [--title t] <key> | list | audit:\n\tUploads a public key to GitHub, lists the keys on the account, or compares them with local keys. Reads the token from GITHUB_TOKEN or github.token in config.toml.")
+	fmt.Println("\n - gitlab [--url u] push [--title t] [--expires YYYY-MM-DD] <key> | list | audit:\n\tThe same as github, for gitlab.com or a self-hosted instance. Reads the token from GITLAB_TOKEN or gitlab.token in config.toml.")
+	fmt.Println("\n - gitea|forgejo [--url u] push [--title t] <key> | list | audit:\n\tThe same as github, for a Gitea or Forgejo instance, such as codeberg.org. Reads the URL from GITEA_URL or gitea.url\n\tand the token from GITEA_TOKEN or gitea.token in config.toml.")
+	fmt.Println("\n - bitbucket push [--title t] <key> | list | audit:\n\tThe same as github, for Bitbucket Cloud. Reads the username and app password from BITBUCKET_USERNAME and\n\tBITBUCKET_TOKEN or bitbucket.username and bitbucket.token in config.toml.")
+	fmt.Println("\n - digitalocean|hetzner push [--name n] <key> | list | audit | prune [--yes]:\n\tUploads a public key to a DigitalOcean or Hetzner Cloud account, lists the keys on it, compares them with the\n\tlocal keys, or deletes the keys that match no local key. Set DIGITALOCEAN_TOKEN or HCLOUD_TOKEN, or the token in\n\tthe [digitalocean] or [hetzner] section of config.toml.")
+	fmt.Println("\n - plugins [--json] [--plain]:\n\tLists the installed plugins: keyman-<name> programs on PATH or in ~/.config/keyman/plugins that speak JSON over\n\tstdin and stdout. A plugin with the keys capability becomes keyman <name> push|list|audit, like github; one with\n\tsecrets becomes a backup --backend; one with audit adds its checks to keyman audit once listed in the audit.plugins\n\tsetting.")
+	fmt.Println("\n - oslogin push [--ttl d] <key> | list [--json] [--plain] | remove <key|fingerprint> | prune [--unknown] [--yes]:\n\tManages the keys of the Google Cloud OS Login profile of the account gcloud is logged in as. push adds a key,\n\tremoved by OS Login after --ttl if given; list shows each key with the local key it matches and when it expires;\n\tprune removes the expired keys and, with --unknown, those not in the ssh directory.")
+	fmt.Println("\n - authorized [--file f] list | add [--options o] <key> | remove <fingerprint|comment>:\n\tManages ~/.ssh/authorized_keys, showing each entry's type, fingerprint, comment and restriction options.")
+	fmt.Println("\n - age recipient <key>... | identity [-o file] [--force] [--passphrase-file f] <key>:\n\tDerives the age X25519 recipient or identity of an Ed25519 key, so the one keypair serves tools such as sops\n\tthat take only age keys. identity prints the secret key unless -o writes it to a file\n\treadable only by you.")
+	fmt.Println("\n - age encrypt --key k,k [--recipient age1...] [--armor] [-o file] [file] | decrypt --key k | --identity file [-o file] [file]:\n\tEncrypts or decrypts a file, or stdin, with the age tool, using ssh keys as recipients and identities.")
+	fmt.Println("\n - backup [--passphrase-file f | --recipient age1... | --key k] <file> | --backend aws-sm|gcp-sm|vault|plugin [--name secret] [--vault-mount m]:\n\tArchives the ~/.ssh directory into a single file encrypted with a passphrase, an age recipient or, with --key, an ssh\n\tkey through age.\n\t--backend stores the encrypted archive as a secret in AWS Secrets Manager, GCP Secret Manager or Vault KV instead,\n\tnamed keyman-<hostname> unless --name is given, as a break-glass copy. Each backend is reached through its aws,\n\tgcloud or vault tool with the credentials already set up for it, and a new backup adds a version to the secret.\n\tThe name of a plugin with the secrets capability stores the backup through that plugin.")
+	fmt.Println("\n - restore [--passphrase-file f | --identity file | --key k] [--force] <file> | --backend aws-sm|gcp-sm|vault|plugin [--vault-mount m] <secret>:\n\tRestores a backup into ~/.ssh, asking before overwriting files that differ. --backend restores the latest version\n\tof a backup stored with backup --backend, by its secret name.")
+	fmt.Println("\n - sync init [<remote>] | push | pull [--ours | --theirs] | status:\n\tKeeps ~/.ssh/config and the files it includes in a git repo in ~/.config/keyman/sync, cloned from the remote if\n\tgiven, for sharing between machines. push commits the config when it changed and pushes it; pull merges in the repo's\n\tchanges host by host and option by option, and stops at hosts and options changed both here and elsewhere unless --ours\n\tor --theirs picks a side. init and push take --keys to sync the public keys too and --private to add the private keys,\n\tencrypted with a passphrase from --passphrase-file or the terminal; pull adds the keys this machine is missing. status\n\tshows what is not synced yet.")
+	fmt.Println("\n - passphrase [--remove] [--min-length n] <key>:\n\tAdds, changes or removes the passphrase on a private key.")
+	fmt.Println("\n - fix-perms [--yes]:\n\tChecks that ~/.ssh is 700, private keys are 600 and config files are not writable by others, and offers to fix them.")
+	fmt.Println("\n - host add|edit [--hostname h] [--user u] [--port p] [--identity key] [--proxy-jump j] <host> | rm <host> | list | tag [--remove] <host> <tag>...:\n\tCreates, edits, removes or lists Host blocks, prompting for options when no flags are given.\n\thost add --template name <host> [args] fills the new block from a [templates.<name>] table in config.toml, whose\n\tvalues may use {host} and the placeholders named in its args list, as in host add --template aws-bastion web 10.0.0.5.\n\thost tag tags hosts for --hosts tag:<tag> to select, and host edit --hosts selector [--yes] sets the flags' options on every\n\thost selected in one change.")
+	fmt.Println("\n - forward add [--force] -L|-R|-D spec <host> | list [--json] [--plain] [host...] | rm [--type t] <host> <[bind:]port>:\n\tManages the LocalForward, RemoteForward and DynamicForward lines of a Host block, so tunnels open with every ssh\n\tto the host. Specs are written as for ssh -L, -R and -D, such as -L 8080:localhost:80 or -D 1080. add refuses a port\n\tthe host already forwards, or that another host forwards locally unless --force is given; list marks such ports in\n\tred. rm removes the forwards on a port, narrowed to local, remote or dynamic ones with --type.")
+	fmt.Println("\n - fleet push|test [--hosts file | --fleet name | --inventory file [--limit pattern]] [--concurrency n] [--retries n] [--timeout s] [-i identity] [--json] [<key>]:\n\tpush installs a public key in authorized_keys on many hosts at once, read one per line from --hosts (- for stdin),\n\ttaken from a fleet in config.toml or from an Ansible inventory in INI or YAML, --limit picking groups or hosts from it\n\tas ansible --limit does. Hosts are done --concurrency at a time (default 10), trying each failed one --retries more\n\ttimes (default 2). push --remove old-key takes an old key off the hosts as well, logging in with the new key so that\n\thosts it does not work on keep the old one, or on its own revokes a key everywhere. test only logs in to each host,\n\twith the key if one is given. Both exit with 3 if any host failed.")
+	fmt.Println("\n - known-hosts scan [--port p] [--type t] [--hash] [--fingerprint f] [--yes] [--timeout s] [--file path] <host>...:\n\tFetches the host keys of hosts with ssh-keyscan, using the HostName, Port and HostKeyAlias from the ssh config,\n\tshows their fingerprints and adds the new ones to known_hosts once confirmed, hashed with --hash or HashKnownHosts yes.\n\t--fingerprint adds only the key with that fingerprint without asking, failing if the host does not offer it, so\n\tscripts can trust a host without StrictHostKeyChecking=no. Keys that differ from known ones are never added; they\n\tare reported and make keyman exit with 1.")
+	fmt.Println("\n - known-hosts replace [--port p] [--fingerprint f] [--timeout s] [--file path] <host>:\n\tWalks through accepting a host key that changed: shows the key known_hosts has, the one keyman recorded and the\n\tone the server offers, and replaces the known_hosts entry, keeping the old file as known_hosts.old, only once the\n\tnew key's fingerprint, checked with the server's administrator or console, is entered or given with --fingerprint.")
+	fmt.Println("\n - sshfp [--scan] [--port p] [--sha1] [--verify [--dns-server addr]] <host>:\n\tPrints SSHFP records for the zone of a host's HostName from its keys in known_hosts, or scanned with ssh-keyscan\n\twhen it has none or with --scan; --sha1 adds SHA-1 records. --verify looks up the published records instead and\n\tmarks those missing or matching no host key, exiting with 1 if any do, and warns if the answer was not DNSSEC validated.")
+	fmt.Println("\n - mux enable [--persist time] [--dir path] [host] | disable [host] | status [--json] [--plain] | close --all|<host>...:\n\tSets up connection sharing for a host, or for every host in Host * when none is given, so later ssh, scp and git\n\tcommands reuse one connection: ControlMaster auto, ControlPath in ~/.ssh/sockets (or --dir), which is kept at mode\n\t0700, and ControlPersist --persist (default 10m). disable removes them again. status lists the control sockets with\n\ttheir hosts and whether their master is live; close shuts down the shared connection to a host, or --all of them\n\talong with stale sockets.")
+	fmt.Println("\n - which <host>:\n\tShows which keys ssh would actually offer to a host, taking wildcards, Match blocks and defaults into account,\n\tand the jump hosts it goes through with ProxyJump or an ssh ProxyCommand, with the keys each of them offers.")
+	fmt.Println("\n - tag [--remove] <key> <tag>...:\n\tAdds or removes tags on a key in keyman's metadata store (~/.config/keyman/metadata.json).")
+	fmt.Println("\n - note [--owner o] <key> [description]:\n\tSets a key's description and owner.")
+	fmt.Println("\n - expire set <key> <YYYY-MM-DD> | clear <key> | list:\n\tRecords when a key expires. list and audit warn about keys expiring within 30 days.")
+	fmt.Println("\n - rename <old> <new>:\n\tRenames a key pair and rewrites every IdentityFile reference to it, including in Include files.")
+	fmt.Println("\n - copy [--osc52] <key>:\n\tCopies a public key to the clipboard, falling back to the terminal over ssh.")
+	fmt.Println("\n - qr [--invert] <key>:\n\tPrints a public key as a QR code in the terminal.")
+	fmt.Println("\n - ca init|sign|list:\n\tManages a local SSH certificate authority. sign --principals p [--validity v] [--host] <key|pubfile> issues a certificate and records it in the CA index.")
+	fmt.Println("\n - krl add|list|check [--file f]:\n\tMaintains an OpenSSH key revocation list. add takes keys, fingerprints, or --serial/--id for certificates from the keyman CA.")
+	fmt.Println("\n - sign --key <key> [--namespace n] <file>...:\n\tSigns files with an SSH key, writing <file>.sig.")
+	fmt.Println("\n - verify [--sig s] [--signer allowed_signers] [--identity i] [--namespace n] <file>:\n\tVerifies a file's SSH signature against an allowed_signers file.")
+	fmt.Println("\n - git-signing setup|status [--local] [--email e] [<key>]:\n\tConfigures git to sign commits and tags with an SSH key and trusts it in ~/.ssh/allowed_signers.")
+	fmt.Println("\n - signers list|add|remove [--file f]:\n\tManages an allowed_signers file. add [--namespaces n] [--valid-after d] [--valid-before d] <principal> <key|pubfile|url|github:user> trusts a signer's keys.")
+	fmt.Println("\n - import [--file f] [--options o] <github:user|gitlab:user|url|pubfile>...:\n\tAuthorizes someone's public keys for logging in to this machine, fetching them from GitHub, GitLab or a URL.")
+	fmt.Println("\n - apply <manifest.yaml>:\n\tCreates, changes and deletes keys and Host blocks to match a manifest, showing the plan and config diff first.")
+	fmt.Println("\n - history:\n\tLists the recent changes keyman made to the SSH configuration, newest first. A snapshot is saved under ~/.ssh/.keyman/backups before every write.")
+	fmt.Println("\n - undo [id]:\n\tRolls the SSH configuration back to before the latest change, or to before the change with the given id.")
+	fmt.Println("\n - log [--json]:\n\tShows the journal of changes keyman has made, with who made them and when. --json prints one object per line for export.")
+	fmt.Println("\n - profiles:\n\tLists the profiles defined in ~/.config/keyman/profiles.yaml and which one is active.")
+	fmt.Println("\n - settings:\n\tShows the defaults in effect from ~/.config/keyman/config.toml and the environment: key type, comment template, audit thresholds, output, tokens, hooks and fleets.\n\tThe [hooks] section runs shell commands before and after generate, map, delete and rotate, as pre_map or post_map\n\tand so on, with the key, hosts and paths as KEYMAN_* variables and as JSON on stdin. A failing pre hook stops the command.")
+	fmt.Println("\n - convert [--to openssh|ppk|pem|pkcs8|rfc4716] [--ppk-version 2|3] [--rounds n] [--passphrase-file f] [--no-passphrase] <key|file> [output]:\n\tConverts a private key between OpenSSH, PuTTY's PPK, PEM and PKCS#8, keeping its passphrase, or a public key between OpenSSH, RFC 4716, PEM and PKCS#8.\n\tA .ppk is imported into ~/.ssh, an OpenSSH key is exported to <key>.ppk, other private keys are rewritten in place and public keys are printed.\n\t--rounds sets the bcrypt KDF rounds when upgrading a legacy PEM key to the OpenSSH format.")
+	fmt.Println("\n - pubkey [--force] <key>... | --all:\n\tDerives the public key from a private key and writes its missing .pub file. list and audit point out private keys without one.")
+	fmt.Println("\n - usage [import [<log>...]]:\n\tShows when each key last logged in to a host. import reads ssh client logs, by default ~/.ssh/.keyman/ssh.log as written by\n\tssh -E ~/.ssh/.keyman/ssh.log -o LogLevel=DEBUG1, and keyman records the logins it makes itself.")
+	fmt.Println("\n - defaults [show|set <option> <value>|unset <option>]:\n\tManages the Host * block of options every host gets, such as ServerAliveInterval, AddKeysToAgent or HashKnownHosts.\n\tNew hosts are added above it, since ssh uses the first value it finds for an option.")
+	fmt.Println("\n - ssh <host> [ssh arguments...]:\n\tConnects to a host with ssh using only the key it is mapped to (-i with IdentitiesOnly=yes) and records the login for keyman usage\n\twhen the host has a single key.\n\tWarns when the mapped key is missing or not loaded in ssh-agent.")
+	fmt.Println("\n - metrics [--textfile file] [--listen addr] [--unused-after d]:\n\tPrints Prometheus gauges for key count, unused keys, oldest key age, keys without a passphrase, weak keys and expiring certificates.\n\t--textfile writes them for the node_exporter textfile collector, --listen serves them on /metrics.")
+	fmt.Println("\n - daemon [--interval d] [--poll d] [--webhook url] [--webhook-format f] [--no-notify] [--min-severity s] [--policy file] [--unused-after d]:\n\tWatches the ssh directory and audits it every --interval (default 1h), reporting new keys, permission drift and keys past the expiry or policy thresholds.\n\tKeys count as unused as audit counts them, after --unused-after (default 90d).\n\tEvents are printed, shown as desktop notifications and posted to --webhook or the notify.webhook setting.")
+	fmt.Println("\n - serve [--listen addr] [--token t] [--token-file f]:\n\tServes a web dashboard and REST API on 127.0.0.1:7070 by default. GET /api/keys, /api/hosts, /api/audit and /api/fleets return JSON;\n\tPOST /api/map, /api/unmap, /api/generate and /api/rotate make changes. Every API request needs the token (or\n\tKEYMAN_API_TOKEN) as a bearer token; without one a token is made up and printed with a link that gives it to the\n\tdashboard. Requests naming another host than the address served are refused.")
+	fmt.Println("\n - completion bash|zsh|fish:\n\tPrints a shell completion script. Commands, key names and host aliases are completed from the current ssh directory and config.\n\tLoad it with source <(keyman completion bash), source <(keyman completion zsh) or keyman completion fish | source.")
+	fmt.Println("\n - show [--json] <key>:\n\tShows everything known about one key: its files, type, algorithm, both fingerprints, comment, creation and\n\tmodification times, whether it has a passphrase and is loaded in ssh-agent, the hosts it is mapped to, tags,\n\texpiry and certificate.")
+	fmt.Println("\n - hosts [--json] [--missing] [--plain]:\n\tLists every Host block as a table with the HostName, User and Port it connects with, the jump hosts it goes\n\tthrough and the identity files it offers, taking in options from matching blocks such as Host * the way ssh\n\tdoes. Identity files missing on disk are marked in red; --missing lists only the hosts that have one.")
+	fmt.Println("\n - graph [--format dot|mermaid] [--unused]:\n\tPrints the keys, the hosts they are mapped to and the ProxyJump chains between hosts as a Graphviz or Mermaid\n\tgraph, such as keyman graph | dot -Tsvg > keys.svg. Identity files missing on disk are drawn in red; --unused adds\n\tkeys mapped to no host.")
+	fmt.Println("\n - audit [--policy file] [--expiry-window d] [--unused-after d] [--expired-only] [--fail-on severity] [--report md|html|sarif] [-o file] [--notify] [--webhook url] [--webhook-format json|slack|discord] [--notify-severity s] [--no-plugins] [--plain] [--sort col] [--columns c,c] [--format tmpl]:\n\tPerforms an audit of SSH keys and configuration, providing information like key age, unused keys, keys mapped to multiple hosts, duplicate keys, etc.\n\tKeys with a recorded last use count as unused when not used within --unused-after (default 90d), others when not mapped to a host.\n\tRules in ~/.config/keyman/policy.yaml and the checks of the plugins listed in audit.plugins in config.toml are\n\tevaluated too, exiting non-zero on warnings or errors; --no-plugins skips the plugins.\n\tDSA keys, RSA keys under 3072 bits and ECDSA keys on weak curves are flagged; --fail-on info|warning|error exits non-zero\n\ton findings of that severity or worse (default error), such as expired keys and loose permissions.\n\tHost key fingerprints in known_hosts are recorded when first seen, and a host whose key later changes is reported.\n\t--report writes a Markdown or HTML report with a summary, findings by severity and per-key details instead,\n\tor a SARIF log of the findings for GitHub code scanning and other security dashboards.\n\t--format prints each key through a template as list does, with .Findings holding the findings about it.\n\t--notify posts findings of warning or worse to the [notify] webhook from config.toml, rendered from its template.")
+	fmt.Println("\n - server audit [--file path] [--fail-on severity] [--report md|html|sarif] [-o file] [--plain]:\n\tAudits the local sshd_config and the files it includes for weak settings: root and password logins, obsolete\n\tciphers, MACs and key exchanges, and authorized_keys handling, including Match blocks that turn them back on.\n\tExits non-zero on findings of --fail-on severity or worse (default error); --report writes the same reports as audit.")
+	fmt.Println("\n - server hostkeys list [--dir path] [--max-age d] [--json] [--plain] | rotate [--max-age d] [--type t,t] [--sshd-config path] [--no-reload] [--yes]:\n\tLists the sshd host keys in /etc/ssh with their type, age and fingerprint, marking weak keys and those older than\n\t--max-age (default 5y). rotate regenerates them, or the --type ones, keeping the old files as .old, removes DSA keys,\n\tputs the old keys back if sshd -t rejects the result and reloads sshd through systemd or with SIGHUP. It refuses\n\twhen .old files from an earlier rotation are still there.")
+	fmt.Println("\n - scan [--max-size bytes] [--include-ssh-dir] [--json] [--plain] <dir|file>...:\n\tSearches directory trees such as ~ or a folder of repositories, or single files, for private keys left outside the\n\tssh directory: OpenSSH, PEM, PKCS#8 and PuTTY keys anywhere in a file and files named like id_rsa. Each is listed with\n\twhether it has a passphrase, whether it copies a key in the ssh directory and whether git tracks it. Files over\n\t--max-size (default 1 MiB), named ones included, are only found by name. Exits 1 if any are found.")
+	fmt.Println("\nGlobal flags:")
+	fmt.Println(" --dry-run:\n\tShows the config diff and file operations map, unmap, rename, delete, rotate, apply and host would perform, without changing anything.\n\tCommands that cannot show their changes first, such as import, authorized and signers, refuse it.")
+	fmt.Println(" --diff:\n\tShows a unified diff of each ssh config file before it is written.")
+	fmt.Println(" --all-users:\n\tWith audit, run as root, audits the ~/.ssh of root and of every user under /home: their keys, authorized_keys\n\tand Host blocks with the findings about them, then a summary per user. --fail-on sets the severity that exits\n\twith 1 (default error) and --json prints it all as JSON.")
+	fmt.Println(" --profile name:\n\tUses a profile from ~/.config/keyman/profiles.yaml, each with its own ssh directory, config and known_hosts.\n\tKEYMAN_PROFILE sets the same default, otherwise the file's default profile is used.")
+	fmt.Println(" --ssh-dir dir:\n\tWorks on another directory instead of ~/.ssh, such as a test fixture, a mounted backup or another user's ~/.ssh.\n\tKEYMAN_SSH_DIR sets the same default.")
+	fmt.Println(" --errors text|json:\n\tReports fatal errors as a log line (the default) or as a JSON object on stderr. KEYMAN_ERRORS sets the same default.")
+	fmt.Println("\nExit codes:")
+	fmt.Println(" 0: success\n 1: a check such as audit or krl check found problems, or find matched no key\n 2: usage error\n 3: keyman could not finish, such as on an I/O error")
 }
 
-func listKeys() {
+func listKeys(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	showMD5 := flags.Bool("md5", false, "also show MD5 fingerprints")
+	asJSON := flags.Bool("json", settings.Output == "json", "print the keys as JSON")
+	expiredOnly := flags.Bool("expired-only", false, "only list keys that have expired")
+	long := flags.Bool("long", false, "print every detail of each key instead of a table")
+	var filter keyFilter
+	flags.StringVar(&filter.keyType, "type", "", "only list keys of this type, such as ed25519 or rsa")
+	olderThan := flags.String("older-than", "", "only list keys older than this, such as 365d, 52w or 1y")
+	flags.BoolVar(&filter.unused, "unused", false, "only list keys that are not in use")
+	flags.StringVar(&filter.tag, "tag", "", "only list keys with this tag")
+	flags.StringVar(&filter.host, "host", "", "only list keys mapped to a host matching this pattern, such as 'prod-*'")
+	tokens := flags.Bool("tokens", false, "also list keys on PKCS#11 tokens and FIDO security keys that have no files")
+	providers, resident := addTokenFlags(flags)
+	table := addTableFlags(flags)
+	parseFlagSet(flags, args)
+	if *olderThan != "" {
+		age, err := keyman.ParseAge(*olderThan)
+		if err != nil {
+			fatalUsagef("Invalid --older-than: %v", err)
+		}
+		filter.olderThan = age
+	}
+
 	keys, err := getKeys()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	for _, key := range keys {
-		if key.comment != "" {
-			fmt.Printf("Key: %s\nCreated: %s\nComment: %s\n\n", key.name, key.created.Format(time.RFC3339), key.comment)
-		} else {
-			fmt.Printf("Key: %s\nCreated: %s\n\n", key.name, key.created.Format(time.RFC3339))
+	if *expiredOnly {
+		var expired []keyman.Key
+		for _, key := range keys {
+			if key.Metadata.Expired(time.Now()) {
+				expired = append(expired, key)
+			}
 		}
+		keys = expired
 	}
-}
 
-func getKeys() ([]sshKey, error) {
-	sshPath, err := getSSHPath()
+	statuses, weak, err := keyStatuses(keys)
 	if err != nil {
-		return nil, err
+		fatal(err)
 	}
-
-	files, err := os.ReadDir(sshPath)
+	if *tokens && !*expiredOnly {
+		found, err := findTokenKeys(*providers, *resident)
+		if err != nil {
+			fatal(err)
+		}
+		tokenKeys, hosts := tokenStatuses(found)
+		for _, status := range tokenKeys {
+			weak = append(weak, keyman.CheckStrength([]keyman.Key{status.Key})...)
+		}
+		statuses = append(statuses, tokenKeys...)
+		filter.tokenHosts = hosts
+	}
+	statuses, err = filter.apply(statuses)
 	if err != nil {
-		return nil, err
+		fatal(err)
 	}
 
-	var keys []sshKey
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), keyFileExt) {
-			keyName := strings.TrimSuffix(file.Name(), keyFileExt)
-			keyPath := filepath.Join(sshPath, file.Name())
-			created, err := getFileCreationTime(keyPath)
-			if err != nil {
-				return nil, err
+	if *asJSON || *long {
+		var matched []keyman.Key
+		for _, status := range statuses {
+			matched = append(matched, status.Key)
+		}
+		if *asJSON {
+			printKeysJSON(matched)
+			return
+		}
+		for _, key := range matched {
+			printKey(key, *showMD5)
+		}
+		return
+	}
+
+	if *showMD5 {
+		if !containsString(strings.Split(*table.columns, ","), "fingerprint") {
+			*table.columns += ",fingerprint"
+		}
+		*table.columns += ",md5"
+	}
+	printKeyTable(statuses, weak, nil, table)
+}
+
+// keyFilter holds the list flags that narrow which keys are listed. Zero
+// fields match every key.
+type keyFilter struct {
+	keyType   string
+	olderThan time.Duration
+	unused    bool
+	tag       string
+	host      string
+
+	// tokenHosts maps hardware-backed keys to the hosts that use them,
+	// which the ssh config does not name them by.
+	tokenHosts map[string][]string
+}
+
+// apply returns the keys that match every filter that is set.
+func (f keyFilter) apply(keys []keyman.KeyStatus) ([]keyman.KeyStatus, error) {
+	var hosts map[string][]string
+	if f.host != "" {
+		var err error
+		if hosts, err = keyHosts(); err != nil {
+			return nil, err
+		}
+		for name, tokenHosts := range f.tokenHosts {
+			hosts[name] = tokenHosts
+		}
+	}
+
+	var matched []keyman.KeyStatus
+	for _, key := range keys {
+		switch {
+		case f.keyType != "" && (key.Public == nil || !strings.EqualFold(key.Public.TypeName(), f.keyType)):
+			continue
+		case key.Age < f.olderThan:
+			continue
+		case f.unused && key.InUse:
+			continue
+		case f.tag != "" && !key.Metadata.HasTag(f.tag):
+			continue
+		}
+		if f.host != "" {
+			mapped := false
+			for _, host := range hosts[key.Name] {
+				if keyman.MatchPatterns([]string{f.host}, host) {
+					mapped = true
+					break
+				}
 			}
-			comment, err := getKeyComment(keyPath)
-			if err != nil {
-				return nil, err
+			if !mapped {
+				continue
 			}
-
-			keys = append(keys, sshKey{
-				name:    keyName,
-				path:    keyPath,
-				created: created,
-				comment: comment,
-			})
 		}
+		matched = append(matched, key)
 	}
+	return matched, nil
+}
 
-	return keys, nil
+// keyJSON is the JSON form of a key printed by list --json.
+type keyJSON struct {
+	Name        string     `json:"name"`
+	Path        string     `json:"path"`
+	Created     time.Time  `json:"created"`
+	Modified    time.Time  `json:"modified"`
+	Comment     string     `json:"comment,omitempty"`
+	Type        string     `json:"type,omitempty"`
+	Algorithm   string     `json:"algorithm,omitempty"`
+	Length      int        `json:"encoded_length,omitempty"`
+	Bits        int        `json:"bits,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	SecurityKey bool       `json:"security_key,omitempty"`
+	Token       string     `json:"token,omitempty"`
+	Provider    string     `json:"provider,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Certificate *certJSON  `json:"certificate,omitempty"`
+
+	MissingPublic  bool `json:"missing_public,omitempty"`
+	MissingPrivate bool `json:"missing_private,omitempty"`
 }
 
-func getSSHPath() (string, error) {
-	usr, err := user.Current()
-	if err != nil {
-		return "", err
+type certJSON struct {
+	Type        string     `json:"type"`
+	KeyID       string     `json:"key_id"`
+	Serial      uint64     `json:"serial"`
+	Principals  []string   `json:"principals"`
+	ValidAfter  *time.Time `json:"valid_after,omitempty"`
+	ValidBefore *time.Time `json:"valid_before,omitempty"`
+	CA          string     `json:"ca"`
+}
+
+func printKeysJSON(keys []keyman.Key) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(keysJSON(keys)); err != nil {
+		fatal(err)
 	}
+}
 
-	return filepath.Join(usr.HomeDir, sshDir), nil
+// keysJSON converts keys to the form list --json prints.
+func keysJSON(keys []keyman.Key) []keyJSON {
+	out := []keyJSON{}
+	for _, key := range keys {
+		entry := keyJSON{
+			Name:           key.Name,
+			Path:           key.Path,
+			Created:        key.Created,
+			Modified:       key.Modified,
+			Comment:        key.Comment,
+			MissingPublic:  key.MissingPublic,
+			MissingPrivate: key.MissingPrivate,
+			Token:          key.Token,
+			Provider:       key.Provider,
+		}
+		if key.Public != nil {
+			entry.Type = key.Public.TypeName()
+			entry.Algorithm = key.Public.Algorithm
+			entry.Length = len(key.Public.Blob)
+			entry.Bits = key.Public.Bits()
+			entry.Fingerprint = key.Public.FingerprintSHA256()
+			entry.SecurityKey = key.Public.IsSecurityKey()
+			if entry.Comment == "" {
+				entry.Comment = key.Public.Comment
+			}
+		}
+		if cert := key.Certificate; cert != nil {
+			entry.Certificate = &certJSON{
+				Type:       cert.TypeName(),
+				KeyID:      cert.KeyID,
+				Serial:     cert.Serial,
+				Principals: cert.Principals,
+				CA:         cert.SignatureKey.FingerprintSHA256(),
+			}
+			if !cert.ValidAfter.IsZero() {
+				entry.Certificate.ValidAfter = &cert.ValidAfter
+			}
+			if !cert.Forever() {
+				entry.Certificate.ValidBefore = &cert.ValidBefore
+			}
+		}
+		if meta := key.Metadata; meta != nil {
+			entry.Tags = meta.Tags
+			entry.Description = meta.Description
+			entry.Owner = meta.Owner
+			entry.Expires = meta.Expires
+		}
+		out = append(out, entry)
+	}
+	return out
 }
 
-func getFileCreationTime(path string) (time.Time, error) {
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		return time.Time{}, err
+func printKey(key keyman.Key, showMD5 bool) {
+	fmt.Printf("Key: %s\nCreated: %s\n", key.Name, key.Created.Format(time.RFC3339))
+	if !key.Modified.Equal(key.Created) {
+		fmt.Printf("Modified: %s\n", key.Modified.Format(time.RFC3339))
+	}
+	if key.Public != nil {
+		fmt.Printf("Type: %s %d", key.Public.TypeName(), key.Public.Bits())
+		if key.Public.IsSecurityKey() {
+			fmt.Print(" (security key)")
+		}
+		fmt.Printf("\nFingerprint: %s\n", key.Public.FingerprintSHA256())
+		if showMD5 {
+			fmt.Printf("Fingerprint: %s\n", key.Public.FingerprintMD5())
+		}
 	}
+	if key.Comment != "" {
+		fmt.Printf("Comment: %s\n", key.Comment)
+	}
+	printCertificate(key.Certificate)
+	printKeyMetadata(key.Metadata)
+	printMissingHalf(key)
+	fmt.Println()
+}
 
-	return fileInfo.ModTime(), nil
+// printMissingHalf warns when a key is missing its public or private file.
+func printMissingHalf(key keyman.Key) {
+	if key.MissingPublic {
+		fmt.Printf("Warning: no public key file, run keyman pubkey %s\n", key.Name)
+	}
+	if key.MissingPrivate {
+		fmt.Println("Warning: no private key file")
+	}
 }
 
-func getKeyComment(path string) (string, error) {
-	file, err := os.Open(path)
+func getKeys() ([]keyman.Key, error) {
+	sshPath, err := getSSHPath()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer file.Close()
 
-	content, err := io.ReadAll(file)
+	keys, err := keyman.ListKeys(sshPath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, commentLine) {
-			return strings.TrimPrefix(line, commentLine), nil
-		}
+	metadata, err := loadMetadata()
+	if err != nil {
+		return nil, err
 	}
+	metadata.Attach(keys)
 
-	return "", nil
+	return keys, nil
 }
 
-type sshKey struct {
-	name    string
-	path    string
-	created time.Time
-	comment string
+// sshPathOverride is the directory given with --ssh-dir or KEYMAN_SSH_DIR,
+// used instead of ~/.ssh when set.
+var sshPathOverride string
+
+// globalArgs are the global flags keyman was started with, passed on when
+// it runs itself.
+var globalArgs []string
+
+// parseGlobalFlags strips the global flags from args, wherever they appear,
+// and returns what is left.
+func parseGlobalFlags(args []string) []string {
+	values := map[string]string{
+		"ssh-dir": os.Getenv("KEYMAN_SSH_DIR"),
+		"profile": os.Getenv("KEYMAN_PROFILE"),
+		"errors":  os.Getenv("KEYMAN_ERRORS"),
+	}
+
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "__complete" {
+			// The words being completed are not keyman's own flags.
+			rest = append(rest, args[i:]...)
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if !strings.HasPrefix(arg, "-") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		switch name {
+		case "dry-run":
+			dryRun = true
+			globalArgs = append(globalArgs, arg)
+			continue
+		case "diff":
+			showDiff = true
+			globalArgs = append(globalArgs, arg)
+			continue
+		case "all-users":
+			allUsers = true
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(name, "=")
+		if _, ok := values[name]; !ok {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				fatalUsagef("--%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		values[name] = value
+		globalArgs = append(globalArgs, "--"+name+"="+value)
+	}
+
+	switch values["errors"] {
+	case "", "text":
+	case "json":
+		errorsJSON = true
+	default:
+		fatalUsagef("--errors must be text or json, not %q", values["errors"])
+	}
+
+	// An explicit --ssh-dir replaces the profile's files altogether.
+	useProfile(values["profile"])
+	if values["ssh-dir"] != "" {
+		configPathOverride, knownHostsPath = "", ""
+		setSSHPath(values["ssh-dir"])
+	}
+	return rest
 }
 
-func showConfig() {
-	configPath, err := getConfigPath()
+// setSSHPath points keyman at another ssh directory. When it is some home's
+// .ssh, such as another user's under sudo, ~ in config files is taken to be
+// that home.
+func setSSHPath(dir string) {
+	path, err := keyman.ExpandPath(dir)
+	if err != nil {
+		fatal(err)
+	}
+	info, err := os.Stat(path)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if !info.IsDir() {
+		fatalf("%s is not a directory", path)
+	}
+
+	sshPathOverride = path
+	if filepath.Base(path) == sshDir {
+		keyman.HomeDir = filepath.Dir(path)
+	}
+}
+
+func getSSHPath() (string, error) {
+	if sshPathOverride != "" {
+		return sshPathOverride, nil
 	}
 
-	content, err := os.ReadFile(configPath)
+	return keyman.ExpandPath(filepath.Join("~", sshDir))
+}
+
+func showConfig(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "lint":
+			lintConfig(args[1:])
+			return
+		case "fmt":
+			formatConfig(args[1:])
+			return
+		case "edit":
+			editConfig(args[1:])
+			return
+		case "dedupe":
+			dedupeConfig(args[1:])
+			return
+		case "split":
+			splitConfig(args[1:])
+			return
+		case "diff":
+			diffConfig(args[1:])
+			return
+		}
+	}
+
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	mappings := flags.Bool("mappings", false, "list each host with its keys in the order ssh tries them")
+	parseFlags(flags, args)
+
+	config, err := loadConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	fmt.Println(string(content))
+	if *mappings {
+		showMappings(config)
+		return
+	}
+
+	for i, file := range config.Files() {
+		if i > 0 {
+			fmt.Printf("# Included from %s\n", file.Path)
+		}
+		fmt.Println(string(file.Bytes()))
+	}
+}
+
+// showMappings lists the keys of every Host block, numbered in the order
+// ssh offers them.
+func showMappings(config *keyman.Config) {
+	for _, block := range config.AllBlocks() {
+		if block.Match {
+			continue
+		}
+		identities := block.Options("IdentityFile")
+		if block.IsDefaults() {
+			if len(identities) == 0 {
+				continue
+			}
+			fmt.Println("Host: * (defaults, tried after each host's own keys)")
+		} else {
+			fmt.Printf("Host: %s\n", block.Name())
+		}
+		if len(identities) == 0 {
+			fmt.Println("No keys mapped")
+		}
+		for i, identity := range identities {
+			fmt.Printf("%d. %s\n", i+1, identity)
+		}
+		fmt.Println()
+	}
 }
 
 func getConfigPath() (string, error) {
+	if configPathOverride != "" {
+		return configPathOverride, nil
+	}
+
 	sshPath, err := getSSHPath()
 	if err != nil {
 		return "", err
@@ -194,15 +781,30 @@ func getConfigPath() (string, error) {
 	return filepath.Join(sshPath, configFile), nil
 }
 
-func listUnusedKeys() {
+// identityReference returns how a config should name the key called name:
+// as ~/.ssh/name, or by absolute path when keyman is working on a directory
+// that is not a home's .ssh.
+func identityReference(name string) string {
+	if sshPathOverride != "" && filepath.Base(sshPathOverride) != sshDir {
+		return filepath.Join(sshPathOverride, name)
+	}
+	return filepath.Join("~", sshDir, name)
+}
+
+func listUnusedKeys(args []string) {
+	flags := flag.NewFlagSet("unused", flag.ExitOnError)
+	long := flags.Bool("long", false, "print every detail of each key instead of a table")
+	table := addTableFlags(flags)
+	parseFlagSet(flags, args)
+
 	keys, err := getKeys()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	config, err := parseConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	usedKeys := make(map[string]bool)
@@ -212,169 +814,516 @@ func listUnusedKeys() {
 		}
 	}
 
-	var unusedKeys []sshKey
+	var unusedKeys []keyman.Key
 	for _, key := range keys {
-		if !usedKeys[key.name] {
+		if !usedKeys[key.Name] {
 			unusedKeys = append(unusedKeys, key)
 		}
 	}
 
-	for _, key := range unusedKeys {
-		if key.comment != "" {
-			fmt.Printf("Key: %s\nCreated: %s\nComment: %s\n\n", key.name, key.created.Format(time.RFC3339), key.comment)
-		} else {
-			fmt.Printf("Key: %s\nCreated: %s\n\n", key.name, key.created.Format(time.RFC3339))
+	if *long {
+		for _, key := range unusedKeys {
+			printKey(key, false)
 		}
+		return
 	}
-}
 
-func isKeyUsed(key sshKey, config map[string][]string) bool {
-	for _, keyPaths := range config {
-		for _, keyPath := range keyPaths {
-			keyBase := strings.TrimSuffix(filepath.Base(key.path), ".pub")
-			if keyBase == filepath.Base(keyPath) {
-				return true
-			}
-		}
+	statuses, weak, err := keyStatuses(unusedKeys)
+	if err != nil {
+		fatal(err)
 	}
-	return false
+	printKeyTable(statuses, weak, nil, table)
 }
 
 func parseConfig() (map[string][]string, error) {
-	configPath, err := getConfigPath()
+	config, err := loadConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	content, err := os.ReadFile(configPath)
+	return config.Mappings()
+}
+
+func loadConfig() (*keyman.Config, error) {
+	configPath, err := getConfigPath()
 	if err != nil {
 		return nil, err
 	}
 
-	config := make(map[string][]string)
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "Host ") {
-			host := strings.TrimSpace(strings.TrimPrefix(line, "Host "))
-			config[host] = nil
-		} else if strings.HasPrefix(line, "IdentityFile ") {
-			keyPath := strings.TrimSpace(strings.TrimPrefix(line, "IdentityFile "))
-			keyPath, err = expandPath(keyPath)
-			if err != nil {
-				return nil, err
-			}
-			host := getLastHost(config)
-			config[host] = append(config[host], keyPath)
+	return keyman.LoadConfig(configPath, filepath.Dir(configPath))
+}
+
+// mapOptions are the flags of keyman map.
+type mapOptions struct {
+	add bool
+
+	// identitiesOnly, addKeysToAgent and useKeychain turn the options of
+	// the same name on for the host.
+	identitiesOnly bool
+	addKeysToAgent bool
+	useKeychain    bool
+
+	// hostname, user and port are set on the Host block, and asked for
+	// when prompt is set and keyman creates the block.
+	hostname string
+	user     string
+	port     string
+	prompt   bool
+
+	// securityKeyProvider is set as the host's SecurityKeyProvider, the
+	// library ssh reaches a FIDO security key through.
+	securityKeyProvider string
+}
+
+func mapKeyCommand(args []string) {
+	flags := flag.NewFlagSet("map", flag.ExitOnError)
+	add := flags.Bool("add", false, "add the key after the host's existing keys instead of refusing")
+	hostname := flags.String("hostname", "", "real host name or address to connect to")
+	user := flags.String("user", "", "user to log in as")
+	port := flags.String("port", "", "port to connect to")
+	promptFlag := flags.Bool("prompt", false, "ask for the host name, user and port when the host is not in the config yet")
+	identitiesOnly := flags.Bool("identities-only", settings.MapIdentitiesOnly, "set IdentitiesOnly yes so ssh only offers the mapped keys")
+	addKeysToAgent := flags.Bool("add-keys-to-agent", settings.MapAddKeysToAgent, "set AddKeysToAgent yes so the key is loaded into ssh-agent on first use")
+	useKeychain := flags.Bool("use-keychain", settings.MapUseKeychain, "set UseKeychain yes so macOS keeps the passphrase in the keychain")
+	hosts := flags.String("hosts", "", "map the key to every host this selects instead: tag:<tag> or a pattern such as '*.prod.example.com', comma separated")
+	yes := flags.Bool("yes", false, "with --hosts, make the change without showing it and asking first")
+	pkcs11 := flags.String("pkcs11", "", "map the keys on the tokens of this PKCS#11 library to the host with PKCS11Provider, instead of a key file")
+	securityKeyProvider := flags.String("security-key-provider", "", "set SecurityKeyProvider to this library, for security keys ssh cannot reach on its own")
+	args = parseFlags(flags, args)
+	usage := "Usage: keyman map [--add] [--hostname h] [--user u] [--port p] [--prompt] [--identities-only] [--add-keys-to-agent] [--use-keychain] [--security-key-provider lib] <key> <host> | --hosts selector [--yes] <key> | --pkcs11 lib <host>"
+	if len(args) > 2 || (*hosts != "" && len(args) != 1) || (*pkcs11 != "" && (len(args) > 1 || *hosts != "")) {
+		fatalUsage(usage)
+	}
+	if len(args) == 0 {
+		args = append(args, pickOrUsage(usage, "Key", keyNames(), false))
+	}
+	opts := mapOptions{
+		add:            *add,
+		identitiesOnly: *identitiesOnly,
+		addKeysToAgent: *addKeysToAgent,
+		useKeychain:    *useKeychain,
+		hostname:       *hostname,
+		user:           *user,
+		port:           *port,
+		prompt:         *promptFlag,
+
+		securityKeyProvider: *securityKeyProvider,
+	}
+	if *pkcs11 != "" {
+		if len(args) == 0 {
+			args = append(args, pickOrUsage(usage, "Host", hostNames(), true))
 		}
+		mapProvider(*pkcs11, args[0], opts)
+		return
 	}
-
-	return config, nil
+	if *hosts != "" {
+		mapKeyToHosts(args[0], *hosts, opts, *yes)
+		return
+	}
+	if len(args) == 1 {
+		args = append(args, pickOrUsage(usage, "Host", hostNames(), true))
+	}
+	mapKey(args[0], args[1], opts)
 }
 
-func getLastHost(config map[string][]string) string {
-	var lastHost string
-	for host := range config {
-		lastHost = host
+// mapKey sets key as the IdentityFile for host, creating a Host block for
+// it if there is none. With add, a host that already has keys gets key as
+// one more for ssh to fall back to.
+func mapKey(key, host string, opts mapOptions) {
+	keyPath, key := resolveMapKey(key, &opts)
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	block := config.FindHost(host)
+	created := block == nil
+	if created {
+		block = config.AppendHost(host)
+	}
+
+	if created && opts.prompt {
+		opts.hostname = prompt("HostName", opts.hostname)
+		opts.user = prompt("User", opts.user)
+		opts.port = prompt("Port", opts.port)
+	}
+	if !mapKeyToBlock(block, keyPath, key, opts) {
+		return
+	}
+
+	hook := hookContext{Key: keyPath, Hosts: []string{host}}
+	runHooks("pre", "map", hook)
+	err = saveConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+	journal("map", host, "", key)
+	runHooks("post", "map", hook)
+
+	if !dryRun {
+		if created {
+			fmt.Printf("Added host %s\n", host)
+		}
+		fmt.Printf("Mapped key %s to host %s\n", key, host)
 	}
-	return lastHost
 }
 
-func mapKey(key, host string) {
-	configPath, err := getConfigPath()
+// mapProvider sets the PKCS#11 library ssh loads host's keys from,
+// creating a Host block for it if there is none. ssh offers every key on
+// the library's tokens, so there is no key file to map.
+func mapProvider(provider, host string, opts mapOptions) {
+	config, err := loadConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	config, err := parseConfig()
+	block := config.FindHost(host)
+	created := block == nil
+	if created {
+		block = config.AppendHost(host)
+	}
+	current := block.Option("PKCS11Provider")
+	if current == provider {
+		fmt.Printf("Host %s already uses %s\n", host, provider)
+		return
+	}
+	if current != "" && !opts.add {
+		fmt.Printf("The host %s already uses %s. Use --add to replace it.\n", host, current)
+		return
+	}
+
+	if created && opts.prompt {
+		opts.hostname = prompt("HostName", opts.hostname)
+		opts.user = prompt("User", opts.user)
+		opts.port = prompt("Port", opts.port)
+	}
+	setMapOptions(block, opts)
+	block.SetOption("PKCS11Provider", provider)
+
+	hook := hookContext{Key: provider, Hosts: []string{host}}
+	runHooks("pre", "map", hook)
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	journal("map", host, current, provider)
+	runHooks("post", "map", hook)
+
+	if !dryRun {
+		if created {
+			fmt.Printf("Added host %s\n", host)
+		}
+		fmt.Printf("Mapped PKCS#11 library %s to host %s\n", provider, host)
+	}
+}
+
+// mapKeyToHosts maps key to every host selector picks, showing the whole
+// change and asking once before saving it as a single step for keyman undo.
+func mapKeyToHosts(key, selector string, opts mapOptions, yes bool) {
+	keyPath, key := resolveMapKey(key, &opts)
+
+	config, err := loadConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	blocks, err := selectHosts(config, selector)
+	if err != nil {
+		fatal(err)
 	}
 
-	if len(config[host]) >= 1 {
-		fmt.Printf("The host %s already has a key mapped. Please unmap the current key before mapping a new one.\n", host)
+	var mapped []string
+	for _, block := range blocks {
+		if mapKeyToBlock(block, keyPath, key, opts) {
+			mapped = append([]string{block.Name()}, mapped...)
+		}
+	}
+	if len(mapped) == 0 {
+		return
+	}
+	if !confirmBulk(config, fmt.Sprintf("Map key %s to %d host(s)?", key, len(mapped)), yes) {
 		return
 	}
 
-	config[host] = append(config[host], key)
+	hook := hookContext{Key: keyPath, Hosts: mapped}
+	runHooks("pre", "map", hook)
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	for _, host := range mapped {
+		journal("map", host, "", key)
+	}
+	runHooks("post", "map", hook)
+	if !dryRun {
+		fmt.Printf("Mapped key %s to %d host(s): %s\n", key, len(mapped), strings.Join(mapped, ", "))
+	}
+}
 
-	err = writeConfig(configPath, config)
+// resolveMapKey finds the key map was given, returning its path and how the
+// config should name it, and drops the options opts cannot have here.
+func resolveMapKey(key string, opts *mapOptions) (string, string) {
+	keyPath, err := resolveKeyArg(key)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if _, err := os.Stat(keyPath); err != nil {
+		if _, pubErr := os.Stat(keyPath + keyFileExt); pubErr != nil {
+			fatalf("Key %s not found: %v", key, err)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s has no private key, ssh can only use it through ssh-agent\n", keyPath)
+	}
+
+	// Other ssh clients reject UseKeychain as an unknown option.
+	if opts.useKeychain && runtime.GOOS != "darwin" {
+		fmt.Fprintln(os.Stderr, "Warning: UseKeychain is only understood by ssh on macOS, not setting it")
+		opts.useKeychain = false
+	}
+	return keyPath, configKeyPath(keyPath)
+}
+
+// mapKeyToBlock adds key as an IdentityFile of block along with the options
+// in opts, reporting whether it did. A host that already has the key, or
+// another key without opts.add, is left alone.
+func mapKeyToBlock(block *keyman.HostBlock, keyPath, key string, opts mapOptions) bool {
+	host := block.Name()
+	identities := block.Options("IdentityFile")
+	if containsPath(identities, keyPath) {
+		fmt.Printf("Key %s is already mapped to host %s\n", key, host)
+		return false
 	}
+	if len(identities) >= 1 && !opts.add {
+		fmt.Printf("The host %s already has a key mapped. Please unmap the current key before mapping a new one, or use --add to keep both.\n", host)
+		return false
+	}
+
+	setMapOptions(block, opts)
+	block.AddOption("IdentityFile", key)
+	return true
+}
 
-	fmt.Printf("Mapped key %s to host %s\n", key, host)
+// setMapOptions sets the options in opts on block, before the key is
+// added, in the order keyman host add uses.
+func setMapOptions(block *keyman.HostBlock, opts mapOptions) {
+	for _, option := range []struct{ keyword, value string }{
+		{"HostName", opts.hostname},
+		{"User", opts.user},
+		{"Port", opts.port},
+		{"IdentitiesOnly", yesIf(opts.identitiesOnly)},
+		{"AddKeysToAgent", yesIf(opts.addKeysToAgent)},
+		{"UseKeychain", yesIf(opts.useKeychain)},
+		{"SecurityKeyProvider", opts.securityKeyProvider},
+	} {
+		if option.value != "" {
+			block.SetOption(option.keyword, option.value)
+		}
+	}
 }
 
 // func mapKey(key, host string) {
 // 	configPath, err := getConfigPath()
 // 	if err != nil {
-// 		log.Fatal(err)
+// 		fatal(err)
 // 	}
 
 // 	config, err := parseConfig()
 // 	if err != nil {
-// 		log.Fatal(err)
+// 		fatal(err)
 // 	}
 
 // 	config[host] = append(config[host], key)
 
 // 	err = writeConfig(configPath, config)
 // 	if err != nil {
-// 		log.Fatal(err)
+// 		fatal(err)
 // 	}
 
 // 	fmt.Printf("Mapped key %s to host %s\n", key, host)
 // }
 
-func unmapKey(key, host string) {
-	configPath, err := getConfigPath()
+// yesIf returns "yes" when on is set, and nothing otherwise.
+func yesIf(on bool) string {
+	if on {
+		return "yes"
+	}
+	return ""
+}
+
+// resolveKeyArg turns a key named on the command line into the path of its
+// private key. Relative names are looked up in the ssh directory first and
+// then the working directory, and a .pub suffix is dropped.
+func resolveKeyArg(key string) (string, error) {
+	key = strings.TrimSuffix(key, keyFileExt)
+	if strings.HasPrefix(key, "~") || filepath.IsAbs(key) {
+		return keyman.ExpandPath(key)
+	}
+
+	keyPath, err := getFullKeyPath(key)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	if _, err := os.Stat(keyPath); err != nil {
+		if local, err := filepath.Abs(key); err == nil {
+			if _, err := os.Stat(local); err == nil {
+				return local, nil
+			}
+		}
+	}
+	return keyPath, nil
+}
+
+// configKeyPath returns how the config should name the key at keyPath:
+// like identityReference for keys in the ssh directory, otherwise by its
+// absolute path.
+func configKeyPath(keyPath string) string {
+	sshPath, err := getSSHPath()
+	if err == nil && filepath.Dir(keyPath) == sshPath {
+		return identityReference(filepath.Base(keyPath))
 	}
+	return keyPath
+}
 
+// unmapKeyCommand runs unmap, letting the user pick the host and key from
+// the current mappings when they are left out.
+func unmapKeyCommand(args []string) {
+	flags := flag.NewFlagSet("unmap", flag.ExitOnError)
+	selector := flags.String("hosts", "", "unmap the key from every host this selects instead: tag:<tag> or a pattern such as '*.prod.example.com', comma separated")
+	yes := flags.Bool("yes", false, "with --hosts, make the change without showing it and asking first")
+	args = parseFlags(flags, args)
+	if *selector != "" {
+		if len(args) != 1 {
+			fatalUsage("Usage: keyman unmap --hosts selector [--yes] <key>")
+		}
+		unmapKeyFromHosts(args[0], *selector, *yes)
+		return
+	}
+	if len(args) >= 2 {
+		unmapKey(args[0], args[1])
+		return
+	}
+
+	usage := "Usage: keyman unmap [--hosts selector] [--yes] <key> <host>"
 	config, err := parseConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	if len(args) == 1 {
+		var hosts []string
+		for host, keyPaths := range config {
+			for _, keyPath := range keyPaths {
+				if keyPath == args[0] || filepath.Base(keyPath) == args[0] {
+					hosts = append(hosts, host)
+					break
+				}
+			}
+		}
+		sort.Strings(hosts)
+		unmapKey(args[0], pickOrUsage(usage, "Host", hosts, false))
+		return
+	}
+
+	var hosts []string
+	for host, keyPaths := range config {
+		if len(keyPaths) > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	host := pickOrUsage(usage, "Host", hosts, false)
+
+	keyPaths := config[host]
+	key := keyPaths[0]
+	if len(keyPaths) > 1 {
+		key = pickOrUsage(usage, "Key", keyPaths, false)
+	}
+	unmapKey(key, host)
+}
+
+func unmapKey(key, host string) {
+	keyPath, err := resolveKeyArg(key)
+	if err != nil {
+		fatal(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	block := config.FindHost(host)
+	if block == nil {
+		fatalf("Host %s not found in config", host)
 	}
 
-	keyPaths := config[host]
-	for i, keyPath := range keyPaths {
-		if keyPath == key {
-			config[host] = append(keyPaths[:i], keyPaths[i+1:]...)
-			break
-		}
+	removed := unmapKeyFromBlock(block, key, keyPath)
+	if removed == 0 {
+		fatalf("Key %s is not mapped to host %s", key, host)
 	}
 
-	err = writeConfig(configPath, config)
+	err = saveConfig(config)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	journal("unmap", host, key, "")
 
-	fmt.Printf("Unmapped key %s from host %s\n", key, host)
+	if !dryRun {
+		fmt.Printf("Unmapped key %s from host %s\n", key, host)
+	}
 }
 
-func writeConfig(path string, config map[string][]string) error {
-	var lines []string
-
-	hosts := make([]string, 0, len(config))
-	for host := range config {
-		hosts = append(hosts, host)
+// unmapKeyFromHosts removes key from every host selector picks that has it,
+// showing the whole change and asking once before saving it.
+func unmapKeyFromHosts(key, selector string, yes bool) {
+	keyPath, err := resolveKeyArg(key)
+	if err != nil {
+		fatal(err)
 	}
 
-	sort.Strings(hosts)
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	blocks, err := selectHosts(config, selector)
+	if err != nil {
+		fatal(err)
+	}
 
-	for _, host := range hosts {
-		lines = append(lines, fmt.Sprintf("Host %s", host))
-		keyPaths := config[host]
-		for _, keyPath := range keyPaths {
-			lines = append(lines, fmt.Sprintf("  IdentityFile %s", keyPath))
+	var unmapped []string
+	for _, block := range blocks {
+		if unmapKeyFromBlock(block, key, keyPath) > 0 {
+			unmapped = append([]string{block.Name()}, unmapped...)
 		}
-		lines = append(lines, "")
 	}
+	if len(unmapped) == 0 {
+		fatalf("Key %s is not mapped to any host matching %s", key, selector)
+	}
+	if !confirmBulk(config, fmt.Sprintf("Unmap key %s from %d host(s)?", key, len(unmapped)), yes) {
+		return
+	}
+
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	for _, host := range unmapped {
+		journal("unmap", host, key, "")
+	}
+	if !dryRun {
+		fmt.Printf("Unmapped key %s from %d host(s): %s\n", key, len(unmapped), strings.Join(unmapped, ", "))
+	}
+}
 
-	content := strings.Join(lines, "\n")
-	return os.WriteFile(path, []byte(content), 0644)
+// unmapKeyFromBlock removes the IdentityFile lines of block that point to
+// key, returning how many it removed.
+func unmapKeyFromBlock(block *keyman.HostBlock, key, keyPath string) int {
+	// A bare name matches the key wherever the config points to it.
+	bareName := !strings.ContainsAny(key, `/\`)
+	name := filepath.Base(keyPath)
+	return block.RemoveOption("IdentityFile", func(value string) bool {
+		expanded, err := keyman.ExpandPath(value)
+		if err != nil {
+			return value == key
+		}
+		return expanded == keyPath || (bareName && filepath.Base(expanded) == name)
+	})
 }
 
 // func writeConfig(path string, config map[string]string) error {
@@ -424,8 +1373,80 @@ func writeConfig(path string, config map[string][]string) error {
 // 	return os.WriteFile(path, []byte(content), 0644)
 // }
 
-func generateKey() {
-	reader := bufio.NewReader(os.Stdin)
+// keySpec describes a key to be created with ssh-keygen. A nil passphrase
+// lets ssh-keygen prompt for one.
+type keySpec struct {
+	keyType    string
+	name       string
+	comment    string
+	bits       int
+	passphrase *string
+
+	// options are passed to ssh-keygen with -O, for security key types.
+	options []string
+}
+
+func generateKey(args []string) {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	keyType := flags.String("type", defaultKeyType(), "key type: ed25519, rsa, ecdsa, dsa, ed25519-sk or ecdsa-sk")
+	name := flags.String("name", "", "key file name (default id_<type>_<timestamp>)")
+	comment := flags.String("comment", "", "key comment")
+	bits := flags.Int("bits", 0, "key size in bits, for rsa and ecdsa")
+	passphraseFile := flags.String("passphrase-file", "", "read the passphrase from a file, or - for stdin")
+	resident := flags.Bool("resident", false, "store the key on the security key so it can be loaded with ssh-keygen -K")
+	verifyRequired := flags.Bool("verify-required", false, "require a PIN or biometric on the security key for every signature")
+	application := flags.String("application", "", "security key application string, e.g. ssh:work (default ssh:)")
+	parseFlagSet(flags, args)
+
+	var spec keySpec
+	if flags.NFlag() == 0 {
+		spec = promptKeySpec()
+	} else {
+		spec = keySpec{keyType: *keyType, name: *name, comment: *comment, bits: *bits}
+		if spec.bits == 0 && spec.keyType == settings.KeyType {
+			spec.bits = settings.KeyBits
+		}
+		if *resident {
+			spec.options = append(spec.options, "resident")
+		}
+		if *verifyRequired {
+			spec.options = append(spec.options, "verify-required")
+		}
+		if *application != "" {
+			spec.options = append(spec.options, "application="+*application)
+		}
+
+		// Running unattended, so never let ssh-keygen stop to ask.
+		passphrase := ""
+		if *passphraseFile != "" {
+			var err error
+			passphrase, err = readPassphraseFile(*passphraseFile)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		spec.passphrase = &passphrase
+	}
+
+	if spec.name == "" {
+		spec.name = defaultKeyName(spec.keyType)
+	}
+	keyPath, err := getFullKeyPath(spec.name)
+	if err != nil {
+		fatal(err)
+	}
+	runHooks("pre", "generate", hookContext{Key: keyPath})
+
+	keyPath, err = createKey(spec)
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("Generated key %s\n", filepath.Base(keyPath))
+	runHooks("post", "generate", hookContext{Key: keyPath})
+}
+
+func promptKeySpec() keySpec {
 
 	fmt.Println("Let's generate a new SSH key.")
 	fmt.Println("You will be asked for some information to help configure the key.")
@@ -434,10 +1455,11 @@ func generateKey() {
 	fmt.Println("1. ed25519 (best)")
 	fmt.Println("2. rsa (better)")
 	fmt.Println("3. ecdsa (good)")
-	fmt.Println("4. dsa (bad)")
-	fmt.Print("Your choice (default is 1): ")
+	fmt.Println("4. ed25519-sk (hardware security key)")
+	fmt.Println("5. ecdsa-sk (hardware security key)")
+	fmt.Printf("Your choice (default is %s): ", defaultKeyType())
 
-	keyTypeChoice, _ := reader.ReadString('\n')
+	keyTypeChoice, _ := stdin.ReadString('\n')
 	keyTypeChoice = strings.TrimSpace(keyTypeChoice)
 
 	var keyType string
@@ -447,99 +1469,305 @@ func generateKey() {
 	case "3":
 		keyType = "ecdsa"
 	case "4":
-		keyType = "dsa"
-	default:
+		keyType = "ed25519-sk"
+	case "5":
+		keyType = "ecdsa-sk"
+	case "1":
 		keyType = "ed25519"
+	default:
+		keyType = defaultKeyType()
 	}
 
-	fmt.Print("Key name (default is id_ed25519_timestamp): ")
-	keyName, _ := reader.ReadString('\n')
-	keyName = strings.TrimSpace(keyName)
-	if keyName == "" {
-		keyName = fmt.Sprintf("id_ed25519_%d", time.Now().Unix())
+	var options []string
+	if isSecurityKeyType(keyType) {
+		fmt.Print("Store the key on the security key (resident)? [y/N]: ")
+		answer, _ := stdin.ReadString('\n')
+		if strings.EqualFold(strings.TrimSpace(answer), "y") {
+			options = append(options, "resident")
+		}
 	}
 
+	fmt.Printf("Key name (default is id_%s_timestamp): ", keyType)
+	keyName, _ := stdin.ReadString('\n')
+	keyName = strings.TrimSpace(keyName)
+
 	fmt.Print("Comment: ")
-	comment, _ := reader.ReadString('\n')
+	comment, _ := stdin.ReadString('\n')
 	comment = strings.TrimSpace(comment)
 
+	spec := keySpec{keyType: keyType, name: keyName, comment: comment, options: options}
+	if keyType == settings.KeyType {
+		spec.bits = settings.KeyBits
+	}
+	return spec
+}
+
+// isSecurityKeyType reports whether an ssh-keygen key type is backed by a
+// FIDO2 security key.
+func isSecurityKeyType(keyType string) bool {
+	return strings.HasSuffix(keyType, "-sk")
+}
+
+// createKey runs ssh-keygen for spec and returns the private key path.
+func createKey(spec keySpec) (string, error) {
+	switch spec.keyType {
+	case "ed25519", "rsa", "ecdsa", "dsa", "ed25519-sk", "ecdsa-sk":
+	default:
+		return "", fmt.Errorf("unsupported key type %q", spec.keyType)
+	}
+
+	if spec.name == "" {
+		spec.name = defaultKeyName(spec.keyType)
+	}
+	if spec.comment == "" && settings.CommentTemplate != "" {
+		spec.comment = expandCommentTemplate(spec)
+	}
+
 	sshPath, err := getSSHPath()
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+
+	keyPath := filepath.Join(sshPath, spec.name)
+	if _, err := os.Stat(keyPath); err == nil {
+		return "", fmt.Errorf("key %s already exists", keyPath)
 	}
 
-	keyPath := filepath.Join(sshPath, keyName)
+	args := []string{"-o", "-a", "100", "-t", spec.keyType, "-f", keyPath, "-C", spec.comment}
+	if spec.bits > 0 {
+		args = append(args, "-b", strconv.Itoa(spec.bits))
+	}
+	if len(spec.options) > 0 && !isSecurityKeyType(spec.keyType) {
+		return "", fmt.Errorf("security key options need an ed25519-sk or ecdsa-sk key")
+	}
+	for _, option := range spec.options {
+		args = append(args, "-O", option)
+	}
+
+	if dryRun {
+		fmt.Printf("Would generate %s key %s\n", spec.keyType, keyPath)
+		return keyPath, nil
+	}
 
-	err = runCommand("ssh-keygen", "-o", "-a", "100", "-t", keyType, "-f", keyPath, "-C", comment)
+	if spec.passphrase == nil {
+		err = runCommand("ssh-keygen", args...)
+	} else {
+		err = runKeygen("", *spec.passphrase, args...)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+
+	journal("generate", keyPath, "", keyFingerprint(keyPath))
+	recordCreation(spec.name)
+	return keyPath, nil
+}
+
+// defaultKeyName is the name a new key of keyType gets when none is given.
+func defaultKeyName(keyType string) string {
+	return fmt.Sprintf("id_%s_%d", keyType, time.Now().Unix())
+}
+
+// stdin is the one buffered reader of os.Stdin, so what one read buffers
+// past its line, such as keys piped after a passphrase, is still there for
+// the next.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphraseFile returns the first line of path, or of stdin if path
+// is "-". An empty line is an error rather than no passphrase, so a file
+// or pipe that turned up empty never leaves a key unencrypted.
+func readPassphraseFile(path string) (string, error) {
+	r, name := stdin, "stdin"
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		r, name = bufio.NewReader(file), path
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
 	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("no passphrase in %s", name)
+	}
+	return passphrase, nil
+}
 
-	fmt.Printf("Generated key %s\n", keyName)
+// parseFlags parses args with flags, allowing flags to appear after
+// positional arguments, and returns the positional arguments.
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		parseFlagSet(flags, args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
 
 func runCommand(command string, args ...string) error {
-	cmd := exec.Command(command, args...)
+	cmd := exec.Command(toolPath(command), args...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	return cmd.Run()
 }
 
-// deleteKey deletes a key and removes it from the SSH config.
-func deleteKey(key string) {
+// deleteOptions control how deleteKey disposes of a key pair.
+type deleteOptions struct {
+	agent          bool
+	remote         bool
+	archive        bool
+	shred          bool
+	passphraseFile string
+}
+
+func deleteKeyCommand(args []string) {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	force := flags.Bool("force", false, "delete without asking for confirmation")
+	archive := flags.Bool("archive", false, "keep an encrypted copy of the key pair in ~/.ssh/.keyman/trash")
+	shred := flags.Bool("shred", false, "overwrite the private key before removing it")
+	agent := flags.Bool("agent", false, "also remove the key from the running ssh-agent")
+	remote := flags.Bool("remote", false, "also remove the key from authorized_keys on every host it is mapped to")
+	passphraseFile := flags.String("passphrase-file", "", "passphrase for the archive, from a file or - for stdin")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		args = []string{pickOrUsage("Usage: keyman delete [--force] [--archive] [--shred] [--agent] [--remote] <key>", "Key", keyNames(), false)}
+	}
+	key := args[0]
+
 	fullKeyPath, err := getFullKeyPath(key)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	var hosts []string
+	for _, block := range config.AllBlocks() {
+		if containsPath(block.Options("IdentityFile"), fullKeyPath) {
+			hosts = append(hosts, block.Name())
+		}
+	}
+
+	if !*force && !dryRun {
+		fmt.Printf("Delete key %s and remove it from %d host(s)? [y/N]: ", key, len(hosts))
+		answer, _ := stdin.ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			fmt.Println("Aborted")
+			return
+		}
 	}
 
-	err = os.Remove(fullKeyPath)
+	hook := hookContext{Key: fullKeyPath, Hosts: hosts}
+	runHooks("pre", "delete", hook)
+	deleteKey(key, deleteOptions{
+		agent:          *agent,
+		remote:         *remote,
+		archive:        *archive,
+		shred:          *shred,
+		passphraseFile: *passphraseFile,
+	})
+	runHooks("post", "delete", hook)
+}
+
+// deleteKey deletes a key and removes it from the SSH config.
+func deleteKey(key string, opts deleteOptions) {
+	fullKeyPath, err := getFullKeyPath(key)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	pubFilePath := fullKeyPath + ".pub"
-	err = os.Remove(pubFilePath)
-	if err != nil {
-		log.Fatal(err)
+	fingerprint := keyFingerprint(fullKeyPath)
+
+	// Revoke remote access first, while the key can still be used to log in.
+	if opts.remote {
+		err = revokeRemoteKey(fullKeyPath)
+		if err != nil {
+			fatalf("%v, key left in place", err)
+		}
 	}
 
-	configPath, err := getConfigPath()
-	if err != nil {
-		log.Fatal(err)
+	if opts.agent && dryRun {
+		fmt.Printf("Would remove %s from ssh-agent\n", key)
+	} else if opts.agent {
+		err = removeAgentKey(pubFilePath)
+		if err != nil {
+			fmt.Printf("Could not remove %s from ssh-agent: %v\n", key, err)
+		} else {
+			fmt.Printf("Removed %s from ssh-agent\n", key)
+		}
 	}
 
-	config, err := parseConfig()
-	if err != nil {
-		log.Fatal(err)
+	if opts.archive && dryRun {
+		fmt.Printf("Would archive %s to %s\n", key, filepath.Join(filepath.Dir(fullKeyPath), keymanDir, "trash"))
+	} else if opts.archive {
+		archivePath, err := archiveKey(fullKeyPath, opts.passphraseFile)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Archived key %s to %s\n", key, archivePath)
 	}
 
-	// Iterate over each host and its keys.
-	for host, keyPaths := range config {
-		// Iterate over the keys of this host.
-		for i, keyPath := range keyPaths {
-			if keyPath == fullKeyPath {
-				// Remove the key from the host's key paths.
-				keyPaths = append(keyPaths[:i], keyPaths[i+1:]...)
-
-				if len(keyPaths) == 0 {
-					// If the host has no more keys, delete the host from the config.
-					delete(config, host)
-				} else {
-					// Otherwise, update the host's keys.
-					config[host] = keyPaths
-				}
+	// A half that is already gone counts as deleted, and whatever happens to
+	// the files the config is cleaned up and the delete journaled before
+	// any error stops the command, so nothing is left pointing at them.
+	if opts.shred && !dryRun {
+		err = shredFile(fullKeyPath)
+	} else {
+		err = removeFile(fullKeyPath)
+	}
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	removeErr := err
 
-				break
-			}
+	err = removeFile(pubFilePath)
+	if err != nil && !os.IsNotExist(err) && removeErr == nil {
+		removeErr = err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	// Iterate over each host block and drop the key's IdentityFile lines.
+	blocks := config.AllBlocks()
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+		removed := block.RemoveOption("IdentityFile", func(value string) bool {
+			expanded, err := keyman.ExpandPath(value)
+			return err == nil && expanded == fullKeyPath
+		})
+
+		// If the host has nothing left in it, delete the host from the config.
+		if removed > 0 && block.IsEmpty() {
+			block.Remove()
 		}
 	}
 
-	err = writeConfig(configPath, config)
+	err = saveConfig(config)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	journal("delete", fullKeyPath, fingerprint, "")
+	if removeErr != nil {
+		fatal(removeErr)
 	}
 
-	fmt.Printf("Deleted key %s\n", key)
+	if !dryRun {
+		fmt.Printf("Deleted key %s\n", key)
+	}
 }
 
 func getFullKeyPath(key string) (string, error) {
@@ -562,7 +1790,7 @@ func getFullKeyPath(key string) (string, error) {
 // 	} else {
 // 		sshPath, err := getSSHPath()
 // 		if err != nil {
-// 			log.Fatal(err)
+// 			fatal(err)
 // 		}
 
 // 		fullKeyPath = filepath.Join(sshPath, key)
@@ -570,23 +1798,23 @@ func getFullKeyPath(key string) (string, error) {
 
 // 	err := os.Remove(fullKeyPath)
 // 	if err != nil {
-// 		log.Fatal(err)
+// 		fatal(err)
 // 	}
 
 // 	pubFilePath := fullKeyPath + ".pub"
 // 	err = os.Remove(pubFilePath)
 // 	if err != nil {
-// 		log.Fatal(err)
+// 		fatal(err)
 // 	}
 
 // 	configPath, err := getConfigPath()
 // 	if err != nil {
-// 		log.Fatal(err)
+// 		fatal(err)
 // 	}
 
 // 	content, err := os.ReadFile(configPath)
 // 	if err != nil {
-// 		log.Fatal(err)
+// 		fatal(err)
 // 	}
 
 // 	configLines := strings.Split(string(content), "\n")
@@ -603,100 +1831,385 @@ func getFullKeyPath(key string) (string, error) {
 // 	newContent := strings.Join(newConfigLines, "\n")
 // 	err = os.WriteFile(configPath, []byte(newContent), 0644)
 // 	if err != nil {
-// 		log.Fatal(err)
+// 		fatal(err)
 // 	}
 
 // 	fmt.Printf("Deleted key %s\n", key)
 // }
 
-func audit() {
+func audit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	policyPath := flags.String("policy", "", "policy file to evaluate (default ~/.config/keyman/policy.yaml if present)")
+	defaultWindow := "30d"
+	if settings.ExpiryWindow > 0 {
+		defaultWindow = settings.ExpiryWindow.String()
+	}
+	expiryWindowFlag := flags.String("expiry-window", defaultWindow, "warn about keys expiring within this long")
+	unusedAfterFlag := flags.String("unused-after", "90d", "count keys with a recorded last use as unused when not used for this long")
+	expiredOnly := flags.Bool("expired-only", false, "only report keys that have expired")
+	failOnFlag := flags.String("fail-on", "", "exit non-zero on findings of this severity or worse: info, warning or error (default error)")
+	reportFormat := flags.String("report", "", "write a report in this format instead: md, html or sarif")
+	reportPath := flags.String("o", "", "file to write the report to (default stdout)")
+	notify := flags.Bool("notify", false, "post findings to the webhook from the notify settings")
+	webhook := flags.String("webhook", "", "post findings to this URL")
+	webhookFormat := flags.String("webhook-format", "", "post findings as json, slack or discord messages (default notify.format from the settings)")
+	notifySeverity := flags.String("notify-severity", "", "only post findings of this severity or worse (default notify.min_severity from the settings, or warning)")
+	noPlugins := flags.Bool("no-plugins", false, "skip the checks of the plugins listed in audit.plugins")
+	table := addTableFlags(flags)
+	parseFlagSet(flags, args)
+
+	var hook *notifier
+	if *notify || *webhook != "" {
+		var err error
+		hook, err = newNotifier(*webhook, *webhookFormat, *notifySeverity)
+		if err != nil {
+			fatalUsage(err)
+		}
+	}
+
+	expiryWindow, err := keyman.ParseAge(*expiryWindowFlag)
+	if err != nil {
+		fatal(err)
+	}
+	unusedAfter, err := keyman.ParseAge(*unusedAfterFlag)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Without --fail-on errors fail the audit, as with --all-users, and so
+	// do policy and plugin findings of warning or worse.
+	failOn, policyFailOn := keyman.SeverityError, keyman.SeverityWarning
+	if *failOnFlag != "" {
+		failOn, err = keyman.ParseSeverity(*failOnFlag)
+		if err != nil {
+			fatal(err)
+		}
+		policyFailOn = failOn
+	}
+
 	keys, err := getKeys()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	config, err := parseConfig()
+	policy, err := auditPolicy(*policyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	sshConfig, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	config, err := sshConfig.Mappings()
+	if err != nil {
+		fatal(err)
+	}
+
+	report := keyman.Audit(keys, config, unusedAfter)
+
+	weak := keyman.CheckStrength(keys)
+	jumpFindings := sshConfig.CheckJumpChains()
+	hostKeyFindings, err := checkHostKeys(sshConfig)
+	if err != nil {
+		fatal(err)
+	}
+	var policyFindings []keyman.Finding
+	if policy != nil {
+		policyFindings = policy.Evaluate(keys)
+	}
+	// Plugin checks are opted into by listing them in audit.plugins, so
+	// they fail the audit the way policy rules do.
+	var pluginFindings []keyman.Finding
+	if !*noPlugins {
+		pluginFindings = pluginAuditFindings(keys)
+	}
+
+	findings, err := auditFindings(report, sshConfig, expiryWindow, *expiredOnly, weak, append(policyFindings, pluginFindings...))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	failed := false
+	for _, finding := range findings {
+		if finding.Severity >= failOn {
+			failed = true
+		}
+	}
+	for _, finding := range append(policyFindings, pluginFindings...) {
+		if finding.Severity >= policyFailOn {
+			failed = true
+		}
+	}
+	if hook != nil {
+		for _, finding := range findings {
+			if err := hook.notify(findingNotification(finding)); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: webhook failed: %v\n", err)
+				break
+			}
+		}
+	}
+
+	if *reportFormat != "" {
+		sshPath, err := getSSHPath()
+		if err != nil {
+			fatal(err)
+		}
+		configPath, err := getConfigPath()
+		if err != nil {
+			fatal(err)
+		}
+		hostname, _ := os.Hostname()
+		err = writeAuditReport(*reportFormat, *reportPath, auditDocument{
+			Generated:  time.Now(),
+			Host:       hostname,
+			SSHDir:     sshPath,
+			ConfigPath: configPath,
+			Keys:       report.Keys,
+			Findings:   findings,
+		})
+		if err != nil {
+			fatal(err)
+		}
+		if *reportPath != "" {
+			fmt.Printf("Wrote audit report to %s\n", *reportPath)
+		}
+		if failed {
+			os.Exit(exitFindings)
+		}
+		return
+	}
+
+	if *table.format != "" {
+		printKeyTable(report.Keys, weak, findings, table)
+		if failed {
+			os.Exit(exitFindings)
+		}
+		return
 	}
 
 	fmt.Println("SSH Key Audit:")
 	fmt.Println("==============")
 
 	fmt.Println("\n--- Keys ---")
+	printKeyTable(report.Keys, weak, nil, table)
+
+	fmt.Println("\n--- Incomplete Key Pairs ---")
+	incomplete := 0
 	for _, key := range keys {
-		keyUsed := isKeyUsed(key, config)
-		timeSinceCreation := time.Since(key.created)
-		timeSinceCreationHours := timeSinceCreation.Hours()
-		timeString := ""
-		if timeSinceCreationHours < 24 {
-			timeString = fmt.Sprintf("%.1f hours ago", timeSinceCreationHours)
-		} else {
-			timeString = fmt.Sprintf("%.1f days ago", timeSinceCreationHours/24)
+		if key.MissingPublic {
+			fmt.Printf("Key: %s\nProblem: private key without a public key, run keyman pubkey %s\n\n", key.Name, key.Name)
+			incomplete++
 		}
-
-		if key.comment != "" {
-			fmt.Printf("Key: %s\nCreated: %s (%s)\nIn Use: %t\nComment: %s\n\n", key.name, key.created.Format(time.RFC3339), timeString, keyUsed, key.comment)
-		} else {
-			fmt.Printf("Key: %s\nCreated: %s (%s)\nIn Use: %t\n\n", key.name, key.created.Format(time.RFC3339), timeString, keyUsed)
+		if key.MissingPrivate {
+			fmt.Printf("Key: %s\nProblem: public key without a private key\n\n", key.Name)
+			incomplete++
 		}
 	}
+	if incomplete == 0 {
+		fmt.Println("No incomplete key pairs found")
+	}
 
 	fmt.Println("\n--- Unused Keys ---")
-	var unusedKeys []sshKey
-	for _, key := range keys {
-		if !isKeyUsed(key, config) {
-			unusedKeys = append(unusedKeys, key)
-		}
-	}
-	if len(unusedKeys) == 0 {
+	if len(report.Unused) == 0 {
 		fmt.Println("No unused keys found")
 	} else {
-		for _, key := range unusedKeys {
-			if key.comment != "" {
-				fmt.Printf("Key: %s\nCreated: %s\nComment: %s\n\n", key.name, key.created.Format(time.RFC3339), key.comment)
-			} else {
-				fmt.Printf("Key: %s\nCreated: %s\n\n", key.name, key.created.Format(time.RFC3339))
+		var unused []keyman.KeyStatus
+		for _, key := range report.Keys {
+			if !key.InUse {
+				unused = append(unused, key)
 			}
 		}
+		printKeyTable(unused, weak, nil, table)
+	}
+
+	fmt.Println("\n--- Hosts With Multiple Keys ---")
+	if len(report.MultipleKeys) == 0 {
+		fmt.Println("No hosts with multiple keys found")
+	} else {
+		hosts := make([]string, 0, len(report.MultipleKeys))
+		for host := range report.MultipleKeys {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			fmt.Printf("Host: %s\nKeys (in order tried): %s\n\n", host, strings.Join(report.MultipleKeys[host], ", "))
+		}
 	}
 
 	fmt.Println("\n--- Multiple Mappings ---")
-	multipleMappings := findMultipleMappings(config)
-	if len(multipleMappings) == 0 {
+	if len(report.MultipleMappings) == 0 {
 		fmt.Println("No keys with multiple mappings found")
 	} else {
-		for key, hosts := range multipleMappings {
+		for key, hosts := range report.MultipleMappings {
 			fmt.Printf("Key: %s\nMapped to Hosts: %s\n\n", key, strings.Join(hosts, ", "))
 		}
 	}
-}
 
-func findMultipleMappings(config map[string][]string) map[string][]string {
-	keyMappings := make(map[string][]string)
-	for host, keyPaths := range config {
-		for _, keyPath := range keyPaths {
-			keyMappings[keyPath] = append(keyMappings[keyPath], host)
+	fmt.Println("\n--- Duplicate Keys ---")
+	if len(report.Duplicates) == 0 && len(report.SameKeyHosts) == 0 {
+		fmt.Println("No duplicate keys found")
+	}
+	for _, group := range report.Duplicates {
+		var names []string
+		for _, key := range group {
+			names = append(names, key.Name)
+		}
+		fmt.Printf("Fingerprint: %s\nSame Key In: %s\n\n", group[0].Public.FingerprintSHA256(), strings.Join(names, ", "))
+	}
+	sameKeyHosts := make([]string, 0, len(report.SameKeyHosts))
+	for host := range report.SameKeyHosts {
+		sameKeyHosts = append(sameKeyHosts, host)
+	}
+	sort.Strings(sameKeyHosts)
+	for _, host := range sameKeyHosts {
+		fmt.Printf("Host: %s\nIdentityFiles With The Same Key: %s\n\n", host, strings.Join(report.SameKeyHosts[host], ", "))
+	}
+
+	fmt.Println("\n--- IdentitiesOnly ---")
+	withoutIdentitiesOnly := sshConfig.WithoutIdentitiesOnly()
+	if len(withoutIdentitiesOnly) == 0 {
+		fmt.Println("All hosts with explicit keys set IdentitiesOnly")
+	} else {
+		for _, block := range withoutIdentitiesOnly {
+			fmt.Printf("Host: %s\nRecommendation: set IdentitiesOnly yes so ssh-agent keys are not offered first, avoiding \"Too many authentication failures\"\n\n", block.Name())
+		}
+	}
+
+	fmt.Println("\n--- Jump Hosts ---")
+	if len(jumpFindings) == 0 {
+		fmt.Println("No jump host problems found")
+	}
+	for _, finding := range jumpFindings {
+		printFinding(finding, useColor(*table.plain))
+	}
+
+	fmt.Println("\n--- Host Keys ---")
+	if len(hostKeyFindings) == 0 {
+		fmt.Println("No host key in known_hosts changed since it was recorded")
+	}
+	for _, finding := range hostKeyFindings {
+		printFinding(finding, useColor(*table.plain))
+	}
+
+	fmt.Println("\n--- Expiry ---")
+	expiring := 0
+	now := time.Now()
+	for _, key := range keys {
+		meta := key.Metadata
+		if meta.Expired(now) || (!*expiredOnly && meta.ExpiresWithin(now, expiryWindow)) {
+			fmt.Printf("Key: %s\nExpires: %s\n\n", key.Name, expiryString(meta))
+			expiring++
+		}
+	}
+	if expiring == 0 {
+		fmt.Println("No expired or expiring keys found")
+	}
+
+	fmt.Println("\n--- Certificates ---")
+	certs := 0
+	for _, key := range keys {
+		cert := key.Certificate
+		if cert == nil {
+			continue
+		}
+		if cert.Expired(now) || (!*expiredOnly && cert.ExpiresWithin(now, expiryWindow)) {
+			fmt.Printf("Key: %s\nValid: %s\nPrincipals: %s\n\n", key.Name, validityString(cert), strings.Join(cert.Principals, ", "))
+			certs++
+		}
+	}
+	if certs == 0 {
+		fmt.Println("No expired or expiring certificates found")
+	}
+
+	fmt.Println("\n--- Git Signing ---")
+	signingProblem, err := checkGitSigning()
+	if err != nil {
+		fatal(err)
+	}
+	if signingProblem == "" {
+		fmt.Println("No git signing problems found")
+	} else {
+		fmt.Println(signingProblem)
+	}
+
+	fmt.Println("\n--- Permissions ---")
+	problems, err := checkPermissions()
+	if err != nil {
+		fatal(err)
+	}
+	if len(problems) == 0 {
+		fmt.Println("No permission problems found")
+	} else {
+		printPermissionProblems(problems)
+		fmt.Println("Run keyman fix-perms to correct these")
+	}
+
+	fmt.Println("\n--- Weak Keys ---")
+	if len(weak) == 0 {
+		fmt.Println("No weak keys found")
+	}
+	for _, finding := range weak {
+		printFinding(finding, useColor(*table.plain))
+	}
+
+	if policy != nil {
+		fmt.Println("\n--- Policy Findings ---")
+		if len(policyFindings) == 0 {
+			fmt.Println("No policy violations found")
+		}
+		for _, finding := range policyFindings {
+			printFinding(finding, useColor(*table.plain))
 		}
 	}
 
-	multipleMappings := make(map[string][]string)
-	for key, hosts := range keyMappings {
-		if len(hosts) > 1 {
-			multipleMappings[key] = hosts
+	if len(pluginFindings) > 0 {
+		fmt.Println("\n--- Plugin Checks ---")
+		for _, finding := range pluginFindings {
+			printFinding(finding, useColor(*table.plain))
 		}
 	}
 
-	return multipleMappings
+	if failed {
+		os.Exit(exitFindings)
+	}
+}
+
+func printFinding(finding keyman.Finding, color bool) {
+	severity := paint(strings.ToUpper(finding.Severity.String()), severityColor(finding.Severity), color)
+	fmt.Printf("[%s] %s: %s (%s)\n", severity, finding.Subject, finding.Message, finding.Rule)
 }
 
-func expandPath(path string) (string, error) {
-	if strings.HasPrefix(path, "~") {
-		usr, err := user.Current()
+// loadPolicy reads the policy at path, or the default policy file if path
+// is empty. It returns nil if no path was given and no default exists.
+func loadPolicy(path string) (*keyman.Policy, error) {
+	if path == "" {
+		configDir, err := os.UserConfigDir()
 		if err != nil {
-			return "", err
+			return nil, nil
+		}
+		path = filepath.Join(configDir, "keyman", "policy.yaml")
+		if _, err := os.Stat(path); err != nil {
+			return nil, nil
+		}
+	}
+
+	return keyman.LoadPolicy(path)
+}
+
+// auditPolicy loads the policy an audit evaluates, with max_key_age from
+// the settings applied when the policy file does not set it.
+func auditPolicy(path string) (*keyman.Policy, error) {
+	policy, err := loadPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	if settings.MaxKeyAge > 0 {
+		if policy == nil {
+			policy = keyman.NewPolicy()
+		}
+		if policy.MaxKeyAge == 0 {
+			policy.MaxKeyAge = settings.MaxKeyAge
 		}
-		return filepath.Join(usr.HomeDir, path[1:]), nil
 	}
-	return filepath.Abs(path)
+	return policy, nil
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const (
+	metadataFile = "metadata.json"
+
+	// expiryWarningWindow is how far ahead list and audit warn about keys
+	// that are about to expire.
+	expiryWarningWindow = 30 * 24 * time.Hour
+)
+
+// metadataHome is the home whose ~/.config/keyman holds the metadata
+// store, set by --all-users to the user being audited. Otherwise the store
+// is the current user's.
+var metadataHome string
+
+func getMetadataPath() (string, error) {
+	if metadataHome != "" {
+		return filepath.Join(metadataHome, ".config", "keyman", metadataFile), nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "keyman", metadataFile), nil
+}
+
+func loadMetadata() (*keyman.Metadata, error) {
+	path, err := getMetadataPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return keyman.LoadMetadata(path)
+}
+
+// recordCreation remembers when keyman generated a key, since the key
+// files' own timestamps change whenever they are copied or touched.
+// Failing to record it is only reported.
+func recordCreation(name string) {
+	metadata, err := loadMetadata()
+	if err == nil {
+		now := time.Now()
+		metadata.Get(name).Created = &now
+		err = metadata.Save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not record when %s was created: %v\n", name, err)
+	}
+}
+
+// keyName resolves a key argument to the name metadata is stored under,
+// checking that the key exists.
+func keyName(key string) (string, error) {
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(key, keyFileExt))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(keyPath + keyFileExt); err != nil {
+		return "", fmt.Errorf("key %s not found", key)
+	}
+	return filepath.Base(keyPath), nil
+}
+
+func tagKey(args []string) {
+	flags := flag.NewFlagSet("tag", flag.ExitOnError)
+	remove := flags.Bool("remove", false, "remove the tags instead of adding them")
+	args = parseFlags(flags, args)
+	if len(args) < 2 {
+		fatalUsage("Usage: keyman tag [--remove] <key> <tag>...")
+	}
+
+	name, err := keyName(args[0])
+	if err != nil {
+		fatal(err)
+	}
+
+	metadata, err := loadMetadata()
+	if err != nil {
+		fatal(err)
+	}
+
+	meta := metadata.Get(name)
+	oldTags := strings.Join(meta.Tags, ", ")
+	if *remove {
+		meta.RemoveTags(args[1:]...)
+	} else {
+		meta.AddTags(args[1:]...)
+	}
+
+	err = metadata.Save()
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("tag", name, oldTags, strings.Join(meta.Tags, ", "))
+	fmt.Printf("Tags for %s: %s\n", name, strings.Join(meta.Tags, ", "))
+}
+
+func noteKey(args []string) {
+	flags := flag.NewFlagSet("note", flag.ExitOnError)
+	owner := flags.String("owner", "", "set the key's owner")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman note [--owner o] <key> [description]")
+	}
+
+	name, err := keyName(args[0])
+	if err != nil {
+		fatal(err)
+	}
+
+	metadata, err := loadMetadata()
+	if err != nil {
+		fatal(err)
+	}
+
+	meta := metadata.Get(name)
+	old := strings.TrimSpace(meta.Owner + " " + meta.Description)
+	if len(args) > 1 {
+		meta.Description = strings.Join(args[1:], " ")
+	}
+	if *owner != "" {
+		meta.Owner = *owner
+	}
+
+	err = metadata.Save()
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("note", name, old, strings.TrimSpace(meta.Owner+" "+meta.Description))
+	fmt.Printf("Updated notes for %s\n", name)
+}
+
+func expireKey(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman expire set <key> <YYYY-MM-DD> | clear <key> | list")
+	}
+
+	metadata, err := loadMetadata()
+	if err != nil {
+		fatal(err)
+	}
+
+	var name, old string
+	switch args[0] {
+	case "set":
+		if len(args) < 3 {
+			fatalUsage("Usage: keyman expire set <key> <YYYY-MM-DD>")
+		}
+		name, err = keyName(args[1])
+		if err != nil {
+			fatal(err)
+		}
+		expires, err := time.ParseInLocation("2006-01-02", args[2], time.Local)
+		if err != nil {
+			fatalf("Invalid expiry date %q, expected YYYY-MM-DD", args[2])
+		}
+		old = expiryDate(metadata.Get(name))
+		metadata.Get(name).Expires = &expires
+		fmt.Printf("Key %s expires on %s\n", name, args[2])
+	case "clear":
+		if len(args) < 2 {
+			fatalUsage("Usage: keyman expire clear <key>")
+		}
+		name, err = keyName(args[1])
+		if err != nil {
+			fatal(err)
+		}
+		old = expiryDate(metadata.Get(name))
+		metadata.Get(name).Expires = nil
+		fmt.Printf("Cleared the expiry date of %s\n", name)
+	case "list":
+		listExpiringKeys(metadata)
+		return
+	default:
+		fatalUsage("Unknown expire command")
+	}
+
+	err = metadata.Save()
+	if err != nil {
+		fatal(err)
+	}
+	journal("expire", name, old, expiryDate(metadata.Get(name)))
+}
+
+func listExpiringKeys(metadata *keyman.Metadata) {
+	var names []string
+	for name, meta := range metadata.Keys {
+		if meta.Expires != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return metadata.Keys[names[i]].Expires.Before(*metadata.Keys[names[j]].Expires)
+	})
+
+	if len(names) == 0 {
+		fmt.Println("No keys have an expiry date")
+		return
+	}
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, expiryString(metadata.Keys[name]))
+	}
+}
+
+// expiryDate returns a key's expiry date as YYYY-MM-DD, or "" if it has none.
+func expiryDate(meta *keyman.KeyMetadata) string {
+	if meta.Expires == nil {
+		return ""
+	}
+	return meta.Expires.Format("2006-01-02")
+}
+
+// expiryString formats a key's expiry date with how close it is.
+func expiryString(meta *keyman.KeyMetadata) string {
+	now := time.Now()
+	date := meta.Expires.Format("2006-01-02")
+	switch {
+	case meta.Expired(now):
+		return date + " (EXPIRED)"
+	case meta.ExpiresWithin(now, expiryWarningWindow):
+		return fmt.Sprintf("%s (expires in %.0f days)", date, meta.Expires.Sub(now).Hours()/24)
+	default:
+		return date
+	}
+}
+
+func printKeyMetadata(meta *keyman.KeyMetadata) {
+	if meta == nil {
+		return
+	}
+	if len(meta.Tags) > 0 {
+		fmt.Printf("Tags: %s\n", strings.Join(meta.Tags, ", "))
+	}
+	if meta.Description != "" {
+		fmt.Printf("Description: %s\n", meta.Description)
+	}
+	if meta.Owner != "" {
+		fmt.Printf("Owner: %s\n", meta.Owner)
+	}
+	if meta.Expires != nil {
+		fmt.Printf("Expires: %s\n", expiryString(meta))
+	}
+	if meta.LastUsed != nil {
+		fmt.Printf("Last Used: %s\n", lastUsedString(meta))
+	}
+}
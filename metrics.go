@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// metrics exposes key hygiene as Prometheus gauges, written once to stdout
+// or a node_exporter textfile, or served over HTTP for every scrape.
+func metrics(args []string) {
+	flags := flag.NewFlagSet("metrics", flag.ExitOnError)
+	textfile := flags.String("textfile", "", "write the metrics to this file for the node_exporter textfile collector")
+	listen := flags.String("listen", "", "serve the metrics over HTTP on this address, such as :9840")
+	unusedAfterFlag := flags.String("unused-after", "90d", "count keys with a recorded last use as unused when not used for this long")
+	parseFlagSet(flags, args)
+
+	unusedAfter, err := keyman.ParseAge(*unusedAfterFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+
+	switch {
+	case *listen != "":
+		http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			text, err := collectMetrics(unusedAfter)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fmt.Fprint(w, text)
+		})
+		fmt.Printf("Serving metrics on http://%s/metrics\n", *listen)
+		fatal(http.ListenAndServe(*listen, nil))
+	case *textfile != "":
+		text, err := collectMetrics(unusedAfter)
+		if err != nil {
+			fatal(err)
+		}
+		if err := writeTextfile(*textfile, text); err != nil {
+			fatal(err)
+		}
+	default:
+		text, err := collectMetrics(unusedAfter)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Print(text)
+	}
+}
+
+// writeTextfile replaces path with text in one rename, so the collector
+// never reads a half written file.
+func writeTextfile(path, text string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), ".keyman-metrics-")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := file.WriteString(text); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// collectMetrics audits the keys and returns the results in the Prometheus
+// text exposition format.
+func collectMetrics(unusedAfter time.Duration) (string, error) {
+	keys, err := getKeys()
+	if err != nil {
+		return "", err
+	}
+	config, err := parseConfig()
+	if err != nil {
+		return "", err
+	}
+	report := keyman.Audit(keys, config, unusedAfter)
+
+	expiryWindow := settings.ExpiryWindow
+	if expiryWindow == 0 {
+		expiryWindow = 30 * 24 * time.Hour
+	}
+
+	now := time.Now()
+	types := make(map[string]int)
+	var oldest time.Duration
+	unencrypted, expiringCerts, expiredCerts, expiringKeys := 0, 0, 0, 0
+	for _, key := range report.Keys {
+		if key.Public != nil {
+			types[key.Public.TypeName()]++
+		}
+		if key.Age > oldest {
+			oldest = key.Age
+		}
+		if !key.MissingPrivate {
+			if encrypted, err := keyman.IsEncrypted(key.PrivatePath()); err == nil && !encrypted && (key.Public == nil || !key.Public.IsSecurityKey()) {
+				unencrypted++
+			}
+		}
+		if cert := key.Certificate; cert != nil {
+			if cert.Expired(now) {
+				expiredCerts++
+			} else if cert.ExpiresWithin(now, expiryWindow) {
+				expiringCerts++
+			}
+		}
+		if key.Metadata.Expired(now) || key.Metadata.ExpiresWithin(now, expiryWindow) {
+			expiringKeys++
+		}
+	}
+
+	var b strings.Builder
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+
+	fmt.Fprintf(&b, "# HELP keyman_keys SSH keys in the ssh directory, by type.\n# TYPE keyman_keys gauge\n")
+	var typeNames []string
+	for name := range types {
+		typeNames = append(typeNames, name)
+	}
+	sort.Strings(typeNames)
+	for _, name := range typeNames {
+		fmt.Fprintf(&b, "keyman_keys{type=%q} %d\n", strings.ToLower(name), types[name])
+	}
+	gauge("keyman_keys_total", "SSH keys in the ssh directory.", float64(len(report.Keys)))
+	gauge("keyman_unused_keys", "Keys not mapped to any host or not used recently.", float64(len(report.Unused)))
+	gauge("keyman_oldest_key_age_seconds", "Age of the oldest key.", oldest.Seconds())
+	gauge("keyman_unencrypted_keys", "Private keys without a passphrase, not counting security keys.", float64(unencrypted))
+	gauge("keyman_weak_keys", "Keys using a weak algorithm or key size.", float64(len(keyman.CheckStrength(keys))))
+	gauge("keyman_expiring_keys", "Keys that have expired or expire within the expiry window.", float64(expiringKeys))
+	gauge("keyman_expiring_certificates", "Certificates that expire within the expiry window.", float64(expiringCerts))
+	gauge("keyman_expired_certificates", "Certificates that have expired.", float64(expiredCerts))
+	gauge("keyman_last_run_timestamp_seconds", "When these metrics were collected.", float64(now.Unix()))
+	return b.String(), nil
+}
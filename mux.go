@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// muxOptions are the options mux enable sets and mux disable removes, in
+// the order they are written.
+var muxOptions = []string{"ControlMaster", "ControlPath", "ControlPersist"}
+
+// muxSocketName is the ControlPath file name mux enable uses. %C is a hash
+// of the local host, remote host, port, user and jump hosts, which keeps
+// socket paths short and never puts a user supplied host name in them.
+const muxSocketName = "%C"
+
+// maxSocketPath is the longest path a Unix socket may have on macOS and the
+// BSDs. Linux allows a few more characters.
+const maxSocketPath = 104
+
+var (
+	persistPattern = regexp.MustCompile(`^(?i)(yes|no|([0-9]+[smhdw]?)+)$`)
+	masterPID      = regexp.MustCompile(`pid=([0-9]+)`)
+)
+
+// muxSocket is a control socket as mux status shows it, with the hosts
+// whose ControlPath it is. A socket that is not live has no master behind
+// it, as when one was killed.
+type muxSocket struct {
+	Path  string   `json:"path"`
+	Hosts []string `json:"hosts"`
+	Live  bool     `json:"live"`
+	PID   int      `json:"pid,omitempty"`
+}
+
+func mux(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman mux enable|disable|status|close")
+	}
+	if runtime.GOOS == "windows" {
+		fatal("OpenSSH for Windows does not support ControlMaster connection sharing")
+	}
+
+	switch args[0] {
+	case "enable":
+		enableMux(args[1:])
+	case "disable":
+		disableMux(args[1:])
+	case "status":
+		muxStatus(args[1:])
+	case "close":
+		closeMux(args[1:])
+	default:
+		fatalUsage("Unknown mux command")
+	}
+}
+
+// enableMux sets ControlMaster, ControlPath and ControlPersist on a host,
+// or in Host * for every host, with the sockets in a directory only the
+// user can reach.
+func enableMux(args []string) {
+	flags := flag.NewFlagSet("mux enable", flag.ExitOnError)
+	persist := flags.String("persist", "10m", "how long the shared connection stays open after the last session ends: a time such as 10m, yes for good, or no")
+	dir := flags.String("dir", "", "directory for the control sockets (default ~/.ssh/sockets)")
+	args = parseFlags(flags, args)
+	if len(args) > 1 {
+		fatalUsage("Usage: keyman mux enable [--persist time] [--dir path] [host]")
+	}
+	if !persistPattern.MatchString(*persist) {
+		fatalUsagef("Invalid --persist %q, use a time such as 10m or 1h30m, yes or no", *persist)
+	}
+
+	socketDir, err := muxSocketDir(*dir)
+	if err != nil {
+		fatal(err)
+	}
+	// %C expands to 40 hex characters, and while the master sets up its
+	// socket ssh adds a dot and 16 random characters to it. The limit
+	// counts the NUL that ends the path too.
+	if len(socketDir)+1+40+17+1 > maxSocketPath {
+		fatalf("Sockets in %s would have paths over the %d characters a socket path may have, use a shorter --dir", socketDir, maxSocketPath)
+	}
+	if err := prepareSocketDir(socketDir); err != nil {
+		fatal(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	block, subject := muxBlock(config, args, true)
+	values := []string{"auto", filepath.Join(socketDir, muxSocketName), *persist}
+	for i, option := range muxOptions {
+		block.SetOption(option, values[i])
+	}
+
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	journal("mux enable", subject, "", socketDir)
+	if !dryRun {
+		fmt.Printf("Enabled connection sharing for %s, with sockets in %s\n", subject, socketDir)
+		if len(args) == 0 {
+			warnDefaultsOrder(config)
+		}
+	}
+}
+
+// disableMux removes the options mux enable sets from a host, or from
+// Host *.
+func disableMux(args []string) {
+	if len(args) > 1 {
+		fatalUsage("Usage: keyman mux disable [host]")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	block, subject := muxBlock(config, args, false)
+	removed := 0
+	for _, option := range muxOptions {
+		removed += block.RemoveOption(option, func(string) bool { return true })
+	}
+	if removed == 0 {
+		fatalf("Connection sharing is not set up for %s", subject)
+	}
+	if block.IsDefaults() && block.IsEmpty() {
+		block.Remove()
+	}
+
+	if err := saveConfig(config); err != nil {
+		fatal(err)
+	}
+	journal("mux disable", subject, "", "")
+	if !dryRun {
+		fmt.Printf("Disabled connection sharing for %s; connections already open stay open until closed\n", subject)
+	}
+}
+
+// muxBlock returns the Host block named in args, or Host * when there is
+// none, creating Host * if create is set, along with how to refer to it.
+func muxBlock(config *keyman.Config, args []string, create bool) (*keyman.HostBlock, string) {
+	if len(args) == 0 || args[0] == keyman.DefaultsHost {
+		block := config.Defaults()
+		switch {
+		case block == nil && !create:
+			fatal("Connection sharing is not set up in the Host * defaults")
+		case block == nil:
+			block = config.AppendHost(keyman.DefaultsHost)
+		}
+		return block, "all hosts"
+	}
+
+	block := config.FindHost(args[0])
+	if block == nil {
+		fatalf("Host %s not found in config", args[0])
+	}
+	return block, "host " + args[0]
+}
+
+// muxSocketDir returns dir expanded, or the default socket directory.
+func muxSocketDir(dir string) (string, error) {
+	if dir != "" {
+		return keyman.ExpandPath(dir)
+	}
+	sshPath, err := getSSHPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(sshPath, "sockets"), nil
+}
+
+// prepareSocketDir creates dir, or tightens it, so only the user can reach
+// the sockets in it: anyone who can connect to a control socket can run
+// commands on the host as the user without logging in.
+func prepareSocketDir(dir string) error {
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err) && dryRun:
+		fmt.Printf("Would create %s\n", dir)
+		return nil
+	case os.IsNotExist(err):
+		return os.MkdirAll(dir, 0700)
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("%s is not a directory", dir)
+	case info.Mode().Perm()&0077 == 0:
+		return nil
+	case dryRun:
+		fmt.Printf("Would change the mode of %s to 0700\n", dir)
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %s was mode %04o, changing it to 0700\n", dir, info.Mode().Perm())
+	return os.Chmod(dir, 0700)
+}
+
+// muxStatus lists the control sockets in the directories the config's
+// ControlPaths point to, with the hosts they serve and whether a master
+// connection is still behind each.
+func muxStatus(args []string) {
+	flags := flag.NewFlagSet("mux status", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the sockets as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	parseFlagSet(flags, args)
+
+	sockets, err := findMuxSockets()
+	if err != nil {
+		fatal(err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(sockets); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if len(sockets) == 0 {
+		fmt.Println("No control sockets found")
+		return
+	}
+
+	var rows [][]tableCell
+	for _, socket := range sockets {
+		status := tableCell{text: fmt.Sprintf("live (pid %d)", socket.PID), color: colorGreen}
+		if !socket.Live {
+			status = tableCell{text: "stale", color: colorYellow}
+		}
+		rows = append(rows, []tableCell{{text: strings.Join(socket.Hosts, ", ")}, status, {text: socket.Path}})
+	}
+	writeTable(os.Stdout, []string{"host", "status", "socket"}, rows, useColor(*plain))
+}
+
+// closeMux asks the masters of the hosts named, or of every live socket
+// with --all, to exit, closing every session sharing them.
+func closeMux(args []string) {
+	flags := flag.NewFlagSet("mux close", flag.ExitOnError)
+	all := flags.Bool("all", false, "close every live master and remove stale sockets")
+	hosts := parseFlags(flags, args)
+	if *all == (len(hosts) > 0) {
+		fatalUsage("Usage: keyman mux close --all | <host>...")
+	}
+
+	if !*all {
+		for _, host := range hosts {
+			if dryRun {
+				fmt.Printf("Would close the shared connection to %s\n", host)
+				continue
+			}
+			if _, err := muxControl("exit", "", host); err != nil {
+				fatal(err)
+			}
+			fmt.Printf("Closed the shared connection to %s\n", host)
+		}
+		return
+	}
+
+	sockets, err := findMuxSockets()
+	if err != nil {
+		fatal(err)
+	}
+	for _, socket := range sockets {
+		name := socket.Path
+		if len(socket.Hosts) > 0 {
+			name = strings.Join(socket.Hosts, ", ")
+		}
+		if !socket.Live {
+			if err := removeFile(socket.Path); err != nil {
+				fatal(err)
+			}
+			continue
+		}
+		if dryRun {
+			fmt.Printf("Would close the shared connection to %s\n", name)
+			continue
+		}
+		if _, err := muxControl("exit", socket.Path, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+		fmt.Printf("Closed the shared connection to %s\n", name)
+	}
+}
+
+// findMuxSockets returns the sockets in the directories of every ControlPath
+// in the config, and the default socket directory, sorted by path.
+func findMuxSockets() ([]muxSocket, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]bool)
+	if dir, err := muxSocketDir(""); err == nil {
+		dirs[dir] = true
+	}
+	var hosts []string
+	for _, block := range config.AllBlocks() {
+		for _, path := range block.Options("ControlPath") {
+			if path == "none" {
+				continue
+			}
+			path, err := keyman.ExpandPath(path)
+			if err == nil && !strings.Contains(filepath.Dir(path), "%") {
+				dirs[filepath.Dir(path)] = true
+			}
+		}
+		if !block.Match && !strings.ContainsAny(block.Name(), "*?!") {
+			hosts = append(hosts, block.Patterns...)
+		}
+	}
+
+	// ssh -G expands the ControlPath of each host, %C and all, which is
+	// the only way to tell whose socket is whose.
+	owners := make(map[string][]string)
+	for _, host := range hosts {
+		shared := false
+		for _, block := range config.MatchingBlocks(host) {
+			shared = shared || block.Option("ControlPath") != ""
+		}
+		if !shared {
+			continue
+		}
+		resolved, err := resolveHost(host)
+		if err != nil {
+			continue
+		}
+		if path := first(resolved["controlpath"]); path != "" {
+			owners[path] = append(owners[path], host)
+		}
+	}
+
+	sockets := []muxSocket{}
+	for dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type()&os.ModeSocket == 0 {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			socket := muxSocket{Path: path, Hosts: owners[path]}
+			if socket.Hosts == nil {
+				socket.Hosts = []string{}
+			}
+			if output, err := muxControl("check", path, ""); err == nil {
+				socket.Live = true
+				if match := masterPID.FindStringSubmatch(output); match != nil {
+					socket.PID, _ = strconv.Atoi(match[1])
+				}
+			}
+			sockets = append(sockets, socket)
+		}
+	}
+	sort.Slice(sockets, func(i, j int) bool { return sockets[i].Path < sockets[j].Path })
+	return sockets, nil
+}
+
+// muxControl sends a control command such as check or exit to the master
+// of a socket, or of host as the config sets it up, returning what ssh
+// printed.
+func muxControl(command, socket, host string) (string, error) {
+	args := []string{"-O", command}
+	if socket != "" {
+		// ssh wants a destination, though with -S it goes unused.
+		args = append(args, "-S", socket, "keyman")
+	} else {
+		configPath, err := getConfigPath()
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(configPath); err == nil {
+			args = append(args, "-F", configPath)
+		}
+		args = append(args, "--", host)
+	}
+
+	cmd := exec.Command(toolPath("ssh"), args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		target := host
+		if target == "" {
+			target = socket
+		}
+		return "", fmt.Errorf("ssh -O %s %s: %v: %s", command, target, err, strings.TrimSpace(output.String()))
+	}
+	return output.String(), nil
+}
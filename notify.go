@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const defaultNotifyTemplate = "keyman {severity} on {host}: {subject}: {message}"
+
+// notification is an audit finding or daemon event, as printed and posted
+// to a webhook.
+type notification struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Event    string    `json:"event"`
+	Severity string    `json:"severity"`
+	Rule     string    `json:"rule,omitempty"`
+	Subject  string    `json:"subject"`
+	Message  string    `json:"message"`
+	Text     string    `json:"text"`
+}
+
+// notifier posts notifications of at least minSeverity to a webhook in the
+// shape its service expects.
+type notifier struct {
+	url         string
+	format      string
+	template    string
+	minSeverity keyman.Severity
+}
+
+// newNotifier sets up a notifier, falling back to the [notify] settings for
+// anything not given.
+func newNotifier(url, format, minSeverity string) (*notifier, error) {
+	n := &notifier{
+		url:      orDefault(url, settings.NotifyWebhook),
+		format:   orDefault(format, orDefault(settings.NotifyFormat, "json")),
+		template: orDefault(settings.NotifyTemplate, defaultNotifyTemplate),
+	}
+	if n.url == "" {
+		return nil, fmt.Errorf("no webhook configured, set notify.webhook in %s or use --webhook", settingsFile)
+	}
+	switch n.format {
+	case "json", "slack", "discord":
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q, use json, slack or discord", n.format)
+	}
+
+	var err error
+	n.minSeverity, err = keyman.ParseSeverity(orDefault(minSeverity, orDefault(settings.NotifyMinSeverity, "warning")))
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// findingNotification describes an audit finding as a notification.
+func findingNotification(finding keyman.Finding) notification {
+	return notification{
+		Event:    "finding",
+		Severity: finding.Severity.String(),
+		Rule:     finding.Rule,
+		Subject:  finding.Subject,
+		Message:  finding.Message,
+	}
+}
+
+// notify posts event unless it is less severe than the notifier's minimum.
+func (n *notifier) notify(event notification) error {
+	if severity, _ := keyman.ParseSeverity(event.Severity); severity < n.minSeverity {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Host == "" {
+		event.Host, _ = os.Hostname()
+	}
+	event.Text = strings.NewReplacer(
+		"{severity}", event.Severity,
+		"{host}", event.Host,
+		"{event}", event.Event,
+		"{rule}", event.Rule,
+		"{subject}", event.Subject,
+		"{message}", event.Message,
+		"{time}", event.Time.Format(time.RFC3339),
+	).Replace(n.template)
+
+	var payload interface{} = event
+	switch n.format {
+	case "slack":
+		payload = map[string]string{"text": event.Text}
+	case "discord":
+		payload = map[string]string{"content": event.Text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// osLoginProfile is the part of gcloud's OS Login profile keyman reads.
+type osLoginProfile struct {
+	Name          string `json:"name"`
+	PosixAccounts []struct {
+		Username string `json:"username"`
+		Primary  bool   `json:"primary"`
+	} `json:"posixAccounts"`
+	SSHPublicKeys map[string]struct {
+		Key                string `json:"key"`
+		Fingerprint        string `json:"fingerprint"`
+		ExpirationTimeUsec string `json:"expirationTimeUsec"`
+	} `json:"sshPublicKeys"`
+}
+
+// osLoginKey is a key registered with OS Login, as oslogin list --json
+// shows it. ID is the fingerprint OS Login knows the key by.
+type osLoginKey struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Comment     string     `json:"comment,omitempty"`
+	LocalKey    string     `json:"local_key,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Expired     bool       `json:"expired"`
+	pub         *keyman.PublicKey
+}
+
+// oslogin manages the keys of the gcloud account's Google Cloud OS Login
+// profile, which GCE instances with OS Login enabled accept in place of
+// keys in instance or project metadata.
+func oslogin(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman oslogin push|list|remove|prune")
+	}
+
+	switch args[0] {
+	case "push":
+		osLoginPush(args[1:])
+	case "list":
+		osLoginList(args[1:])
+	case "remove":
+		osLoginRemove(args[1:])
+	case "prune":
+		osLoginPrune(args[1:])
+	default:
+		fatalUsage("Unknown oslogin command")
+	}
+}
+
+func osLoginPush(args []string) {
+	flags := flag.NewFlagSet("oslogin push", flag.ExitOnError)
+	ttl := flags.String("ttl", "", "remove the key from the profile after this long, such as 12h or 30d")
+	args = parseFlags(flags, args)
+	if len(args) != 1 {
+		fatalUsage("Usage: keyman oslogin push [--ttl d] <key>")
+	}
+
+	keyPath, err := resolveKeyArg(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	pubPath := keyPath + keyFileExt
+	pub, err := keyman.ReadPublicKeyFile(pubPath)
+	if err != nil {
+		fatal(err)
+	}
+	gcloudArgs := []string{"compute", "os-login", "ssh-keys", "add", "--key-file=" + pubPath}
+	expires := ""
+	if *ttl != "" {
+		duration, err := keyman.ParseAge(*ttl)
+		if err != nil || duration < time.Second {
+			fatalUsagef("Invalid --ttl %q, expected a duration such as 12h or 30d", *ttl)
+		}
+		gcloudArgs = append(gcloudArgs, fmt.Sprintf("--ttl=%ds", int64(duration.Seconds())))
+		expires = time.Now().Add(duration).Format(time.RFC3339)
+	}
+
+	if dryRun {
+		fmt.Printf("Would add key %s to the OS Login profile\n", args[0])
+		return
+	}
+	if _, err := runCloudTool(nil, "gcloud", gcloudArgs...); err != nil {
+		fatal(err)
+	}
+	journal("oslogin push", keyPath, "", pub.FingerprintSHA256())
+	fmt.Printf("Added key %s to the OS Login profile\n", args[0])
+	if expires != "" {
+		fmt.Printf("Expires: %s\n", expires)
+	}
+	if profile, err := fetchOSLoginProfile(); err == nil {
+		if user := profile.posixUser(); user != "" {
+			fmt.Printf("Log in to instances as %s\n", user)
+		}
+	}
+}
+
+func osLoginList(args []string) {
+	flags := flag.NewFlagSet("oslogin list", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the keys as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman oslogin list [--json] [--plain]")
+	}
+
+	profile, err := fetchOSLoginProfile()
+	if err != nil {
+		fatal(err)
+	}
+	keys, err := profile.keys()
+	if err != nil {
+		fatal(err)
+	}
+
+	if *asJSON {
+		if keys == nil {
+			keys = []osLoginKey{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(keys); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	fmt.Printf("OS Login profile %s", profile.Name)
+	if user := profile.posixUser(); user != "" {
+		fmt.Printf(", user %s", user)
+	}
+	fmt.Println()
+	if len(keys) == 0 {
+		fmt.Println("No keys")
+		return
+	}
+	var rows [][]tableCell
+	for _, key := range keys {
+		local := tableCell{text: key.LocalKey}
+		if key.LocalKey == "" {
+			local = tableCell{text: "not local", color: colorYellow}
+		}
+		expires := tableCell{text: "never"}
+		if key.ExpiresAt != nil {
+			expires.text = key.ExpiresAt.Local().Format("2006-01-02 15:04")
+		}
+		if key.Expired {
+			expires.color = colorRed
+		}
+		rows = append(rows, []tableCell{
+			{text: key.Type},
+			{text: key.Fingerprint},
+			{text: key.Comment},
+			local,
+			expires,
+		})
+	}
+	writeTable(os.Stdout, []string{"type", "fingerprint", "comment", "local key", "expires"}, rows, useColor(*plain))
+}
+
+func osLoginRemove(args []string) {
+	flags := flag.NewFlagSet("oslogin remove", flag.ExitOnError)
+	args = parseFlags(flags, args)
+	if len(args) != 1 {
+		fatalUsage("Usage: keyman oslogin remove <key|fingerprint>")
+	}
+
+	profile, err := fetchOSLoginProfile()
+	if err != nil {
+		fatal(err)
+	}
+	keys, err := profile.keys()
+	if err != nil {
+		fatal(err)
+	}
+
+	query := args[0]
+	var localPub *keyman.PublicKey
+	if keyPath, err := resolveKeyArg(query); err == nil {
+		localPub, _ = keyman.ReadPublicKeyFile(keyPath + keyFileExt)
+	}
+	var matched []osLoginKey
+	for _, key := range keys {
+		switch {
+		case key.ID == query, key.pub != nil && keyman.FingerprintMatches(key.pub, query):
+		case key.pub != nil && localPub != nil && string(key.pub.Blob) == string(localPub.Blob):
+		default:
+			continue
+		}
+		matched = append(matched, key)
+	}
+	if len(matched) == 0 {
+		fatalf("No key in the OS Login profile matches %s", query)
+	}
+	removeOSLoginKeys(matched)
+}
+
+// osLoginPrune removes the stale keys from the OS Login profile: those
+// that have expired and, with --unknown, those with no key in the ssh
+// directory, which are often left from machines long gone.
+func osLoginPrune(args []string) {
+	flags := flag.NewFlagSet("oslogin prune", flag.ExitOnError)
+	unknown := flags.Bool("unknown", false, "also remove keys that are not in the ssh directory")
+	yes := flags.Bool("yes", false, "remove without asking")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman oslogin prune [--unknown] [--yes]")
+	}
+
+	profile, err := fetchOSLoginProfile()
+	if err != nil {
+		fatal(err)
+	}
+	keys, err := profile.keys()
+	if err != nil {
+		fatal(err)
+	}
+	var stale []osLoginKey
+	for _, key := range keys {
+		if key.Expired || (*unknown && key.LocalKey == "") {
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) == 0 {
+		fmt.Println("No stale keys in the OS Login profile")
+		return
+	}
+
+	for _, key := range stale {
+		reason := "not local"
+		if key.Expired {
+			reason = "expired"
+		}
+		fmt.Printf("%s %s %s (%s)\n", key.Type, orDefault(key.Fingerprint, key.ID), key.Comment, reason)
+	}
+	if !*yes && !dryRun {
+		fmt.Printf("Remove %d key(s) from the OS Login profile? [y/N]: ", len(stale))
+		answer, _ := stdin.ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			fmt.Println("Nothing removed")
+			return
+		}
+	}
+	removeOSLoginKeys(stale)
+}
+
+// removeOSLoginKeys removes keys from the OS Login profile, going on past
+// any that fail.
+func removeOSLoginKeys(keys []osLoginKey) {
+	failed := 0
+	for _, key := range keys {
+		name := orDefault(key.Fingerprint, key.ID)
+		if dryRun {
+			fmt.Printf("Would remove %s from the OS Login profile\n", name)
+			continue
+		}
+		if _, err := runCloudTool(nil, "gcloud", "compute", "os-login", "ssh-keys", "remove", "--key="+key.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: removing %s: %v\n", name, err)
+			failed++
+			continue
+		}
+		journal("oslogin remove", name, key.Comment, "")
+		fmt.Printf("Removed %s from the OS Login profile\n", name)
+	}
+	if failed > 0 {
+		fatalf("%d key(s) could not be removed", failed)
+	}
+}
+
+// fetchOSLoginProfile reads the OS Login profile of the account gcloud is
+// logged in as.
+func fetchOSLoginProfile() (*osLoginProfile, error) {
+	output, err := runCloudTool(nil, "gcloud", "compute", "os-login", "describe-profile", "--format=json")
+	if err != nil {
+		return nil, err
+	}
+	var profile osLoginProfile
+	if err := json.Unmarshal(output, &profile); err != nil {
+		return nil, fmt.Errorf("reading the OS Login profile: %v", err)
+	}
+	return &profile, nil
+}
+
+// posixUser is the user name OS Login gives the account on instances.
+func (p *osLoginProfile) posixUser() string {
+	for _, account := range p.PosixAccounts {
+		if account.Primary {
+			return account.Username
+		}
+	}
+	if len(p.PosixAccounts) > 0 {
+		return p.PosixAccounts[0].Username
+	}
+	return ""
+}
+
+// keys lists the profile's keys sorted by comment, matched against the
+// keys in the ssh directory.
+func (p *osLoginProfile) keys() ([]osLoginKey, error) {
+	localKeys, err := getKeys()
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]string)
+	for _, key := range localKeys {
+		if key.Public != nil {
+			local[string(key.Public.Blob)] = key.Name
+		}
+	}
+
+	now := time.Now()
+	var keys []osLoginKey
+	for id, entry := range p.SSHPublicKeys {
+		key := osLoginKey{ID: orDefault(entry.Fingerprint, id)}
+		if pub, err := keyman.ParsePublicKey(entry.Key); err == nil {
+			key.pub = pub
+			key.Type = fmt.Sprintf("%s %d", pub.TypeName(), pub.Bits())
+			key.Fingerprint = pub.FingerprintSHA256()
+			key.Comment = pub.Comment
+			key.LocalKey = local[string(pub.Blob)]
+		}
+		if usec, err := strconv.ParseInt(entry.ExpirationTimeUsec, 10, 64); err == nil && usec > 0 {
+			expires := time.UnixMicro(usec)
+			key.ExpiresAt = &expires
+			key.Expired = expires.Before(now)
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Comment != keys[j].Comment {
+			return keys[i].Comment < keys[j].Comment
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
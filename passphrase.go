@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const minPassphraseLength = 8
+
+// changePassphrase adds, changes or removes the passphrase on a private key
+// using ssh-keygen -p.
+func changePassphrase(args []string) {
+	flags := flag.NewFlagSet("passphrase", flag.ExitOnError)
+	remove := flags.Bool("remove", false, "remove the passphrase")
+	minLength := flags.Int("min-length", minPassphraseLength, "minimum length of the new passphrase")
+	passphraseFile := flags.String("passphrase-file", "", "read the new passphrase from a file, or - for stdin")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman passphrase [--remove] [--min-length n] [--passphrase-file f] <key>")
+	}
+
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(args[0], keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	encrypted, err := keyman.IsEncrypted(keyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *remove && !encrypted {
+		fmt.Printf("Key %s has no passphrase\n", args[0])
+		return
+	}
+
+	oldPassphrase := ""
+	if encrypted {
+		oldPassphrase, err = readSecret("Current passphrase: ")
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	newPassphrase := ""
+	if !*remove {
+		if *passphraseFile != "" {
+			newPassphrase, err = readPassphraseFile(*passphraseFile)
+		} else {
+			newPassphrase, err = getPassphrase("", "New passphrase: ", true)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if len(newPassphrase) < *minLength {
+			fatalf("The new passphrase must be at least %d characters long", *minLength)
+		}
+	}
+
+	if err := runKeygen(oldPassphrase, newPassphrase, "-q", "-p", "-f", keyPath); err != nil {
+		fatalf("Changing the passphrase failed: %v", err)
+	}
+
+	journal("passphrase", keyPath, "", "")
+	switch {
+	case *remove:
+		fmt.Printf("Removed the passphrase from %s\n", args[0])
+	case encrypted:
+		fmt.Printf("Changed the passphrase on %s\n", args[0])
+	default:
+		fmt.Printf("Added a passphrase to %s\n", args[0])
+	}
+}
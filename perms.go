@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+func fixPerms(args []string) {
+	flags := flag.NewFlagSet("fix-perms", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "fix permissions without asking")
+	parseFlagSet(flags, args)
+
+	if runtime.GOOS == "windows" {
+		fmt.Println("Windows controls access with ACLs rather than file modes; restrict ~/.ssh with icacls instead")
+		return
+	}
+
+	problems, err := checkPermissions()
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("All permissions are correct")
+		return
+	}
+
+	printPermissionProblems(problems)
+
+	if !*yes {
+		fmt.Print("Fix these permissions? [y/N]: ")
+		answer, _ := stdin.ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			return
+		}
+	}
+
+	for _, problem := range problems {
+		err := os.Chmod(problem.Path, problem.Want)
+		if err != nil {
+			fatal(err)
+		}
+		journal("chmod", problem.Path, fmt.Sprintf("%04o", problem.Mode), fmt.Sprintf("%04o", problem.Want))
+		fmt.Printf("Changed %s to %04o\n", problem.Path, problem.Want)
+	}
+}
+
+func checkPermissions() ([]keyman.PermissionProblem, error) {
+	sshPath, err := getSSHPath()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := getKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return keyman.CheckPermissions(sshPath, keys)
+}
+
+func printPermissionProblems(problems []keyman.PermissionProblem) {
+	for _, problem := range problems {
+		fmt.Printf("Path: %s\nMode: %04o (want %04o)\nProblem: %s\n\n", problem.Path, problem.Mode, problem.Want, problem.Message)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// pickerHeight is how many matches the picker shows at once.
+const pickerHeight = 10
+
+var errPickerCancelled = errors.New("cancelled")
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// pickOrUsage lets the user choose one of items when keyman runs in a
+// terminal, and otherwise exits with usage, as a command missing an
+// argument did before. With allowNew, text that matches nothing can be
+// chosen as typed.
+func pickOrUsage(usage, label string, items []string, allowNew bool) string {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stderr) || (len(items) == 0 && !allowNew) {
+		fatalUsage(usage)
+	}
+	choice, err := pick(label, items, allowNew)
+	if err == errPickerCancelled {
+		fatalUsage("Cancelled")
+	}
+	if err != nil {
+		fatal(err)
+	}
+	return choice
+}
+
+// pick shows a list of items on stderr that narrows as the user types,
+// fzf style, and returns the one chosen with Enter. The arrow keys or
+// Ctrl-P and Ctrl-N move the selection, Esc or Ctrl-C cancels.
+func pick(label string, items []string, allowNew bool) (string, error) {
+	restore, err := makeRaw()
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	var query []rune
+	selected := 0
+	buf := make([]byte, 64)
+	for {
+		matches := fuzzyFilter(items, string(query))
+		if selected >= len(matches) {
+			selected = len(matches) - 1
+		}
+		if selected < 0 {
+			selected = 0
+		}
+		drawPicker(label, string(query), matches, selected)
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			clearPicker()
+			return "", err
+		}
+		input := buf[:n]
+
+		switch {
+		case n == 1 && (input[0] == 3 || input[0] == 27):
+			clearPicker()
+			return "", errPickerCancelled
+		case input[0] == '\r' || input[0] == '\n':
+			clearPicker()
+			if len(matches) > 0 {
+				return matches[selected], nil
+			}
+			if allowNew && len(query) > 0 {
+				return string(query), nil
+			}
+		case string(input) == "\x1b[A" || string(input) == "\x1bOA" || input[0] == 16:
+			selected--
+		case string(input) == "\x1b[B" || string(input) == "\x1bOB" || input[0] == 14:
+			selected++
+		case input[0] == 127 || input[0] == 8:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+			}
+		case input[0] == 21:
+			query = nil
+		case input[0] == 27:
+			// Some other escape sequence, such as Home or a function key.
+		default:
+			for _, r := range string(input) {
+				if unicode.IsPrint(r) {
+					query = append(query, r)
+				}
+			}
+			selected = 0
+		}
+	}
+}
+
+// drawPicker draws the prompt line with the matches below it, then puts the
+// cursor back at the end of the query.
+func drawPicker(label, query string, matches []string, selected int) {
+	var b strings.Builder
+	b.WriteString("\r\x1b[J")
+	fmt.Fprintf(&b, "%s> %s", label, query)
+
+	// Scroll so the selection stays in view.
+	start := 0
+	if selected >= pickerHeight {
+		start = selected - pickerHeight + 1
+	}
+	lines := 0
+	for i := start; i < len(matches) && i < start+pickerHeight; i++ {
+		marker := "  "
+		if i == selected {
+			marker = "\x1b[7m> "
+		}
+		fmt.Fprintf(&b, "\r\n%s%s\x1b[0m", marker, matches[i])
+		lines++
+	}
+	if len(matches) == 0 {
+		b.WriteString("\r\n  (no matches)")
+		lines++
+	}
+
+	fmt.Fprintf(&b, "\x1b[%dA\r\x1b[%dC", lines, len([]rune(label))+2+len([]rune(query)))
+	os.Stderr.WriteString(b.String())
+}
+
+func clearPicker() {
+	os.Stderr.WriteString("\r\x1b[J")
+}
+
+// fuzzyFilter returns the items containing the letters of query in order,
+// best matches first. Matches are scored higher for runs of consecutive
+// letters and for starting at the beginning of the item or a word in it.
+func fuzzyFilter(items []string, query string) []string {
+	type match struct {
+		item  string
+		score int
+		index int
+	}
+
+	var matches []match
+	for i, item := range items {
+		if score, ok := fuzzyScore(item, query); ok {
+			matches = append(matches, match{item, score, i})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	result := make([]string, len(matches))
+	for i, m := range matches {
+		result[i] = m.item
+	}
+	return result
+}
+
+func fuzzyScore(item, query string) (int, bool) {
+	itemRunes := []rune(strings.ToLower(item))
+	score, pos, previous := 0, 0, -2
+	for _, q := range strings.ToLower(query) {
+		for pos < len(itemRunes) && itemRunes[pos] != q {
+			pos++
+		}
+		if pos == len(itemRunes) {
+			return 0, false
+		}
+		score++
+		if pos == previous+1 {
+			score += 2
+		}
+		if pos == 0 || strings.ContainsRune("_-. @/", itemRunes[pos-1]) {
+			score += 3
+		}
+		previous = pos
+		pos++
+	}
+	return score, true
+}
@@ -0,0 +1,149 @@
+package keyman
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Human-readable parts of age's Bech32 encoded X25519 keys.
+const (
+	ageRecipientPrefix = "age"
+	ageIdentityPrefix  = "age-secret-key-"
+)
+
+// ErrNotEd25519 is returned when converting a key other than Ed25519 to an
+// age key, since only Ed25519 has an X25519 counterpart.
+var ErrNotEd25519 = errors.New("only Ed25519 keys convert to age keys")
+
+// curve25519P is the field prime 2^255 - 19.
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// AgeRecipient converts an Ed25519 public key to the age X25519 recipient
+// (age1...) of the same key pair, as ssh-to-age does, mapping the Edwards
+// point to its Montgomery form u = (1 + y) / (1 - y).
+func AgeRecipient(pub *PublicKey) (string, error) {
+	if pub.Algorithm != "ssh-ed25519" {
+		return "", ErrNotEd25519
+	}
+	_, rest, _ := readWireString(pub.Blob)
+	point, _, ok := readWireString(rest)
+	if !ok || len(point) != ed25519.PublicKeySize {
+		return "", errors.New("malformed Ed25519 public key")
+	}
+
+	// y is little-endian, with the top bit holding the sign of x.
+	encoded := make([]byte, len(point))
+	for i, b := range point {
+		encoded[len(point)-1-i] = b
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+	if y.Cmp(curve25519P) >= 0 {
+		return "", errors.New("malformed Ed25519 public key")
+	}
+
+	one := big.NewInt(1)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return "", errors.New("Ed25519 public key has no X25519 form")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, denominator.ModInverse(denominator, curve25519P))
+	u.Mod(u, curve25519P)
+
+	montgomery := make([]byte, 32)
+	u.FillBytes(montgomery)
+	for i, j := 0, len(montgomery)-1; i < j; i, j = i+1, j-1 {
+		montgomery[i], montgomery[j] = montgomery[j], montgomery[i]
+	}
+	return bech32Encode(ageRecipientPrefix, montgomery), nil
+}
+
+// AgeIdentity converts an Ed25519 private key to the age X25519 identity
+// (AGE-SECRET-KEY-1...) of the same key pair, the scalar Ed25519 derives
+// from its seed, and returns it with its recipient.
+func AgeIdentity(key *PrivateKey) (identity, recipient string, err error) {
+	private, ok := key.Key.(ed25519.PrivateKey)
+	if !ok {
+		return "", "", ErrNotEd25519
+	}
+	digest := sha512.Sum512(private.Seed())
+	scalar := digest[:32]
+
+	exchange, err := ecdh.X25519().NewPrivateKey(scalar)
+	if err != nil {
+		return "", "", err
+	}
+	identity = strings.ToUpper(bech32Encode(ageIdentityPrefix, scalar))
+	return identity, bech32Encode(ageRecipientPrefix, exchange.PublicKey().Bytes()), nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Encode encodes data as Bech32 (BIP 173) with the human-readable
+// part hrp, without the 90 character limit, as age does.
+func bech32Encode(hrp string, data []byte) string {
+	// Regroup the bytes into 5-bit values, padding the last one.
+	var values []byte
+	acc, bits := 0, 0
+	for _, b := range data {
+		acc = (acc<<8 | int(b)) & 0xfff
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits)&31)
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits))&31)
+	}
+
+	checksum := bech32Checksum(hrp, values)
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range append(values, checksum...) {
+		b.WriteByte(bech32Charset[v])
+	}
+	return b.String()
+}
+
+func bech32Checksum(hrp string, values []byte) []byte {
+	var expanded []byte
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	expanded = append(expanded, values...)
+	expanded = append(expanded, 0, 0, 0, 0, 0, 0)
+
+	mod := bech32Polymod(expanded) ^ 1
+	checksum := make([]byte, 6)
+	for i := range checksum {
+		checksum[i] = byte(mod>>uint(5*(5-i))) & 31
+	}
+	return checksum
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
@@ -0,0 +1,79 @@
+package keyman
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// agentKinds maps part of an agent socket's path to the program that
+// serves it, for the agents that keep their socket in a known place.
+var agentKinds = []struct{ fragment, kind string }{
+	{"com.1password/", "1Password"},
+	{".1password/agent.sock", "1Password"},
+	{"com.maxgoedjen.Secretive", "Secretive"},
+	{".bitwarden-ssh-agent.sock", "Bitwarden"},
+	{"S.gpg-agent.ssh", "gpg-agent"},
+	{"/keyring/ssh", "GNOME Keyring"},
+	{"com.apple.launchd.", "ssh-agent"},
+}
+
+// AgentKind names the program serving the agent socket at path, such as
+// 1Password or gpg-agent, returning ssh-agent for OpenSSH's own agent and
+// nothing when it cannot tell.
+func AgentKind(path string) string {
+	slashed := filepath.ToSlash(path)
+	for _, known := range agentKinds {
+		if strings.Contains(slashed, known.fragment) {
+			return known.kind
+		}
+	}
+	// ssh-agent makes /tmp/ssh-XXXXXXXXXX/agent.<ppid>.
+	if strings.HasPrefix(filepath.Base(path), "agent.") && strings.HasPrefix(filepath.Base(filepath.Dir(path)), "ssh-") {
+		return "ssh-agent"
+	}
+	return ""
+}
+
+// agentEnvVar matches the ${VAR} references ssh expands in IdentityAgent.
+var agentEnvVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandIdentityAgent resolves an IdentityAgent value the way ssh does:
+// SSH_AUTH_SOCK or $VAR name an environment variable holding the socket,
+// ${VAR} is replaced by the variable and ~ by the home directory. Unset
+// and none are returned as nothing.
+func ExpandIdentityAgent(value string) string {
+	switch {
+	case value == "", strings.EqualFold(value, "none"):
+		return ""
+	case value == "SSH_AUTH_SOCK":
+		return os.Getenv("SSH_AUTH_SOCK")
+	case strings.HasPrefix(value, "$") && !strings.HasPrefix(value, "${"):
+		return os.Getenv(value[1:])
+	}
+	value = agentEnvVar.ReplaceAllStringFunc(value, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+	if strings.HasPrefix(value, "~") {
+		if expanded, err := ExpandPath(value); err == nil {
+			return expanded
+		}
+	}
+	return value
+}
+
+// IdentityAgents returns the agent sockets the config's IdentityAgent
+// options point at, expanded, with the Host blocks that use each.
+func (c *Config) IdentityAgents() map[string][]string {
+	agents := make(map[string][]string)
+	for _, block := range c.AllBlocks() {
+		if block.Match {
+			continue
+		}
+		if socket := ExpandIdentityAgent(block.Option("IdentityAgent")); socket != "" {
+			agents[socket] = append(agents[socket], block.Name())
+		}
+	}
+	return agents
+}
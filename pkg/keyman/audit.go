@@ -0,0 +1,240 @@
+package keyman
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AuditReport is the result of auditing a set of keys against the host
+// mappings in an ssh config.
+type AuditReport struct {
+	Keys             []KeyStatus
+	Unused           []Key
+	MultipleMappings map[string][]string
+
+	// MultipleKeys lists the hosts with more than one IdentityFile, in the
+	// order ssh tries them.
+	MultipleKeys map[string][]string
+
+	// Duplicates groups the keys that hold the same key material under
+	// different names, and SameKeyHosts lists the hosts whose
+	// IdentityFiles name different files holding the same key.
+	Duplicates   [][]Key
+	SameKeyHosts map[string][]string
+}
+
+// KeyStatus is a key along with what the audit found out about it.
+type KeyStatus struct {
+	Key
+	InUse bool
+	Age   time.Duration
+}
+
+// Audit checks keys against mappings, as returned by Config.Mappings. A key
+// with a recorded last use is in use if it was used within unusedAfter;
+// without one, it is in use if it is mapped to a host. keyman audit passes
+// 90 days.
+func Audit(keys []Key, mappings map[string][]string, unusedAfter time.Duration) AuditReport {
+	report := AuditReport{
+		MultipleMappings: FindMultipleMappings(mappings),
+		MultipleKeys:     FindMultipleKeys(mappings),
+		Duplicates:       FindDuplicateKeys(keys),
+		SameKeyHosts:     FindSameKeyHosts(keys, mappings),
+	}
+	for _, key := range keys {
+		inUse := IsKeyUsed(key, mappings)
+		if meta := key.Metadata; meta != nil && meta.LastUsed != nil {
+			inUse = time.Since(*meta.LastUsed) <= unusedAfter
+		}
+		status := KeyStatus{
+			Key:   key,
+			InUse: inUse,
+			Age:   time.Since(key.Created),
+		}
+		report.Keys = append(report.Keys, status)
+		if !status.InUse {
+			report.Unused = append(report.Unused, key)
+		}
+	}
+	return report
+}
+
+// Mappings returns the expanded IdentityFile paths of every Host block in
+// the config and its includes, keyed by the block's patterns.
+func (c *Config) Mappings() (map[string][]string, error) {
+	config := make(map[string][]string)
+	for _, block := range c.AllBlocks() {
+		if block.Match {
+			continue
+		}
+		host := block.Name()
+		if _, ok := config[host]; !ok {
+			config[host] = nil
+		}
+		for _, keyPath := range block.Options("IdentityFile") {
+			keyPath, err := ExpandPath(keyPath)
+			if err != nil {
+				return nil, err
+			}
+			config[host] = append(config[host], keyPath)
+		}
+	}
+
+	return config, nil
+}
+
+// IsKeyUsed reports whether any host in mappings uses key.
+func IsKeyUsed(key Key, mappings map[string][]string) bool {
+	for _, keyPaths := range mappings {
+		for _, keyPath := range keyPaths {
+			keyBase := strings.TrimSuffix(filepath.Base(key.Path), PublicKeyExt)
+			if keyBase == filepath.Base(keyPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FindMultipleMappings returns the keys in mappings that are used by more
+// than one host, along with those hosts.
+func FindMultipleMappings(mappings map[string][]string) map[string][]string {
+	keyMappings := make(map[string][]string)
+	for host, keyPaths := range mappings {
+		for _, keyPath := range keyPaths {
+			keyMappings[keyPath] = append(keyMappings[keyPath], host)
+		}
+	}
+
+	multipleMappings := make(map[string][]string)
+	for key, hosts := range keyMappings {
+		if len(hosts) > 1 {
+			multipleMappings[key] = hosts
+		}
+	}
+
+	return multipleMappings
+}
+
+// FindMultipleKeys returns the hosts in mappings that have more than one
+// key, keeping the keys in order.
+func FindMultipleKeys(mappings map[string][]string) map[string][]string {
+	multipleKeys := make(map[string][]string)
+	for host, keyPaths := range mappings {
+		if len(keyPaths) > 1 {
+			multipleKeys[host] = keyPaths
+		}
+	}
+	return multipleKeys
+}
+
+// WithoutIdentitiesOnly returns the Host blocks that name keys with
+// IdentityFile but do not get IdentitiesOnly yes from any block, so ssh
+// offers every key in the agent first and servers may give up with "Too
+// many authentication failures" before reaching the right one.
+func (c *Config) WithoutIdentitiesOnly() []*HostBlock {
+	var blocks []*HostBlock
+	for _, block := range c.AllBlocks() {
+		if block.Match || len(block.Options("IdentityFile")) == 0 {
+			continue
+		}
+		host := ""
+		for _, pattern := range block.Patterns {
+			if !strings.HasPrefix(pattern, "!") {
+				host = pattern
+				break
+			}
+		}
+
+		// Like ssh, take the first value any matching block gives.
+		value := ""
+		for _, matching := range c.MatchingBlocks(host) {
+			if value = matching.Option("IdentitiesOnly"); value != "" {
+				break
+			}
+		}
+		if !strings.EqualFold(value, "yes") {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// FindDuplicateKeys groups keys by fingerprint and returns the groups with
+// more than one key, in the order the keys were listed.
+func FindDuplicateKeys(keys []Key) [][]Key {
+	groups := make(map[string][]Key)
+	var fingerprints []string
+	for _, key := range keys {
+		if key.Public == nil {
+			continue
+		}
+		fingerprint := key.Public.FingerprintSHA256()
+		if _, ok := groups[fingerprint]; !ok {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+		groups[fingerprint] = append(groups[fingerprint], key)
+	}
+
+	var duplicates [][]Key
+	for _, fingerprint := range fingerprints {
+		if len(groups[fingerprint]) > 1 {
+			duplicates = append(duplicates, groups[fingerprint])
+		}
+	}
+	return duplicates
+}
+
+// FindSameKeyHosts returns the hosts in mappings that use two or more
+// different files holding the same key, along with those files. Keys not
+// among keys are looked up by their .pub file.
+func FindSameKeyHosts(keys []Key, mappings map[string][]string) map[string][]string {
+	fingerprints := make(map[string]string)
+	for _, key := range keys {
+		if key.Public != nil {
+			fingerprints[key.PrivatePath()] = key.Public.FingerprintSHA256()
+		}
+	}
+	fingerprint := func(keyPath string) string {
+		if _, ok := fingerprints[keyPath]; !ok {
+			if pub, err := ReadPublicKeyFile(keyPath + PublicKeyExt); err == nil {
+				fingerprints[keyPath] = pub.FingerprintSHA256()
+			} else {
+				fingerprints[keyPath] = ""
+			}
+		}
+		return fingerprints[keyPath]
+	}
+
+	sameKey := make(map[string][]string)
+	for host, keyPaths := range mappings {
+		files := make(map[string][]string)
+		for _, keyPath := range keyPaths {
+			if fp := fingerprint(keyPath); fp != "" && !containsString(files[fp], keyPath) {
+				files[fp] = append(files[fp], keyPath)
+			}
+		}
+		var same []string
+		for _, paths := range files {
+			if len(paths) > 1 {
+				same = append(same, paths...)
+			}
+		}
+		if len(same) > 0 {
+			sort.Strings(same)
+			sameKey[host] = same
+		}
+	}
+	return sameKey
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
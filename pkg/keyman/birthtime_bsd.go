@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package keyman
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func birthTime(_ string, info os.FileInfo) (time.Time, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Birthtimespec.Sec <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stat.Birthtimespec.Unix()), true
+}
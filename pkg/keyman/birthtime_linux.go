@@ -0,0 +1,75 @@
+package keyman
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// statxTraps are the statx system call numbers, which the syscall package
+// predates.
+var statxTraps = map[string]uintptr{
+	"386":     383,
+	"amd64":   332,
+	"arm":     397,
+	"arm64":   291,
+	"loong64": 291,
+	"ppc64":   383,
+	"ppc64le": 383,
+	"riscv64": 291,
+	"s390x":   379,
+}
+
+const (
+	atFDCWD    = -0x64
+	statxBtime = 0x800
+)
+
+type statxTimestamp struct {
+	Sec  int64
+	Nsec uint32
+	_    int32
+}
+
+type statxResult struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	UID            uint32
+	GID            uint32
+	Mode           uint16
+	_              uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          statxTimestamp
+	Btime          statxTimestamp
+	Ctime          statxTimestamp
+	Mtime          statxTimestamp
+	_              [16]uint64
+}
+
+// birthTime asks statx for the file's creation time, which only newer
+// kernels and some filesystems record.
+func birthTime(path string, _ os.FileInfo) (time.Time, bool) {
+	trap, ok := statxTraps[runtime.GOARCH]
+	if !ok {
+		return time.Time{}, false
+	}
+	name, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var result statxResult
+	dirfd := atFDCWD
+	_, _, errno := syscall.Syscall6(trap, uintptr(dirfd), uintptr(unsafe.Pointer(name)), 0, statxBtime, uintptr(unsafe.Pointer(&result)), 0)
+	if errno != 0 || result.Mask&statxBtime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(result.Btime.Sec, int64(result.Btime.Nsec)), true
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package keyman
+
+import (
+	"os"
+	"time"
+)
+
+func birthTime(_ string, _ os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,15 @@
+package keyman
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func birthTime(_ string, info os.FileInfo) (time.Time, bool) {
+	attributes, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, attributes.CreationTime.Nanoseconds()), true
+}
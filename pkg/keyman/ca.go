@@ -0,0 +1,97 @@
+package keyman
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// IssuedCertificate is a certificate recorded in a CA index.
+type IssuedCertificate struct {
+	Serial      uint64     `json:"serial"`
+	KeyID       string     `json:"key_id"`
+	Type        string     `json:"type"`
+	Principals  []string   `json:"principals,omitempty"`
+	ValidAfter  *time.Time `json:"valid_after,omitempty"`
+	ValidBefore *time.Time `json:"valid_before,omitempty"`
+	Fingerprint string     `json:"fingerprint"`
+	Path        string     `json:"path"`
+	Issued      time.Time  `json:"issued"`
+	Revoked     *time.Time `json:"revoked,omitempty"`
+}
+
+// CAIndex tracks the certificates a local CA has issued, so they can be
+// audited and revoked later.
+type CAIndex struct {
+	NextSerial   uint64               `json:"next_serial"`
+	Certificates []*IssuedCertificate `json:"certificates"`
+	path         string
+}
+
+// LoadCAIndex reads the index at path. A missing file is an empty index.
+func LoadCAIndex(path string) (*CAIndex, error) {
+	index := &CAIndex{NextSerial: 1, path: path}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Save writes the index back to the path it was loaded from.
+func (x *CAIndex) Save() error {
+	content, err := json.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(x.path, append(content, '\n'), 0600)
+}
+
+// Record adds a newly signed certificate stored at path to the index.
+func (x *CAIndex) Record(cert *Certificate, path string, issued time.Time) *IssuedCertificate {
+	entry := &IssuedCertificate{
+		Serial:      cert.Serial,
+		KeyID:       cert.KeyID,
+		Type:        cert.TypeName(),
+		Principals:  cert.Principals,
+		Fingerprint: cert.SignedKey.FingerprintSHA256(),
+		Path:        path,
+		Issued:      issued,
+	}
+	if !cert.ValidAfter.IsZero() {
+		validAfter := cert.ValidAfter
+		entry.ValidAfter = &validAfter
+	}
+	if !cert.Forever() {
+		validBefore := cert.ValidBefore
+		entry.ValidBefore = &validBefore
+	}
+
+	x.Certificates = append(x.Certificates, entry)
+	if cert.Serial >= x.NextSerial {
+		x.NextSerial = cert.Serial + 1
+	}
+	return entry
+}
+
+// Find returns the certificate with the given serial, or nil.
+func (x *CAIndex) Find(serial uint64) *IssuedCertificate {
+	for _, entry := range x.Certificates {
+		if entry.Serial == serial {
+			return entry
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package keyman
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// CertificateSuffix is the suffix ssh-keygen gives certificates, which
+	// ssh picks up next to the private key of the same name.
+	CertificateSuffix = "-cert.pub"
+
+	certAlgorithmSuffix = "-cert-v01@openssh.com"
+
+	// UserCert and HostCert are the certificate types.
+	UserCert = 1
+	HostCert = 2
+)
+
+// certKeyFields is the number of wire fields each key type stores between
+// the nonce and the serial of a certificate.
+var certKeyFields = map[string]int{
+	"ssh-rsa":                            2,
+	"ssh-dss":                            4,
+	"ssh-ed25519":                        1,
+	"ecdsa-sha2-nistp256":                2,
+	"ecdsa-sha2-nistp384":                2,
+	"ecdsa-sha2-nistp521":                2,
+	"sk-ssh-ed25519@openssh.com":         2,
+	"sk-ecdsa-sha2-nistp256@openssh.com": 3,
+}
+
+// Certificate is an OpenSSH certificate, a public key signed by a CA. Key
+// is the certificate itself and SignedKey the plain key it certifies.
+type Certificate struct {
+	Key             *PublicKey
+	SignedKey       *PublicKey
+	Serial          uint64
+	Type            uint32
+	KeyID           string
+	Principals      []string
+	ValidAfter      time.Time
+	ValidBefore     time.Time
+	CriticalOptions []string
+	Extensions      []string
+	SignatureKey    *PublicKey
+}
+
+// IsCertificate reports whether the key is a certificate.
+func (k *PublicKey) IsCertificate() bool {
+	return strings.HasSuffix(k.Algorithm, certAlgorithmSuffix)
+}
+
+// ParseCertificate decodes the certificate fields of a certificate key.
+func ParseCertificate(key *PublicKey) (*Certificate, error) {
+	if !key.IsCertificate() {
+		return nil, fmt.Errorf("%s is not a certificate", key.Algorithm)
+	}
+
+	base := strings.TrimSuffix(key.Algorithm, certAlgorithmSuffix)
+	if strings.HasPrefix(base, "sk-") {
+		base += "@openssh.com"
+	}
+	fields, ok := certKeyFields[base]
+	if !ok {
+		return nil, fmt.Errorf("unsupported certificate type %s", key.Algorithm)
+	}
+
+	r := wireReader{rest: key.Blob}
+	r.string() // algorithm
+	r.string() // nonce
+	keyStart := r.rest
+	for i := 0; i < fields; i++ {
+		r.string()
+	}
+	keyFields := keyStart[:len(keyStart)-len(r.rest)]
+
+	blob := binary.BigEndian.AppendUint32(nil, uint32(len(base)))
+	blob = append(append(blob, base...), keyFields...)
+	cert := &Certificate{
+		Key:       key,
+		SignedKey: &PublicKey{Algorithm: base, Blob: blob, Comment: key.Comment},
+	}
+	cert.Serial = r.uint64()
+	cert.Type = r.uint32()
+	cert.KeyID = string(r.string())
+	cert.Principals = r.strings()
+	cert.ValidAfter = certTime(r.uint64())
+	cert.ValidBefore = certTime(r.uint64())
+	cert.CriticalOptions = r.names()
+	cert.Extensions = r.names()
+	r.string() // reserved
+	signatureKey := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	algorithm, _, _ := readWireString(signatureKey)
+	cert.SignatureKey = &PublicKey{Algorithm: string(algorithm), Blob: signatureKey}
+	return cert, nil
+}
+
+// certTime converts a certificate timestamp; the maximum value means
+// forever and is returned as the zero time.
+func certTime(t uint64) time.Time {
+	if t == 0 || t >= 1<<63 {
+		return time.Time{}
+	}
+	return time.Unix(int64(t), 0)
+}
+
+// TypeName returns "user" or "host".
+func (c *Certificate) TypeName() string {
+	if c.Type == HostCert {
+		return "host"
+	}
+	return "user"
+}
+
+// Forever reports whether the certificate has no expiry.
+func (c *Certificate) Forever() bool {
+	return c.ValidBefore.IsZero()
+}
+
+// Expired reports whether the certificate is no longer valid at now.
+func (c *Certificate) Expired(now time.Time) bool {
+	return !c.Forever() && !now.Before(c.ValidBefore)
+}
+
+// ExpiresWithin reports whether the certificate is still valid but expires
+// within window of now.
+func (c *Certificate) ExpiresWithin(now time.Time, window time.Duration) bool {
+	return !c.Forever() && !c.Expired(now) && c.ValidBefore.Sub(now) <= window
+}
+
+// ReadCertificateFile reads and decodes the certificate at path.
+func ReadCertificateFile(path string) (*Certificate, error) {
+	key, err := ReadPublicKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCertificate(key)
+}
+
+// wireReader reads SSH wire format values, remembering the first error so
+// callers can check once at the end.
+type wireReader struct {
+	rest []byte
+	err  error
+}
+
+var errTruncated = errors.New("truncated key data")
+
+func (r *wireReader) string() []byte {
+	if r.err != nil {
+		return nil
+	}
+	value, rest, ok := readWireString(r.rest)
+	if !ok {
+		r.err = errTruncated
+		return nil
+	}
+	r.rest = rest
+	return value
+}
+
+func (r *wireReader) uint32() uint32 {
+	if r.err != nil || len(r.rest) < 4 {
+		r.err = errTruncated
+		return 0
+	}
+	value := binary.BigEndian.Uint32(r.rest)
+	r.rest = r.rest[4:]
+	return value
+}
+
+func (r *wireReader) uint64() uint64 {
+	if r.err != nil || len(r.rest) < 8 {
+		r.err = errTruncated
+		return 0
+	}
+	value := binary.BigEndian.Uint64(r.rest)
+	r.rest = r.rest[8:]
+	return value
+}
+
+// strings reads a string holding a list of strings.
+func (r *wireReader) strings() []string {
+	inner := wireReader{rest: r.string()}
+	var values []string
+	for r.err == nil && inner.err == nil && len(inner.rest) > 0 {
+		values = append(values, string(inner.string()))
+	}
+	if inner.err != nil {
+		r.err = inner.err
+	}
+	return values
+}
+
+// names reads a list of name/data pairs, such as certificate options, and
+// returns the names with any non-empty data as name=value.
+func (r *wireReader) names() []string {
+	inner := wireReader{rest: r.string()}
+	var values []string
+	for r.err == nil && inner.err == nil && len(inner.rest) > 0 {
+		name := string(inner.string())
+		data := inner.string()
+		if value, _, ok := readWireString(data); ok && len(value) > 0 {
+			name += "=" + string(value)
+		}
+		values = append(values, name)
+	}
+	if inner.err != nil {
+		r.err = inner.err
+	}
+	return values
+}
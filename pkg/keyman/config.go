@@ -0,0 +1,596 @@
+// Package keyman implements SSH key discovery, ssh_config parsing and
+// auditing for the keyman command, for use by other Go programs.
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth matches the recursion limit OpenSSH applies to Include.
+const maxIncludeDepth = 16
+
+// DefaultsHost is the pattern of the Host block that sets defaults for
+// every host.
+const DefaultsHost = "*"
+
+// Indent is how far the options of a Host or Match block are indented
+// when the block has no options to copy the indentation of, and how far
+// keyman config fmt indents them.
+const Indent = "    "
+
+// Config is a lossless representation of an ssh_config file. Every line
+// is kept verbatim so that writing the file back only changes the lines
+// that were explicitly edited. Files with CRLF line endings, as editors on
+// Windows write them, are written back with CRLF.
+type Config struct {
+	Path     string
+	Lines    []Line
+	CRLF     bool
+	modified bool
+}
+
+// Line is a single line of an ssh_config file. Keyword is lowercased
+// and empty for blank lines and comments. For Include lines, Included holds
+// the files the directive expanded to.
+type Line struct {
+	Text     string
+	Keyword  string
+	Value    string
+	Included []*Config
+}
+
+// HostBlock is a Host or Match section, spanning Lines[start:end] of File.
+type HostBlock struct {
+	File     *Config
+	Patterns []string
+	Match    bool
+	start    int
+	end      int
+}
+
+// ParseConfig parses a single ssh_config file without following Include
+// directives. A missing file parses as an empty config.
+func ParseConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{Path: path}, nil
+		}
+		return nil, err
+	}
+
+	return ParseConfigBytes(path, content), nil
+}
+
+// LoadConfig parses path and every file it includes, recursively.
+// Relative Include paths are resolved against baseDir.
+func LoadConfig(path, baseDir string) (*Config, error) {
+	return loadConfigDepth(path, baseDir, 0)
+}
+
+func loadConfigDepth(path, baseDir string, depth int) (*Config, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: too many nested Include directives", path)
+	}
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, line := range config.Lines {
+		if line.Keyword != "include" {
+			continue
+		}
+		for _, pattern := range strings.Fields(line.Value) {
+			paths, err := expandInclude(pattern, baseDir)
+			if err != nil {
+				return nil, err
+			}
+			for _, includePath := range paths {
+				included, err := loadConfigDepth(includePath, baseDir, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				config.Lines[i].Included = append(config.Lines[i].Included, included)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+func expandInclude(pattern, baseDir string) ([]string, error) {
+	pattern, err := includePattern(pattern, baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// includePattern returns the absolute glob an Include pattern stands for,
+// with ~ expanded and a relative pattern taken from baseDir.
+func includePattern(pattern, baseDir string) (string, error) {
+	if strings.HasPrefix(pattern, "~") {
+		home, err := homeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, pattern[1:]), nil
+	}
+	if !filepath.IsAbs(pattern) {
+		return filepath.Join(baseDir, pattern), nil
+	}
+	return filepath.Clean(pattern), nil
+}
+
+// ParseConfigBytes parses content as the ssh_config file at path.
+func ParseConfigBytes(path string, content []byte) *Config {
+	config := &Config{Path: path}
+	text := string(content)
+	if text == "" {
+		return config
+	}
+	config.CRLF = strings.Contains(text, "\r\n")
+	text = strings.TrimSuffix(text, "\n")
+	for _, line := range strings.Split(text, "\n") {
+		config.Lines = append(config.Lines, newConfigLine(strings.TrimSuffix(line, "\r")))
+	}
+	return config
+}
+
+func newConfigLine(text string) Line {
+	keyword, value := splitConfigLine(text)
+	return Line{Text: text, Keyword: keyword, Value: value}
+}
+
+// splitConfigLine splits a line into its lowercased keyword and value,
+// accepting both "Keyword value" and "Keyword=value" forms. A trailing
+// comment is left out of the value, as ssh ignores it.
+func splitConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+
+	keyword := line[:i]
+	value := strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	value, _ = cutComment(value)
+	return strings.ToLower(keyword), unquote(value)
+}
+
+// cutComment splits text before a trailing comment, which like in ssh
+// starts with a # at the start of a word outside quotes. The comment keeps
+// the space before it.
+func cutComment(text string) (string, string) {
+	quoted := false
+	for i, r := range text {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '#' && !quoted && i > 0 && (text[i-1] == ' ' || text[i-1] == '\t'):
+			before := strings.TrimRight(text[:i], " \t")
+			return before, text[len(before):]
+		}
+	}
+	return text, ""
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Bytes returns the file contents, including any edits.
+func (c *Config) Bytes() []byte {
+	if len(c.Lines) == 0 {
+		return nil
+	}
+	newline := "\n"
+	if c.CRLF {
+		newline = "\r\n"
+	}
+	var b strings.Builder
+	for _, line := range c.Lines {
+		b.WriteString(line.Text)
+		b.WriteString(newline)
+	}
+	return []byte(b.String())
+}
+
+// Save writes the file back to its path.
+func (c *Config) Save() error {
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(c.Path, c.Bytes(), 0600)
+}
+
+// Files returns this file followed by every file it includes, depth first.
+func (c *Config) Files() []*Config {
+	files := []*Config{c}
+	for _, line := range c.Lines {
+		for _, included := range line.Included {
+			files = append(files, included.Files()...)
+		}
+	}
+	return files
+}
+
+// SaveAll writes back every file in the include tree that was edited.
+func (c *Config) SaveAll() error {
+	for _, file := range c.Files() {
+		if !file.modified {
+			continue
+		}
+		if err := file.Save(); err != nil {
+			return err
+		}
+		file.modified = false
+	}
+	return nil
+}
+
+// Blocks returns the Host and Match sections of the file in order. Lines
+// before the first section are global and belong to no block.
+func (c *Config) Blocks() []*HostBlock {
+	var blocks []*HostBlock
+	var current *HostBlock
+	for i, line := range c.Lines {
+		if line.Keyword != "host" && line.Keyword != "match" {
+			continue
+		}
+		if current != nil {
+			current.end = i
+		}
+		current = &HostBlock{
+			File:     c,
+			Patterns: strings.Fields(line.Value),
+			Match:    line.Keyword == "match",
+			start:    i,
+		}
+		blocks = append(blocks, current)
+	}
+	if current != nil {
+		current.end = len(c.Lines)
+	}
+	return blocks
+}
+
+// AllBlocks returns the sections of this file and every included file in
+// the order ssh reads them, with included blocks at their Include line.
+func (c *Config) AllBlocks() []*HostBlock {
+	var blocks []*HostBlock
+	own := c.Blocks()
+	next := 0
+	for i, line := range c.Lines {
+		for next < len(own) && own[next].start == i {
+			blocks = append(blocks, own[next])
+			next++
+		}
+		for _, included := range line.Included {
+			blocks = append(blocks, included.AllBlocks()...)
+		}
+	}
+	return blocks
+}
+
+// Defaults returns the Host * block, searching included files as well, or
+// nil if there is none.
+func (c *Config) Defaults() *HostBlock {
+	return c.FindHost(DefaultsHost)
+}
+
+// IsDefaults reports whether the block is a Host * block, which applies to
+// every host rather than naming one.
+func (b *HostBlock) IsDefaults() bool {
+	return !b.Match && len(b.Patterns) == 1 && b.Patterns[0] == DefaultsHost
+}
+
+// FindHost returns the first Host block whose patterns are exactly host,
+// searching included files as well.
+func (c *Config) FindHost(host string) *HostBlock {
+	for _, block := range c.AllBlocks() {
+		if !block.Match && block.Name() == host {
+			return block
+		}
+	}
+	return nil
+}
+
+// Name returns the block's patterns as written on its Host line.
+func (b *HostBlock) Name() string {
+	return strings.Join(b.Patterns, " ")
+}
+
+// Options returns the values of every line in the block with keyword.
+func (b *HostBlock) Options(keyword string) []string {
+	var values []string
+	for _, i := range b.optionLines(keyword) {
+		values = append(values, b.File.Lines[i].Value)
+	}
+	return values
+}
+
+// Option returns the first value for keyword, or "" if it is not set.
+func (b *HostBlock) Option(keyword string) string {
+	values := b.Options(keyword)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (b *HostBlock) optionLines(keyword string) []int {
+	keyword = strings.ToLower(keyword)
+	var indexes []int
+	for i := b.start + 1; i < b.end; i++ {
+		if b.File.Lines[i].Keyword == keyword {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// indent returns the indentation used by options in the block, defaulting
+// to Indent.
+func (b *HostBlock) indent() string {
+	for i := b.start + 1; i < b.end; i++ {
+		line := b.File.Lines[i]
+		if line.Keyword != "" {
+			return line.Text[:len(line.Text)-len(strings.TrimLeft(line.Text, " \t"))]
+		}
+	}
+	return Indent
+}
+
+// lastOptionLine returns the index of the last non-blank line in the block,
+// which is where new options are inserted after. Comments that follow a
+// blank line at the end of the block introduce the next one, so they do
+// not count.
+func (b *HostBlock) lastOptionLine() int {
+	last := b.start
+	afterBlank := false
+	for i := b.start + 1; i < b.end; i++ {
+		line := b.File.Lines[i]
+		switch {
+		case strings.TrimSpace(line.Text) == "":
+			afterBlank = true
+		case line.Keyword != "" || !afterBlank:
+			last = i
+			afterBlank = false
+		}
+	}
+	return last
+}
+
+// AddOption appends "keyword value" to the block, after any existing lines
+// with the same keyword so repeated options keep their order.
+func (b *HostBlock) AddOption(keyword, value string) {
+	b.addOption(keyword, quoteValue(value))
+}
+
+// addOption adds keyword with its value written as is, for options such as
+// LocalForward whose value is more than one argument.
+func (b *HostBlock) addOption(keyword, text string) {
+	at := b.lastOptionLine()
+	if existing := b.optionLines(keyword); len(existing) > 0 {
+		at = existing[len(existing)-1]
+	}
+	b.File.InsertLine(at+1, b.indent()+keyword+" "+text)
+	b.end++
+}
+
+// SetOption replaces the first line with keyword, or adds one. A comment
+// at the end of the line is kept.
+func (b *HostBlock) SetOption(keyword, value string) {
+	existing := b.optionLines(keyword)
+	if len(existing) == 0 {
+		b.AddOption(keyword, value)
+		return
+	}
+	i := existing[0]
+	line := b.File.Lines[i].Text
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	_, comment := cutComment(line)
+	b.File.Lines[i] = newConfigLine(indent + keyword + " " + quoteValue(value) + comment)
+	b.File.modified = true
+}
+
+// ReplaceOption sets the value of every line with keyword for which match
+// returns true, keeping comments at the end of the lines.
+func (b *HostBlock) ReplaceOption(keyword string, match func(value string) bool, value string) {
+	for _, i := range b.optionLines(keyword) {
+		if !match(b.File.Lines[i].Value) {
+			continue
+		}
+		line := b.File.Lines[i].Text
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		_, comment := cutComment(line)
+		b.File.Lines[i] = newConfigLine(indent + b.File.Lines[i].keywordText() + " " + quoteValue(value) + comment)
+		b.File.modified = true
+	}
+}
+
+// RemoveOption removes every line with keyword for which match returns
+// true, reporting how many lines were removed.
+func (b *HostBlock) RemoveOption(keyword string, match func(value string) bool) int {
+	removed := 0
+	existing := b.optionLines(keyword)
+	for j := len(existing) - 1; j >= 0; j-- {
+		i := existing[j]
+		if match(b.File.Lines[i].Value) {
+			b.File.RemoveLine(i)
+			b.end--
+			removed++
+		}
+	}
+	return removed
+}
+
+// Lines returns the option lines of the block, without its Host or Match
+// line, blank lines and comments.
+func (b *HostBlock) Lines() []Line {
+	var lines []Line
+	for i := b.start + 1; i < b.end; i++ {
+		if b.File.Lines[i].Keyword != "" {
+			lines = append(lines, b.File.Lines[i])
+		}
+	}
+	return lines
+}
+
+// IsEmpty reports whether the block has nothing but its Host or Match line,
+// blank lines and comments.
+func (b *HostBlock) IsEmpty() bool {
+	for i := b.start + 1; i < b.end; i++ {
+		if b.File.Lines[i].Keyword != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove deletes the whole block from its file, along with a single
+// trailing blank separator line if it leaves two in a row.
+func (b *HostBlock) Remove() {
+	c := b.File
+	c.Lines = append(c.Lines[:b.start], c.Lines[b.end:]...)
+	c.modified = true
+	if b.start > 0 && b.start < len(c.Lines) && c.Lines[b.start-1].Text == "" && c.Lines[b.start].Text == "" {
+		c.RemoveLine(b.start)
+	}
+	b.end = b.start
+}
+
+// InsertLine inserts a line of text before index at.
+func (c *Config) InsertLine(at int, text string) {
+	c.Lines = append(c.Lines, Line{})
+	copy(c.Lines[at+1:], c.Lines[at:])
+	c.Lines[at] = newConfigLine(text)
+	c.modified = true
+}
+
+// RemoveLine deletes the line at index at.
+func (c *Config) RemoveLine(at int) {
+	c.Lines = append(c.Lines[:at], c.Lines[at+1:]...)
+	c.modified = true
+}
+
+// AppendHost adds a new, empty Host block to the end of the file, or just
+// before a trailing Host * block. Since ssh uses the first value it finds
+// for an option, defaults only fill in what the blocks above them leave
+// unset. In a config that Split has broken up, a host named outright gets
+// a file of its own in FragmentDir instead.
+func (c *Config) AppendHost(host string) *HostBlock {
+	if include := c.fragmentsLine(); include >= 0 && !strings.ContainsAny(host, "*?! ") {
+		path := c.addToFragment(include, host, []Line{newConfigLine("Host " + host)}, false)
+		for _, fragment := range c.Lines[include].Included {
+			if fragment.Path == path {
+				blocks := fragment.Blocks()
+				return blocks[len(blocks)-1]
+			}
+		}
+	}
+
+	blocks := c.Blocks()
+	if n := len(blocks); n > 0 && host != DefaultsHost && blocks[n-1].IsDefaults() {
+		// Keep comments that introduce the defaults above them.
+		at := blocks[n-1].start
+		for at > 0 && strings.HasPrefix(strings.TrimSpace(c.Lines[at-1].Text), "#") {
+			at--
+		}
+		c.InsertLine(at, "")
+		c.InsertLine(at, "Host "+host)
+		if at > 0 && strings.TrimSpace(c.Lines[at-1].Text) != "" {
+			c.InsertLine(at, "")
+		}
+		return c.Blocks()[n-1]
+	}
+
+	if len(c.Lines) > 0 && strings.TrimSpace(c.Lines[len(c.Lines)-1].Text) != "" {
+		c.Lines = append(c.Lines, newConfigLine(""))
+	}
+	c.Lines = append(c.Lines, newConfigLine("Host "+host))
+	c.modified = true
+	blocks = c.Blocks()
+	return blocks[len(blocks)-1]
+}
+
+// keywordText returns the keyword as it was written in the file.
+func (l Line) keywordText() string {
+	text := strings.TrimSpace(l.Text)
+	return text[:len(l.Keyword)]
+}
+
+func quoteValue(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// MatchesHost reports whether host matches the block's Host patterns the
+// way ssh evaluates them: any pattern may match, but a matching negated
+// pattern (!pattern) excludes the host. Match blocks never match.
+func (b *HostBlock) MatchesHost(host string) bool {
+	if b.Match {
+		return false
+	}
+	return MatchPatterns(b.Patterns, host)
+}
+
+// MatchPatterns matches host against ssh_config style patterns using * and
+// ? wildcards and ! negation.
+func MatchPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+		if err != nil || !ok {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// MatchingBlocks returns the Host blocks that apply to host, in order.
+func (c *Config) MatchingBlocks(host string) []*HostBlock {
+	var blocks []*HostBlock
+	for _, block := range c.AllBlocks() {
+		if block.MatchesHost(host) {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
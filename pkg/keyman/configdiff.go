@@ -0,0 +1,155 @@
+package keyman
+
+import (
+	"sort"
+	"strings"
+)
+
+// GlobalHost names the options set before the first Host or Match line in
+// a ConfigChange.
+const GlobalHost = "(global)"
+
+// Kinds of ConfigChange.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// ConfigChange is one difference between two configs. A change with no
+// Keyword is a whole Host or Match block added or removed. Otherwise Old
+// and New hold the option's values, one of them empty when it was added
+// or removed.
+type ConfigChange struct {
+	Host    string
+	Kind    string
+	Keyword string
+	Old     string
+	New     string
+}
+
+// hostSettings are the options of one host across all of its blocks, as
+// ssh reads them: the first value of single valued options, every value of
+// those like IdentityFile that add up.
+type hostSettings struct {
+	name     string
+	keywords []string
+	values   map[string][]string
+}
+
+// DiffConfigs compares what two sets of config files configure, host by
+// host, rather than line by line, so reordering, reformatting and moving
+// hosts between files do not show up. Pass Files of a loaded config.
+func DiffConfigs(old, new []*Config) []ConfigChange {
+	oldHosts, oldOrder := configSettings(old)
+	newHosts, newOrder := configSettings(new)
+
+	var changes []ConfigChange
+	for _, name := range oldOrder {
+		if _, ok := newHosts[name]; !ok {
+			changes = append(changes, ConfigChange{Host: name, Kind: ChangeRemoved})
+		}
+	}
+	for _, name := range newOrder {
+		after := newHosts[name]
+		before, ok := oldHosts[name]
+		if !ok {
+			changes = append(changes, ConfigChange{Host: name, Kind: ChangeAdded})
+			for _, keyword := range after.keywords {
+				for _, value := range after.values[strings.ToLower(keyword)] {
+					changes = append(changes, ConfigChange{Host: name, Kind: ChangeAdded, Keyword: keyword, New: value})
+				}
+			}
+			continue
+		}
+		changes = append(changes, diffSettings(before, after)...)
+	}
+	return changes
+}
+
+func diffSettings(before, after *hostSettings) []ConfigChange {
+	var changes []ConfigChange
+	keywords := append([]string{}, before.keywords...)
+	for _, keyword := range after.keywords {
+		if _, ok := before.values[strings.ToLower(keyword)]; !ok {
+			keywords = append(keywords, keyword)
+		}
+	}
+
+	for _, keyword := range keywords {
+		lower := strings.ToLower(keyword)
+		oldValues, newValues := before.values[lower], after.values[lower]
+		if !multiValueKeywords[lower] {
+			switch {
+			case len(newValues) == 0:
+				changes = append(changes, ConfigChange{Host: after.name, Kind: ChangeRemoved, Keyword: keyword, Old: oldValues[0]})
+			case len(oldValues) == 0:
+				changes = append(changes, ConfigChange{Host: after.name, Kind: ChangeAdded, Keyword: keyword, New: newValues[0]})
+			case oldValues[0] != newValues[0]:
+				changes = append(changes, ConfigChange{Host: after.name, Kind: ChangeChanged, Keyword: keyword, Old: oldValues[0], New: newValues[0]})
+			}
+			continue
+		}
+		for _, value := range oldValues {
+			if !containsString(newValues, value) {
+				changes = append(changes, ConfigChange{Host: after.name, Kind: ChangeRemoved, Keyword: keyword, Old: value})
+			}
+		}
+		for _, value := range newValues {
+			if !containsString(oldValues, value) {
+				changes = append(changes, ConfigChange{Host: after.name, Kind: ChangeAdded, Keyword: keyword, New: value})
+			}
+		}
+	}
+	return changes
+}
+
+// configSettings gathers the options of every host in files, keyed by the
+// host's patterns in sorted order, along with the hosts in the order they
+// first appear.
+func configSettings(files []*Config) (map[string]*hostSettings, []string) {
+	hosts := make(map[string]*hostSettings)
+	var order []string
+	for _, file := range files {
+		current := GlobalHost
+		for _, line := range file.Lines {
+			switch line.Keyword {
+			case "":
+				continue
+			case "include":
+				continue
+			case "host", "match":
+				current = "Match " + strings.Join(strings.Fields(line.Value), " ")
+				if line.Keyword == "host" {
+					patterns := strings.Fields(line.Value)
+					sort.Strings(patterns)
+					current = "Host " + strings.Join(patterns, " ")
+				}
+				if _, ok := hosts[current]; !ok {
+					hosts[current] = &hostSettings{name: current, values: make(map[string][]string)}
+					order = append(order, current)
+				}
+				continue
+			}
+
+			settings, ok := hosts[current]
+			if !ok {
+				settings = &hostSettings{name: current, values: make(map[string][]string)}
+				hosts[current] = settings
+				order = append(order, current)
+			}
+			if _, seen := settings.values[line.Keyword]; !seen {
+				keyword := line.keywordText()
+				if canonical, ok := CanonicalKeyword(keyword); ok {
+					keyword = canonical
+				}
+				settings.keywords = append(settings.keywords, keyword)
+			}
+			values := settings.values[line.Keyword]
+			if !containsString(values, line.Value) {
+				settings.values[line.Keyword] = append(values, line.Value)
+			}
+		}
+	}
+	return hosts, order
+}
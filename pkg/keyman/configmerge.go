@@ -0,0 +1,320 @@
+package keyman
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConfigConflict is a host or option that two configs changed in different
+// ways since the config they both started from. Ours and Theirs hold each
+// side's values, empty where a side removed the option. A conflict with no
+// Keyword is a whole block one side removed and the other changed, and
+// Ours and Theirs say which did which.
+type ConfigConflict struct {
+	Host    string
+	Keyword string
+	Ours    string
+	Theirs  string
+}
+
+// configSection is the global options or one Host or Match block of a
+// file, with the blank lines and comments that follow it.
+type configSection struct {
+	name  string
+	lines []Line
+}
+
+// MergeConfigs merges the changes ours and theirs each made to base into
+// ours. Like DiffConfigs it compares hosts and options rather than lines,
+// so edits to different hosts or options of the same host merge cleanly
+// however the lines around them moved, and options like IdentityFile that
+// add up merge their values as sets. Where both sides changed a host or
+// option in different ways the merge keeps ours, or theirs with
+// preferTheirs, and reports the conflict.
+func MergeConfigs(base, ours, theirs *Config, preferTheirs bool) (*Config, []ConfigConflict) {
+	baseSections := sectionIndex(configSections(base))
+	ourSections := configSections(ours)
+	ourIndex := sectionIndex(ourSections)
+	theirSections := configSections(theirs)
+	theirIndex := sectionIndex(theirSections)
+
+	var merged []configSection
+	var conflicts []ConfigConflict
+	for _, section := range ourSections {
+		before, inBase := baseSections[section.name]
+		after, inTheirs := theirIndex[section.name]
+		switch {
+		case inTheirs:
+			lines, found := mergeSection(section.name, before.lines, section.lines, after.lines, preferTheirs)
+			conflicts = append(conflicts, found...)
+			section.lines = lines
+		case !inBase:
+			// Added on our side.
+		case sameSettings(section.lines, before.lines):
+			// Removed on their side.
+			continue
+		default:
+			conflicts = append(conflicts, ConfigConflict{Host: section.name, Ours: "changed", Theirs: "removed"})
+			if preferTheirs {
+				continue
+			}
+		}
+		merged = append(merged, section)
+	}
+
+	// Blocks only theirs has go after the block they follow there, as
+	// ssh takes the first value it finds and order matters.
+	for i, section := range theirSections {
+		if _, inOurs := ourIndex[section.name]; inOurs {
+			continue
+		}
+		if before, inBase := baseSections[section.name]; inBase {
+			if sameSettings(section.lines, before.lines) {
+				// Removed on our side.
+				continue
+			}
+			conflicts = append(conflicts, ConfigConflict{Host: section.name, Ours: "removed", Theirs: "changed"})
+			if !preferTheirs {
+				continue
+			}
+		}
+		at := 0
+		for j := i - 1; j >= 0; j-- {
+			if k := sectionPosition(merged, theirSections[j].name); k >= 0 {
+				at = k + 1
+				break
+			}
+		}
+		section.lines = append([]Line{}, section.lines...)
+		if at > 0 {
+			previous := &merged[at-1]
+			if n := len(previous.lines); n > 0 && previous.lines[n-1].Keyword != "" {
+				previous.lines = append(previous.lines, newConfigLine(""))
+			}
+		}
+		if n := len(section.lines); at < len(merged) && n > 0 && section.lines[n-1].Keyword != "" {
+			section.lines = append(section.lines, newConfigLine(""))
+		}
+		merged = append(merged, configSection{})
+		copy(merged[at+1:], merged[at:])
+		merged[at] = section
+	}
+
+	result := &Config{Path: ours.Path, CRLF: ours.CRLF}
+	for _, section := range merged {
+		result.Lines = append(result.Lines, section.lines...)
+	}
+	result.modified = !bytes.Equal(result.Bytes(), ours.Bytes())
+	return result, conflicts
+}
+
+// mergeSection merges one block that ours and theirs both have, option by
+// option. base is nil when both sides added the block.
+func mergeSection(name string, base, ours, theirs []Line, preferTheirs bool) ([]Line, []ConfigConflict) {
+	switch {
+	case sameSettings(ours, theirs), base != nil && sameSettings(theirs, base):
+		return ours, nil
+	case base != nil && sameSettings(ours, base):
+		return append([]Line{}, theirs...), nil
+	}
+
+	_, baseValues := sectionValues(base)
+	ourKeywords, ourValues := sectionValues(ours)
+	theirKeywords, theirValues := sectionValues(theirs)
+
+	keywords := ourKeywords
+	for _, keyword := range theirKeywords {
+		if _, ok := ourValues[keyword]; !ok {
+			keywords = append(keywords, keyword)
+		}
+	}
+
+	lines := append([]Line{}, ours...)
+	var conflicts []ConfigConflict
+	for _, keyword := range keywords {
+		before, mine, yours := baseValues[keyword], ourValues[keyword], theirValues[keyword]
+		if stringsEqual(mine, yours) || stringsEqual(yours, before) {
+			continue
+		}
+		want := yours
+		switch {
+		case stringsEqual(mine, before):
+		case multiValueKeywords[keyword]:
+			want = mergeValues(before, mine, yours)
+		default:
+			display := keyword
+			if canonical, ok := CanonicalKeyword(keyword); ok {
+				display = canonical
+			}
+			conflicts = append(conflicts, ConfigConflict{
+				Host:    name,
+				Keyword: display,
+				Ours:    strings.Join(mine, ", "),
+				Theirs:  strings.Join(yours, ", "),
+			})
+			if !preferTheirs {
+				continue
+			}
+		}
+		lines = setSectionValues(lines, keyword, want, theirs)
+	}
+	return lines, conflicts
+}
+
+// mergeValues merges the values of an option that adds up: ours, with
+// what theirs added since base and without what theirs removed.
+func mergeValues(base, ours, theirs []string) []string {
+	var merged []string
+	for _, value := range ours {
+		if containsString(base, value) && !containsString(theirs, value) {
+			continue
+		}
+		merged = append(merged, value)
+	}
+	for _, value := range theirs {
+		if !containsString(base, value) && !containsString(merged, value) {
+			merged = append(merged, value)
+		}
+	}
+	return merged
+}
+
+// setSectionValues replaces keyword's lines in a block with one for each
+// of values, where the first of them was, or after the block's last
+// option. Lines are copied from the block or from theirs so they keep how
+// they were written.
+func setSectionValues(lines []Line, keyword string, values []string, theirs []Line) []Line {
+	at := -1
+	var kept []Line
+	for _, line := range lines {
+		if line.Keyword == keyword {
+			if at < 0 {
+				at = len(kept)
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if at < 0 {
+		at = 0
+		for i, line := range kept {
+			if line.Keyword != "" {
+				at = i + 1
+			}
+		}
+	}
+
+	var added []Line
+	for _, value := range values {
+		added = append(added, findValueLine(keyword, value, lines, theirs))
+	}
+	return append(kept[:at], append(added, kept[at:]...)...)
+}
+
+// findValueLine returns the line setting keyword to value in ours or
+// theirs, whichever has it first.
+func findValueLine(keyword, value string, ours, theirs []Line) Line {
+	for _, lines := range [][]Line{ours, theirs} {
+		for _, line := range lines {
+			if line.Keyword == keyword && line.Value == value {
+				return line
+			}
+		}
+	}
+	return newConfigLine(fmt.Sprintf("%s%s %s", Indent, keyword, quoteValue(value)))
+}
+
+// configSections splits a file into its global options and its blocks,
+// named as DiffConfigs names hosts. A repeated name gets a number so each
+// block is merged with its counterpart.
+func configSections(c *Config) []configSection {
+	var sections []configSection
+	seen := make(map[string]int)
+	current := configSection{name: GlobalHost}
+	for _, line := range c.Lines {
+		if line.Keyword == "host" || line.Keyword == "match" {
+			if current.name != GlobalHost || len(current.lines) > 0 {
+				sections = append(sections, current)
+			}
+			name := "Match " + strings.Join(strings.Fields(line.Value), " ")
+			if line.Keyword == "host" {
+				patterns := strings.Fields(line.Value)
+				sort.Strings(patterns)
+				name = "Host " + strings.Join(patterns, " ")
+			}
+			if seen[name]++; seen[name] > 1 {
+				name = fmt.Sprintf("%s (%d)", name, seen[name])
+			}
+			current = configSection{name: name}
+		}
+		current.lines = append(current.lines, line)
+	}
+	if current.name != GlobalHost || len(current.lines) > 0 {
+		sections = append(sections, current)
+	}
+	return sections
+}
+
+func sectionIndex(sections []configSection) map[string]configSection {
+	index := make(map[string]configSection)
+	for _, section := range sections {
+		index[section.name] = section
+	}
+	return index
+}
+
+func sectionPosition(sections []configSection, name string) int {
+	for i, section := range sections {
+		if section.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// sectionValues returns the options a block sets, in order, and the
+// values of each.
+func sectionValues(lines []Line) ([]string, map[string][]string) {
+	var keywords []string
+	values := make(map[string][]string)
+	for _, line := range lines {
+		if line.Keyword == "" || line.Keyword == "host" || line.Keyword == "match" {
+			continue
+		}
+		if _, ok := values[line.Keyword]; !ok {
+			keywords = append(keywords, line.Keyword)
+		}
+		values[line.Keyword] = append(values[line.Keyword], line.Value)
+	}
+	return keywords, values
+}
+
+// sameSettings reports whether two blocks set the same options to the
+// same values, whatever their comments and formatting.
+func sameSettings(a, b []Line) bool {
+	aKeywords, aValues := sectionValues(a)
+	bKeywords, bValues := sectionValues(b)
+	if len(aKeywords) != len(bKeywords) {
+		return false
+	}
+	for _, keyword := range aKeywords {
+		if !stringsEqual(aValues[keyword], bValues[keyword]) {
+			return false
+		}
+	}
+	return true
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package keyman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DuplicateHost is a set of Host blocks with the same patterns, which ssh
+// reads as one: the first value of each option wins, and options such as
+// IdentityFile that can be given more than once add up.
+type DuplicateHost struct {
+	Host    string
+	Blocks  []*HostBlock
+	Options []ResolvedOption
+}
+
+// ResolvedOption is an option of a duplicated host. Ignored is set when
+// an earlier of the blocks already sets it and ssh never uses it.
+type ResolvedOption struct {
+	Keyword string
+	Value   string
+	Block   *HostBlock
+	Line    int
+	Ignored bool
+}
+
+// FindDuplicateHosts returns the hosts with more than one Host block, in
+// the order their first blocks appear. Patterns are compared as sets, so
+// "Host a b" and "Host b a" are duplicates.
+func (c *Config) FindDuplicateHosts() []DuplicateHost {
+	var duplicates []DuplicateHost
+	index := make(map[string]int)
+	for _, block := range c.AllBlocks() {
+		if block.Match {
+			continue
+		}
+		patterns := append([]string{}, block.Patterns...)
+		sort.Strings(patterns)
+		key := strings.Join(patterns, " ")
+		if i, ok := index[key]; ok {
+			duplicates[i].Blocks = append(duplicates[i].Blocks, block)
+			continue
+		}
+		index[key] = len(duplicates)
+		duplicates = append(duplicates, DuplicateHost{Host: block.Name(), Blocks: []*HostBlock{block}})
+	}
+
+	var found []DuplicateHost
+	for _, duplicate := range duplicates {
+		if len(duplicate.Blocks) < 2 {
+			continue
+		}
+		set := make(map[string]bool)
+		for _, block := range duplicate.Blocks {
+			for i := block.start + 1; i < block.end; i++ {
+				line := block.File.Lines[i]
+				if line.Keyword == "" {
+					continue
+				}
+				duplicate.Options = append(duplicate.Options, ResolvedOption{
+					Keyword: line.keywordText(),
+					Value:   line.Value,
+					Block:   block,
+					Line:    i + 1,
+					Ignored: set[line.Keyword] && !multiValueKeywords[line.Keyword],
+				})
+				set[line.Keyword] = true
+			}
+		}
+		found = append(found, duplicate)
+	}
+	return found
+}
+
+// Line returns the 1-based line number of the block's Host or Match line.
+func (b *HostBlock) Line() int {
+	return b.start + 1
+}
+
+// MergeDuplicate folds the later blocks of d into the first, along with
+// the comments inside and above them, dropping the options ssh ignores. It
+// refuses when that could change what ssh does: when the blocks are in
+// different files, or a block between them that may match the same hosts
+// sets an option being moved above it. d must come from
+// FindDuplicateHosts on c, with no edits since.
+func (c *Config) MergeDuplicate(d DuplicateHost) error {
+	first := d.Blocks[0]
+	all := c.AllBlocks()
+	position := func(b *HostBlock) int {
+		for i, block := range all {
+			if block.sameAs(b) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, later := range d.Blocks[1:] {
+		if later.File != first.File {
+			return fmt.Errorf("the blocks of Host %s are in %s and %s, merge them by hand", d.Host, first.File.Path, later.File.Path)
+		}
+	}
+	for _, option := range d.Options {
+		if option.Block == first || option.Ignored {
+			continue
+		}
+		keyword := strings.ToLower(option.Keyword)
+		for _, between := range all[position(first)+1 : position(option.Block)] {
+			if containsBlock(d.Blocks, between) || !mayOverlap(between, d.Blocks[0]) {
+				continue
+			}
+			if len(between.optionLines(keyword)) > 0 {
+				return fmt.Errorf("%s at %s:%d cannot move above %s at %s:%d, which also sets it, merge them by hand",
+					option.Keyword, first.File.Path, option.Line, blockHeader(between), between.File.Path, between.Line())
+			}
+		}
+	}
+
+	ignored := make(map[int]bool)
+	for _, option := range d.Options {
+		if option.Ignored {
+			ignored[option.Line-1] = true
+		}
+	}
+
+	// Take the later blocks out last to first, so the line numbers of
+	// those before stay valid, then add their lines to the first.
+	indent := first.indent()
+	at := first.lastOptionLine() + 1
+	var moved []string
+	for j := len(d.Blocks) - 1; j >= 1; j-- {
+		block := d.Blocks[j]
+		from := block.start
+		for from > at && first.File.Lines[from-1].isComment() {
+			from--
+		}
+		to := block.lastOptionLine()
+
+		var lines []string
+		for i := from; i <= to; i++ {
+			line := first.File.Lines[i]
+			if i == block.start || ignored[i] || strings.TrimSpace(line.Text) == "" {
+				continue
+			}
+			lines = append(lines, indent+strings.TrimSpace(line.Text))
+		}
+		moved = append(lines, moved...)
+
+		c := first.File
+		c.Lines = append(c.Lines[:from], c.Lines[to+1:]...)
+		for from > 0 && from < len(c.Lines) && strings.TrimSpace(c.Lines[from-1].Text) == "" && strings.TrimSpace(c.Lines[from].Text) == "" {
+			c.RemoveLine(from)
+		}
+		if from == len(c.Lines) && from > 0 && strings.TrimSpace(c.Lines[from-1].Text) == "" {
+			c.RemoveLine(from - 1)
+		}
+	}
+
+	for i, text := range moved {
+		first.File.InsertLine(at+i, text)
+	}
+	first.File.modified = true
+	return nil
+}
+
+func containsBlock(blocks []*HostBlock, block *HostBlock) bool {
+	for _, b := range blocks {
+		if b.sameAs(block) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAs reports whether b and other are the same section of the same
+// file, as blocks are found afresh on every call to Blocks.
+func (b *HostBlock) sameAs(other *HostBlock) bool {
+	return b.File == other.File && b.start == other.start
+}
+
+// mayOverlap reports whether a and b could apply to the same host. Match
+// blocks are assumed to.
+func mayOverlap(a, b *HostBlock) bool {
+	if a.Match || b.Match {
+		return true
+	}
+	for _, pattern := range b.Patterns {
+		if !strings.HasPrefix(pattern, "!") && MatchPatterns(a.Patterns, pattern) {
+			return true
+		}
+	}
+	for _, pattern := range a.Patterns {
+		if !strings.HasPrefix(pattern, "!") && MatchPatterns(b.Patterns, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func blockHeader(b *HostBlock) string {
+	if b.Match {
+		return "Match " + b.Name()
+	}
+	return "Host " + b.Name()
+}
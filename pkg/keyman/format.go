@@ -0,0 +1,95 @@
+package keyman
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Format rewrites the file into a consistent layout without changing what
+// it means: options are spelled as the manual spells them and written as
+// "Keyword value", options and comments inside a Host or Match block are
+// indented by indent, blocks are separated by a single blank line with the
+// comments that introduce them kept above them, and runs of blank lines
+// and trailing whitespace are dropped. It reports whether anything
+// changed. Included files are left alone; format each of Files.
+func (c *Config) Format(indent string) bool {
+	before := c.Bytes()
+
+	var lines []Line
+	blank := false
+	inBlock := false
+	for i, line := range c.Lines {
+		text := strings.TrimSpace(line.Text)
+		switch {
+		case text == "":
+			blank = len(lines) > 0
+			continue
+		case line.Keyword == "host" || line.Keyword == "match":
+			inBlock = true
+			text = formatOption(line)
+		case line.Keyword != "":
+			text = formatOption(line)
+			if inBlock {
+				text = indent + text
+			}
+		case inBlock && !introducesBlock(c.Lines, i):
+			text = indent + text
+		}
+
+		// Blocks, and the comments above them, start after a blank line.
+		if len(lines) > 0 && (line.Keyword == "host" || line.Keyword == "match") && !lines[len(lines)-1].isComment() {
+			blank = true
+		}
+		if len(lines) > 0 && line.Keyword == "" && introducesBlock(c.Lines, i) && !lines[len(lines)-1].isComment() {
+			blank = true
+		}
+		if blank {
+			lines = append(lines, newConfigLine(""))
+			blank = false
+		}
+
+		line.Text = text
+		lines = append(lines, line)
+	}
+
+	c.Lines = lines
+	if bytes.Equal(before, c.Bytes()) {
+		return false
+	}
+	c.modified = true
+	return true
+}
+
+// formatOption writes an option line as "Keyword value", keeping the value
+// as written, quotes and all. The patterns of a Host line are separated by
+// single spaces.
+func formatOption(line Line) string {
+	keyword := line.keywordText()
+	value := strings.TrimSpace(strings.TrimSpace(line.Text)[len(keyword):])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if canonical, ok := CanonicalKeyword(keyword); ok {
+		keyword = canonical
+	}
+	if line.Keyword == "host" {
+		value = strings.Join(strings.Fields(value), " ")
+	}
+	if value == "" {
+		return keyword
+	}
+	return keyword + " " + value
+}
+
+// introducesBlock reports whether the comment at lines[i] is part of a run
+// of comments that leads straight into a Host or Match line.
+func introducesBlock(lines []Line, i int) bool {
+	for ; i < len(lines); i++ {
+		if !lines[i].isComment() {
+			return lines[i].Keyword == "host" || lines[i].Keyword == "match"
+		}
+	}
+	return false
+}
+
+func (l Line) isComment() bool {
+	return strings.HasPrefix(strings.TrimSpace(l.Text), "#")
+}
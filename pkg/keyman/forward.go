@@ -0,0 +1,250 @@
+package keyman
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Keywords of the port forwarding options Forward describes.
+const (
+	LocalForward   = "LocalForward"
+	RemoteForward  = "RemoteForward"
+	DynamicForward = "DynamicForward"
+)
+
+// Forward is a LocalForward, RemoteForward or DynamicForward option. Listen
+// is the port, or Unix socket path, that ssh listens on, locally for local
+// and dynamic forwards and on the server for remote ones, and Bind the
+// address it listens on when one is given. Target is where connections are
+// forwarded to, as host:port or a socket path, and is empty for dynamic
+// forwards, which act as a SOCKS proxy instead.
+type Forward struct {
+	Keyword string
+	Bind    string
+	Listen  string
+	Target  string
+}
+
+// HostForward is a Forward along with the Host block it is set in.
+type HostForward struct {
+	Host string
+	Forward
+}
+
+// ParseForward parses the value of a forwarding option as written in the
+// config, such as "8080 localhost:80" or "127.0.0.1:1080".
+func ParseForward(keyword, value string) (Forward, error) {
+	canonical, ok := CanonicalKeyword(keyword)
+	if !ok || !isForwardKeyword(canonical) {
+		return Forward{}, fmt.Errorf("%s is not a forwarding option", keyword)
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Forward{}, fmt.Errorf("%s %q should be [bind:]port followed by host:port", canonical, value)
+	}
+
+	forward := Forward{Keyword: canonical}
+	forward.Bind, forward.Listen = splitListen(fields[0])
+	if len(fields) == 2 {
+		forward.Target = fields[1]
+	}
+	return forward, forward.validate()
+}
+
+// ParseForwardSpec parses a forward written the way ssh's -L, -R and -D
+// flags take it, with colons throughout: "[bind:]port:host:hostport" for
+// local and remote forwards and "[bind:]port" for dynamic ones and remote
+// forwards that act as a SOCKS proxy. IPv6 addresses go in brackets.
+func ParseForwardSpec(keyword, spec string) (Forward, error) {
+	parts := splitSpec(spec)
+	forward := Forward{Keyword: keyword}
+	switch {
+	case keyword == DynamicForward && len(parts) <= 2, keyword == RemoteForward && len(parts) <= 2:
+		if len(parts) == 2 {
+			forward.Bind = parts[0]
+		}
+		forward.Listen = parts[len(parts)-1]
+	case keyword != DynamicForward && (len(parts) == 3 || len(parts) == 4):
+		if len(parts) == 4 {
+			forward.Bind, parts = parts[0], parts[1:]
+		}
+		forward.Listen = parts[0]
+		forward.Target = joinHostPort(parts[1], parts[2])
+	default:
+		usage := "[bind:]port:host:hostport"
+		if keyword == DynamicForward {
+			usage = "[bind:]port"
+		}
+		return Forward{}, fmt.Errorf("%s %q should be %s", keyword, spec, usage)
+	}
+	forward.Bind = strings.TrimSuffix(strings.TrimPrefix(forward.Bind, "["), "]")
+	return forward, forward.validate()
+}
+
+// Value returns the forward as written after its keyword in the config.
+func (f Forward) Value() string {
+	listen := f.Listen
+	if f.Bind != "" {
+		listen = joinHostPort(f.Bind, f.Listen)
+	}
+	if f.Target == "" {
+		return listen
+	}
+	return listen + " " + f.Target
+}
+
+// Remote reports whether ssh listens for the forward on the server rather
+// than on this machine.
+func (f Forward) Remote() bool {
+	return f.Keyword == RemoteForward
+}
+
+func (f Forward) validate() error {
+	if !strings.Contains(f.Listen, "/") {
+		if err := validatePort(f.Listen); err != nil {
+			return fmt.Errorf("%s listen port %v", f.Keyword, err)
+		}
+	}
+	if f.Keyword == DynamicForward && f.Target != "" {
+		return fmt.Errorf("DynamicForward takes no target, it acts as a SOCKS proxy")
+	}
+	if f.Keyword == LocalForward && f.Target == "" {
+		return fmt.Errorf("LocalForward needs a host:port to forward to")
+	}
+	if f.Target != "" && !strings.Contains(f.Target, "/") {
+		i := strings.LastIndex(f.Target, ":")
+		if i <= 0 {
+			return fmt.Errorf("%s target %q should be host:port", f.Keyword, f.Target)
+		}
+		if err := validatePort(f.Target[i+1:]); err != nil {
+			return fmt.Errorf("%s target port %v", f.Keyword, err)
+		}
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%q is not a port between 1 and 65535", port)
+	}
+	return nil
+}
+
+// Forwards returns the forwarding options set in the block, in order.
+// Values that do not parse are skipped; config lint reports them.
+func (b *HostBlock) Forwards() []Forward {
+	var forwards []Forward
+	for i := b.start + 1; i < b.end; i++ {
+		line := b.File.Lines[i]
+		canonical, _ := CanonicalKeyword(line.Keyword)
+		if !isForwardKeyword(canonical) {
+			continue
+		}
+		forward, err := ParseForward(canonical, line.Value)
+		if err == nil {
+			forwards = append(forwards, forward)
+		}
+	}
+	return forwards
+}
+
+// AddForward adds f to the block after any forwards of the same kind.
+func (b *HostBlock) AddForward(f Forward) {
+	b.addOption(f.Keyword, f.Value())
+}
+
+// Forwards returns the forwarding options of every Host block in the config
+// and its includes.
+func (c *Config) Forwards() []HostForward {
+	var forwards []HostForward
+	for _, block := range c.AllBlocks() {
+		if block.Match {
+			continue
+		}
+		for _, forward := range block.Forwards() {
+			forwards = append(forwards, HostForward{Host: block.Name(), Forward: forward})
+		}
+	}
+	return forwards
+}
+
+// ForwardConflicts returns the forwards that would listen on the same port
+// as f if f were added to host: those of host itself on the same side of
+// the connection, and local and dynamic forwards of other hosts, which
+// cannot be open at the same time as f.
+func (c *Config) ForwardConflicts(host string, f Forward) []HostForward {
+	var conflicts []HostForward
+	for _, other := range c.Forwards() {
+		if other.Remote() != f.Remote() || other.Listen != f.Listen || !bindsOverlap(other.Bind, f.Bind) {
+			continue
+		}
+		if other.Host == host || !f.Remote() {
+			conflicts = append(conflicts, other)
+		}
+	}
+	return conflicts
+}
+
+// bindsOverlap reports whether listening on a and b could clash. No
+// address means localhost, as ssh binds there unless GatewayPorts is set.
+func bindsOverlap(a, b string) bool {
+	normalize := func(bind string) string {
+		switch strings.ToLower(bind) {
+		case "", "localhost", "127.0.0.1", "::1":
+			return "localhost"
+		case "*", "0.0.0.0", "::":
+			return "*"
+		}
+		return strings.ToLower(bind)
+	}
+	a, b = normalize(a), normalize(b)
+	return a == b || a == "*" || b == "*"
+}
+
+func isForwardKeyword(keyword string) bool {
+	return keyword == LocalForward || keyword == RemoteForward || keyword == DynamicForward
+}
+
+// splitListen splits the listen half of a forward into its bind address
+// and port.
+func splitListen(listen string) (string, string) {
+	if strings.HasPrefix(listen, "[") {
+		if end := strings.Index(listen, "]:"); end > 0 {
+			return listen[1:end], listen[end+2:]
+		}
+	}
+	if i := strings.LastIndex(listen, ":"); i >= 0 && !strings.Contains(listen, "/") {
+		return listen[:i], listen[i+1:]
+	}
+	return "", listen
+}
+
+// splitSpec splits a forward spec at the colons outside brackets.
+func splitSpec(spec string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range spec {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, spec[start:])
+}
+
+// joinHostPort joins host and port, putting IPv6 addresses in brackets.
+func joinHostPort(host, port string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	return host + ":" + port
+}
@@ -0,0 +1,148 @@
+package keyman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RuleHostKeyChanged is the rule of findings for hosts whose key in
+// known_hosts is not the one keyman recorded for them.
+const RuleHostKeyChanged = "host_key_changed"
+
+func hostKeyID(name, algorithm string) string {
+	return name + " " + algorithm
+}
+
+// RecordHostKey notes key as the verified key of its type for name, as
+// KnownHostName gives it.
+func (m *Metadata) RecordHostKey(name string, key *PublicKey, when time.Time) {
+	m.HostKeys[hostKeyID(name, key.Algorithm)] = &HostKeyRecord{Fingerprint: key.FingerprintSHA256(), Recorded: when}
+}
+
+// RecordedHostKey returns the record of name's key of algorithm, or nil if
+// there is none.
+func (m *Metadata) RecordedHostKey(name, algorithm string) *HostKeyRecord {
+	return m.HostKeys[hostKeyID(name, algorithm)]
+}
+
+// RecordedHostNames returns the names of the hosts with recorded keys.
+func (m *Metadata) RecordedHostNames() []string {
+	var names []string
+	for id := range m.HostKeys {
+		if i := strings.LastIndex(id, " "); i > 0 && !containsString(names, id[:i]) {
+			names = append(names, id[:i])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Names returns the host names the entry is for: its patterns that are
+// plain names, and those of candidates its hashed patterns match.
+func (k KnownHost) Names(candidates []string) []string {
+	var names []string
+	for _, pattern := range k.Hosts {
+		switch {
+		case strings.HasPrefix(pattern, "|1|"):
+			for _, candidate := range candidates {
+				if hashMatches(pattern, candidate) && !containsString(names, candidate) {
+					names = append(names, candidate)
+				}
+			}
+		case !strings.ContainsAny(pattern, "*?!"):
+			if name := strings.ToLower(pattern); !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// CheckHostKeys compares the keys in known_hosts with those recorded,
+// returning a finding for each host whose recorded key of a type is no
+// longer there while another key of that type is. Keys of hosts with none
+// recorded are recorded, and recorded reports whether any were. Hashed
+// entries are matched against candidates and the recorded hosts' names.
+func (m *Metadata) CheckHostKeys(known []KnownHost, candidates []string, now time.Time) (findings []Finding, recorded bool) {
+	candidates = append(append([]string{}, candidates...), m.RecordedHostNames()...)
+	current := make(map[string][]*PublicKey)
+	var ids []string
+	for _, entry := range known {
+		if entry.Marker != "" {
+			continue
+		}
+		for _, name := range entry.Names(candidates) {
+			id := hostKeyID(name, entry.Key.Algorithm)
+			if _, ok := current[id]; !ok {
+				ids = append(ids, id)
+			}
+			current[id] = append(current[id], entry.Key)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		keys := current[id]
+		record := m.HostKeys[id]
+		if record == nil {
+			m.HostKeys[id] = &HostKeyRecord{Fingerprint: keys[0].FingerprintSHA256(), Recorded: now}
+			recorded = true
+			continue
+		}
+		if hasFingerprint(keys, record.Fingerprint) {
+			continue
+		}
+		name := id[:strings.LastIndex(id, " ")]
+		findings = append(findings, Finding{
+			Severity: SeverityError,
+			Rule:     RuleHostKeyChanged,
+			Subject:  name,
+			Message: fmt.Sprintf("%s host key in known_hosts is %s, not %s as recorded on %s; if the server's keys were replaced, verify it with keyman known-hosts replace %s",
+				keys[0].TypeName(), keys[0].FingerprintSHA256(), record.Fingerprint, record.Recorded.Format("2006-01-02"), name),
+		})
+	}
+	return findings, recorded
+}
+
+func hasFingerprint(keys []*PublicKey, fingerprint string) bool {
+	for _, key := range keys {
+		if key.FingerprintSHA256() == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveKnownHost removes name from the known_hosts lines holding a key of
+// algorithm for it, dropping lines left with no host, and returns the
+// lines kept and how many lines it changed. Lines with a marker are kept.
+func RemoveKnownHost(lines []string, name, algorithm string) ([]string, int) {
+	var kept []string
+	changed := 0
+	for _, line := range lines {
+		entries := ParseKnownHosts([]byte(line))
+		if len(entries) != 1 || entries[0].Marker != "" || entries[0].Key.Algorithm != algorithm {
+			kept = append(kept, line)
+			continue
+		}
+		var hosts []string
+		for _, pattern := range entries[0].Hosts {
+			if strings.HasPrefix(pattern, "|1|") && hashMatches(pattern, name) || strings.EqualFold(pattern, name) {
+				continue
+			}
+			hosts = append(hosts, pattern)
+		}
+		if len(hosts) == len(entries[0].Hosts) {
+			kept = append(kept, line)
+			continue
+		}
+		changed++
+		if len(hosts) > 0 {
+			fields := strings.Fields(line)
+			kept = append(kept, strings.Join(append([]string{strings.Join(hosts, ",")}, fields[1:]...), " "))
+		}
+	}
+	return kept, changed
+}
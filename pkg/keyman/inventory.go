@@ -0,0 +1,571 @@
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/yamlite"
+)
+
+// Inventory is an Ansible inventory: its hosts, with the variables set on
+// them, and the groups they are in. Every group is under "all", and hosts
+// in no other group are in "ungrouped", as in Ansible.
+type Inventory struct {
+	Hosts  map[string]*InventoryHost
+	Groups map[string]*InventoryGroup
+	order  []string
+}
+
+// InventoryHost is a host of an Inventory with the variables set on it
+// directly.
+type InventoryHost struct {
+	Name string
+	Vars map[string]string
+}
+
+// InventoryGroup is a group of an Inventory, with the hosts and groups in
+// it and its variables.
+type InventoryGroup struct {
+	Name     string
+	Hosts    []string
+	Children []string
+	Vars     map[string]string
+}
+
+// LoadInventory reads and parses the inventory at path.
+func LoadInventory(path string) (*Inventory, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inventory, err := ParseInventory(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return inventory, nil
+}
+
+// ParseInventory parses an inventory in Ansible's INI or YAML format,
+// telling them apart by the first line: an INI file starts with a host or a
+// [group] line, a YAML one with a group name followed by a colon.
+func ParseInventory(content []byte) (*Inventory, error) {
+	inventory := &Inventory{Hosts: make(map[string]*InventoryHost), Groups: make(map[string]*InventoryGroup)}
+	inventory.group("all")
+	inventory.group("ungrouped")
+
+	var err error
+	if isYAMLInventory(string(content)) {
+		err = inventory.parseYAML(content)
+	} else {
+		err = inventory.parseINI(string(content))
+	}
+	if err != nil {
+		return nil, err
+	}
+	inventory.finish()
+
+	// ssh would take a destination starting with - as an option, such as
+	// -oProxyCommand running a local command.
+	for _, name := range inventory.order {
+		if target := inventory.Target(name); strings.HasPrefix(target, "-") {
+			return nil, fmt.Errorf("host %s: ssh destination %q starts with -", name, target)
+		}
+	}
+	return inventory, nil
+}
+
+func isYAMLInventory(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		return line == "---" || strings.HasSuffix(line, ":")
+	}
+	return false
+}
+
+// parseINI reads the INI format:
+//
+//	mail.example.com
+//
+//	[webservers]
+//	web[01:03].example.com ansible_user=deploy
+//	db.example.com:2222
+//
+//	[prod:children]
+//	webservers
+//
+//	[prod:vars]
+//	ansible_user=admin
+func (inv *Inventory) parseINI(content string) error {
+	group, kind := inv.Groups["ungrouped"], "hosts"
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return fmt.Errorf("line %d: unterminated section %s", i+1, line)
+			}
+			name := line[1 : len(line)-1]
+			kind = "hosts"
+			if j := strings.LastIndex(name, ":"); j >= 0 {
+				name, kind = name[:j], name[j+1:]
+				if kind != "children" && kind != "vars" {
+					return fmt.Errorf("line %d: unknown section type %s", i+1, kind)
+				}
+			}
+			group = inv.group(name)
+			continue
+		}
+
+		fields := splitInventoryFields(line)
+		switch kind {
+		case "children":
+			inv.group(fields[0])
+			group.Children = appendUnique(group.Children, fields[0])
+		case "vars":
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return fmt.Errorf("line %d: expected key=value in [%s:vars]", i+1, group.Name)
+			}
+			group.Vars[strings.TrimSpace(key)] = unquoteInventory(strings.TrimSpace(value))
+		default:
+			vars := make(map[string]string)
+			// A port may follow the name, as in db.example.com:2222, but not
+			// an IPv6 address or a host range, whose colons are their own.
+			name := fields[0]
+			rest := name[strings.LastIndex(name, "]")+1:]
+			if j := strings.LastIndex(rest, ":"); j >= 0 && strings.Count(rest, ":") == 1 {
+				j += len(name) - len(rest)
+				name, vars["ansible_port"] = name[:j], name[j+1:]
+			}
+			for _, field := range fields[1:] {
+				key, value, ok := strings.Cut(field, "=")
+				if !ok {
+					return fmt.Errorf("line %d: expected key=value after the host name, got %s", i+1, field)
+				}
+				vars[key] = unquoteInventory(value)
+			}
+			names, err := expandHostRange(name)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", i+1, err)
+			}
+			for _, name := range names {
+				inv.addHost(group, name, vars)
+			}
+		}
+	}
+	return nil
+}
+
+// parseYAML reads the YAML format:
+//
+//	all:
+//	  hosts:
+//	    mail.example.com:
+//	  children:
+//	    webservers:
+//	      hosts:
+//	        web[01:03].example.com:
+//	        db.example.com:
+//	          ansible_port: 2222
+//	      vars:
+//	        ansible_user: deploy
+func (inv *Inventory) parseYAML(content []byte) error {
+	doc, err := yamlite.Parse(content)
+	if err != nil {
+		return err
+	}
+	groups := yamlite.Map(doc)
+	if groups == nil {
+		return fmt.Errorf("inventory must be a mapping of groups")
+	}
+	for _, name := range sortedKeys(groups) {
+		if err := inv.parseYAMLGroup(name, groups[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (inv *Inventory) parseYAMLGroup(name string, value interface{}) error {
+	group := inv.group(name)
+	fields := yamlite.Map(value)
+	if fields == nil && value != nil {
+		return fmt.Errorf("group %s must be a mapping of hosts, children and vars", name)
+	}
+	for key, value := range yamlite.Map(fields["vars"]) {
+		group.Vars[key] = yamlite.String(value)
+	}
+
+	hosts := yamlite.Map(fields["hosts"])
+	for _, host := range sortedKeys(hosts) {
+		vars := make(map[string]string)
+		for key, value := range yamlite.Map(hosts[host]) {
+			vars[key] = yamlite.String(value)
+		}
+		names, err := expandHostRange(host)
+		if err != nil {
+			return fmt.Errorf("group %s: %v", name, err)
+		}
+		for _, host := range names {
+			inv.addHost(group, host, vars)
+		}
+	}
+
+	children := yamlite.Map(fields["children"])
+	for _, child := range sortedKeys(children) {
+		group.Children = appendUnique(group.Children, child)
+		if err := inv.parseYAMLGroup(child, children[child]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (inv *Inventory) group(name string) *InventoryGroup {
+	group, ok := inv.Groups[name]
+	if !ok {
+		group = &InventoryGroup{Name: name, Vars: make(map[string]string)}
+		inv.Groups[name] = group
+	}
+	return group
+}
+
+func (inv *Inventory) addHost(group *InventoryGroup, name string, vars map[string]string) {
+	host, ok := inv.Hosts[name]
+	if !ok {
+		host = &InventoryHost{Name: name, Vars: make(map[string]string)}
+		inv.Hosts[name] = host
+		inv.order = append(inv.order, name)
+	}
+	for key, value := range vars {
+		host.Vars[key] = value
+	}
+	if group.Name != "all" {
+		group.Hosts = appendUnique(group.Hosts, name)
+	}
+}
+
+// finish puts every group no other group holds under all, and every host in
+// no group but all in ungrouped.
+func (inv *Inventory) finish() {
+	held := map[string]bool{"all": true}
+	grouped := make(map[string]bool)
+	for _, group := range inv.Groups {
+		for _, child := range group.Children {
+			held[child] = true
+		}
+		if group.Name != "ungrouped" {
+			for _, host := range group.Hosts {
+				grouped[host] = true
+			}
+		}
+	}
+	all := inv.Groups["all"]
+	for _, name := range sortedGroupNames(inv.Groups) {
+		if !held[name] {
+			all.Children = append(all.Children, name)
+		}
+	}
+	ungrouped := inv.Groups["ungrouped"]
+	for _, name := range inv.order {
+		if !grouped[name] && !containsString(ungrouped.Hosts, name) {
+			ungrouped.Hosts = append(ungrouped.Hosts, name)
+		}
+	}
+}
+
+// Vars returns the variables of host as Ansible resolves them: those of
+// all first, then of each group the host is in, shallower groups before
+// deeper ones and by name within a level, and the host's own last.
+func (inv *Inventory) Vars(host string) map[string]string {
+	depth := map[string]int{"all": 0}
+	queue := []string{"all"}
+	for len(queue) > 0 {
+		group := inv.Groups[queue[0]]
+		queue = queue[1:]
+		for _, child := range group.Children {
+			if _, seen := depth[child]; !seen {
+				depth[child] = depth[group.Name] + 1
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	var groups []string
+	for name := range inv.Groups {
+		if name == "all" || containsString(inv.groupHosts(name, nil), host) {
+			groups = append(groups, name)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if depth[groups[i]] != depth[groups[j]] {
+			return depth[groups[i]] < depth[groups[j]]
+		}
+		return groups[i] < groups[j]
+	})
+
+	vars := make(map[string]string)
+	for _, name := range groups {
+		for key, value := range inv.Groups[name].Vars {
+			vars[key] = value
+		}
+	}
+	if h, ok := inv.Hosts[host]; ok {
+		for key, value := range h.Vars {
+			vars[key] = value
+		}
+	}
+	return vars
+}
+
+// Target returns the destination to give ssh for host, from its
+// ansible_host, ansible_user and ansible_port variables. A port makes it
+// an ssh:// URI, as ssh takes no port in user@host.
+func (inv *Inventory) Target(host string) string {
+	vars := inv.Vars(host)
+	address := firstNonEmpty(vars["ansible_host"], vars["ansible_ssh_host"], host)
+	user := firstNonEmpty(vars["ansible_user"], vars["ansible_ssh_user"])
+	port := firstNonEmpty(vars["ansible_port"], vars["ansible_ssh_port"])
+
+	target := address
+	if port != "" {
+		target = joinHostPort(address, port)
+	}
+	if user != "" {
+		target = user + "@" + target
+	}
+	if port != "" {
+		target = "ssh://" + target
+	}
+	return target
+}
+
+// Select returns the hosts a --limit pattern picks, in inventory order. As
+// in Ansible, the pattern is a comma separated list of group names, host
+// names and wildcards such as web*.example.com; terms starting with ! drop
+// the hosts they match and terms starting with & keep only those they also
+// match. An empty pattern is all.
+func (inv *Inventory) Select(pattern string) ([]string, error) {
+	if strings.TrimSpace(pattern) == "" {
+		pattern = "all"
+	}
+	selected := make(map[string]bool)
+	var excluded, intersected [][]string
+	for _, term := range strings.Split(pattern, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		op := term[0]
+		if op == '!' || op == '&' {
+			term = term[1:]
+		}
+		hosts := inv.match(term)
+		if len(hosts) == 0 && op != '!' {
+			return nil, fmt.Errorf("no hosts or groups in the inventory match %s", term)
+		}
+		switch op {
+		case '!':
+			excluded = append(excluded, hosts)
+		case '&':
+			intersected = append(intersected, hosts)
+		default:
+			for _, host := range hosts {
+				selected[host] = true
+			}
+		}
+	}
+
+	var hosts []string
+	for _, host := range inv.order {
+		keep := selected[host]
+		for _, list := range intersected {
+			keep = keep && containsString(list, host)
+		}
+		for _, list := range excluded {
+			keep = keep && !containsString(list, host)
+		}
+		if keep {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// match returns the hosts of the groups term names or matches, and the
+// hosts it names or matches itself.
+func (inv *Inventory) match(term string) []string {
+	var hosts []string
+	for _, name := range sortedGroupNames(inv.Groups) {
+		if matched, _ := path.Match(term, name); matched || term == name {
+			hosts = inv.groupHosts(name, hosts)
+		}
+	}
+	for _, name := range inv.order {
+		if matched, _ := path.Match(term, name); matched || term == name {
+			hosts = appendUnique(hosts, name)
+		}
+	}
+	return hosts
+}
+
+// groupHosts appends the hosts of a group and of the groups under it to
+// hosts.
+func (inv *Inventory) groupHosts(name string, hosts []string) []string {
+	seen := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		group, ok := inv.Groups[name]
+		if !ok || seen[name] {
+			return
+		}
+		seen[name] = true
+		for _, host := range group.Hosts {
+			hosts = appendUnique(hosts, host)
+		}
+		for _, child := range group.Children {
+			walk(child)
+		}
+	}
+	walk(name)
+	return hosts
+}
+
+// expandHostRange expands Ansible's host ranges, such as
+// web[01:03].example.com for web01 to web03 or db-[a:c] for db-a to db-c,
+// with an optional step after a second colon.
+func expandHostRange(name string) ([]string, error) {
+	start := strings.Index(name, "[")
+	if start < 0 {
+		return []string{name}, nil
+	}
+	end := strings.Index(name[start:], "]")
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated host range in %s", name)
+	}
+	end += start
+	parts := strings.Split(name[start+1:end], ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("host range in %s should be [start:end] or [start:end:step]", name)
+	}
+	step := 1
+	if len(parts) == 3 {
+		var err error
+		if step, err = strconv.Atoi(parts[2]); err != nil || step < 1 {
+			return nil, fmt.Errorf("host range step in %s should be a positive number", name)
+		}
+	}
+
+	var values []string
+	from, errFrom := strconv.Atoi(parts[0])
+	to, errTo := strconv.Atoi(parts[1])
+	switch {
+	case errFrom == nil && errTo == nil:
+		for n := from; n <= to; n += step {
+			values = append(values, fmt.Sprintf("%0*d", len(parts[0]), n))
+		}
+	case len(parts[0]) == 1 && len(parts[1]) == 1:
+		for c := parts[0][0]; c <= parts[1][0]; c += byte(step) {
+			values = append(values, string(c))
+		}
+	default:
+		return nil, fmt.Errorf("host range in %s should be of numbers or single letters", name)
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("host range in %s is empty", name)
+	}
+
+	var names []string
+	for _, value := range values {
+		rest, err := expandHostRange(name[end+1:])
+		if err != nil {
+			return nil, err
+		}
+		for _, suffix := range rest {
+			names = append(names, name[:start]+value+suffix)
+		}
+	}
+	return names, nil
+}
+
+// splitInventoryFields splits an INI host line on spaces outside quotes.
+func splitInventoryFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	quote := rune(0)
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+			field.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			field.WriteRune(r)
+		case r == ' ' || r == '\t':
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		case r == '#' && field.Len() == 0:
+			return fields
+		default:
+			field.WriteRune(r)
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+func unquoteInventory(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func appendUnique(list []string, value string) []string {
+	if containsString(list, value) {
+		return list
+	}
+	return append(list, value)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedGroupNames(groups map[string]*InventoryGroup) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
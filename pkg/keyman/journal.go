@@ -0,0 +1,73 @@
+package keyman
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// JournalEntry records one change keyman made: who made it and when, what
+// it was applied to, and the values before and after.
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	Hostname string    `json:"hostname"`
+	Command  string    `json:"command"`
+	Action   string    `json:"action"`
+	Subject  string    `json:"subject"`
+	Old      string    `json:"old,omitempty"`
+	New      string    `json:"new,omitempty"`
+}
+
+// AppendJournal adds an entry to the journal at path, one JSON object per
+// line. The file is only ever appended to.
+func AppendJournal(path string, entry JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadJournal returns the entries in the journal at path, oldest first. A
+// missing file is an empty journal.
+func ReadJournal(path string) ([]JournalEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,264 @@
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RuleJumpIdentity names the findings of CheckJumpChains.
+const RuleJumpIdentity = "jump_identity"
+
+// JumpHop is a host ssh connects through on the way to another, with the
+// options the config sets for it.
+type JumpHop struct {
+	// Host is the hop as named in ProxyJump or in the ssh command of a
+	// ProxyCommand, and Via which of the two named it.
+	Host string
+	Via  string
+
+	HostName string
+	User     string
+	Port     string
+
+	// Identities holds the IdentityFile values of every block matching
+	// Host, as written.
+	Identities []string
+}
+
+// JumpChain returns the hops ssh goes through to reach host, the first it
+// connects to first, following ProxyJump and ProxyCommands that run ssh.
+// ssh reads the config for the first hop, so its own jumps come before it,
+// while later hops of a ProxyJump list are taken as listed since ssh hands
+// them on with -J. It returns an error when the chain loops back on itself.
+func (c *Config) JumpChain(host string) ([]JumpHop, error) {
+	return c.jumpChain(host, host, []string{strings.ToLower(host)})
+}
+
+func (c *Config) jumpChain(target, host string, seen []string) ([]JumpHop, error) {
+	hops := c.jumps(host)
+	if len(hops) == 0 {
+		return nil, nil
+	}
+	for _, hop := range hops {
+		if containsString(seen, strings.ToLower(hop.Host)) {
+			return nil, fmt.Errorf("the jump chain of %s loops back to %s", target, hop.Host)
+		}
+		seen = append(seen, strings.ToLower(hop.Host))
+	}
+	before, err := c.jumpChain(target, hops[0].Host, seen)
+	if err != nil {
+		return nil, err
+	}
+	return append(before, hops...), nil
+}
+
+// jumps returns the hops named by the first ProxyJump or ProxyCommand that
+// applies to host, with the options of each filled in from the config.
+func (c *Config) jumps(host string) []JumpHop {
+	var hops []JumpHop
+	found := false
+	for _, block := range c.MatchingBlocks(host) {
+		if found {
+			break
+		}
+		for i := block.start + 1; i < block.end && !found; i++ {
+			line := block.File.Lines[i]
+			switch line.Keyword {
+			case "proxyjump":
+				hops, found = ParseProxyJump(line.Value), true
+			case "proxycommand":
+				hops, found = ParseProxyCommand(line.Value), true
+			}
+		}
+	}
+
+	for i := range hops {
+		hop := &hops[i]
+		for _, block := range c.MatchingBlocks(hop.Host) {
+			hop.HostName = orEmpty(hop.HostName, block.Option("HostName"))
+			hop.User = orEmpty(hop.User, block.Option("User"))
+			hop.Port = orEmpty(hop.Port, block.Option("Port"))
+			hop.Identities = append(hop.Identities, block.Options("IdentityFile")...)
+		}
+	}
+	return hops
+}
+
+func orEmpty(value, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
+
+// ParseProxyJump splits a ProxyJump value into its hops, each written as
+// [user@]host[:port] or ssh://[user@]host[:port]. "none" has none.
+func ParseProxyJump(value string) []JumpHop {
+	if value == "" || strings.EqualFold(value, "none") {
+		return nil
+	}
+	var hops []JumpHop
+	for _, spec := range strings.Split(value, ",") {
+		spec = strings.TrimPrefix(strings.TrimSpace(spec), "ssh://")
+		hop := JumpHop{Via: "ProxyJump"}
+		if i := strings.LastIndex(spec, "@"); i >= 0 {
+			hop.User, spec = spec[:i], spec[i+1:]
+		}
+		if strings.HasPrefix(spec, "[") {
+			if end := strings.Index(spec, "]"); end > 0 {
+				hop.Port = strings.TrimPrefix(spec[end+1:], ":")
+				spec = spec[1:end]
+			}
+		} else if i := strings.LastIndex(spec, ":"); i >= 0 && strings.Count(spec, ":") == 1 {
+			spec, hop.Port = spec[:i], spec[i+1:]
+		}
+		if spec != "" {
+			hop.Host = spec
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// sshValueFlags are the ssh options that take a value, so the destination
+// of a ProxyCommand can be told from them.
+const sshValueFlags = "BbcDEeFIiJLlmOoPpQRSWw"
+
+// ParseProxyCommand returns the hops of a ProxyCommand that runs ssh, such
+// as "ssh -W %h:%p bastion" or "ssh bastion nc %h %p", along with those
+// passed to it with -J. Other commands, such as nc or a cloud CLI, do not
+// jump through an ssh host and have none.
+func ParseProxyCommand(command string) []JumpHop {
+	fields := strings.Fields(command)
+	if len(fields) > 0 && fields[0] == "exec" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(filepath.ToSlash(fields[0]))), ".exe")
+	if name != "ssh" {
+		return nil
+	}
+
+	var before []JumpHop
+	hop := JumpHop{Via: "ProxyCommand"}
+	for i := 1; i < len(fields); i++ {
+		field := fields[i]
+		if !strings.HasPrefix(field, "-") || field == "-" {
+			destination := ParseProxyJump(field)
+			if len(destination) == 0 {
+				return nil
+			}
+			hop.Host = destination[0].Host
+			hop.User = orEmpty(hop.User, destination[0].User)
+			hop.Port = orEmpty(hop.Port, destination[0].Port)
+			return append(before, hop)
+		}
+
+		// Flags may be grouped, as in -qW, and the last of a group may
+		// take its value from the rest of the field or the next one.
+		for j := 1; j < len(field); j++ {
+			if !strings.ContainsRune(sshValueFlags, rune(field[j])) {
+				continue
+			}
+			value := field[j+1:]
+			if value == "" && i+1 < len(fields) {
+				i++
+				value = fields[i]
+			}
+			switch field[j] {
+			case 'l':
+				hop.User = value
+			case 'p':
+				hop.Port = value
+			case 'J':
+				for _, jump := range ParseProxyJump(value) {
+					jump.Via = "ProxyCommand"
+					before = append(before, jump)
+				}
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// CheckJumpChains reports the hosts ssh jumps through that have no
+// identity to log in with: a hop with no IdentityFile offers whatever the
+// agent and the default keys hold, and one whose IdentityFiles are all
+// missing cannot log in with a key at all. Chains that loop are reported
+// against the block that starts them.
+func (c *Config) CheckJumpChains() []Finding {
+	var findings []Finding
+	targets := make(map[string][]string)
+	hops := make(map[string]JumpHop)
+	var order []string
+	for _, block := range c.AllBlocks() {
+		if block.Match || block.IsDefaults() {
+			continue
+		}
+		host := block.Patterns[0]
+		for _, pattern := range block.Patterns {
+			if !strings.HasPrefix(pattern, "!") {
+				host = pattern
+				break
+			}
+		}
+
+		chain, err := c.JumpChain(host)
+		if err != nil {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Rule:     RuleJumpIdentity,
+				Subject:  block.Name(),
+				Message:  err.Error(),
+			})
+			continue
+		}
+		for _, hop := range chain {
+			if _, ok := hops[hop.Host]; !ok {
+				hops[hop.Host] = hop
+				order = append(order, hop.Host)
+			}
+			if !containsString(targets[hop.Host], block.Name()) {
+				targets[hop.Host] = append(targets[hop.Host], block.Name())
+			}
+		}
+	}
+
+	for _, name := range order {
+		hop := hops[name]
+		behind := strings.Join(targets[name], ", ")
+		if len(hop.Identities) == 0 {
+			findings = append(findings, Finding{
+				Severity: SeverityWarning,
+				Rule:     RuleJumpIdentity,
+				Subject:  name,
+				Message:  fmt.Sprintf("jump host for %s has no IdentityFile, so ssh offers whatever keys the agent and the defaults hold", behind),
+			})
+			continue
+		}
+		var missing []string
+		for _, identity := range hop.Identities {
+			path, err := ExpandPath(identity)
+			if err == nil {
+				_, err = os.Stat(path)
+			}
+			if err != nil {
+				missing = append(missing, identity)
+			}
+		}
+		if len(missing) == len(hop.Identities) {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Rule:     RuleJumpIdentity,
+				Subject:  name,
+				Message:  fmt.Sprintf("jump host for %s has no existing IdentityFile, %s missing", behind, strings.Join(missing, ", ")),
+			})
+		}
+	}
+	return findings
+}
@@ -0,0 +1,270 @@
+package keyman
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// PublicKeyExt is the suffix that marks a file as a public key.
+const PublicKeyExt = ".pub"
+
+// Key is a key pair discovered in an SSH directory. Path is the path of the
+// public key file, or of the private key when MissingPublic is set.
+// Certificate is set when a certificate for the key sits next to it.
+// Created is when keyman generated the key if it recorded that, otherwise
+// the file's creation time where the platform keeps one, otherwise the
+// same as Modified.
+type Key struct {
+	Name        string
+	Path        string
+	Created     time.Time
+	Modified    time.Time
+	Comment     string
+	Public      *PublicKey
+	Certificate *Certificate
+	Metadata    *KeyMetadata
+
+	// MissingPublic marks a private key whose .pub file is gone, and
+	// MissingPrivate a public key or certificate without its private key.
+	MissingPublic  bool
+	MissingPrivate bool
+
+	// Token is TokenPKCS11 or TokenFIDO for a key that lives only on a
+	// hardware token, with no files in the ssh directory. Provider is the
+	// PKCS#11 library a TokenPKCS11 key was found through.
+	Token    string
+	Provider string
+}
+
+// ListKeys returns the keys in dir, one for each public key file, with
+// their certificates attached, followed by any private keys that have lost
+// their public key file.
+func ListKeys(dir string) ([]Key, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	var certs, others []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), CertificateSuffix) {
+			certs = append(certs, file.Name())
+			continue
+		}
+		if !file.IsDir() && strings.HasSuffix(file.Name(), PublicKeyExt) {
+			keyName := strings.TrimSuffix(file.Name(), PublicKeyExt)
+			keyPath := filepath.Join(dir, file.Name())
+			created, modified, err := fileTimes(keyPath)
+			if err != nil {
+				return nil, err
+			}
+			var comment string
+			pub, err := ReadPublicKeyFile(keyPath)
+			if err != nil {
+				pub = nil
+			} else {
+				comment = pub.Comment
+			}
+
+			keys = append(keys, Key{
+				Name:     keyName,
+				Path:     keyPath,
+				Created:  created,
+				Modified: modified,
+				Comment:  comment,
+				Public:   pub,
+			})
+		} else if !file.IsDir() {
+			others = append(others, file.Name())
+		}
+	}
+
+	for _, name := range certs {
+		certPath := filepath.Join(dir, name)
+		cert, err := ReadCertificateFile(certPath)
+		if err != nil {
+			continue
+		}
+
+		keyName := strings.TrimSuffix(name, CertificateSuffix)
+		attached := false
+		for i := range keys {
+			if keys[i].Name == keyName {
+				keys[i].Certificate = cert
+				attached = true
+			}
+		}
+
+		// A certificate without its public key is still worth showing.
+		if !attached {
+			created, modified, err := fileTimes(certPath)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, Key{
+				Name:        keyName,
+				Path:        certPath,
+				Created:     created,
+				Modified:    modified,
+				Comment:     cert.Key.Comment,
+				Certificate: cert,
+			})
+		}
+	}
+
+	for i := range keys {
+		_, err := os.Stat(keys[i].PrivatePath())
+		keys[i].MissingPrivate = os.IsNotExist(err)
+	}
+
+	for _, name := range others {
+		keyPath := filepath.Join(dir, name)
+		if hasKey(keys, name) || !isPrivateKeyFile(keyPath) {
+			continue
+		}
+		created, modified, err := fileTimes(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		key := Key{Name: name, Path: keyPath, Created: created, Modified: modified, MissingPublic: true}
+		if content, err := os.ReadFile(keyPath); err == nil {
+			if pub, err := PublicKeyFromPrivate(content); err == nil {
+				key.Public = pub
+				key.Comment = pub.Comment
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func hasKey(keys []Key, name string) bool {
+	for _, key := range keys {
+		if key.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateKeyFile reports whether the file at path starts like a PEM
+// encoded private key.
+func isPrivateKeyFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(file, head)
+	line, _, _ := bytes.Cut(head[:n], []byte("\n"))
+	return bytes.HasPrefix(line, []byte("-----BEGIN ")) && bytes.Contains(line, []byte("PRIVATE KEY-----"))
+}
+
+// PrivatePath returns the path of the key's private half.
+func (k Key) PrivatePath() string {
+	if strings.HasSuffix(k.Path, CertificateSuffix) {
+		return strings.TrimSuffix(k.Path, CertificateSuffix)
+	}
+	return strings.TrimSuffix(k.Path, PublicKeyExt)
+}
+
+// IsEncrypted reports whether the private key at path is protected by a
+// passphrase. It understands the OpenSSH format as well as legacy PEM and
+// PKCS#8 keys.
+func IsEncrypted(path string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return false, errors.New("not a PEM encoded private key")
+	}
+
+	switch block.Type {
+	case "OPENSSH PRIVATE KEY":
+		const magic = "openssh-key-v1\x00"
+		if !bytes.HasPrefix(block.Bytes, []byte(magic)) {
+			return false, errors.New("invalid OpenSSH private key")
+		}
+		cipher, _, ok := readWireString(block.Bytes[len(magic):])
+		if !ok {
+			return false, errors.New("invalid OpenSSH private key")
+		}
+		return string(cipher) != "none", nil
+	case "ENCRYPTED PRIVATE KEY":
+		return true, nil
+	default:
+		return strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED"), nil
+	}
+}
+
+// fileTimes returns when the file at path was created and last modified.
+// Where the creation time is unknown it is the modification time.
+func fileTimes(path string) (time.Time, time.Time, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if created, ok := birthTime(path, fileInfo); ok {
+		return created, fileInfo.ModTime(), nil
+	}
+	return fileInfo.ModTime(), fileInfo.ModTime(), nil
+}
+
+// KeyComment returns the comment of a public key file: the text after the
+// key in the usual one-line OpenSSH format, or the Comment header of an
+// RFC 4716 file.
+func KeyComment(path string) (string, error) {
+	pub, err := ReadPublicKeyFile(path)
+	if err != nil {
+		return "", err
+	}
+	return pub.Comment, nil
+}
+
+// HomeDir is the directory a leading ~ expands to. It defaults to the
+// current user's home directory when empty, %USERPROFILE% on Windows.
+var HomeDir string
+
+func homeDir() (string, error) {
+	if HomeDir != "" {
+		return HomeDir, nil
+	}
+	if runtime.GOOS == "windows" {
+		if profile := os.Getenv("USERPROFILE"); profile != "" {
+			return profile, nil
+		}
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return usr.HomeDir, nil
+}
+
+// ExpandPath expands a leading ~ to HomeDir and makes path absolute.
+func ExpandPath(path string) (string, error) {
+	if strings.HasPrefix(path, "~") {
+		home, err := homeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, path[1:]), nil
+	}
+	return filepath.Abs(path)
+}
@@ -0,0 +1,168 @@
+package keyman
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"os"
+	"strings"
+)
+
+// KnownHost is a key line of a known_hosts file. Hosts holds its host
+// patterns as written, hashed ones included, and Marker is @cert-authority
+// or @revoked when the line starts with one.
+type KnownHost struct {
+	Line   int
+	Marker string
+	Hosts  []string
+	Key    *PublicKey
+}
+
+// LoadKnownHosts reads the known_hosts file at path, returning no entries
+// if it does not exist.
+func LoadKnownHosts(path string) ([]KnownHost, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseKnownHosts(content), nil
+}
+
+// ParseKnownHosts parses the key lines of a known_hosts file. Comments,
+// blank lines and lines ssh could not use either are skipped.
+func ParseKnownHosts(content []byte) []KnownHost {
+	var entries []KnownHost
+	for i, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		entry := KnownHost{Line: i + 1}
+		if strings.HasPrefix(fields[0], "@") {
+			entry.Marker, fields = fields[0], fields[1:]
+		}
+		if len(fields) < 3 {
+			continue
+		}
+		key, err := ParsePublicKey(strings.Join(fields[1:], " "))
+		if err != nil {
+			continue
+		}
+		entry.Hosts = strings.Split(fields[0], ",")
+		entry.Key = key
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Matches reports whether the entry applies to host, given as
+// KnownHostName returns it. Hashed names are checked by hashing host with
+// their salt; other patterns may use * and ? wildcards and ! negation.
+func (k KnownHost) Matches(host string) bool {
+	matched := false
+	for _, pattern := range k.Hosts {
+		if strings.HasPrefix(pattern, "|1|") {
+			if hashMatches(pattern, host) {
+				matched = true
+			}
+			continue
+		}
+		negated := strings.HasPrefix(pattern, "!")
+		if !matchWildcard(strings.ToLower(strings.TrimPrefix(pattern, "!")), strings.ToLower(host)) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// Hashed reports whether the entry's host names are hashed.
+func (k KnownHost) Hashed() bool {
+	return len(k.Hosts) > 0 && strings.HasPrefix(k.Hosts[0], "|1|")
+}
+
+// KnownHostName returns host as known_hosts names it: bare on port 22,
+// otherwise as [host]:port.
+func KnownHostName(host, port string) string {
+	if port == "" || port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// HashKnownHost hashes a name from KnownHostName the way ssh does with
+// HashKnownHosts yes, as |1|salt|hash with a fresh random salt.
+func HashKnownHost(name string) (string, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(hostHash(salt, name)), nil
+}
+
+// KnownHostLine formats key as a known_hosts line for the names given,
+// which are hashed first if hash is set.
+func KnownHostLine(names []string, key *PublicKey, hash bool) (string, error) {
+	hosts := names
+	if hash {
+		hosts = nil
+		for _, name := range names {
+			hashed, err := HashKnownHost(name)
+			if err != nil {
+				return "", err
+			}
+			hosts = append(hosts, hashed)
+		}
+	}
+	return strings.Join(hosts, ",") + " " + (&PublicKey{Algorithm: key.Algorithm, Blob: key.Blob}).String(), nil
+}
+
+func hashMatches(pattern, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(hash, hostHash(salt, host))
+}
+
+func hostHash(salt []byte, host string) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return mac.Sum(nil)
+}
+
+// matchWildcard matches s against a pattern where * matches any run of
+// characters and ? any one. Unlike path.Match, brackets are literal, as
+// they are in [host]:port names.
+func matchWildcard(pattern, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if matchWildcard(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && matchWildcard(pattern[1:], s[1:])
+	}
+	return s != "" && s[0] == pattern[0] && matchWildcard(pattern[1:], s[1:])
+}
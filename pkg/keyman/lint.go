@@ -0,0 +1,243 @@
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Rule names of the findings Lint reports.
+const (
+	RuleUnknownOption     = "unknown_option"
+	RuleMissingValue      = "missing_value"
+	RuleMissingIdentity   = "missing_identity"
+	RuleDuplicateHost     = "duplicate_host"
+	RuleIneffectiveOption = "ineffective_option"
+	RuleDeprecatedOption  = "deprecated_option"
+)
+
+// configKeywords are the options ssh_config(5) documents, as the manual
+// spells them, along with UseKeychain from macOS and the GSSAPI options
+// that Debian and Fedora patch in.
+var configKeywords = []string{
+	"Host", "Match", "AddKeysToAgent", "AddressFamily", "BatchMode", "BindAddress", "BindInterface",
+	"CanonicalDomains", "CanonicalizeFallbackLocal", "CanonicalizeHostname", "CanonicalizeMaxDots",
+	"CanonicalizePermittedCNAMEs", "CASignatureAlgorithms", "CertificateFile", "ChannelTimeout", "CheckHostIP",
+	"Ciphers", "ClearAllForwardings", "Compression", "ConnectionAttempts", "ConnectTimeout", "ControlMaster",
+	"ControlPath", "ControlPersist", "DynamicForward", "EnableEscapeCommandline", "EnableSSHKeysign",
+	"EscapeChar", "ExitOnForwardFailure", "FingerprintHash", "ForkAfterAuthentication", "ForwardAgent",
+	"ForwardX11", "ForwardX11Timeout", "ForwardX11Trusted", "GatewayPorts", "GlobalKnownHostsFile",
+	"GSSAPIAuthentication", "GSSAPIClientIdentity", "GSSAPIDelegateCredentials", "GSSAPIKeyExchange",
+	"GSSAPIKexAlgorithms", "GSSAPIRenewalForcesRekey", "GSSAPIServerIdentity", "GSSAPITrustDns",
+	"HashKnownHosts", "HostbasedAcceptedAlgorithms", "HostbasedAuthentication", "HostKeyAlgorithms",
+	"HostKeyAlias", "HostName", "IdentitiesOnly", "IdentityAgent", "IdentityFile", "IgnoreUnknown", "Include",
+	"IPQoS", "KbdInteractiveAuthentication", "KbdInteractiveDevices", "KexAlgorithms", "KnownHostsCommand",
+	"LocalCommand", "LocalForward", "LogLevel", "LogVerbose", "MACs", "NoHostAuthenticationForLocalhost",
+	"NumberOfPasswordPrompts", "ObscureKeystrokeTiming", "PasswordAuthentication", "PermitLocalCommand",
+	"PermitRemoteOpen", "PKCS11Provider", "Port", "PreferredAuthentications", "ProxyCommand", "ProxyJump",
+	"ProxyUseFdpass", "PubkeyAcceptedAlgorithms", "PubkeyAuthentication", "RekeyLimit", "RemoteCommand",
+	"RemoteForward", "RequestTTY", "RequiredRSASize", "RevokedHostKeys", "SecurityKeyProvider", "SendEnv",
+	"ServerAliveCountMax", "ServerAliveInterval", "SessionType", "SetEnv", "StdinNull", "StreamLocalBindMask",
+	"StreamLocalBindUnlink", "StrictHostKeyChecking", "SyslogFacility", "Tag", "TCPKeepAlive", "Tunnel",
+	"TunnelDevice", "UpdateHostKeys", "UseKeychain", "User", "UserKnownHostsFile", "VerifyHostKeyDNS",
+	"VisualHostKey", "XAuthLocation",
+}
+
+// deprecatedKeywords are options ssh still parses but ignores or accepts
+// under an old name, with what to do instead.
+var deprecatedKeywords = map[string]string{
+	"protocol":                        "Protocol is ignored, only protocol 2 is supported",
+	"cipher":                          "Cipher only applied to protocol 1, use Ciphers",
+	"compressionlevel":                "CompressionLevel is ignored",
+	"useprivilegedport":               "UsePrivilegedPort is ignored",
+	"rhostsrsaauthentication":         "RhostsRSAAuthentication is ignored",
+	"rsaauthentication":               "RSAAuthentication is ignored, use PubkeyAuthentication",
+	"useroaming":                      "UseRoaming is ignored",
+	"fallbacktorsh":                   "FallBackToRsh is ignored",
+	"usersh":                          "UseRsh is ignored",
+	"keepalive":                       "KeepAlive is an old name for TCPKeepAlive",
+	"challengeresponseauthentication": "ChallengeResponseAuthentication is an old name for KbdInteractiveAuthentication",
+	"pubkeyacceptedkeytypes":          "PubkeyAcceptedKeyTypes is an old name for PubkeyAcceptedAlgorithms",
+	"hostbasedkeytypes":               "HostbasedKeyTypes is an old name for HostbasedAcceptedAlgorithms",
+	"hostbasedacceptedkeytypes":       "HostbasedAcceptedKeyTypes is an old name for HostbasedAcceptedAlgorithms",
+}
+
+// multiValueKeywords are the options every matching block adds to, rather
+// than the first value winning.
+var multiValueKeywords = map[string]bool{
+	"identityfile": true, "certificatefile": true, "localforward": true, "remoteforward": true,
+	"dynamicforward": true, "sendenv": true, "setenv": true, "include": true, "host": true, "match": true,
+	"ignoreunknown": true,
+}
+
+// CanonicalKeyword returns keyword spelled as the ssh_config manual does,
+// or false if ssh does not know it.
+func CanonicalKeyword(keyword string) (string, bool) {
+	for _, known := range configKeywords {
+		if strings.EqualFold(known, keyword) {
+			return known, true
+		}
+	}
+	if _, ok := deprecatedKeywords[strings.ToLower(keyword)]; ok {
+		return keyword, true
+	}
+	return "", false
+}
+
+// Lint checks the config and the files it includes for options ssh does
+// not know or ignores, options without a value, IdentityFiles missing on
+// disk, hosts with more than one Host block and options that an earlier
+// Host * or Match all block already sets, so ssh never uses them. The
+// subject of each finding is the file and line, as path:line.
+func (c *Config) Lint() []Finding {
+	l := &linter{catchAll: true, defaults: make(map[string]string), hosts: make(map[string]string)}
+	l.file(c)
+	return l.findings
+}
+
+type linter struct {
+	findings []Finding
+
+	// catchAll is set while reading options that apply to every host:
+	// those before the first Host line and in Host * or Match all blocks.
+	catchAll bool
+
+	// defaults holds where options were first set for every host, and
+	// hosts where each Host pattern was first seen.
+	defaults map[string]string
+	hosts    map[string]string
+
+	ignoreUnknown []string
+}
+
+func (l *linter) add(severity Severity, rule, at, format string, args ...interface{}) {
+	l.findings = append(l.findings, Finding{
+		Severity: severity,
+		Rule:     rule,
+		Subject:  at,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *linter) file(c *Config) {
+	for i, line := range c.Lines {
+		if line.Keyword == "" {
+			continue
+		}
+		at := fmt.Sprintf("%s:%d", c.Path, i+1)
+		name := line.keywordText()
+
+		switch line.Keyword {
+		case "host":
+			l.catchAll = false
+			for _, pattern := range strings.Fields(line.Value) {
+				if pattern == DefaultsHost {
+					l.catchAll = true
+				}
+				if first, ok := l.hosts[pattern]; ok {
+					l.add(SeverityWarning, RuleDuplicateHost, at, "Host %s is already on the Host line at %s, ssh uses the first value of each option set in both", pattern, first)
+				} else {
+					l.hosts[pattern] = at
+				}
+			}
+		case "match":
+			l.catchAll = strings.EqualFold(strings.TrimSpace(line.Value), "all")
+		}
+
+		if _, deprecated := deprecatedKeywords[line.Keyword]; deprecated {
+			l.add(SeverityWarning, RuleDeprecatedOption, at, "%s", deprecatedKeywords[line.Keyword])
+		} else if _, ok := CanonicalKeyword(line.Keyword); !ok {
+			if !MatchPatterns(l.ignoreUnknown, line.Keyword) {
+				message := fmt.Sprintf("%s is not an ssh option, ssh refuses to start", name)
+				if suggestion := closestKeyword(line.Keyword); suggestion != "" {
+					message += fmt.Sprintf(", did you mean %s?", suggestion)
+				}
+				l.add(SeverityError, RuleUnknownOption, at, "%s", message)
+			}
+			continue
+		}
+
+		if line.Value == "" {
+			l.add(SeverityError, RuleMissingValue, at, "%s has no value", name)
+			continue
+		}
+
+		switch line.Keyword {
+		case "ignoreunknown":
+			for _, pattern := range strings.Split(line.Value, ",") {
+				l.ignoreUnknown = append(l.ignoreUnknown, strings.ToLower(strings.TrimSpace(pattern)))
+			}
+		case "identityfile":
+			l.identityFile(at, line.Value)
+		case "include":
+			catchAll := l.catchAll
+			for _, included := range line.Included {
+				l.file(included)
+			}
+			l.catchAll = catchAll
+		}
+
+		if multiValueKeywords[line.Keyword] {
+			continue
+		}
+		if first, ok := l.defaults[line.Keyword]; ok && !l.catchAll {
+			l.add(SeverityWarning, RuleIneffectiveOption, at, "%s has no effect, %s already sets it for every host and ssh uses the first value", name, first)
+		} else if !ok && l.catchAll {
+			l.defaults[line.Keyword] = at
+		}
+	}
+}
+
+// identityFile reports an IdentityFile that does not exist. Paths using
+// ssh's % tokens or environment variables are left alone.
+func (l *linter) identityFile(at, value string) {
+	if strings.EqualFold(value, "none") || strings.ContainsAny(value, "%$") {
+		return
+	}
+	path, err := ExpandPath(value)
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		l.add(SeverityWarning, RuleMissingIdentity, at, "IdentityFile %s does not exist", value)
+	}
+}
+
+// closestKeyword suggests the known option keyword is most likely a typo
+// of, if any is within two edits.
+func closestKeyword(keyword string) string {
+	best, bestDistance := "", 3
+	for _, known := range configKeywords {
+		if d := editDistance(strings.ToLower(known), keyword); d < bestDistance {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
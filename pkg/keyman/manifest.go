@@ -0,0 +1,149 @@
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/yamlite"
+)
+
+// Manifest declares the keys and host mappings a machine should have, for
+// keyman apply to converge on.
+type Manifest struct {
+	Keys  []ManifestKey
+	Hosts []ManifestHost
+}
+
+// ManifestKey is a key the manifest wants present, or gone if Absent. Name
+// is a file name in the ssh directory.
+type ManifestKey struct {
+	Name           string
+	Type           string
+	Comment        string
+	Bits           int
+	PassphraseFile string
+	Absent         bool
+}
+
+// ManifestHost is a Host block the manifest wants present, or gone if
+// Absent. Options holds ssh_config keywords and their values, in the order
+// they were declared; Identities lists the keys for IdentityFile.
+type ManifestHost struct {
+	Host       string
+	Options    [][2]string
+	Identities []string
+	Absent     bool
+}
+
+// manifestHostOptions maps the short names a manifest may use to
+// ssh_config keywords.
+var manifestHostOptions = []struct {
+	name    string
+	keyword string
+}{
+	{"hostname", "HostName"},
+	{"user", "User"},
+	{"port", "Port"},
+	{"proxy_jump", "ProxyJump"},
+	{"identities_only", "IdentitiesOnly"},
+	{"forward_agent", "ForwardAgent"},
+}
+
+// LoadManifest reads and parses the manifest at path.
+func LoadManifest(path string) (*Manifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(content)
+}
+
+// ParseManifest parses a YAML manifest:
+//
+//	keys:
+//	  - name: id_work
+//	    type: ed25519
+//	    comment: me@work
+//	hosts:
+//	  - host: github.com
+//	    user: git
+//	    identity: id_work
+//
+// A key or host with "state: absent" is removed instead.
+func ParseManifest(content []byte) (*Manifest, error) {
+	doc, err := yamlite.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	fields := yamlite.Map(doc)
+	if fields == nil {
+		return nil, fmt.Errorf("manifest must be a mapping")
+	}
+
+	manifest := &Manifest{}
+	for i, item := range yamlite.List(fields["keys"]) {
+		entry := yamlite.Map(item)
+		key := ManifestKey{
+			Name:           yamlite.String(entry["name"]),
+			Type:           yamlite.String(entry["type"]),
+			Comment:        yamlite.String(entry["comment"]),
+			PassphraseFile: yamlite.String(entry["passphrase_file"]),
+		}
+		if key.Name == "" {
+			return nil, fmt.Errorf("keys[%d]: name is required", i)
+		}
+		// Keys are created and deleted by name in the ssh directory, so a
+		// name must not reach outside it.
+		if key.Name == "." || key.Name == ".." || strings.ContainsAny(key.Name, `/\`) {
+			return nil, fmt.Errorf("keys[%d]: name %q must be a file name in the ssh directory", i, key.Name)
+		}
+		if key.Type == "" {
+			key.Type = "ed25519"
+		}
+		if bits := yamlite.String(entry["bits"]); bits != "" {
+			key.Bits, err = strconv.Atoi(bits)
+			if err != nil {
+				return nil, fmt.Errorf("keys[%d]: invalid bits %q", i, bits)
+			}
+		}
+		key.Absent, err = parseState(yamlite.String(entry["state"]))
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %v", i, err)
+		}
+		manifest.Keys = append(manifest.Keys, key)
+	}
+
+	for i, item := range yamlite.List(fields["hosts"]) {
+		entry := yamlite.Map(item)
+		host := ManifestHost{Host: yamlite.String(entry["host"])}
+		if host.Host == "" {
+			return nil, fmt.Errorf("hosts[%d]: host is required", i)
+		}
+		for _, option := range manifestHostOptions {
+			if value := yamlite.String(entry[option.name]); value != "" {
+				host.Options = append(host.Options, [2]string{option.keyword, value})
+			}
+		}
+		host.Identities = append(yamlite.Strings(entry["identity"]), yamlite.Strings(entry["identities"])...)
+		host.Absent, err = parseState(yamlite.String(entry["state"]))
+		if err != nil {
+			return nil, fmt.Errorf("hosts[%d]: %v", i, err)
+		}
+		manifest.Hosts = append(manifest.Hosts, host)
+	}
+
+	return manifest, nil
+}
+
+func parseState(state string) (bool, error) {
+	switch state {
+	case "", "present":
+		return false, nil
+	case "absent":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown state %q", state)
+	}
+}
@@ -0,0 +1,181 @@
+package keyman
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// KeyMetadata is information about a key that keyman tracks outside the
+// key files themselves.
+type KeyMetadata struct {
+	Tags        []string   `json:"tags,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+
+	LastUsed     *time.Time `json:"last_used,omitempty"`
+	LastUsedHost string     `json:"last_used_host,omitempty"`
+}
+
+// HostMetadata is information about a Host block that keyman tracks
+// outside the ssh config. Tags let commands such as map select hosts as a
+// group.
+type HostMetadata struct {
+	Tags []string `json:"tags,omitempty"`
+}
+
+// HostKeyRecord is the fingerprint a host's key of one type had when
+// keyman first saw it in known_hosts or when it was last verified, so a
+// key that changes later can be caught.
+type HostKeyRecord struct {
+	Fingerprint string    `json:"fingerprint"`
+	Recorded    time.Time `json:"recorded"`
+}
+
+// Metadata is the sidecar store of KeyMetadata, keyed by key name, of
+// HostMetadata, keyed by the Host block's patterns, and of HostKeyRecords,
+// keyed by host name as known_hosts writes it and key algorithm.
+type Metadata struct {
+	Keys     map[string]*KeyMetadata   `json:"keys"`
+	Hosts    map[string]*HostMetadata  `json:"hosts,omitempty"`
+	HostKeys map[string]*HostKeyRecord `json:"host_keys,omitempty"`
+	path     string
+}
+
+// LoadMetadata reads the metadata store at path. A missing file is an
+// empty store.
+func LoadMetadata(path string) (*Metadata, error) {
+	metadata := &Metadata{Keys: make(map[string]*KeyMetadata), Hosts: make(map[string]*HostMetadata), HostKeys: make(map[string]*HostKeyRecord), path: path}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return metadata, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Keys == nil {
+		metadata.Keys = make(map[string]*KeyMetadata)
+	}
+	if metadata.Hosts == nil {
+		metadata.Hosts = make(map[string]*HostMetadata)
+	}
+	if metadata.HostKeys == nil {
+		metadata.HostKeys = make(map[string]*HostKeyRecord)
+	}
+	return metadata, nil
+}
+
+// Save writes the store back to the path it was loaded from.
+func (m *Metadata) Save() error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(m.path, append(content, '\n'), 0600)
+}
+
+// Get returns the metadata for the named key, creating an empty entry if
+// there is none.
+func (m *Metadata) Get(name string) *KeyMetadata {
+	meta, ok := m.Keys[name]
+	if !ok {
+		meta = &KeyMetadata{}
+		m.Keys[name] = meta
+	}
+	return meta
+}
+
+// Host returns the metadata for the named host, creating an empty entry if
+// there is none.
+func (m *Metadata) Host(name string) *HostMetadata {
+	meta, ok := m.Hosts[name]
+	if !ok {
+		meta = &HostMetadata{}
+		m.Hosts[name] = meta
+	}
+	return meta
+}
+
+// Attach sets the Metadata field of each key that has an entry, and its
+// creation time if keyman recorded one.
+func (m *Metadata) Attach(keys []Key) {
+	for i := range keys {
+		keys[i].Metadata = m.Keys[keys[i].Name]
+		if meta := keys[i].Metadata; meta != nil && meta.Created != nil {
+			keys[i].Created = *meta.Created
+		}
+	}
+}
+
+// Expired reports whether the key has an expiry date that is before now.
+func (k *KeyMetadata) Expired(now time.Time) bool {
+	return k != nil && k.Expires != nil && k.Expires.Before(now)
+}
+
+// ExpiresWithin reports whether the key has not expired yet but will
+// within window of now.
+func (k *KeyMetadata) ExpiresWithin(now time.Time, window time.Duration) bool {
+	return k != nil && k.Expires != nil && !k.Expires.Before(now) && k.Expires.Before(now.Add(window))
+}
+
+// AddTags adds tags that are not already present, keeping them sorted.
+func (k *KeyMetadata) AddTags(tags ...string) {
+	k.Tags = addTags(k.Tags, tags)
+}
+
+// RemoveTags removes the given tags.
+func (k *KeyMetadata) RemoveTags(tags ...string) {
+	k.Tags = removeTags(k.Tags, tags)
+}
+
+// HasTag reports whether the key is tagged with tag.
+func (k *KeyMetadata) HasTag(tag string) bool {
+	return k != nil && containsString(k.Tags, tag)
+}
+
+// AddTags adds tags that are not already present, keeping them sorted.
+func (h *HostMetadata) AddTags(tags ...string) {
+	h.Tags = addTags(h.Tags, tags)
+}
+
+// RemoveTags removes the given tags.
+func (h *HostMetadata) RemoveTags(tags ...string) {
+	h.Tags = removeTags(h.Tags, tags)
+}
+
+// HasTag reports whether the host is tagged with tag.
+func (h *HostMetadata) HasTag(tag string) bool {
+	return h != nil && containsString(h.Tags, tag)
+}
+
+func addTags(existing, tags []string) []string {
+	for _, tag := range tags {
+		if !containsString(existing, tag) {
+			existing = append(existing, tag)
+		}
+	}
+	sort.Strings(existing)
+	return existing
+}
+
+func removeTags(existing, tags []string) []string {
+	kept := existing[:0]
+	for _, tag := range existing {
+		if !containsString(tags, tag) {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,65 @@
+package keyman
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// PermissionProblem is a file whose mode ssh would reject or that exposes
+// secrets, along with the mode it should have.
+type PermissionProblem struct {
+	Path    string
+	Mode    os.FileMode
+	Want    os.FileMode
+	Message string
+}
+
+// CheckPermissions verifies that dir is private to its owner, that the
+// private halves of keys are readable only by their owner, and that the
+// config, known_hosts and authorized_keys files are not writable by others.
+// On Windows, where access is governed by ACLs, it reports nothing.
+func CheckPermissions(dir string, keys []Key) ([]PermissionProblem, error) {
+	if runtime.GOOS == "windows" {
+		return nil, nil
+	}
+
+	var problems []PermissionProblem
+	check := func(path string, mask os.FileMode, message string) error {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mode := info.Mode().Perm()
+		if mode&mask != 0 {
+			problems = append(problems, PermissionProblem{
+				Path:    path,
+				Mode:    mode,
+				Want:    mode &^ mask,
+				Message: message,
+			})
+		}
+		return nil
+	}
+
+	if err := check(dir, 0077, "directory should only be accessible by its owner"); err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if err := check(key.PrivatePath(), 0177, "private key should only be readable by its owner"); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range []string{"config", "known_hosts", "authorized_keys"} {
+		if err := check(filepath.Join(dir, name), 0022, "file should not be writable by group or others"); err != nil {
+			return nil, err
+		}
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,177 @@
+package keyman
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Plugins are programs named keyman-<name> that add providers and audit
+// checks. keyman runs a plugin once per call, writes a PluginRequest as
+// JSON to its stdin and reads a PluginResponse as JSON from its stdout.
+// Anything the plugin writes to stderr is shown to the user.
+const (
+	PluginPrefix   = "keyman-"
+	PluginProtocol = 1
+)
+
+// Plugin methods. Every plugin answers describe; the others are called
+// only on plugins with the capability that calls for them.
+const (
+	// PluginDescribe takes no params and returns a PluginInfo.
+	PluginDescribe = "describe"
+	// PluginListKeys takes no params and returns {"keys": [PluginKey]}.
+	PluginListKeys = "list_keys"
+	// PluginAddKey takes PluginAddKeyParams and returns {"key": PluginKey}.
+	PluginAddKey = "add_key"
+	// PluginStoreSecret takes PluginSecret and returns {}.
+	PluginStoreSecret = "store_secret"
+	// PluginFetchSecret takes PluginSecret without a value and returns the
+	// PluginSecret with one.
+	PluginFetchSecret = "fetch_secret"
+	// PluginAudit takes PluginAuditParams and returns {"findings":
+	// [PluginFinding]}.
+	PluginAudit = "audit"
+)
+
+// Plugin capabilities.
+const (
+	// CapabilityKeys plugins keep SSH keys for a cloud or forge account,
+	// and become the command keyman <name> push|list|audit.
+	CapabilityKeys = "keys"
+	// CapabilityKeyExpiry plugins take an expiry date for added keys.
+	CapabilityKeyExpiry = "key_expiry"
+	// CapabilitySecrets plugins store backups, as backup --backend <name>.
+	CapabilitySecrets = "secrets"
+	// CapabilityAudit plugins add checks to keyman audit.
+	CapabilityAudit = "audit"
+)
+
+// PluginRequest is what keyman sends a plugin.
+type PluginRequest struct {
+	Protocol int         `json:"protocol"`
+	Method   string      `json:"method"`
+	Params   interface{} `json:"params,omitempty"`
+}
+
+// PluginResponse is what a plugin answers with: a result, or an error
+// message for the user.
+type PluginResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// PluginInfo is a plugin's answer to describe. Name is how the user knows
+// the provider, such as Linode.
+type PluginInfo struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Can reports whether the plugin has a capability.
+func (p *PluginInfo) Can(capability string) bool {
+	return containsString(p.Capabilities, capability)
+}
+
+// PluginKey is a key registered with a provider.
+type PluginKey struct {
+	ID        string     `json:"id"`
+	Title     string     `json:"title"`
+	Key       string     `json:"key"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PluginAddKeyParams are the params of add_key. Key is an authorized_keys
+// line.
+type PluginAddKeyParams struct {
+	Title     string     `json:"title"`
+	Key       string     `json:"key"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PluginSecret is a backup stored by a secrets plugin, base64 encoded.
+type PluginSecret struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// PluginAuditParams are the params of audit. Keys are as keyman list
+// --json prints them.
+type PluginAuditParams struct {
+	SSHDir     string          `json:"ssh_dir"`
+	ConfigPath string          `json:"config_path"`
+	Keys       json.RawMessage `json:"keys"`
+}
+
+// PluginFinding is a problem an audit plugin found, with a severity of
+// info, warning or error.
+type PluginFinding struct {
+	Severity string `json:"severity"`
+	Rule     string `json:"rule"`
+	Subject  string `json:"subject"`
+	Message  string `json:"message"`
+}
+
+// Finding converts the finding, prefixing its rule with the plugin's name
+// so plugins' rules cannot be taken for keyman's own.
+func (f PluginFinding) Finding(plugin string) (Finding, error) {
+	severity, err := ParseSeverity(f.Severity)
+	if err != nil {
+		return Finding{}, err
+	}
+	if f.Rule == "" || f.Message == "" {
+		return Finding{}, fmt.Errorf("finding without a rule or message")
+	}
+	return Finding{Severity: severity, Rule: plugin + "/" + f.Rule, Subject: f.Subject, Message: f.Message}, nil
+}
+
+// FindPlugins looks in each of dirs, in order, for plugin executables and
+// returns their paths by plugin name. A plugin in an earlier directory
+// hides one of the same name in a later one. Missing directories are
+// skipped.
+func FindPlugins(dirs []string) map[string]string {
+	plugins := make(map[string]string)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name, ok := pluginName(entry.Name())
+			if !ok || plugins[name] != "" {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+				continue
+			}
+			plugins[name] = path
+		}
+	}
+	return plugins
+}
+
+// pluginName returns the plugin name of an executable's file name.
+func pluginName(file string) (string, bool) {
+	if runtime.GOOS == "windows" {
+		if !strings.HasSuffix(strings.ToLower(file), ".exe") {
+			return "", false
+		}
+		file = file[:len(file)-len(".exe")]
+	}
+	name := strings.TrimPrefix(file, PluginPrefix)
+	if name == file || name == "" || strings.ContainsAny(name, ". ") {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,233 @@
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/internal/yamlite"
+)
+
+// Severity ranks how serious an audit finding is.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// ParseSeverity parses info, warning or error.
+func ParseSeverity(s string) (Severity, error) {
+	switch strings.ToLower(s) {
+	case "info":
+		return SeverityInfo, nil
+	case "warning", "warn":
+		return SeverityWarning, nil
+	case "error":
+		return SeverityError, nil
+	}
+	return SeverityInfo, fmt.Errorf("unknown severity %q", s)
+}
+
+// Finding is a single problem reported by an audit rule.
+type Finding struct {
+	Severity Severity
+	Rule     string
+	Subject  string
+	Message  string
+}
+
+// Policy rule names, used as keys in a policy file and in findings.
+const (
+	RuleMaxKeyAge         = "max_key_age"
+	RuleForbiddenTypes    = "forbidden_types"
+	RuleRequirePassphrase = "require_passphrase"
+	RuleRequireComment    = "require_comment"
+)
+
+var defaultSeverities = map[string]Severity{
+	RuleMaxKeyAge:         SeverityWarning,
+	RuleForbiddenTypes:    SeverityError,
+	RuleRequirePassphrase: SeverityError,
+	RuleRequireComment:    SeverityInfo,
+}
+
+// Policy is a set of rules keys are audited against. A zero Policy has no
+// rules enabled.
+type Policy struct {
+	MaxKeyAge         time.Duration
+	ForbiddenTypes    []TypeRule
+	RequirePassphrase bool
+	RequireComment    bool
+	Severities        map[string]Severity
+}
+
+// TypeRule forbids a key type, or only keys of that type smaller than
+// MinBits when it is set, as in "rsa<2048".
+type TypeRule struct {
+	Type    string
+	MinBits int
+}
+
+func (r TypeRule) String() string {
+	if r.MinBits > 0 {
+		return fmt.Sprintf("%s<%d", r.Type, r.MinBits)
+	}
+	return r.Type
+}
+
+// NewPolicy returns a policy with no rules enabled and the default
+// severities.
+func NewPolicy() *Policy {
+	policy := &Policy{Severities: make(map[string]Severity)}
+	for rule, severity := range defaultSeverities {
+		policy.Severities[rule] = severity
+	}
+	return policy
+}
+
+// LoadPolicy reads a YAML policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := ParsePolicy(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return policy, nil
+}
+
+// ParsePolicy parses a YAML policy document.
+func ParsePolicy(content []byte) (*Policy, error) {
+	doc, err := yamlite.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	fields := yamlite.Map(doc)
+	if fields == nil {
+		return nil, fmt.Errorf("policy must be a mapping")
+	}
+
+	policy := NewPolicy()
+	if age := yamlite.String(fields[RuleMaxKeyAge]); age != "" {
+		policy.MaxKeyAge, err = ParseAge(age)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range yamlite.Strings(fields[RuleForbiddenTypes]) {
+		rule, err := parseTypeRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		policy.ForbiddenTypes = append(policy.ForbiddenTypes, rule)
+	}
+
+	policy.RequirePassphrase = yamlite.String(fields[RuleRequirePassphrase]) == "true"
+	policy.RequireComment = yamlite.String(fields[RuleRequireComment]) == "true"
+
+	for rule, value := range yamlite.Map(fields["severities"]) {
+		severity, err := ParseSeverity(yamlite.String(value))
+		if err != nil {
+			return nil, err
+		}
+		policy.Severities[rule] = severity
+	}
+
+	return policy, nil
+}
+
+func parseTypeRule(entry string) (TypeRule, error) {
+	keyType, bits, found := strings.Cut(entry, "<")
+	rule := TypeRule{Type: strings.ToLower(strings.TrimSpace(keyType))}
+	if found {
+		minBits, err := strconv.Atoi(strings.TrimSpace(bits))
+		if err != nil {
+			return rule, fmt.Errorf("invalid key size in %q", entry)
+		}
+		rule.MinBits = minBits
+	}
+	return rule, nil
+}
+
+// ParseAge parses a duration that may also use d (days), w (weeks) and y
+// (365 days) units, such as 90d or 1y.
+func ParseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			value, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(value * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// Evaluate checks every key against the policy's rules.
+func (p *Policy) Evaluate(keys []Key) []Finding {
+	var findings []Finding
+	add := func(rule string, key Key, format string, args ...interface{}) {
+		findings = append(findings, Finding{
+			Severity: p.Severities[rule],
+			Rule:     rule,
+			Subject:  key.Name,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, key := range keys {
+		if p.MaxKeyAge > 0 {
+			if age := time.Since(key.Created); age > p.MaxKeyAge {
+				add(RuleMaxKeyAge, key, "key is %.0f days old, the limit is %.0f days", age.Hours()/24, p.MaxKeyAge.Hours()/24)
+			}
+		}
+
+		if key.Public != nil {
+			keyType := strings.ToLower(key.Public.TypeName())
+			for _, rule := range p.ForbiddenTypes {
+				if rule.Type != keyType {
+					continue
+				}
+				if rule.MinBits == 0 {
+					add(RuleForbiddenTypes, key, "%s keys are forbidden", keyType)
+				} else if bits := key.Public.Bits(); bits < rule.MinBits {
+					add(RuleForbiddenTypes, key, "%s key is %d bits, at least %d are required", keyType, bits, rule.MinBits)
+				}
+			}
+		}
+
+		if p.RequirePassphrase {
+			encrypted, err := IsEncrypted(key.PrivatePath())
+			if err == nil && !encrypted {
+				add(RuleRequirePassphrase, key, "private key is not protected by a passphrase")
+			}
+		}
+
+		if p.RequireComment && key.Comment == "" && (key.Public == nil || key.Public.Comment == "") {
+			add(RuleRequireComment, key, "key has no comment")
+		}
+	}
+
+	return findings
+}
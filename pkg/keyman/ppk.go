@@ -0,0 +1,369 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/argon2"
+)
+
+const (
+	ppkHeaderPrefix = "PuTTY-User-Key-File-"
+	ppkMACKeyPrefix = "putty-private-key-file-mac-key"
+	ppkLineLength   = 64
+
+	// PuTTYgen's defaults for new version 3 files.
+	ppkArgon2Memory      = 8192
+	ppkArgon2Passes      = 21
+	ppkArgon2Parallelism = 1
+	ppkArgon2SaltSize    = 16
+)
+
+// ErrPassphrase is returned when a PPK file's MAC does not verify, which
+// almost always means the passphrase is wrong.
+var ErrPassphrase = errors.New("wrong passphrase or corrupted key file")
+
+// IsPPK reports whether data looks like a PuTTY private key file.
+func IsPPK(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ppkHeaderPrefix))
+}
+
+// PPKEncrypted reports whether a PuTTY private key file needs a
+// passphrase.
+func PPKEncrypted(data []byte) bool {
+	fields, _, err := readPPKFields(data)
+	return err == nil && fields["Encryption"] != "none"
+}
+
+// ParsePPK decodes a PuTTY private key file in format version 2 or 3,
+// decrypting it with passphrase if it is encrypted.
+func ParsePPK(data []byte, passphrase string) (*PrivateKey, error) {
+	fields, version, err := readPPKFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm := fields["PuTTY-User-Key-File-"+strconv.Itoa(version)]
+	encryption := fields["Encryption"]
+	comment := fields["Comment"]
+	public, err := base64.StdEncoding.DecodeString(fields["Public-Lines"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PPK public key: %v", err)
+	}
+	private, err := base64.StdEncoding.DecodeString(fields["Private-Lines"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PPK private key: %v", err)
+	}
+	mac, err := hex.DecodeString(fields["Private-MAC"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PPK MAC: %v", err)
+	}
+
+	if encryption != "none" && encryption != "aes256-cbc" {
+		return nil, fmt.Errorf("unsupported PPK encryption %s", encryption)
+	}
+	if encryption == "none" {
+		passphrase = ""
+	}
+	keys, err := ppkKeys(version, fields, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryption != "none" {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, errors.New("invalid PPK private key: not a whole number of blocks")
+		}
+		block, err := aes.NewCipher(keys.cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCDecrypter(block, keys.iv).CryptBlocks(private, private)
+	}
+
+	if !hmac.Equal(mac, ppkMAC(keys, algorithm, encryption, comment, public, private)) {
+		return nil, ErrPassphrase
+	}
+
+	key, err := parsePPKPrivate(algorithm, public, private)
+	if err != nil {
+		return nil, err
+	}
+	return newPrivateKey(key, comment)
+}
+
+// MarshalPPK encodes the key as a PuTTY private key file in format version
+// 2 or 3, encrypted with passphrase unless it is empty.
+func MarshalPPK(key *PrivateKey, passphrase string, version int) ([]byte, error) {
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported PPK version %d", version)
+	}
+
+	algorithm := key.Algorithm()
+	public := key.PublicKey().Blob
+	private := marshalPPKPrivate(key)
+
+	encryption := "none"
+	fields := map[string]string{}
+	if passphrase != "" {
+		encryption = "aes256-cbc"
+		if version == 3 {
+			salt := make([]byte, ppkArgon2SaltSize)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+			fields["Key-Derivation"] = "Argon2id"
+			fields["Argon2-Memory"] = strconv.Itoa(ppkArgon2Memory)
+			fields["Argon2-Passes"] = strconv.Itoa(ppkArgon2Passes)
+			fields["Argon2-Parallelism"] = strconv.Itoa(ppkArgon2Parallelism)
+			fields["Argon2-Salt"] = hex.EncodeToString(salt)
+		}
+
+		// Pad with the start of the blob's SHA-1, as PuTTYgen does, rather
+		// than anything predictable.
+		sum := sha1.Sum(private)
+		padding := (aes.BlockSize - len(private)%aes.BlockSize) % aes.BlockSize
+		private = append(private, sum[:padding]...)
+	}
+
+	keys, err := ppkKeys(version, fields, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	mac := ppkMAC(keys, algorithm, encryption, key.Comment, public, private)
+
+	if encryption != "none" {
+		block, err := aes.NewCipher(keys.cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(block, keys.iv).CryptBlocks(private, private)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s%d: %s\n", ppkHeaderPrefix, version, algorithm)
+	fmt.Fprintf(&out, "Encryption: %s\n", encryption)
+	fmt.Fprintf(&out, "Comment: %s\n", key.Comment)
+	writePPKLines(&out, "Public-Lines", public)
+	for _, name := range []string{"Key-Derivation", "Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism", "Argon2-Salt"} {
+		if value, ok := fields[name]; ok {
+			fmt.Fprintf(&out, "%s: %s\n", name, value)
+		}
+	}
+	writePPKLines(&out, "Private-Lines", private)
+	fmt.Fprintf(&out, "Private-MAC: %s\n", hex.EncodeToString(mac))
+	return out.Bytes(), nil
+}
+
+// readPPKFields reads the "Name: value" fields of a PPK file, joining the
+// base64 lines that follow Public-Lines and Private-Lines into their value.
+func readPPKFields(data []byte) (map[string]string, int, error) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	fields := make(map[string]string)
+	version := 0
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(lines[i], ": ")
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid PPK line %d", i+1)
+		}
+		if i == 0 {
+			if !strings.HasPrefix(name, ppkHeaderPrefix) {
+				return nil, 0, errors.New("not a PuTTY private key file")
+			}
+			version, _ = strconv.Atoi(strings.TrimPrefix(name, ppkHeaderPrefix))
+			if version != 2 && version != 3 {
+				return nil, 0, fmt.Errorf("unsupported PPK version %s", strings.TrimPrefix(name, ppkHeaderPrefix))
+			}
+		}
+
+		if name == "Public-Lines" || name == "Private-Lines" {
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 0 || i+count >= len(lines) {
+				return nil, 0, fmt.Errorf("invalid PPK line %d", i+1)
+			}
+			value = strings.Join(lines[i+1:i+1+count], "")
+			i += count
+		}
+		fields[name] = value
+	}
+
+	for _, name := range []string{"Encryption", "Comment", "Public-Lines", "Private-Lines", "Private-MAC"} {
+		if _, ok := fields[name]; !ok {
+			return nil, 0, fmt.Errorf("PPK file has no %s", name)
+		}
+	}
+	return fields, version, nil
+}
+
+func writePPKLines(out *bytes.Buffer, name string, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	count := (len(encoded) + ppkLineLength - 1) / ppkLineLength
+	fmt.Fprintf(out, "%s: %d\n", name, count)
+	for len(encoded) > ppkLineLength {
+		out.WriteString(encoded[:ppkLineLength] + "\n")
+		encoded = encoded[ppkLineLength:]
+	}
+	out.WriteString(encoded + "\n")
+}
+
+type ppkKeySet struct {
+	cipherKey []byte
+	iv        []byte
+	macKey    []byte
+	mac       func() hash.Hash
+}
+
+// ppkKeys derives the encryption and MAC keys for a PPK file: SHA-1 based
+// for version 2, Argon2 for version 3.
+func ppkKeys(version int, fields map[string]string, passphrase string) (*ppkKeySet, error) {
+	if version == 2 {
+		mac := sha1.Sum([]byte(ppkMACKeyPrefix + passphrase))
+		first := sha1.Sum(append([]byte{0, 0, 0, 0}, passphrase...))
+		second := sha1.Sum(append([]byte{0, 0, 0, 1}, passphrase...))
+		return &ppkKeySet{
+			cipherKey: append(first[:], second[:12]...),
+			iv:        make([]byte, aes.BlockSize),
+			macKey:    mac[:],
+			mac:       sha1.New,
+		}, nil
+	}
+
+	if passphrase == "" {
+		return &ppkKeySet{mac: sha256.New}, nil
+	}
+
+	variant, err := argon2.ParseVariant(fields["Key-Derivation"])
+	if err != nil {
+		return nil, err
+	}
+	var params [3]uint32
+	for i, name := range []string{"Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism"} {
+		value, err := strconv.ParseUint(fields[name], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PPK %s %q", name, fields[name])
+		}
+		params[i] = uint32(value)
+	}
+	salt, err := hex.DecodeString(fields["Argon2-Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PPK Argon2-Salt: %v", err)
+	}
+
+	derived, err := argon2.Key(argon2.Params{
+		Variant:     variant,
+		Memory:      params[0],
+		Passes:      params[1],
+		Parallelism: params[2],
+	}, []byte(passphrase), salt, nil, nil, 32+aes.BlockSize+32)
+	if err != nil {
+		return nil, err
+	}
+	return &ppkKeySet{
+		cipherKey: derived[:32],
+		iv:        derived[32 : 32+aes.BlockSize],
+		macKey:    derived[32+aes.BlockSize:],
+		mac:       sha256.New,
+	}, nil
+}
+
+// ppkMAC authenticates everything in the file but the key derivation
+// parameters, over the unencrypted private key.
+func ppkMAC(keys *ppkKeySet, algorithm, encryption, comment string, public, private []byte) []byte {
+	var w wireWriter
+	w.string([]byte(algorithm))
+	w.string([]byte(encryption))
+	w.string([]byte(comment))
+	w.string(public)
+	w.string(private)
+
+	mac := hmac.New(keys.mac, keys.macKey)
+	mac.Write(w.buf)
+	return mac.Sum(nil)
+}
+
+// parsePPKPrivate combines a PPK's public and private blobs into a key.
+func parsePPKPrivate(algorithm string, public, private []byte) (interface{}, error) {
+	pub := wireReader{rest: public}
+	if string(pub.string()) != algorithm {
+		return nil, errors.New("PPK public key does not match its algorithm")
+	}
+	priv := wireReader{rest: private}
+
+	var key interface{}
+	var err error
+	switch {
+	case algorithm == "ssh-ed25519":
+		publicKey := pub.string()
+		seed := priv.string()
+		if pub.err == nil && priv.err == nil {
+			if len(seed) != ed25519.SeedSize {
+				return nil, errors.New("invalid Ed25519 private key")
+			}
+			key = ed25519.NewKeyFromSeed(seed)
+			if !bytes.Equal(key.(ed25519.PrivateKey).Public().(ed25519.PublicKey), publicKey) {
+				return nil, errors.New("invalid Ed25519 private key: public key does not match")
+			}
+		}
+	case strings.HasPrefix(algorithm, "ecdsa-sha2-"):
+		curve := string(pub.string())
+		point := pub.string()
+		d := priv.mpint()
+		if pub.err == nil && priv.err == nil {
+			key, err = newECDSAKey(curve, d, point)
+		}
+	case algorithm == "ssh-rsa":
+		e := pub.mpint()
+		n := pub.mpint()
+		d := priv.mpint()
+		p := priv.mpint()
+		q := priv.mpint()
+		if pub.err == nil && priv.err == nil {
+			key, err = newRSAKey(n, e, d, p, q)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PPK key type %s", algorithm)
+	}
+	if pub.err != nil {
+		return nil, pub.err
+	}
+	if priv.err != nil {
+		return nil, priv.err
+	}
+	return key, err
+}
+
+// marshalPPKPrivate returns the unpadded PPK private blob of the key.
+func marshalPPKPrivate(key *PrivateKey) []byte {
+	var w wireWriter
+	switch k := key.Key.(type) {
+	case *rsa.PrivateKey:
+		w.mpint(k.D)
+		w.mpint(k.Primes[0])
+		w.mpint(k.Primes[1])
+		w.mpint(new(big.Int).ModInverse(k.Primes[1], k.Primes[0]))
+	case *ecdsa.PrivateKey:
+		w.mpint(k.D)
+	case ed25519.PrivateKey:
+		w.string(k.Seed())
+	}
+	return w.buf
+}
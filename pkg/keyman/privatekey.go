@@ -0,0 +1,370 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const opensshKeyMagic = "openssh-key-v1\x00"
+
+// ErrEncryptedKey is returned when parsing a private key that is protected
+// by a passphrase keyman cannot remove itself.
+var ErrEncryptedKey = errors.New("private key is encrypted")
+
+// PrivateKey is a decoded, unencrypted RSA, ECDSA or Ed25519 private key.
+type PrivateKey struct {
+	// Key is a *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+	Key     crypto.Signer
+	Comment string
+}
+
+// ParsePrivateKey parses an unencrypted private key in OpenSSH, PKCS#1,
+// SEC 1 or PKCS#8 PEM format.
+func ParsePrivateKey(data []byte) (*PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM encoded private key")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return nil, ErrEncryptedKey
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "OPENSSH PRIVATE KEY":
+		return parseOpenSSHPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newPrivateKey(key, "")
+}
+
+// PublicKeyFromPrivate returns the public half of a private key file.
+// OpenSSH keys carry it unencrypted, so this works even for keys with a
+// passphrase; PEM keys must be unencrypted.
+func PublicKeyFromPrivate(data []byte) (*PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block != nil && block.Type == "OPENSSH PRIVATE KEY" && bytes.HasPrefix(block.Bytes, []byte(opensshKeyMagic)) {
+		r := wireReader{rest: block.Bytes[len(opensshKeyMagic):]}
+		cipherName := string(r.string())
+		r.string() // kdf name
+		r.string() // kdf options
+		r.uint32() // number of keys
+		blob := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		algorithm, _, ok := readWireString(blob)
+		if !ok {
+			return nil, errors.New("invalid OpenSSH private key")
+		}
+
+		// The comment is only readable in unencrypted keys of the types
+		// keyman can parse.
+		pub := &PublicKey{Algorithm: string(algorithm), Blob: blob}
+		if cipherName == "none" {
+			if key, err := parseOpenSSHPrivateKey(block.Bytes); err == nil {
+				pub.Comment = key.Comment
+			}
+		}
+		return pub, nil
+	}
+
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey(), nil
+}
+
+func newPrivateKey(key interface{}, comment string) (*PrivateKey, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, errors.New("multi-prime RSA keys are not supported")
+		}
+		return &PrivateKey{Key: k, Comment: comment}, nil
+	case ed25519.PrivateKey:
+		return &PrivateKey{Key: k, Comment: comment}, nil
+	case *ecdsa.PrivateKey:
+		if curveName(k.Curve) == "" {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+		}
+		return &PrivateKey{Key: k, Comment: comment}, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// parseOpenSSHPrivateKey decodes the body of an "OPENSSH PRIVATE KEY"
+// block, as written by ssh-keygen.
+func parseOpenSSHPrivateKey(data []byte) (*PrivateKey, error) {
+	if !bytes.HasPrefix(data, []byte(opensshKeyMagic)) {
+		return nil, errors.New("invalid OpenSSH private key")
+	}
+
+	r := wireReader{rest: data[len(opensshKeyMagic):]}
+	cipherName := string(r.string())
+	r.string() // kdf name
+	r.string() // kdf options
+	count := r.uint32()
+	r.string() // public key
+	private := wireReader{rest: r.string()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if cipherName != "none" {
+		return nil, ErrEncryptedKey
+	}
+	if count != 1 {
+		return nil, fmt.Errorf("OpenSSH private key files with %d keys are not supported", count)
+	}
+
+	if private.uint32() != private.uint32() {
+		return nil, errors.New("invalid OpenSSH private key: check bytes do not match")
+	}
+	algorithm := string(private.string())
+
+	var key interface{}
+	var err error
+	switch {
+	case algorithm == "ssh-ed25519":
+		private.string() // public key, repeated at the end of the private key
+		seed := private.string()
+		if private.err == nil && len(seed) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid Ed25519 private key")
+		}
+		key = ed25519.PrivateKey(seed)
+	case strings.HasPrefix(algorithm, "ecdsa-sha2-"):
+		curve := string(private.string())
+		point := private.string()
+		key, err = newECDSAKey(curve, private.mpint(), point)
+	case algorithm == "ssh-rsa":
+		n := private.mpint()
+		e := private.mpint()
+		d := private.mpint()
+		private.mpint() // iqmp, recomputed
+		p := private.mpint()
+		q := private.mpint()
+		key, err = newRSAKey(n, e, d, p, q)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %s", algorithm)
+	}
+	comment := string(private.string())
+	if private.err != nil {
+		return nil, private.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newPrivateKey(key, comment)
+}
+
+func newRSAKey(n, e, d, p, q *big.Int) (*rsa.PrivateKey, error) {
+	if n == nil || e == nil || d == nil || p == nil || q == nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA private key")
+	}
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+		D:         d,
+		Primes:    []*big.Int{p, q},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	key.Precompute()
+	return key, nil
+}
+
+// newECDSAKey builds an ECDSA key from its private scalar, checking it
+// against point when one is given.
+func newECDSAKey(curve string, d *big.Int, point []byte) (*ecdsa.PrivateKey, error) {
+	var c elliptic.Curve
+	var exchange ecdh.Curve
+	switch curve {
+	case "nistp256":
+		c, exchange = elliptic.P256(), ecdh.P256()
+	case "nistp384":
+		c, exchange = elliptic.P384(), ecdh.P384()
+	case "nistp521":
+		c, exchange = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("unsupported ECDSA curve %s", curve)
+	}
+	if d == nil {
+		return nil, errors.New("invalid ECDSA private key")
+	}
+
+	size := (c.Params().BitSize + 7) / 8
+	scalar, err := exchange.NewPrivateKey(d.FillBytes(make([]byte, size)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ECDSA private key: %v", err)
+	}
+	public := scalar.PublicKey().Bytes()
+	if point != nil && !bytes.Equal(point, public) {
+		return nil, errors.New("invalid ECDSA private key: public key does not match")
+	}
+
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: c,
+			X:     new(big.Int).SetBytes(public[1 : 1+size]),
+			Y:     new(big.Int).SetBytes(public[1+size:]),
+		},
+		D: d,
+	}, nil
+}
+
+func curveName(curve elliptic.Curve) string {
+	switch curve {
+	case elliptic.P256():
+		return "nistp256"
+	case elliptic.P384():
+		return "nistp384"
+	case elliptic.P521():
+		return "nistp521"
+	}
+	return ""
+}
+
+// ecdsaPoint returns the uncompressed encoding of the key's public point.
+func ecdsaPoint(key *ecdsa.PublicKey) []byte {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	point := make([]byte, 1+2*size)
+	point[0] = 4
+	key.X.FillBytes(point[1 : 1+size])
+	key.Y.FillBytes(point[1+size:])
+	return point
+}
+
+// Algorithm returns the SSH algorithm name of the key, such as ssh-ed25519.
+func (k *PrivateKey) Algorithm() string {
+	switch key := k.Key.(type) {
+	case *rsa.PrivateKey:
+		return "ssh-rsa"
+	case *ecdsa.PrivateKey:
+		return "ecdsa-sha2-" + curveName(key.Curve)
+	default:
+		return "ssh-ed25519"
+	}
+}
+
+// PublicKey returns the public half of the key.
+func (k *PrivateKey) PublicKey() *PublicKey {
+	var w wireWriter
+	w.string([]byte(k.Algorithm()))
+	switch key := k.Key.(type) {
+	case *rsa.PrivateKey:
+		w.mpint(big.NewInt(int64(key.E)))
+		w.mpint(key.N)
+	case *ecdsa.PrivateKey:
+		w.string([]byte(curveName(key.Curve)))
+		w.string(ecdsaPoint(&key.PublicKey))
+	case ed25519.PrivateKey:
+		w.string(key.Public().(ed25519.PublicKey))
+	}
+	return &PublicKey{Algorithm: k.Algorithm(), Blob: w.buf, Comment: k.Comment}
+}
+
+// MarshalOpenSSH encodes the key as an unencrypted OpenSSH private key
+// file. ssh-keygen -p can add a passphrase afterwards.
+func (k *PrivateKey) MarshalOpenSSH() ([]byte, error) {
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+
+	var private wireWriter
+	private.buf = append(private.buf, check[:]...)
+	private.buf = append(private.buf, check[:]...)
+	private.string([]byte(k.Algorithm()))
+	switch key := k.Key.(type) {
+	case *rsa.PrivateKey:
+		private.mpint(key.N)
+		private.mpint(big.NewInt(int64(key.E)))
+		private.mpint(key.D)
+		private.mpint(key.Precomputed.Qinv)
+		private.mpint(key.Primes[0])
+		private.mpint(key.Primes[1])
+	case *ecdsa.PrivateKey:
+		private.string([]byte(curveName(key.Curve)))
+		private.string(ecdsaPoint(&key.PublicKey))
+		private.mpint(key.D)
+	case ed25519.PrivateKey:
+		private.string(key.Public().(ed25519.PublicKey))
+		private.string(key)
+	}
+	private.string([]byte(k.Comment))
+	for i := byte(1); len(private.buf)%8 != 0; i++ {
+		private.buf = append(private.buf, i)
+	}
+
+	var w wireWriter
+	w.buf = []byte(opensshKeyMagic)
+	w.string([]byte("none"))
+	w.string([]byte("none"))
+	w.string(nil)
+	w.uint32(1)
+	w.string(k.PublicKey().Blob)
+	w.string(private.buf)
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: w.buf}), nil
+}
+
+// wireWriter builds SSH wire format values.
+type wireWriter struct {
+	buf []byte
+}
+
+func (w *wireWriter) uint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *wireWriter) string(s []byte) {
+	w.uint32(uint32(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// mpint writes a non-negative integer, with a leading zero byte when the
+// top bit is set so it does not read as negative.
+func (w *wireWriter) mpint(n *big.Int) {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	w.string(b)
+}
+
+// mpint reads a non-negative multiple precision integer.
+func (r *wireReader) mpint() *big.Int {
+	b := r.string()
+	if r.err != nil {
+		return nil
+	}
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		r.err = errors.New("negative integer in key")
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
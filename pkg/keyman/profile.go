@@ -0,0 +1,95 @@
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/donuts-are-good/keyman/internal/yamlite"
+)
+
+// Profile is a named SSH setup keyman can switch to. Empty paths fall back
+// to the usual locations inside SSHDir.
+type Profile struct {
+	Name       string
+	SSHDir     string
+	Config     string
+	KnownHosts string
+}
+
+// Profiles is the set of profiles in a profiles file and the one used when
+// none is asked for.
+type Profiles struct {
+	Default  string
+	Profiles map[string]*Profile
+}
+
+// LoadProfiles reads a YAML profiles file. A missing file has no profiles.
+func LoadProfiles(path string) (*Profiles, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Profiles{Profiles: make(map[string]*Profile)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := ParseProfiles(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return profiles, nil
+}
+
+// ParseProfiles parses a profiles document:
+//
+//	default: work
+//	profiles:
+//	  work:
+//	    ssh_dir: ~/clients/acme/.ssh
+//	    config: ~/clients/acme/ssh_config
+//	    known_hosts: ~/clients/acme/known_hosts
+//	  personal:
+//	    ssh_dir: ~/.ssh
+func ParseProfiles(content []byte) (*Profiles, error) {
+	doc, err := yamlite.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	fields := yamlite.Map(doc)
+	if fields == nil {
+		return nil, fmt.Errorf("profiles file must be a mapping")
+	}
+
+	profiles := &Profiles{
+		Default:  yamlite.String(fields["default"]),
+		Profiles: make(map[string]*Profile),
+	}
+	for name, value := range yamlite.Map(fields["profiles"]) {
+		entry := yamlite.Map(value)
+		if entry == nil {
+			return nil, fmt.Errorf("profile %s must be a mapping", name)
+		}
+		profiles.Profiles[name] = &Profile{
+			Name:       name,
+			SSHDir:     yamlite.String(entry["ssh_dir"]),
+			Config:     yamlite.String(entry["config"]),
+			KnownHosts: yamlite.String(entry["known_hosts"]),
+		}
+	}
+
+	if profiles.Default != "" && profiles.Profiles[profiles.Default] == nil {
+		return nil, fmt.Errorf("default profile %s is not defined", profiles.Default)
+	}
+	return profiles, nil
+}
+
+// Names returns the profile names in order.
+func (p *Profiles) Names() []string {
+	var names []string
+	for name := range p.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
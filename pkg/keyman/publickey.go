@@ -0,0 +1,275 @@
+package keyman
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// PublicKey is a decoded OpenSSH public key.
+type PublicKey struct {
+	Algorithm string
+	Blob      []byte
+	Comment   string
+}
+
+// ParsePublicKey parses a single-line OpenSSH public key of the form
+// "algorithm base64 [comment]".
+func ParsePublicKey(line string) (*PublicKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("not an OpenSSH public key")
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, _, ok := readWireString(blob)
+	if !ok || string(algorithm) != fields[0] {
+		return nil, errors.New("public key algorithm does not match its encoding")
+	}
+
+	return &PublicKey{
+		Algorithm: fields[0],
+		Blob:      blob,
+		Comment:   strings.Join(fields[2:], " "),
+	}, nil
+}
+
+// readWireString reads a uint32 length-prefixed string as used throughout
+// the SSH wire format, returning it and the remaining bytes.
+func readWireString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return nil, nil, false
+	}
+	return b[4 : 4+n], b[4+n:], true
+}
+
+// String formats the key as a line for a .pub or authorized_keys file.
+func (k *PublicKey) String() string {
+	line := k.Algorithm + " " + base64.StdEncoding.EncodeToString(k.Blob)
+	if k.Comment != "" {
+		line += " " + k.Comment
+	}
+	return line
+}
+
+// FingerprintSHA256 returns the fingerprint in the format ssh-keygen prints
+// by default.
+func (k *PublicKey) FingerprintSHA256() string {
+	sum := sha256.Sum256(k.Blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// FingerprintMD5 returns the legacy colon-separated MD5 fingerprint.
+func (k *PublicKey) FingerprintMD5() string {
+	sum := md5.Sum(k.Blob)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return "MD5:" + strings.Join(hex, ":")
+}
+
+// TypeName returns the short algorithm name ssh-keygen prints, such as
+// ED25519 or RSA.
+func (k *PublicKey) TypeName() string {
+	switch {
+	case k.Algorithm == "ssh-rsa":
+		return "RSA"
+	case k.Algorithm == "ssh-dss":
+		return "DSA"
+	case k.Algorithm == "ssh-ed25519":
+		return "ED25519"
+	case strings.HasPrefix(k.Algorithm, "ecdsa-sha2-"):
+		return "ECDSA"
+	case k.Algorithm == "sk-ssh-ed25519@openssh.com":
+		return "ED25519-SK"
+	case strings.HasPrefix(k.Algorithm, "sk-ecdsa-sha2-"):
+		return "ECDSA-SK"
+	default:
+		return k.Algorithm
+	}
+}
+
+// Bits returns the key size in bits, or 0 if it cannot be determined.
+func (k *PublicKey) Bits() int {
+	_, rest, _ := readWireString(k.Blob)
+	switch {
+	case k.Algorithm == "ssh-rsa":
+		// The exponent comes before the modulus.
+		_, rest, _ = readWireString(rest)
+		return mpintBits(rest)
+	case k.Algorithm == "ssh-dss":
+		return mpintBits(rest)
+	case k.Algorithm == "ssh-ed25519", k.Algorithm == "sk-ssh-ed25519@openssh.com":
+		return 256
+	case strings.HasPrefix(k.Algorithm, "ecdsa-sha2-"), strings.HasPrefix(k.Algorithm, "sk-ecdsa-sha2-"):
+		curve, _, _ := readWireString(rest)
+		switch string(curve) {
+		case "nistp256":
+			return 256
+		case "nistp384":
+			return 384
+		case "nistp521":
+			return 521
+		}
+	}
+	return 0
+}
+
+// IsSecurityKey reports whether the private half of the key lives on a
+// FIDO2 hardware security key.
+func (k *PublicKey) IsSecurityKey() bool {
+	return strings.HasPrefix(k.Algorithm, "sk-")
+}
+
+// Application returns the FIDO application a security key was made for,
+// such as ssh:, or nothing for other keys.
+func (k *PublicKey) Application() string {
+	if !k.IsSecurityKey() {
+		return ""
+	}
+	// The algorithm and key, with the curve before the key for ECDSA.
+	skip := 3
+	if k.Algorithm == "sk-ssh-ed25519@openssh.com" {
+		skip = 2
+	}
+	rest := k.Blob
+	for i := 0; i < skip; i++ {
+		var ok bool
+		if _, rest, ok = readWireString(rest); !ok {
+			return ""
+		}
+	}
+	application, _, ok := readWireString(rest)
+	if !ok {
+		return ""
+	}
+	return string(application)
+}
+
+func mpintBits(b []byte) int {
+	n, _, ok := readWireString(b)
+	if !ok {
+		return 0
+	}
+	return new(big.Int).SetBytes(n).BitLen()
+}
+
+// RandomArt renders the OpenSSH "drunken bishop" visualisation of the
+// key's SHA256 fingerprint.
+func (k *PublicKey) RandomArt() string {
+	const (
+		width   = 17
+		height  = 9
+		symbols = " .o+=*BOX@%&#/^SE"
+	)
+	last := len(symbols) - 1
+
+	var field [width][height]int
+	x, y := width/2, height/2
+	sum := sha256.Sum256(k.Blob)
+	for _, b := range sum {
+		for i := 0; i < 4; i++ {
+			if b&0x1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&0x2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = clamp(x, 0, width-1)
+			y = clamp(y, 0, height-1)
+			if field[x][y] < last-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[width/2][height/2] = last - 1
+	field[x][y] = last
+
+	title := fmt.Sprintf("[%s %d]", k.TypeName(), k.Bits())
+	var art strings.Builder
+	art.WriteString(artBorder(title, width))
+	for row := 0; row < height; row++ {
+		art.WriteString("|")
+		for col := 0; col < width; col++ {
+			art.WriteByte(symbols[field[col][row]])
+		}
+		art.WriteString("|\n")
+	}
+	art.WriteString(artBorder("[SHA256]", width))
+	return art.String()
+}
+
+func artBorder(label string, width int) string {
+	if len(label) > width {
+		label = label[:width]
+	}
+	left := (width - len(label)) / 2
+	right := width - left - len(label)
+	return "+" + strings.Repeat("-", left) + label + strings.Repeat("-", right) + "+\n"
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// FingerprintMatches compares pub against a SHA256 or MD5 fingerprint,
+// with or without its hash prefix.
+func FingerprintMatches(pub *PublicKey, fingerprint string) bool {
+	switch {
+	case strings.HasPrefix(fingerprint, "SHA256:"):
+		return pub.FingerprintSHA256() == fingerprint
+	case strings.HasPrefix(strings.ToUpper(fingerprint), "MD5:"):
+		return strings.EqualFold(pub.FingerprintMD5(), fingerprint)
+	case strings.Count(fingerprint, ":") == 15:
+		return strings.EqualFold(pub.FingerprintMD5(), "MD5:"+fingerprint)
+	default:
+		return pub.FingerprintSHA256() == "SHA256:"+strings.TrimRight(fingerprint, "=")
+	}
+}
+
+// ReadPublicKeyFile parses the public key stored at path.
+func ReadPublicKeyFile(path string) (*PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if IsRFC4716(content) {
+		return ParseRFC4716(content)
+	}
+
+	// Only the first key counts; blank lines and comments before it are
+	// skipped.
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return ParsePublicKey(line)
+		}
+	}
+	return nil, errors.New("no public key found")
+}
@@ -0,0 +1,92 @@
+package keyman
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	rfc4716Begin      = "---- BEGIN SSH2 PUBLIC KEY ----"
+	rfc4716End        = "---- END SSH2 PUBLIC KEY ----"
+	rfc4716LineLength = 70
+)
+
+// IsRFC4716 reports whether data looks like an RFC 4716 "SSH2" public key,
+// as exported by PuTTYgen and commercial SSH servers.
+func IsRFC4716(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(rfc4716Begin))
+}
+
+// ParseRFC4716 decodes an RFC 4716 public key, taking the comment from its
+// Comment header.
+func ParseRFC4716(data []byte) (*PublicKey, error) {
+	lines := strings.Split(strings.ReplaceAll(strings.TrimSpace(string(data)), "\r\n", "\n"), "\n")
+	if len(lines) < 2 || lines[0] != rfc4716Begin {
+		return nil, errors.New("not an RFC 4716 public key")
+	}
+
+	var comment string
+	var body strings.Builder
+	inHeaders := true
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == rfc4716End {
+			return newRFC4716Key(body.String(), comment)
+		}
+
+		name, value, isHeader := strings.Cut(line, ":")
+		if inHeaders && isHeader {
+			// A trailing backslash continues the header on the next line.
+			for strings.HasSuffix(value, "\\") && i+1 < len(lines) {
+				i++
+				value = strings.TrimSuffix(value, "\\") + strings.TrimSpace(lines[i])
+			}
+			if strings.EqualFold(name, "Comment") {
+				comment = strings.Trim(strings.TrimSpace(value), "\"")
+			}
+			continue
+		}
+		inHeaders = false
+		body.WriteString(line)
+	}
+	return nil, fmt.Errorf("RFC 4716 public key has no %q line", rfc4716End)
+}
+
+func newRFC4716Key(encoded, comment string) (*PublicKey, error) {
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, _, ok := readWireString(blob)
+	if !ok {
+		return nil, errors.New("invalid RFC 4716 public key")
+	}
+	return &PublicKey{Algorithm: string(algorithm), Blob: blob, Comment: comment}, nil
+}
+
+// MarshalRFC4716 encodes the key in RFC 4716 format, keeping its comment.
+func (k *PublicKey) MarshalRFC4716() []byte {
+	var out bytes.Buffer
+	out.WriteString(rfc4716Begin + "\n")
+	if k.Comment != "" {
+		header := fmt.Sprintf("Comment: \"%s\"", k.Comment)
+		// Header lines may be at most 72 bytes, continued with a backslash.
+		for len(header) > rfc4716LineLength+1 {
+			out.WriteString(header[:rfc4716LineLength] + "\\\n")
+			header = header[rfc4716LineLength:]
+		}
+		out.WriteString(header + "\n")
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(k.Blob)
+	for len(encoded) > rfc4716LineLength {
+		out.WriteString(encoded[:rfc4716LineLength] + "\n")
+		encoded = encoded[rfc4716LineLength:]
+	}
+	out.WriteString(encoded + "\n")
+	out.WriteString(rfc4716End + "\n")
+	return out.Bytes()
+}
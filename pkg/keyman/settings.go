@@ -0,0 +1,322 @@
+package keyman
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/internal/tomlite"
+)
+
+// Settings are the defaults from keyman's config.toml. Zero values mean
+// the setting is not set and keyman's built-in default applies.
+type Settings struct {
+	KeyType         string
+	KeyBits         int
+	CommentTemplate string
+
+	ExpiryWindow time.Duration
+	MaxKeyAge    time.Duration
+
+	// AuditPlugins are the plugins whose checks keyman audit runs. No
+	// other plugin is run by an audit, so a keyman-* program that turns up
+	// on PATH is not given the ssh directory unasked.
+	AuditPlugins []string
+
+	Output string
+	Color  string
+
+	// MapIdentitiesOnly, MapAddKeysToAgent and MapUseKeychain are the
+	// defaults for the options keyman map sets on a host.
+	MapIdentitiesOnly bool
+	MapAddKeysToAgent bool
+	MapUseKeychain    bool
+
+	// NotifyWebhook is where audit and daemon findings of at least
+	// NotifyMinSeverity are posted, as json, slack or discord messages
+	// rendered from NotifyTemplate.
+	NotifyWebhook     string
+	NotifyFormat      string
+	NotifyTemplate    string
+	NotifyMinSeverity string
+
+	GitHubToken  string
+	GitHubURL    string
+	GitHubAPIURL string
+	GitLabToken  string
+	GitLabURL    string
+	GiteaToken   string
+	GiteaURL     string
+
+	// BitbucketUsername and BitbucketToken, an app password or API token,
+	// log in to Bitbucket Cloud.
+	BitbucketUsername string
+	BitbucketToken    string
+
+	DigitalOceanToken string
+	HetznerToken      string
+
+	// Hooks are the shell commands run before and after the commands in
+	// HookCommands, keyed by hook name such as pre_map or post_generate.
+	Hooks map[string][]string
+
+	Fleets    map[string][]string
+	Templates map[string]HostTemplate
+}
+
+// HookCommands are the commands that hooks can be set for.
+var HookCommands = []string{"generate", "map", "delete", "rotate"}
+
+// LoadSettings reads a settings file. A missing file has no settings.
+func LoadSettings(path string) (*Settings, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Settings{Fleets: make(map[string][]string), Templates: make(map[string]HostTemplate)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := ParseSettings(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return settings, nil
+}
+
+// ParseSettings parses a TOML settings document:
+//
+//	[keys]
+//	type = "ed25519"
+//	comment = "{user}@{host}-{date}"
+//
+//	[audit]
+//	expiry_window = "30d"
+//	max_key_age = "1y"
+//	plugins = ["vulnkeys"]
+//
+//	[output]
+//	format = "text"  # or "json"
+//	color = "auto"   # or "always", "never"
+//
+//	[map]
+//	identities_only = true
+//	add_keys_to_agent = true
+//	use_keychain = true  # macOS only
+//
+//	[notify]
+//	webhook = "https://hooks.slack.com/services/..."
+//	format = "slack"  # or "json", "discord"
+//	template = "{severity} on {host}: {subject}: {message}"
+//	min_severity = "warning"
+//
+//	[github]
+//	token = "ghp_..."
+//
+//	[gitlab]
+//	url = "https://gitlab.example.com"
+//
+//	[gitea]
+//	url = "https://codeberg.org"
+//	token = "..."
+//
+//	[bitbucket]
+//	username = "..."
+//	token = "..."
+//
+//	[digitalocean]
+//	token = "dop_v1_..."
+//
+//	[hetzner]
+//	token = "..."
+//
+//	[hooks]
+//	post_map = "cd ~/dotfiles && git commit -qm 'keyman map' ssh/config"
+//	post_generate = ["~/bin/notify-new-key", "curl -fsS https://example.com/ping"]
+//
+//	[fleets]
+//	web = ["web1.example.com", "web2.example.com"]
+//
+//	[templates.aws-bastion]
+//	args = ["address"]
+//	HostName = "{address}"
+//	User = "ec2-user"
+//	ProxyJump = "bastion.example.com"
+func ParseSettings(content []byte) (*Settings, error) {
+	doc, err := tomlite.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := tomlite.Map(doc["keys"])
+	audit := tomlite.Map(doc["audit"])
+	output := tomlite.Map(doc["output"])
+	mapping := tomlite.Map(doc["map"])
+	notify := tomlite.Map(doc["notify"])
+	github := tomlite.Map(doc["github"])
+	gitlab := tomlite.Map(doc["gitlab"])
+	gitea := tomlite.Map(doc["gitea"])
+	bitbucket := tomlite.Map(doc["bitbucket"])
+	digitalocean := tomlite.Map(doc["digitalocean"])
+	hetzner := tomlite.Map(doc["hetzner"])
+
+	settings := &Settings{
+		KeyType:           tomlite.String(keys["type"]),
+		CommentTemplate:   tomlite.String(keys["comment"]),
+		AuditPlugins:      tomlite.Strings(audit["plugins"]),
+		Output:            tomlite.String(output["format"]),
+		Color:             tomlite.String(output["color"]),
+		NotifyWebhook:     tomlite.String(notify["webhook"]),
+		NotifyFormat:      tomlite.String(notify["format"]),
+		NotifyTemplate:    tomlite.String(notify["template"]),
+		NotifyMinSeverity: tomlite.String(notify["min_severity"]),
+		GitHubToken:       tomlite.String(github["token"]),
+		GitHubURL:         tomlite.String(github["url"]),
+		GitHubAPIURL:      tomlite.String(github["api_url"]),
+		GitLabToken:       tomlite.String(gitlab["token"]),
+		GitLabURL:         tomlite.String(gitlab["url"]),
+		GiteaToken:        tomlite.String(gitea["token"]),
+		GiteaURL:          tomlite.String(gitea["url"]),
+		BitbucketUsername: tomlite.String(bitbucket["username"]),
+		BitbucketToken:    tomlite.String(bitbucket["token"]),
+		DigitalOceanToken: tomlite.String(digitalocean["token"]),
+		HetznerToken:      tomlite.String(hetzner["token"]),
+		Hooks:             make(map[string][]string),
+		Fleets:            make(map[string][]string),
+		Templates:         make(map[string]HostTemplate),
+	}
+
+	if bits := tomlite.String(keys["bits"]); bits != "" {
+		settings.KeyBits, err = strconv.Atoi(bits)
+		if err != nil {
+			return nil, fmt.Errorf("keys.bits: invalid number %q", bits)
+		}
+	}
+	if window := tomlite.String(audit["expiry_window"]); window != "" {
+		settings.ExpiryWindow, err = ParseAge(window)
+		if err != nil {
+			return nil, fmt.Errorf("audit.expiry_window: %v", err)
+		}
+	}
+	if age := tomlite.String(audit["max_key_age"]); age != "" {
+		settings.MaxKeyAge, err = ParseAge(age)
+		if err != nil {
+			return nil, fmt.Errorf("audit.max_key_age: %v", err)
+		}
+	}
+
+	bools := []struct {
+		key     string
+		setting *bool
+	}{
+		{"identities_only", &settings.MapIdentitiesOnly},
+		{"add_keys_to_agent", &settings.MapAddKeysToAgent},
+		{"use_keychain", &settings.MapUseKeychain},
+	}
+	for _, option := range bools {
+		if value := tomlite.String(mapping[option.key]); value != "" {
+			*option.setting, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("map.%s: invalid boolean %q", option.key, value)
+			}
+		}
+	}
+
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	for name, commands := range tomlite.Map(doc["hooks"]) {
+		if !isHookName(name) {
+			return nil, fmt.Errorf("hooks.%s: unknown hook, expected pre_ or post_ and generate, map, delete or rotate", name)
+		}
+		settings.Hooks[name] = tomlite.Strings(commands)
+	}
+	for name, hosts := range tomlite.Map(doc["fleets"]) {
+		settings.Fleets[name] = tomlite.Strings(hosts)
+	}
+	for name, table := range tomlite.Map(doc["templates"]) {
+		settings.Templates[name], err = parseTemplate(name, tomlite.Map(table))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// Validate checks the settings that only take a fixed set of values.
+func (s *Settings) Validate() error {
+	switch s.Output {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("output.format must be text or json, not %q", s.Output)
+	}
+	switch s.Color {
+	case "", "auto", "always", "never":
+	default:
+		return fmt.Errorf("output.color must be auto, always or never, not %q", s.Color)
+	}
+	switch s.NotifyFormat {
+	case "", "json", "slack", "discord":
+	default:
+		return fmt.Errorf("notify.format must be json, slack or discord, not %q", s.NotifyFormat)
+	}
+	if s.NotifyMinSeverity != "" {
+		if _, err := ParseSeverity(s.NotifyMinSeverity); err != nil {
+			return fmt.Errorf("notify.min_severity: %v", err)
+		}
+	}
+	return nil
+}
+
+// isHookName reports whether name is pre_ or post_ and a command in
+// HookCommands.
+func isHookName(name string) bool {
+	when, command, _ := strings.Cut(name, "_")
+	return (when == "pre" || when == "post") && containsString(HookCommands, command)
+}
+
+// HookNames returns the names of the hooks that are set, in order.
+func (s *Settings) HookNames() []string {
+	var names []string
+	for name := range s.Hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FleetNames returns the names of the fleets in order.
+func (s *Settings) FleetNames() []string {
+	var names []string
+	for name := range s.Fleets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TemplateNames returns the names of the host templates in order.
+func (s *Settings) TemplateNames() []string {
+	var names []string
+	for name := range s.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExpandComment fills in a comment template's {user}, {host}, {date},
+// {name} and {type} placeholders.
+func ExpandComment(template, user, host, name, keyType string, now time.Time) string {
+	return strings.NewReplacer(
+		"{user}", user,
+		"{host}", host,
+		"{date}", now.Format("2006-01-02"),
+		"{name}", name,
+		"{type}", keyType,
+	).Replace(template)
+}
@@ -0,0 +1,204 @@
+package keyman
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FragmentDir is the directory next to the config that Split moves hosts
+// into, one file per host, read through an Include of fragmentPattern.
+const (
+	FragmentDir     = "config.d"
+	fragmentPattern = FragmentDir + "/*.conf"
+)
+
+// Split moves each Host block that names its hosts outright, along with
+// the comments above it, out of the config into its own file in
+// FragmentDir, and includes them where the first Host block was. Blocks
+// with wildcards or negations, Host * and Match blocks stay, since where
+// they sit decides which options win. It refuses when reading the moved
+// blocks first would put a block ahead of one it may share hosts with.
+// It returns the fragment files written, which SaveAll creates.
+func (c *Config) Split() ([]string, error) {
+	blocks := c.Blocks()
+	var moving, staying []*HostBlock
+	for _, block := range blocks {
+		if splittable(block) {
+			moving = append(moving, block)
+		} else {
+			staying = append(staying, block)
+		}
+	}
+	if len(moving) == 0 {
+		return nil, nil
+	}
+
+	// The moved blocks are read first, in file name order.
+	order := append([]*HostBlock{}, moving...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return FragmentName(order[i].Patterns[0]) < FragmentName(order[j].Patterns[0])
+	})
+	order = append(order, staying...)
+	for i, a := range order {
+		for _, b := range order[i+1:] {
+			if b.start < a.start && mayOverlap(a, b) {
+				return nil, fmt.Errorf("Host %s on line %d would be read before %s on line %d, which may apply to the same hosts; reorder them, or merge duplicates with keyman config dedupe, first",
+					a.Name(), a.Line(), blockHeader(b), b.Line())
+			}
+		}
+	}
+
+	include := c.fragmentsLine()
+	if include < 0 {
+		at := blocks[0].start
+		for at > 0 && c.Lines[at-1].isComment() {
+			at--
+		}
+		c.InsertLine(at, "")
+		c.InsertLine(at, "Include "+fragmentPattern)
+		if at > 0 && strings.TrimSpace(c.Lines[at-1].Text) != "" {
+			c.InsertLine(at, "")
+			at++
+		}
+		// The blocks found before the insert are now three lines or
+		// fewer further down.
+		blocks = c.Blocks()
+		moving = moving[:0]
+		for _, block := range blocks {
+			if splittable(block) {
+				moving = append(moving, block)
+			}
+		}
+	}
+
+	// Take the blocks out last to first, so the line numbers of those
+	// before stay valid.
+	var written []string
+	for j := len(moving) - 1; j >= 0; j-- {
+		block := moving[j]
+		include = c.fragmentsLine()
+		from := block.start
+		for from > include+1 && c.Lines[from-1].isComment() {
+			from--
+		}
+		to := block.lastOptionLine()
+		if from < include && to >= include {
+			to = include - 1
+		}
+		for to > from && strings.TrimSpace(c.Lines[to].Text) == "" {
+			to--
+		}
+
+		var lines []Line
+		for i := from; i <= to; i++ {
+			lines = append(lines, c.Lines[i])
+		}
+		path := c.addToFragment(include, block.Patterns[0], lines, true)
+		if !containsString(written, path) {
+			written = append(written, path)
+		}
+
+		c.Lines = append(c.Lines[:from], c.Lines[to+1:]...)
+		for from > 0 && from < len(c.Lines) && strings.TrimSpace(c.Lines[from-1].Text) == "" && strings.TrimSpace(c.Lines[from].Text) == "" {
+			c.RemoveLine(from)
+		}
+		for len(c.Lines) > 0 && strings.TrimSpace(c.Lines[0].Text) == "" {
+			c.RemoveLine(0)
+		}
+		for len(c.Lines) > 0 && strings.TrimSpace(c.Lines[len(c.Lines)-1].Text) == "" {
+			c.RemoveLine(len(c.Lines) - 1)
+		}
+	}
+	c.modified = true
+	sort.Strings(written)
+	return written, nil
+}
+
+// splittable reports whether Split moves block into a file of its own.
+func splittable(block *HostBlock) bool {
+	return !block.Match && !strings.ContainsAny(block.Name(), "*?!")
+}
+
+// FragmentName returns the name of the file in FragmentDir for host.
+func FragmentName(host string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, host)
+	return name + ".conf"
+}
+
+// fragmentsLine returns the index of the Include line that reads the
+// files Split writes, or -1 if the config has not been split. Any Include
+// whose pattern reads every .conf file in FragmentDir counts, however it
+// is written, such as config.d/* or ~/.ssh/config.d/*.conf.
+func (c *Config) fragmentsLine() int {
+	dir := filepath.Join(filepath.Dir(c.Path), FragmentDir)
+	for i, line := range c.Lines {
+		if line.Keyword != "include" {
+			continue
+		}
+		for _, pattern := range strings.Fields(line.Value) {
+			pattern, err := includePattern(pattern, filepath.Dir(c.Path))
+			if err == nil && readsFragments(pattern, dir) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// readsFragments reports whether the Include glob pattern matches every
+// .conf file in dir. It is tried against the literal name *.conf, which
+// only a pattern at least that broad matches, and an ordinary name to rule
+// out ? standing in for the *.
+func readsFragments(pattern, dir string) bool {
+	if filepath.Dir(pattern) != dir {
+		return false
+	}
+	for _, name := range []string{"*.conf", "web-1.example.com.conf"} {
+		if ok, err := filepath.Match(filepath.Base(pattern), name); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// addToFragment adds lines to the fragment for host, creating it if the
+// Include at lines[include] does not read one yet, and returns its path.
+// With prepend, lines go before those already there, as Split adds blocks
+// last to first.
+func (c *Config) addToFragment(include int, host string, lines []Line, prepend bool) string {
+	path := filepath.Join(filepath.Dir(c.Path), FragmentDir, FragmentName(host))
+	var fragment *Config
+	for _, included := range c.Lines[include].Included {
+		if included.Path == path {
+			fragment = included
+		}
+	}
+	if fragment == nil {
+		fragment = &Config{Path: path, CRLF: c.CRLF}
+		included := append(c.Lines[include].Included, fragment)
+		sort.SliceStable(included, func(i, j int) bool { return included[i].Path < included[j].Path })
+		c.Lines[include].Included = included
+	}
+
+	if len(fragment.Lines) > 0 {
+		if prepend {
+			lines = append(lines, newConfigLine(""))
+		} else {
+			lines = append([]Line{newConfigLine("")}, lines...)
+		}
+	}
+	if prepend {
+		fragment.Lines = append(lines, fragment.Lines...)
+	} else {
+		fragment.Lines = append(fragment.Lines, lines...)
+	}
+	fragment.modified = true
+	return path
+}
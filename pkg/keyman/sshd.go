@@ -0,0 +1,296 @@
+package keyman
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSSHDConfig is where sshd reads its configuration from.
+const DefaultSSHDConfig = "/etc/ssh/sshd_config"
+
+// Rule names of the findings AuditSSHD reports.
+const (
+	RuleSSHDRootLogin      = "sshd_root_login"
+	RuleSSHDPasswords      = "sshd_password_authentication"
+	RuleSSHDWeakAlgorithms = "sshd_weak_algorithms"
+	RuleSSHDAuthorizedKeys = "sshd_authorized_keys"
+)
+
+// weakSSHDAlgorithms are the algorithms, by option, that are broken or
+// only kept for old clients.
+var weakSSHDAlgorithms = map[string][]string{
+	"ciphers": {
+		"3des-cbc", "aes128-cbc", "aes192-cbc", "aes256-cbc", "blowfish-cbc", "cast128-cbc",
+		"arcfour", "arcfour128", "arcfour256", "rijndael-cbc@lysator.liu.se",
+	},
+	"macs": {
+		"hmac-md5", "hmac-md5-96", "hmac-md5-etm@openssh.com", "hmac-md5-96-etm@openssh.com",
+		"hmac-sha1", "hmac-sha1-96", "hmac-sha1-etm@openssh.com", "hmac-sha1-96-etm@openssh.com", "hmac-ripemd160",
+		"hmac-ripemd160@openssh.com", "hmac-ripemd160-etm@openssh.com", "umac-64@openssh.com",
+		"umac-64-etm@openssh.com",
+	},
+	"kexalgorithms": {
+		"diffie-hellman-group1-sha1", "diffie-hellman-group14-sha1", "diffie-hellman-group-exchange-sha1",
+		"gss-gex-sha1-", "gss-group1-sha1-", "gss-group14-sha1-",
+	},
+	"hostkeyalgorithms":        {"ssh-dss", "ssh-dss-cert-v01@openssh.com"},
+	"pubkeyacceptedalgorithms": {"ssh-dss", "ssh-dss-cert-v01@openssh.com"},
+}
+
+// SSHDSetting is the value an sshd_config option takes and the file and
+// line it came from, which are empty when it is sshd's default.
+type SSHDSetting struct {
+	Keyword string
+	Value   string
+	Path    string
+	Line    int
+}
+
+// Source describes where the setting came from, for messages.
+func (s SSHDSetting) Source() string {
+	if s.Path == "" {
+		return "the default"
+	}
+	return fmt.Sprintf("%s line %d", s.Path, s.Line)
+}
+
+// SSHDMatch is a Match block of an sshd_config and the settings in it.
+type SSHDMatch struct {
+	Criteria string
+	Settings []SSHDSetting
+}
+
+// SSHDConfig is what sshd makes of its configuration files: the settings
+// outside Match blocks, where the first value of an option wins, and the
+// Match blocks that override them for some connections.
+type SSHDConfig struct {
+	Path    string
+	Global  map[string]SSHDSetting
+	Matches []SSHDMatch
+}
+
+// sshdDefaults are the values of the options AuditSSHD checks when the
+// configuration does not set them, as OpenSSH ships them.
+var sshdDefaults = map[string]string{
+	"permitrootlogin":              "prohibit-password",
+	"passwordauthentication":       "yes",
+	"kbdinteractiveauthentication": "yes",
+	"permitemptypasswords":         "no",
+	"usepam":                       "no",
+	"strictmodes":                  "yes",
+	"authorizedkeysfile":           ".ssh/authorized_keys .ssh/authorized_keys2",
+}
+
+// sshdAliases maps old option names to the ones sshd now uses.
+var sshdAliases = map[string]string{
+	"challengeresponseauthentication": "kbdinteractiveauthentication",
+	"pubkeyacceptedkeytypes":          "pubkeyacceptedalgorithms",
+}
+
+// LoadSSHDConfig reads the sshd_config at path and the files it includes,
+// resolving relative Include paths against its directory as sshd does.
+func LoadSSHDConfig(path string) (*SSHDConfig, error) {
+	config, err := LoadConfig(path, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	sshd := &SSHDConfig{Path: path, Global: make(map[string]SSHDSetting)}
+	sshd.read(config, -1)
+	return sshd, nil
+}
+
+// read adds the settings of config in order, with match the index of the
+// Match block its lines start in, or -1. A Match block ends at the end of
+// its file.
+func (s *SSHDConfig) read(config *Config, match int) {
+	for i, line := range config.Lines {
+		if line.Keyword == "" {
+			continue
+		}
+		if line.Keyword == "match" {
+			s.Matches = append(s.Matches, SSHDMatch{Criteria: line.Value})
+			match = len(s.Matches) - 1
+			continue
+		}
+		if line.Keyword == "include" {
+			for _, included := range line.Included {
+				s.read(included, match)
+			}
+			continue
+		}
+		keyword := line.Keyword
+		if alias, ok := sshdAliases[keyword]; ok {
+			keyword = alias
+		}
+		setting := SSHDSetting{Keyword: keyword, Value: line.Value, Path: config.Path, Line: i + 1}
+		if match >= 0 {
+			s.Matches[match].Settings = append(s.Matches[match].Settings, setting)
+		} else if _, ok := s.Global[keyword]; !ok {
+			s.Global[keyword] = setting
+		}
+	}
+}
+
+// Setting returns the global value of keyword, given lowercased, or its
+// default.
+func (s *SSHDConfig) Setting(keyword string) SSHDSetting {
+	if setting, ok := s.Global[keyword]; ok {
+		return setting
+	}
+	return SSHDSetting{Keyword: keyword, Value: sshdDefaults[keyword]}
+}
+
+// AuditSSHD checks an sshd configuration for settings that weaken the
+// server: root and password logins, obsolete ciphers, MACs and key
+// exchanges, and authorized_keys handling that lets keys hide or be
+// tampered with. Match blocks that turn a risky setting back on are
+// reported too.
+func AuditSSHD(s *SSHDConfig) []Finding {
+	var findings []Finding
+	add := func(severity Severity, rule string, setting SSHDSetting, format string, args ...interface{}) {
+		findings = append(findings, Finding{
+			Severity: severity,
+			Rule:     rule,
+			Subject:  sshdKeywordName(setting.Keyword),
+			Message:  fmt.Sprintf(format, args...) + " (" + setting.Source() + ")",
+		})
+	}
+
+	switch root := s.Setting("permitrootlogin"); strings.ToLower(root.Value) {
+	case "yes":
+		add(SeverityError, RuleSSHDRootLogin, root, "root may log in with a password; set PermitRootLogin no, or prohibit-password if root needs key logins")
+	case "prohibit-password", "without-password":
+		add(SeverityInfo, RuleSSHDRootLogin, root, "root may log in with a key; set PermitRootLogin no unless root logins are needed")
+	}
+
+	if password := s.Setting("passwordauthentication"); isYes(password.Value) {
+		add(SeverityWarning, RuleSSHDPasswords, password, "passwords are accepted, so the server can be brute forced; set PasswordAuthentication no once every user has a key")
+	}
+	if kbd := s.Setting("kbdinteractiveauthentication"); isYes(kbd.Value) && isYes(s.Setting("usepam").Value) {
+		add(SeverityWarning, RuleSSHDPasswords, kbd, "with UsePAM yes, PAM may still ask for passwords; set KbdInteractiveAuthentication no unless PAM needs it for other factors")
+	}
+	if empty := s.Setting("permitemptypasswords"); isYes(empty.Value) {
+		add(SeverityError, RuleSSHDPasswords, empty, "accounts without a password may log in; set PermitEmptyPasswords no")
+	}
+
+	for _, keyword := range []string{"ciphers", "macs", "kexalgorithms", "hostkeyalgorithms", "pubkeyacceptedalgorithms"} {
+		setting, ok := s.Global[keyword]
+		if !ok {
+			continue
+		}
+		if weak := weakAlgorithms(keyword, setting.Value); len(weak) > 0 {
+			add(SeverityError, RuleSSHDWeakAlgorithms, setting, "allows obsolete algorithms %s; remove them", strings.Join(weak, ", "))
+		}
+	}
+
+	if strict := s.Setting("strictmodes"); !isYes(strict.Value) {
+		add(SeverityError, RuleSSHDAuthorizedKeys, strict, "sshd uses authorized_keys files that others can write to; set StrictModes yes")
+	}
+	keysFile := s.Setting("authorizedkeysfile")
+	for _, file := range strings.Fields(keysFile.Value) {
+		if strings.HasSuffix(file, "authorized_keys2") {
+			add(SeverityWarning, RuleSSHDAuthorizedKeys, keysFile, "sshd also reads the legacy %s, where keys are easily overlooked; set AuthorizedKeysFile .ssh/authorized_keys", file)
+			break
+		}
+	}
+
+	for _, match := range s.Matches {
+		for _, setting := range match.Settings {
+			subject := SSHDSetting{Keyword: setting.Keyword, Path: setting.Path, Line: setting.Line}
+			switch {
+			case setting.Keyword == "permitrootlogin" && strings.EqualFold(setting.Value, "yes"):
+				add(SeverityError, RuleSSHDRootLogin, subject, "Match %s lets root log in with a password", match.Criteria)
+			case setting.Keyword == "passwordauthentication" && isYes(setting.Value):
+				add(SeverityWarning, RuleSSHDPasswords, subject, "Match %s accepts passwords", match.Criteria)
+			case setting.Keyword == "permitemptypasswords" && isYes(setting.Value):
+				add(SeverityError, RuleSSHDPasswords, subject, "Match %s lets accounts without a password log in", match.Criteria)
+			case setting.Keyword == "authorizedkeysfile" && strings.Contains(setting.Value, "authorized_keys2"):
+				add(SeverityWarning, RuleSSHDAuthorizedKeys, subject, "Match %s reads the legacy authorized_keys2", match.Criteria)
+			}
+		}
+	}
+	return findings
+}
+
+// weakAlgorithms returns the weak algorithms an algorithm list enables.
+// Lists starting with - remove algorithms, so they enable none; + and ^
+// add to the defaults, which hold no weak ones.
+func weakAlgorithms(keyword, value string) []string {
+	if strings.HasPrefix(value, "-") {
+		return nil
+	}
+	var weak []string
+	for _, algorithm := range strings.Split(strings.TrimLeft(value, "+^"), ",") {
+		algorithm = strings.TrimSpace(algorithm)
+		name := strings.ToLower(algorithm)
+		for _, known := range weakSSHDAlgorithms[keyword] {
+			// GSSAPI key exchange names end in a mechanism suffix.
+			if name == known || strings.HasSuffix(known, "-") && strings.HasPrefix(name, known) {
+				weak = append(weak, algorithm)
+				break
+			}
+		}
+	}
+	return weak
+}
+
+// sshdKeywordName returns keyword spelled as sshd_config(5) does.
+func sshdKeywordName(keyword string) string {
+	for _, name := range []string{
+		"PermitRootLogin", "PasswordAuthentication", "KbdInteractiveAuthentication", "PermitEmptyPasswords",
+		"UsePAM", "StrictModes", "AuthorizedKeysFile", "Ciphers", "MACs", "KexAlgorithms", "HostKeyAlgorithms",
+		"PubkeyAcceptedAlgorithms",
+	} {
+		if strings.EqualFold(name, keyword) {
+			return name
+		}
+	}
+	return keyword
+}
+
+func isYes(value string) bool {
+	return strings.EqualFold(value, "yes")
+}
+
+// DefaultHostKeyDir is where sshd keeps its host keys.
+const DefaultHostKeyDir = "/etc/ssh"
+
+// ListHostKeys returns the sshd host keys in dir, the ssh_host_*_key files
+// and their public halves.
+func ListHostKeys(dir string) ([]Key, error) {
+	keys, err := ListKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	var hostKeys []Key
+	for _, key := range keys {
+		if strings.HasPrefix(key.Name, "ssh_host_") && strings.HasSuffix(key.Name, "_key") {
+			hostKeys = append(hostKeys, key)
+		}
+	}
+	return hostKeys, nil
+}
+
+// HostKeyReplacement returns the ssh-keygen type and size of the key to
+// replace a host key like pub with: the same type, with RSA keys at least
+// the recommended size. DSA keys, which ssh no longer accepts, have no
+// replacement and give "".
+func HostKeyReplacement(pub *PublicKey) (keyType string, bits int) {
+	switch {
+	case pub.Algorithm == "ssh-rsa":
+		bits = pub.Bits()
+		if bits < recommendedRSABits {
+			bits = recommendedRSABits
+		}
+		return "rsa", bits
+	case strings.HasPrefix(pub.Algorithm, "ecdsa-sha2-"):
+		if bits = pub.Bits(); bits == 0 {
+			bits = 256
+		}
+		return "ecdsa", bits
+	case pub.Algorithm == "ssh-ed25519":
+		return "ed25519", 0
+	}
+	return "", 0
+}
@@ -0,0 +1,236 @@
+package keyman
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// SSHFP algorithm numbers, from RFC 4255, 6594 and 7479.
+const (
+	SSHFPRSA     = 1
+	SSHFPDSA     = 2
+	SSHFPECDSA   = 3
+	SSHFPEd25519 = 4
+)
+
+// SSHFP fingerprint types.
+const (
+	SSHFPSHA1   = 1
+	SSHFPSHA256 = 2
+)
+
+const dnsTypeSSHFP = 44
+
+// SSHFP is an SSHFP DNS record: a host key's algorithm and the hash of its
+// blob, in hex.
+type SSHFP struct {
+	Algorithm   int
+	Type        int
+	Fingerprint string
+}
+
+// String returns the record's data as written in a zone file.
+func (r SSHFP) String() string {
+	return fmt.Sprintf("%d %d %s", r.Algorithm, r.Type, r.Fingerprint)
+}
+
+// SSHFPAlgorithm returns the SSHFP algorithm number of key, or 0 if SSHFP
+// has none for it.
+func SSHFPAlgorithm(key *PublicKey) int {
+	switch {
+	case key.Algorithm == "ssh-rsa":
+		return SSHFPRSA
+	case key.Algorithm == "ssh-dss":
+		return SSHFPDSA
+	case strings.HasPrefix(key.Algorithm, "ecdsa-sha2-"):
+		return SSHFPECDSA
+	case key.Algorithm == "ssh-ed25519":
+		return SSHFPEd25519
+	}
+	return 0
+}
+
+// SSHFPRecord returns the SSHFP record of key with the fingerprint type
+// given.
+func SSHFPRecord(key *PublicKey, fingerprintType int) (SSHFP, error) {
+	algorithm := SSHFPAlgorithm(key)
+	if algorithm == 0 {
+		return SSHFP{}, fmt.Errorf("SSHFP has no algorithm number for %s keys", key.Algorithm)
+	}
+	var sum []byte
+	switch fingerprintType {
+	case SSHFPSHA1:
+		hash := sha1.Sum(key.Blob)
+		sum = hash[:]
+	case SSHFPSHA256:
+		hash := sha256.Sum256(key.Blob)
+		sum = hash[:]
+	default:
+		return SSHFP{}, fmt.Errorf("unknown SSHFP fingerprint type %d", fingerprintType)
+	}
+	return SSHFP{Algorithm: algorithm, Type: fingerprintType, Fingerprint: hex.EncodeToString(sum)}, nil
+}
+
+// DefaultDNSServer returns the first nameserver in /etc/resolv.conf, as
+// host:port.
+func DefaultDNSServer() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("no DNS server known, give one with --dns-server: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf, give one with --dns-server")
+}
+
+// LookupSSHFP asks the DNS server at server, as host:port, for the SSHFP
+// records of name. authenticated reports whether the server validated the
+// answer with DNSSEC, which ssh needs before it trusts the records.
+func LookupSSHFP(name, server string, timeout time.Duration) (records []SSHFP, authenticated bool, err error) {
+	query, id, err := dnsQuery(name, dnsTypeSSHFP)
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, err := dnsExchange("udp", server, query, timeout)
+	if err == nil && len(response) > 2 && response[2]&0x02 != 0 {
+		// Truncated: ask again over TCP.
+		response, err = dnsExchange("tcp", server, query, timeout)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return parseSSHFPResponse(response, id)
+}
+
+// dnsQuery builds a recursive query for name with the AD bit set, so the
+// server says whether it validated the answer.
+func dnsQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	query := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(query[0:], id)
+	binary.BigEndian.PutUint16(query[2:], 0x0120) // RD and AD
+	binary.BigEndian.PutUint16(query[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, 0, fmt.Errorf("%q is not a valid DNS name", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	return query, id, nil
+}
+
+func dnsExchange(network, server string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if network == "tcp" {
+		framed := make([]byte, 2, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		if _, err := conn.Write(append(framed, query...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err := io.ReadFull(conn, response)
+		return response, err
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 65535)
+	n, err := conn.Read(response)
+	return response[:n], err
+}
+
+func parseSSHFPResponse(response []byte, id uint16) ([]SSHFP, bool, error) {
+	if len(response) < 12 || binary.BigEndian.Uint16(response) != id {
+		return nil, false, errors.New("malformed DNS response")
+	}
+	authenticated := response[3]&0x20 != 0
+	switch rcode := response[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		return nil, authenticated, nil
+	default:
+		return nil, false, fmt.Errorf("DNS server answered with error code %d", rcode)
+	}
+
+	questions := int(binary.BigEndian.Uint16(response[4:]))
+	answers := int(binary.BigEndian.Uint16(response[6:]))
+	offset := 12
+	var ok bool
+	for i := 0; i < questions; i++ {
+		if offset, ok = skipDNSName(response, offset); !ok || offset+4 > len(response) {
+			return nil, false, errors.New("malformed DNS response")
+		}
+		offset += 4
+	}
+
+	var records []SSHFP
+	for i := 0; i < answers; i++ {
+		if offset, ok = skipDNSName(response, offset); !ok || offset+10 > len(response) {
+			return nil, false, errors.New("malformed DNS response")
+		}
+		rtype := binary.BigEndian.Uint16(response[offset:])
+		length := int(binary.BigEndian.Uint16(response[offset+8:]))
+		offset += 10
+		if offset+length > len(response) {
+			return nil, false, errors.New("malformed DNS response")
+		}
+		data := response[offset : offset+length]
+		offset += length
+		if rtype == dnsTypeSSHFP && len(data) > 2 {
+			records = append(records, SSHFP{Algorithm: int(data[0]), Type: int(data[1]), Fingerprint: hex.EncodeToString(data[2:])})
+		}
+	}
+	return records, authenticated, nil
+}
+
+// skipDNSName returns the offset just past the possibly compressed name
+// starting at offset.
+func skipDNSName(message []byte, offset int) (int, bool) {
+	for offset < len(message) {
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1, true
+		case length&0xc0 == 0xc0:
+			return offset + 2, offset+2 <= len(message)
+		}
+		offset += 1 + length
+	}
+	return 0, false
+}
@@ -0,0 +1,155 @@
+package keyman
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// strayKeyName matches the file names ssh-keygen gives private keys, with
+// any suffix people add to tell them apart.
+var strayKeyName = regexp.MustCompile(`^id_(rsa|dsa|ecdsa|ed25519|ecdsa_sk|ed25519_sk|xmss)([_-][^.]*)?$`)
+
+// privateKeyFormats names the PEM block types of private keys.
+var privateKeyFormats = map[string]string{
+	"OPENSSH PRIVATE KEY":   "OpenSSH",
+	"RSA PRIVATE KEY":       "PEM RSA",
+	"DSA PRIVATE KEY":       "PEM DSA",
+	"EC PRIVATE KEY":        "PEM EC",
+	"PRIVATE KEY":           "PKCS#8",
+	"ENCRYPTED PRIVATE KEY": "PKCS#8",
+}
+
+// StrayKey is a file found by FindStrayKeys. Format is empty when only the
+// file's name looks like a private key; Line is where the key starts in
+// files that hold more than the key. Public is nil when the public half
+// cannot be read without the passphrase.
+type StrayKey struct {
+	Path      string
+	Format    string
+	Line      int
+	Encrypted bool
+	Public    *PublicKey
+}
+
+// FindStrayKeys walks the tree under root for files that hold a private
+// key, in OpenSSH, PEM, PKCS#8 or PuTTY format and anywhere in the file,
+// or that are named like one. root may also be a single file. Directories
+// in skip and .git directories are not searched, files larger than maxSize
+// bytes are not read, root included, though those named like a key are
+// still returned, symlinks are not followed, and unreadable directories
+// and files are counted but otherwise skipped.
+func FindStrayKeys(root string, skip []string, maxSize int64) (found []StrayKey, unreadable int, err error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, 0, err
+	}
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			unreadable++
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if (path != root && entry.Name() == ".git") || containsString(skip, path) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			unreadable++
+			return nil
+		}
+
+		named := strayKeyName.MatchString(entry.Name())
+		if info.Size() > maxSize {
+			if named {
+				found = append(found, StrayKey{Path: path})
+			}
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			unreadable++
+			return nil
+		}
+		if key, ok := findPrivateKey(content); ok {
+			key.Path = path
+			found = append(found, key)
+		} else if named {
+			found = append(found, StrayKey{Path: path})
+		}
+		return nil
+	})
+	return found, unreadable, err
+}
+
+// findPrivateKey looks for the first private key in content.
+func findPrivateKey(content []byte) (StrayKey, bool) {
+	if IsPPK(content) {
+		key := StrayKey{Format: "PuTTY", Line: 1, Encrypted: PPKEncrypted(content)}
+		if fields, _, err := readPPKFields(content); err == nil {
+			if blob, err := base64.StdEncoding.DecodeString(fields["Public-Lines"]); err == nil {
+				if algorithm, _, ok := readWireString(blob); ok {
+					key.Public = &PublicKey{Algorithm: string(algorithm), Blob: blob, Comment: fields["Comment"]}
+				}
+			}
+		}
+		return key, true
+	}
+	// Binary files cannot hold a PEM key.
+	head := content
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return StrayKey{}, false
+	}
+
+	rest := content
+	for {
+		start := bytes.Index(rest, []byte("-----BEGIN "))
+		if start < 0 {
+			return StrayKey{}, false
+		}
+		block, remaining := pem.Decode(rest[start:])
+		if block == nil {
+			rest = rest[start+len("-----BEGIN "):]
+			continue
+		}
+		format, ok := privateKeyFormats[block.Type]
+		if !ok {
+			rest = remaining
+			continue
+		}
+
+		offset := len(content) - len(rest) + start
+		key := StrayKey{Format: format, Line: bytes.Count(content[:offset], []byte("\n")) + 1}
+		keyBytes := content[offset : len(content)-len(remaining)]
+		switch block.Type {
+		case "OPENSSH PRIVATE KEY":
+			if bytes.HasPrefix(block.Bytes, []byte(opensshKeyMagic)) {
+				cipher, _, _ := readWireString(block.Bytes[len(opensshKeyMagic):])
+				key.Encrypted = string(cipher) != "none"
+			}
+		case "ENCRYPTED PRIVATE KEY":
+			key.Encrypted = true
+		default:
+			key.Encrypted = strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+		}
+		if pub, err := PublicKeyFromPrivate(keyBytes); err == nil {
+			key.Public = pub
+		}
+		return key, true
+	}
+}
@@ -0,0 +1,52 @@
+package keyman
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RuleWeakAlgorithm names the findings of CheckStrength.
+const RuleWeakAlgorithm = "weak_algorithm"
+
+// Key sizes below which RSA keys are reported. Anything under 2048 bits is
+// within reach of a well funded attacker, and 3072 bits matches the 128-bit
+// security of ed25519.
+const (
+	minRSABits         = 2048
+	recommendedRSABits = 3072
+)
+
+// CheckStrength reports keys whose algorithm or size is no longer safe: DSA
+// keys, which OpenSSH 7.0 and later reject, RSA keys under 3072 bits and
+// ECDSA keys on curves other than the NIST ones OpenSSH supports.
+func CheckStrength(keys []Key) []Finding {
+	var findings []Finding
+	add := func(severity Severity, key Key, format string, args ...interface{}) {
+		findings = append(findings, Finding{
+			Severity: severity,
+			Rule:     RuleWeakAlgorithm,
+			Subject:  key.Name,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, key := range keys {
+		pub := key.Public
+		if pub == nil {
+			continue
+		}
+
+		bits := pub.Bits()
+		switch {
+		case pub.Algorithm == "ssh-dss":
+			add(SeverityError, key, "DSA keys are rejected by OpenSSH 7.0 and later, replace it with an ed25519 key")
+		case pub.Algorithm == "ssh-rsa" && bits < minRSABits:
+			add(SeverityError, key, "RSA key is %d bits, which can be broken; replace it with an ed25519 or %d bit RSA key", bits, recommendedRSABits)
+		case pub.Algorithm == "ssh-rsa" && bits < recommendedRSABits:
+			add(SeverityWarning, key, "RSA key is %d bits, %d or more are recommended", bits, recommendedRSABits)
+		case strings.Contains(pub.Algorithm, "ecdsa-sha2-") && bits == 0:
+			add(SeverityError, key, "ECDSA key uses an unknown or weak curve (%s)", pub.Algorithm)
+		}
+	}
+	return findings
+}
@@ -0,0 +1,142 @@
+package keyman
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/tomlite"
+)
+
+// HostTemplate is a set of options for new Host blocks, from a
+// [templates.<name>] table in the settings. Values may hold placeholders:
+// {host} for the new host's name and {arg} for each of Args, which are
+// given after the host's name when the template is used.
+type HostTemplate struct {
+	Name    string
+	Args    []string
+	Options []TemplateOption
+}
+
+// TemplateOption is an option of a HostTemplate. Options such as
+// IdentityFile may have several values, each written on its own line.
+type TemplateOption struct {
+	Keyword string
+	Values  []string
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z0-9_-]+)\}`)
+
+// templateOrder is the order options are written in, matching the options
+// keyman host add takes. Other options follow in alphabetical order.
+var templateOrder = []string{"HostName", "User", "Port", "IdentityFile", "ProxyJump"}
+
+// parseTemplate reads a [templates.<name>] table, such as:
+//
+//	[templates.aws-bastion]
+//	args = ["address"]
+//	HostName = "{address}"
+//	User = "ec2-user"
+//	ProxyJump = "bastion.example.com"
+//	IdentityFile = ["~/.ssh/aws_ed25519", "~/.ssh/{host}"]
+func parseTemplate(name string, table map[string]interface{}) (HostTemplate, error) {
+	template := HostTemplate{Name: name, Args: tomlite.Strings(table["args"])}
+	known := map[string]bool{"host": true}
+	for _, arg := range template.Args {
+		if !placeholderPattern.MatchString("{" + arg + "}") {
+			return HostTemplate{}, fmt.Errorf("templates.%s.args: %q is not a valid name", name, arg)
+		}
+		known[arg] = true
+	}
+
+	for key, value := range table {
+		if key == "args" {
+			continue
+		}
+		keyword, ok := CanonicalKeyword(key)
+		if !ok {
+			return HostTemplate{}, fmt.Errorf("templates.%s: %s is not an ssh option", name, key)
+		}
+		if keyword == "Host" || keyword == "Match" || keyword == "Include" {
+			return HostTemplate{}, fmt.Errorf("templates.%s: %s cannot be set in a template", name, keyword)
+		}
+		values := tomlite.Strings(value)
+		if len(values) == 0 {
+			return HostTemplate{}, fmt.Errorf("templates.%s.%s: expected a string or an array of strings", name, key)
+		}
+		for _, value := range values {
+			for _, match := range placeholderPattern.FindAllStringSubmatch(value, -1) {
+				if !known[match[1]] {
+					return HostTemplate{}, fmt.Errorf("templates.%s.%s: unknown placeholder {%s}, add it to args", name, key, match[1])
+				}
+			}
+		}
+		template.Options = append(template.Options, TemplateOption{Keyword: keyword, Values: values})
+	}
+
+	rank := func(keyword string) int {
+		for i, ordered := range templateOrder {
+			if ordered == keyword {
+				return i
+			}
+		}
+		return len(templateOrder)
+	}
+	sort.Slice(template.Options, func(i, j int) bool {
+		a, b := template.Options[i].Keyword, template.Options[j].Keyword
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		return a < b
+	})
+	return template, nil
+}
+
+// Expand returns the template's options for host, with the placeholders
+// filled in from host and args, which must match Args.
+func (t HostTemplate) Expand(host string, args []string) ([]TemplateOption, error) {
+	if len(args) != len(t.Args) && len(t.Args) == 0 {
+		return nil, fmt.Errorf("template %s takes no arguments after the host name", t.Name)
+	}
+	if len(args) != len(t.Args) {
+		return nil, fmt.Errorf("template %s takes %d argument(s) after the host name (%s), got %d", t.Name, len(t.Args), t.Usage(), len(args))
+	}
+	values := map[string]string{"host": host}
+	for i, arg := range t.Args {
+		values[arg] = args[i]
+	}
+
+	var options []TemplateOption
+	for _, option := range t.Options {
+		expanded := TemplateOption{Keyword: option.Keyword}
+		for _, value := range option.Values {
+			expanded.Values = append(expanded.Values, placeholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+				return values[strings.Trim(placeholder, "{}")]
+			}))
+		}
+		options = append(options, expanded)
+	}
+	return options, nil
+}
+
+// AddOptions adds options, as returned by HostTemplate.Expand, to the
+// block. Values are written as the template gives them, so those of options
+// such as ProxyCommand or LocalForward that take several words keep them.
+func (b *HostBlock) AddOptions(options []TemplateOption) {
+	for _, option := range options {
+		for _, value := range option.Values {
+			b.addOption(option.Keyword, value)
+		}
+	}
+}
+
+// Usage returns the template's arguments as they follow the host name on
+// the command line.
+func (t HostTemplate) Usage() string {
+	var args []string
+	for _, arg := range t.Args {
+		args = append(args, "<"+arg+">")
+	}
+	return strings.Join(args, " ")
+}
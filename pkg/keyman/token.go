@@ -0,0 +1,90 @@
+package keyman
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of hardware-backed key, as Key.Token holds them.
+const (
+	TokenPKCS11 = "pkcs11"
+	TokenFIDO   = "fido"
+)
+
+// ParsePKCS11Keys reads the public keys ssh-keygen -D prints for the
+// PKCS#11 library provider. Each is named after its label on the token, or
+// after the library and its position when the token gives it none.
+func ParsePKCS11Keys(provider string, output []byte) []Key {
+	library := strings.TrimSuffix(filepath.Base(provider), filepath.Ext(provider))
+	var keys []Key
+	for _, line := range strings.Split(string(output), "\n") {
+		pub, err := ParsePublicKey(line)
+		if err != nil {
+			continue
+		}
+		name := pub.Comment
+		if name == "" {
+			name = fmt.Sprintf("%s#%d", library, len(keys)+1)
+		}
+		keys = append(keys, Key{
+			Name:     TokenPKCS11 + ":" + name,
+			Comment:  pub.Comment,
+			Public:   pub,
+			Token:    TokenPKCS11,
+			Provider: provider,
+		})
+	}
+	return keys
+}
+
+// FIDOKey returns a security key that is on a FIDO token but not in the
+// ssh directory, such as a resident key loaded with ssh-add -K, named
+// after the application it was made for.
+func FIDOKey(pub *PublicKey) Key {
+	return Key{
+		Name:    TokenFIDO + ":" + pub.Application(),
+		Comment: pub.Comment,
+		Public:  pub,
+		Token:   TokenFIDO,
+	}
+}
+
+// PKCS11Providers returns the PKCS#11 libraries the config's
+// PKCS11Provider options name, each once.
+func (c *Config) PKCS11Providers() []string {
+	var providers []string
+	for _, block := range c.AllBlocks() {
+		for _, provider := range block.Options("PKCS11Provider") {
+			if !strings.EqualFold(provider, "none") && !containsString(providers, provider) {
+				providers = append(providers, provider)
+			}
+		}
+	}
+	return providers
+}
+
+// ProviderHosts returns the Host blocks whose PKCS11Provider is the
+// library provider, comparing paths after expanding ~.
+func (c *Config) ProviderHosts(provider string) []string {
+	var hosts []string
+	for _, block := range c.AllBlocks() {
+		if !block.Match && sameProvider(block.Option("PKCS11Provider"), provider) {
+			hosts = append(hosts, block.Name())
+		}
+	}
+	return hosts
+}
+
+func sameProvider(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if expanded, err := ExpandPath(a); err == nil {
+		a = expanded
+	}
+	if expanded, err := ExpandPath(b); err == nil {
+		b = expanded
+	}
+	return filepath.Clean(a) == filepath.Clean(b)
+}
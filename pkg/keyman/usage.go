@@ -0,0 +1,110 @@
+package keyman
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+)
+
+// KeyUse is a successful public key login.
+type KeyUse struct {
+	KeyPath string
+	Host    string
+	Time    time.Time
+}
+
+// RecordUse notes that the named key logged in to host at when, unless a
+// later use is already recorded. It reports whether anything changed.
+func (m *Metadata) RecordUse(name, host string, when time.Time) bool {
+	meta := m.Get(name)
+	if meta.LastUsed != nil && !when.After(*meta.LastUsed) {
+		return false
+	}
+	meta.LastUsed = &when
+	meta.LastUsedHost = host
+	return true
+}
+
+// ParseSSHLog finds public key logins in ssh client debug output, as written
+// by ssh -v or ssh -E file -o LogLevel=DEBUG1. Lines that start with a
+// syslog or ISO 8601 timestamp are dated by it; other lines get fallback.
+func ParseSSHLog(r io.Reader, fallback time.Time) ([]KeyUse, error) {
+	var uses []KeyUse
+	var offered, accepted string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		when, line := splitLogTime(scanner.Text(), fallback)
+
+		switch {
+		case strings.Contains(line, "Connecting to "):
+			offered, accepted = "", ""
+		case strings.Contains(line, "Offering public key: "):
+			offered = logKeyPath(line[strings.Index(line, "Offering public key: "):])
+		case strings.Contains(line, "Server accepts key: "):
+			// Older clients only name the algorithm here, so fall back to
+			// the key that was offered last.
+			accepted = logKeyPath(line[strings.Index(line, "Server accepts key: "):])
+			if accepted == "" {
+				accepted = offered
+			}
+		case strings.Contains(line, "Authenticated to "):
+			rest := line[strings.Index(line, "Authenticated to ")+len("Authenticated to "):]
+			if accepted == "" || (strings.Contains(rest, " using ") && !strings.Contains(rest, `"publickey"`)) {
+				continue
+			}
+			host, _, _ := strings.Cut(rest, " ")
+			uses = append(uses, KeyUse{KeyPath: accepted, Host: host, Time: when})
+			offered, accepted = "", ""
+		}
+	}
+	return uses, scanner.Err()
+}
+
+// logKeyPath returns the first field of a log message that looks like a
+// file path.
+func logKeyPath(message string) string {
+	for _, field := range strings.Fields(message) {
+		if strings.ContainsAny(field, `/\`) && !strings.HasPrefix(field, "SHA256:") {
+			return field
+		}
+	}
+	return ""
+}
+
+var logTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05",
+	time.Stamp,
+}
+
+// splitLogTime strips a leading timestamp from a log line.
+func splitLogTime(line string, fallback time.Time) (time.Time, string) {
+	for _, layout := range logTimeLayouts {
+		if len(line) < len(layout) {
+			continue
+		}
+		n := len(layout)
+		if layout == time.RFC3339Nano {
+			n = strings.IndexByte(line, ' ')
+			if n < 0 {
+				continue
+			}
+		}
+		when, err := time.ParseInLocation(layout, line[:n], time.Local)
+		if err != nil {
+			continue
+		}
+		if layout == time.Stamp {
+			// Syslog leaves out the year; assume the latest one that does
+			// not put the line in the future.
+			when = when.AddDate(fallback.Year(), 0, 0)
+			if when.After(fallback) {
+				when = when.AddDate(-1, 0, 0)
+			}
+		}
+		return when, line[n:]
+	}
+	return fallback, line
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// setEcho turns echoing of typed characters on the terminal on or off.
+func setEcho(on bool) {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
+
+// makeRaw puts the terminal in raw mode so keys can be read one at a time,
+// returning a function that restores the previous mode.
+func makeRaw() (func(), error) {
+	save := exec.Command("stty", "-g")
+	save.Stdin = os.Stdin
+	state, err := save.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := exec.Command("stty", "raw", "-echo")
+	raw.Stdin = os.Stdin
+	if err := raw.Run(); err != nil {
+		return nil, err
+	}
+	return func() {
+		restore := exec.Command("stty", strings.TrimSpace(string(state)))
+		restore.Stdin = os.Stdin
+		restore.Run()
+	}, nil
+}
+
+// agentAvailable reports whether ssh-add can reach an agent.
+func agentAvailable() bool {
+	return os.Getenv("SSH_AUTH_SOCK") != ""
+}
+
+// toolPath finds an external command.
+func toolPath(name string) string {
+	return name
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	enableProcessedInput            = 0x0001
+	enableLineInput                 = 0x0002
+	enableEchoInput                 = 0x0004
+	enableVirtualTerminalInput      = 0x0200
+	enableVirtualTerminalProcessing = 0x0004
+)
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// setEcho turns echoing of typed characters on the console on or off.
+func setEcho(on bool) {
+	handle := syscall.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(handle, &mode); err != nil {
+		return
+	}
+	if on {
+		mode |= enableEchoInput
+	} else {
+		mode &^= enableEchoInput
+	}
+	procSetConsoleMode.Call(uintptr(handle), uintptr(mode))
+}
+
+// makeRaw puts the console in raw mode so keys can be read one at a time,
+// with arrow keys and output escape sequences handled as on a terminal. It
+// returns a function that restores the previous modes.
+func makeRaw() (func(), error) {
+	in := syscall.Handle(os.Stdin.Fd())
+	out := syscall.Handle(os.Stderr.Fd())
+	var inMode, outMode uint32
+	if err := syscall.GetConsoleMode(in, &inMode); err != nil {
+		return nil, err
+	}
+	if err := syscall.GetConsoleMode(out, &outMode); err != nil {
+		return nil, err
+	}
+
+	raw := inMode&^(enableEchoInput|enableLineInput|enableProcessedInput) | enableVirtualTerminalInput
+	procSetConsoleMode.Call(uintptr(in), uintptr(raw))
+	procSetConsoleMode.Call(uintptr(out), uintptr(outMode|enableVirtualTerminalProcessing))
+	return func() {
+		procSetConsoleMode.Call(uintptr(in), uintptr(inMode))
+		procSetConsoleMode.Call(uintptr(out), uintptr(outMode))
+	}, nil
+}
+
+// agentAvailable reports whether ssh-add can reach an agent. The Windows
+// OpenSSH agent listens on a fixed named pipe, so SSH_AUTH_SOCK is only
+// needed for other agents.
+func agentAvailable() bool {
+	return true
+}
+
+// toolPath finds an external command, falling back to the OpenSSH client
+// that ships with Windows when it is not on PATH.
+func toolPath(name string) string {
+	if _, err := exec.LookPath(name); err == nil {
+		return name
+	}
+	bundled := filepath.Join(os.Getenv("SystemRoot"), "System32", "OpenSSH", name+".exe")
+	if _, err := os.Stat(bundled); err == nil {
+		return bundled
+	}
+	return name
+}
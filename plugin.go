@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// plugin is an installed keyman-<name> program and what it says it can do.
+type plugin struct {
+	name string
+	path string
+	info keyman.PluginInfo
+}
+
+// pluginView is a plugin as plugins --json shows it.
+type pluginView struct {
+	Name         string   `json:"name"`
+	Path         string   `json:"path"`
+	Provider     string   `json:"provider,omitempty"`
+	Description  string   `json:"description,omitempty"`
+	Capabilities []string `json:"capabilities"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// pluginDirs are where plugins are looked for: keyman's own plugins
+// directory, then each directory on PATH.
+func pluginDirs() []string {
+	var dirs []string
+	if configDir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(configDir, "keyman", "plugins"))
+	}
+	return append(dirs, filepath.SplitList(os.Getenv("PATH"))...)
+}
+
+// findPlugin finds the plugin called name and asks what it can do. It
+// returns nil when no such plugin is installed.
+func findPlugin(name string) (*plugin, error) {
+	path := keyman.FindPlugins(pluginDirs())[name]
+	if path == "" {
+		return nil, nil
+	}
+	p := &plugin{name: name, path: path}
+	if err := p.call(keyman.PluginDescribe, nil, &p.info); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func sortedPluginNames() []string {
+	var names []string
+	for name := range keyman.FindPlugins(pluginDirs()) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// call runs the plugin with a request for method and decodes the result
+// into result, unless it is nil.
+func (p *plugin) call(method string, params, result interface{}) error {
+	request, err := json.Marshal(keyman.PluginRequest{Protocol: keyman.PluginProtocol, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(p.path)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stderr = os.Stderr
+	output, runErr := cmd.Output()
+
+	var response keyman.PluginResponse
+	if err := json.Unmarshal(output, &response); err != nil {
+		if runErr != nil {
+			return fmt.Errorf("plugin %s: %s: %v", p.name, method, runErr)
+		}
+		return fmt.Errorf("plugin %s: %s: invalid response: %v", p.name, method, err)
+	}
+	if response.Error != "" {
+		return fmt.Errorf("plugin %s: %s: %s", p.name, method, response.Error)
+	}
+	if runErr != nil {
+		return fmt.Errorf("plugin %s: %s: %v", p.name, method, runErr)
+	}
+	if result != nil && len(response.Result) > 0 {
+		if err := json.Unmarshal(response.Result, result); err != nil {
+			return fmt.Errorf("plugin %s: %s: invalid result: %v", p.name, method, err)
+		}
+	}
+	return nil
+}
+
+// listPlugins shows the installed plugins and what each adds.
+func listPlugins(args []string) {
+	flags := flag.NewFlagSet("plugins", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the plugins as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman plugins [--json] [--plain]")
+	}
+
+	paths := keyman.FindPlugins(pluginDirs())
+	views := []pluginView{}
+	for _, name := range sortedPluginNames() {
+		view := pluginView{Name: name, Path: paths[name], Capabilities: []string{}}
+		p, err := findPlugin(name)
+		if err != nil {
+			view.Error = err.Error()
+		} else {
+			view.Provider = p.info.Name
+			view.Description = p.info.Description
+			if p.info.Capabilities != nil {
+				view.Capabilities = p.info.Capabilities
+			}
+		}
+		views = append(views, view)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(views); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if len(views) == 0 {
+		fmt.Printf("No plugins: install keyman-<name> programs on PATH or in %s\n", pluginDirs()[0])
+		return
+	}
+	var rows [][]tableCell
+	for _, view := range views {
+		about := tableCell{text: view.Description}
+		if view.Error != "" {
+			about = tableCell{text: view.Error, color: colorRed}
+		}
+		rows = append(rows, []tableCell{
+			{text: view.Name},
+			{text: view.Provider},
+			{text: strings.Join(view.Capabilities, ", ")},
+			about,
+			{text: view.Path},
+		})
+	}
+	writeTable(os.Stdout, []string{"name", "provider", "capabilities", "description", "path"}, rows, useColor(*plain))
+}
+
+// runPluginCommand runs keyman <name> for a plugin that keeps keys, as
+// push, list and audit like the built-in forges. It reports false when no
+// plugin is called name.
+func runPluginCommand(name string, args []string) bool {
+	p, err := findPlugin(name)
+	if err != nil {
+		fatal(err)
+	}
+	if p == nil {
+		return false
+	}
+	if !p.info.Can(keyman.CapabilityKeys) {
+		fatalf("Plugin %s is not a command, it adds: %s", name, strings.Join(p.info.Capabilities, ", "))
+	}
+	forgeProviders[name] = forgeProvider{
+		expires: p.info.Can(keyman.CapabilityKeyExpiry),
+		open:    func(string) forge { return pluginForge{p: p} },
+	}
+	forgeCommand(name, args)
+	return true
+}
+
+// pluginForge is a plugin with the keys capability, taking the part of a
+// forge.
+type pluginForge struct {
+	p *plugin
+}
+
+func (f pluginForge) name() string { return orDefault(f.p.info.Name, f.p.name) }
+
+func (f pluginForge) host() string { return f.p.name }
+
+func (f pluginForge) listKeys() ([]remoteKey, error) {
+	var result struct {
+		Keys []keyman.PluginKey `json:"keys"`
+	}
+	if err := f.p.call(keyman.PluginListKeys, nil, &result); err != nil {
+		return nil, err
+	}
+	var keys []remoteKey
+	for _, key := range result.Keys {
+		keys = append(keys, pluginRemoteKey(key))
+	}
+	return keys, nil
+}
+
+func (f pluginForge) addKey(title, key string, expires *time.Time) (remoteKey, error) {
+	var result struct {
+		Key keyman.PluginKey `json:"key"`
+	}
+	params := keyman.PluginAddKeyParams{Title: title, Key: key, ExpiresAt: expires}
+	err := f.p.call(keyman.PluginAddKey, params, &result)
+	return pluginRemoteKey(result.Key), err
+}
+
+func pluginRemoteKey(key keyman.PluginKey) remoteKey {
+	remote := remoteKey{ID: keyID(key.ID), Title: key.Title, Key: key.Key, ExpiresAt: key.ExpiresAt}
+	if key.CreatedAt != nil {
+		remote.CreatedAt = *key.CreatedAt
+	}
+	return remote
+}
+
+// pluginAuditFindings runs the checks of the plugins listed in the
+// audit.plugins setting on keys. A plugin that is missing, cannot audit or
+// fails is warned about and skipped.
+func pluginAuditFindings(keys []keyman.Key) []keyman.Finding {
+	var plugins []*plugin
+	for _, name := range settings.AuditPlugins {
+		p, err := findPlugin(name)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		case p == nil:
+			fmt.Fprintf(os.Stderr, "Warning: audit plugin %s is not installed\n", name)
+		case !p.info.Can(keyman.CapabilityAudit):
+			fmt.Fprintf(os.Stderr, "Warning: plugin %s has no audit capability\n", name)
+		default:
+			plugins = append(plugins, p)
+		}
+	}
+	if len(plugins) == 0 {
+		return nil
+	}
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+	configPath, err := getConfigPath()
+	if err != nil {
+		fatal(err)
+	}
+	keyList, err := json.Marshal(keysJSON(keys))
+	if err != nil {
+		fatal(err)
+	}
+	params := keyman.PluginAuditParams{SSHDir: sshPath, ConfigPath: configPath, Keys: keyList}
+
+	var findings []keyman.Finding
+	for _, p := range plugins {
+		var result struct {
+			Findings []keyman.PluginFinding `json:"findings"`
+		}
+		if err := p.call(keyman.PluginAudit, params, &result); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+		for _, reported := range result.Findings {
+			finding, err := reported.Finding(p.name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: plugin %s: %v\n", p.name, err)
+				continue
+			}
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const profilesFile = "profiles.yaml"
+
+var (
+	// activeProfile is the profile selected with --profile, KEYMAN_PROFILE
+	// or the profiles file's default, if any.
+	activeProfile string
+
+	// configPathOverride and knownHostsPath come from the active profile.
+	configPathOverride string
+	knownHostsPath     string
+)
+
+func getProfilesPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "keyman", profilesFile), nil
+}
+
+func loadProfiles() (*keyman.Profiles, error) {
+	path, err := getProfilesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return keyman.LoadProfiles(path)
+}
+
+// useProfile switches keyman to the named profile, or to the default
+// profile when name is empty and one is set.
+func useProfile(name string) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		fatal(err)
+	}
+
+	if name == "" {
+		name = profiles.Default
+		if name == "" {
+			return
+		}
+	}
+	profile := profiles.Profiles[name]
+	if profile == nil {
+		fatalf("Profile %s not found, see keyman profiles", name)
+	}
+	activeProfile = name
+
+	// Expand every path before setSSHPath can change what ~ means.
+	if profile.Config != "" {
+		configPathOverride, err = keyman.ExpandPath(profile.Config)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if profile.KnownHosts != "" {
+		knownHostsPath, err = keyman.ExpandPath(profile.KnownHosts)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if profile.SSHDir != "" {
+		setSSHPath(profile.SSHDir)
+	}
+}
+
+// sshClientArgs returns the ssh arguments that make it use the same config
+// and known_hosts files keyman is working on.
+func sshClientArgs() ([]string, error) {
+	var args []string
+	if sshPathOverride != "" || configPathOverride != "" {
+		configPath, err := getConfigPath()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(configPath); err == nil {
+			args = append(args, "-F", configPath)
+		}
+	}
+	if knownHostsPath != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+knownHostsPath)
+	}
+	return args, nil
+}
+
+func listProfiles() {
+	profiles, err := loadProfiles()
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(profiles.Profiles) == 0 {
+		path, _ := getProfilesPath()
+		fmt.Printf("No profiles defined in %s\n", path)
+		return
+	}
+
+	for _, name := range profiles.Names() {
+		profile := profiles.Profiles[name]
+		marker := ""
+		if name == activeProfile {
+			marker = " (active)"
+		}
+		fmt.Printf("Profile: %s%s\n", name, marker)
+		if profile.SSHDir != "" {
+			fmt.Printf("SSH Directory: %s\n", profile.SSHDir)
+		}
+		if profile.Config != "" {
+			fmt.Printf("Config: %s\n", profile.Config)
+		}
+		if profile.KnownHosts != "" {
+			fmt.Printf("Known Hosts: %s\n", profile.KnownHosts)
+		}
+		fmt.Println()
+	}
+}
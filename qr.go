@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/qrcode"
+)
+
+// quietZone is the light border, in modules, scanners expect around a code.
+const quietZone = 4
+
+// showQR prints a key's public key line as a QR code made of half blocks,
+// two rows of modules per line of text.
+func showQR(args []string) {
+	flags := flag.NewFlagSet("qr", flag.ExitOnError)
+	invert := flags.Bool("invert", false, "draw dark modules as blocks, for terminals with a light background")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman qr [--invert] <key>")
+	}
+
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(args[0], keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	pubKey, err := readPublicKey(keyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	code, err := qrcode.Encode([]byte(pubKey), qrcode.Medium)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Terminals are usually dark, so light modules are drawn as blocks
+	// unless --invert is given.
+	filled := func(x, y int) bool {
+		return code.Black(x, y) == *invert
+	}
+
+	var out strings.Builder
+	for y := -quietZone; y < code.Size+quietZone; y += 2 {
+		for x := -quietZone; x < code.Size+quietZone; x++ {
+			top, bottom := filled(x, y), filled(x, y+1)
+			switch {
+			case top && bottom:
+				out.WriteString("█")
+			case top:
+				out.WriteString("▀")
+			case bottom:
+				out.WriteString("▄")
+			default:
+				out.WriteString(" ")
+			}
+		}
+		out.WriteString("\n")
+	}
+	fmt.Print(out.String())
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// installKeyScript appends the public key read from stdin to the remote
+// authorized_keys unless an identical line is already present.
+const installKeyScript = `umask 077; mkdir -p ~/.ssh && k=$(cat) && touch ~/.ssh/authorized_keys && ` +
+	`(grep -qxF "$k" ~/.ssh/authorized_keys || printf '%s\n' "$k" >> ~/.ssh/authorized_keys)`
+
+func copyID(args []string) {
+	flags := flag.NewFlagSet("copy-id", flag.ExitOnError)
+	alias := flags.String("alias", "", "create or update a Host block with this name for the target")
+	identity := flags.String("i", "", "identity to authenticate with while copying")
+	args = parseFlags(flags, args)
+	if len(args) < 2 {
+		fatalUsage("Usage: keyman copy-id [--alias name] [-i identity] <key> <user@host>")
+	}
+	key, target := args[0], args[1]
+
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(key, keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	pubKey, err := readPublicKey(keyPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	var sshArgs []string
+	if *identity != "" {
+		identityPath, err := getFullKeyPath(*identity)
+		if err != nil {
+			fatal(err)
+		}
+		sshArgs = append(sshArgs, "-i", identityPath)
+	}
+
+	err = installRemoteKey(target, pubKey, sshArgs...)
+	if err != nil {
+		fatalf("Copying key to %s: %v", target, err)
+	}
+	fmt.Printf("Installed key %s on %s\n", key, target)
+
+	if *alias == "" {
+		return
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	block := config.FindHost(*alias)
+	if block == nil {
+		block = config.AppendHost(*alias)
+	}
+
+	user, host := splitTarget(target)
+	block.SetOption("HostName", host)
+	if user != "" {
+		block.SetOption("User", user)
+	}
+	if !containsPath(block.Options("IdentityFile"), keyPath) {
+		block.AddOption("IdentityFile", keyPath)
+	}
+
+	err = saveConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("copy-id", target, "", keyFingerprint(keyPath))
+	fmt.Printf("Mapped key %s to host %s\n", key, *alias)
+}
+
+// readPublicKey returns the single-line public key for the private key at
+// keyPath.
+func readPublicKey(keyPath string) (string, error) {
+	content, err := os.ReadFile(keyPath + keyFileExt)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// installRemoteKey appends pubKey to authorized_keys on target over ssh.
+func installRemoteKey(target, pubKey string, sshArgs ...string) error {
+	return runRemote(target, installKeyScript, pubKey, sshArgs...)
+}
+
+// removeRemoteKey removes pubKey from authorized_keys on target and returns
+// how many lines it removed. A dry run removes none.
+func removeRemoteKey(target, pubKey string, sshArgs ...string) (int, error) {
+	if dryRun {
+		fmt.Printf("Would remove the key from authorized_keys on %s\n", target)
+		return 0, nil
+	}
+
+	cmd, err := remoteCommand(target, removeKeyScript, pubKey, sshArgs...)
+	if err != nil {
+		return 0, err
+	}
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+	return parseRemovedCount(output)
+}
+
+// parseRemovedCount reads the count removeKeyScript prints last.
+func parseRemovedCount(output []byte) (int, error) {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	removed, err := strconv.Atoi(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output from the remote host: %q", strings.TrimSpace(string(output)))
+	}
+	return removed, nil
+}
+
+// runRemote runs script on target with input on its stdin.
+func runRemote(target, script, input string, sshArgs ...string) error {
+	if dryRun {
+		fmt.Printf("Would run on %s: %s\n", target, script)
+		return nil
+	}
+
+	cmd, err := remoteCommand(target, script, input, sshArgs...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// remoteCommand returns the ssh command that runs script on target with
+// input on its stdin. target comes after --, so one from a hosts file or
+// inventory is never taken for an ssh option. The script is handed to sh
+// -c, as the remote user's login shell, which runs the command ssh sends,
+// may be fish or csh.
+func remoteCommand(target, script, input string, sshArgs ...string) (*exec.Cmd, error) {
+	args, err := sshClientArgs()
+	if err != nil {
+		return nil, err
+	}
+	args = append(append(args, sshArgs...), "--", target, "sh -c "+shellQuote(script))
+	cmd := exec.Command(toolPath("ssh"), args...)
+	cmd.Stdin = strings.NewReader(input + "\n")
+	return cmd, nil
+}
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// revokeRemoteKey removes the public key from authorized_keys on every host
+// the key is mapped to, logging in with the key itself.
+func revokeRemoteKey(keyPath string) error {
+	pubKey, err := readPublicKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	for _, block := range mappedHosts(config, keyPath) {
+		host := block.Patterns[0]
+		removed, err := removeRemoteKey(host, pubKey, identityArgs(keyPath)...)
+		if err != nil {
+			return fmt.Errorf("removing key from %s: %w", host, err)
+		}
+		if dryRun {
+			continue
+		}
+		if removed == 0 {
+			fmt.Fprintf(os.Stderr, "Warning: the key was not in authorized_keys on %s\n", host)
+			continue
+		}
+		fmt.Printf("Removed key from %s, %d line(s)\n", host, removed)
+	}
+	return nil
+}
+
+// removeAgentKey unloads the key with the given public key file from the
+// running ssh-agent.
+func removeAgentKey(pubPath string) error {
+	if !agentAvailable() {
+		return fmt.Errorf("no ssh-agent is running")
+	}
+
+	cmd := exec.Command(toolPath("ssh-add"), "-d", pubPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// splitTarget splits user@host into its parts; user is empty if absent.
+func splitTarget(target string) (string, string) {
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return "", target
+}
+
+// containsPath reports whether any of paths refers to path once expanded.
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		expanded, err := keyman.ExpandPath(p)
+		if err == nil && expanded == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// renameKey renames a key pair and rewrites every IdentityFile that points
+// at it, keeping each reference's directory spelling (such as ~/.ssh).
+func renameKey(oldKey, newKey string) {
+	oldPath, err := getFullKeyPath(strings.TrimSuffix(oldKey, keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	newPath := filepath.Join(filepath.Dir(oldPath), filepath.Base(strings.TrimSuffix(newKey, keyFileExt)))
+	if filepath.IsAbs(newKey) {
+		newPath = strings.TrimSuffix(newKey, keyFileExt)
+	}
+
+	if _, err := os.Stat(oldPath); err != nil {
+		fatalf("Key %s not found", oldKey)
+	}
+	for _, suffix := range []string{"", keyFileExt, certFileSuffix} {
+		if _, err := os.Stat(newPath + suffix); err == nil {
+			fatalf("%s already exists", newPath+suffix)
+		}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	references := 0
+	for _, block := range config.AllBlocks() {
+		for _, value := range block.Options("IdentityFile") {
+			if !containsPath([]string{value}, oldPath) {
+				continue
+			}
+			renamed := filepath.Join(filepath.Dir(value), filepath.Base(newPath))
+			if filepath.Dir(value) == "." {
+				renamed = filepath.Base(newPath)
+			}
+			block.ReplaceOption("IdentityFile", func(v string) bool { return v == value }, renamed)
+			references++
+		}
+	}
+
+	for _, suffix := range []string{"", keyFileExt, certFileSuffix} {
+		err := renameFile(oldPath+suffix, newPath+suffix)
+		if err != nil && !(suffix != "" && os.IsNotExist(err)) {
+			fatal(err)
+		}
+	}
+
+	err = saveConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+	if dryRun {
+		return
+	}
+	journal("rename", filepath.Base(oldPath), oldPath, newPath)
+
+	metadata, err := loadMetadata()
+	if err != nil {
+		fatal(err)
+	}
+	if meta, ok := metadata.Keys[filepath.Base(oldPath)]; ok {
+		delete(metadata.Keys, filepath.Base(oldPath))
+		metadata.Keys[filepath.Base(newPath)] = meta
+		err = metadata.Save()
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	fmt.Printf("Renamed key %s to %s and updated %d config reference(s)\n", filepath.Base(oldPath), filepath.Base(newPath), references)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// removeKeyScript deletes the lines of the remote authorized_keys with the
+// key type and base64 of the public key read from stdin, whatever options
+// or comment they have, and prints how many it deleted. The file is only
+// rewritten once awk has read all of it, and left alone if it failed.
+const removeKeyScript = `umask 077; set -f; k=$(cat) && set -- $k && f=~/.ssh/authorized_keys && t="$f.keyman" && ` +
+	`if [ ! -f "$f" ]; then echo 0; exit 0; fi && : > "$t" && ` +
+	`n=$(awk -v type="$1" -v blob="$2" -v out="$t" '` +
+	`/^[ \t]*#/ { print > out; next } ` +
+	`{ for (i = 1; i < NF; i++) if ($i == type && $(i + 1) == blob) { removed++; next }; print > out } ` +
+	`END { print removed + 0 }' "$f") && ` +
+	`{ [ "$n" -eq 0 ] || cat "$t" > "$f"; } && rm -f "$t" && echo "$n" || { rm -f "$t"; exit 1; }`
+
+// rotateKey replaces a key with a freshly generated one on every host it is
+// mapped to, then retires the old key once the new one is known to work.
+func rotateKey(args []string) {
+	flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+	name := flags.String("name", "", "name for the replacement key (default <key>_<timestamp>)")
+	passphraseFile := flags.String("passphrase-file", "", "read the new key's passphrase from a file, or - for stdin")
+	keepOld := flags.Bool("keep-old", false, "keep the old key pair and its remote authorized_keys entries")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman rotate [--name n] [--passphrase-file f] [--keep-old] <key>")
+	}
+
+	oldPath, err := getFullKeyPath(args[0])
+	if err != nil {
+		fatal(err)
+	}
+
+	oldPubKey, err := readPublicKey(oldPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	hosts := mappedHosts(config, oldPath)
+
+	// Blocks for host patterns and Match blocks name no host to deploy the
+	// new key to, so they keep the old key, and so must its files.
+	var kept []string
+	for _, block := range config.AllBlocks() {
+		if containsPath(block.Options("IdentityFile"), oldPath) && (block.Match || strings.ContainsAny(block.Patterns[0], "*?!")) {
+			kept = append(kept, block.Name())
+		}
+	}
+	if len(hosts) == 0 && len(kept) > 0 {
+		fatalf("%s is only mapped to %s, which name no single host to deploy a new key to", filepath.Base(oldPath), strings.Join(kept, ", "))
+	}
+
+	fields := strings.Fields(oldPubKey)
+	spec := keySpec{
+		keyType: sshKeyType(fields[0]),
+		name:    *name,
+	}
+	// The new key is the same size as the old one, as ssh-keygen would
+	// otherwise give an RSA or ECDSA key its default size.
+	if pub, err := keyman.ParsePublicKey(oldPubKey); err == nil && !pub.IsSecurityKey() && spec.keyType != "ed25519" {
+		spec.bits = pub.Bits()
+	}
+	if len(fields) > 2 {
+		spec.comment = strings.Join(fields[2:], " ")
+	}
+	if spec.name == "" {
+		spec.name = fmt.Sprintf("%s_%d", filepath.Base(oldPath), time.Now().Unix())
+	}
+	if *passphraseFile != "" {
+		passphrase, err := readPassphraseFile(*passphraseFile)
+		if err != nil {
+			fatal(err)
+		}
+		spec.passphrase = &passphrase
+	}
+
+	newPath, err := getFullKeyPath(spec.name)
+	if err != nil {
+		fatal(err)
+	}
+	hook := hookContext{Key: oldPath, NewKey: newPath}
+	for _, block := range hosts {
+		hook.Hosts = append(hook.Hosts, block.Patterns[0])
+	}
+	runHooks("pre", "rotate", hook)
+
+	newPath, err = createKey(spec)
+	if err != nil {
+		fatal(err)
+	}
+
+	newPubKey := ""
+	if !dryRun {
+		newPubKey, err = readPublicKey(newPath)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	newKeyArgs := make(map[string][]string)
+	for _, block := range hosts {
+		host := block.Patterns[0]
+		fmt.Printf("Deploying %s to %s\n", spec.name, host)
+		err = installRemoteKey(host, newPubKey, identityArgs(oldPath)...)
+		if err != nil {
+			fatalf("Deploying to %s failed, config left unchanged: %v", host, err)
+		}
+
+		newKeyArgs[host], err = onlyIdentityArgs(host, newPath)
+		if err != nil {
+			fatalf("Checking the new key on %s failed, config left unchanged: %v", host, err)
+		}
+		err = runRemote(host, "true", "", newKeyArgs[host]...)
+		if err != nil {
+			fatalf("New key was rejected by %s, config left unchanged: %v", host, err)
+		}
+		recordKeyUse(newPath, host)
+	}
+
+	for _, block := range hosts {
+		block.ReplaceOption("IdentityFile", func(value string) bool {
+			return containsPath([]string{value}, oldPath)
+		}, newPath)
+	}
+
+	err = saveConfig(config)
+	if err != nil {
+		fatal(err)
+	}
+
+	journal("rotate", filepath.Base(oldPath), oldPath, newPath)
+	if !dryRun {
+		fmt.Printf("Rotated %s to %s on %d host(s)\n", filepath.Base(oldPath), spec.name, len(hosts))
+	}
+
+	if len(kept) > 0 && !*keepOld {
+		fmt.Printf("Keeping %s, it is still mapped to %s\n", filepath.Base(oldPath), strings.Join(kept, ", "))
+	}
+	if !*keepOld && len(kept) == 0 {
+		for _, block := range hosts {
+			host := block.Patterns[0]
+			removed, err := removeRemoteKey(host, oldPubKey, newKeyArgs[host]...)
+			if err != nil {
+				fmt.Printf("Could not remove the old key from %s: %v\n", host, err)
+			} else if removed == 0 && !dryRun {
+				fmt.Fprintf(os.Stderr, "Warning: the old key was not in authorized_keys on %s\n", host)
+			}
+		}
+
+		deleteKey(oldPath, deleteOptions{})
+	}
+	runHooks("post", "rotate", hook)
+}
+
+// mappedHosts returns the Host blocks that use keyPath and name a single host
+// that can be connected to.
+func mappedHosts(config *keyman.Config, keyPath string) []*keyman.HostBlock {
+	var hosts []*keyman.HostBlock
+	for _, block := range config.AllBlocks() {
+		if block.Match || !containsPath(block.Options("IdentityFile"), keyPath) {
+			continue
+		}
+		if strings.ContainsAny(block.Patterns[0], "*?!") {
+			fmt.Printf("Skipping host pattern %s, it does not name a single host\n", block.Name())
+			continue
+		}
+		hosts = append(hosts, block)
+	}
+	return hosts
+}
+
+// identityArgs returns ssh arguments that authenticate with only keyPath.
+func identityArgs(keyPath string) []string {
+	return []string{"-i", keyPath, "-o", "IdentitiesOnly=yes"}
+}
+
+// onlyIdentityArgs returns ssh arguments that log in to host with keyPath
+// and nothing else, not even a password. identityArgs
+// alone is not enough to prove a key works, as ssh still offers the
+// IdentityFiles the config gives the host, so the config is left out with
+// -F none and the settings that say where to connect and as whom are
+// passed from ssh -G instead. Jump hosts are still reached with the config,
+// as only the last hop has to accept the key.
+func onlyIdentityArgs(host, keyPath string) ([]string, error) {
+	resolved, err := resolveHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-F", "none"}
+	for _, option := range []string{"hostname", "user", "port", "hostkeyalias", "userknownhostsfile", "globalknownhostsfile", "proxycommand"} {
+		if value := first(resolved[option]); value != "" && value != "none" {
+			args = append(args, "-o", option+"="+value)
+		}
+	}
+	if jump := first(resolved["proxyjump"]); jump != "" && jump != "none" {
+		command := "ssh"
+		configPath, err := getConfigPath()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(configPath); err == nil {
+			command += " -F " + shellQuote(configPath)
+		}
+		hops := strings.Split(jump, ",")
+		if len(hops) > 1 {
+			command += " -J " + shellQuote(strings.Join(hops[:len(hops)-1], ","))
+		}
+		command += " -W '[%h]:%p' -- " + shellQuote(hops[len(hops)-1])
+		args = append(args, "-o", "ProxyCommand="+command)
+	}
+	args = append(args, "-o", "PasswordAuthentication=no", "-o", "KbdInteractiveAuthentication=no")
+	return append(args, identityArgs(keyPath)...), nil
+}
+
+// sshKeyType maps a public key algorithm name to an ssh-keygen -t value.
+func sshKeyType(algorithm string) string {
+	switch {
+	case algorithm == "ssh-rsa":
+		return "rsa"
+	case algorithm == "ssh-dss":
+		return "dsa"
+	case strings.HasPrefix(algorithm, "ecdsa-"):
+		return "ecdsa"
+	case strings.HasPrefix(algorithm, "sk-ecdsa-"):
+		return "ecdsa-sk"
+	case strings.HasPrefix(algorithm, "sk-ssh-ed25519"):
+		return "ed25519-sk"
+	default:
+		return "ed25519"
+	}
+}
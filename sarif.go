@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+// ruleDescriptions describe every rule a finding can come from, for the
+// rule list of a SARIF log.
+var ruleDescriptions = map[string]string{
+	keyman.RuleMaxKeyAge:          "Key is older than the policy allows",
+	keyman.RuleForbiddenTypes:     "Key type or size is forbidden by policy",
+	keyman.RuleRequirePassphrase:  "Private key is not protected by a passphrase",
+	keyman.RuleRequireComment:     "Key has no comment",
+	keyman.RuleWeakAlgorithm:      "Key uses a weak algorithm or key size",
+	keyman.RuleHostKeyChanged:     "Host key in known_hosts differs from the recorded one",
+	keyman.RuleSSHDRootLogin:      "sshd lets root log in",
+	keyman.RuleSSHDPasswords:      "sshd accepts passwords",
+	keyman.RuleSSHDWeakAlgorithms: "sshd allows obsolete ciphers, MACs or key exchanges",
+	keyman.RuleSSHDAuthorizedKeys: "sshd reads authorized_keys files unsafely",
+	ruleIncompletePair:            "Key is missing its public or private half",
+	ruleUnusedKey:                 "Key is not in use",
+	ruleDuplicateKey:              "Several files hold the same key",
+	ruleSameKeyHost:               "A host names the same key twice under different files",
+	ruleIdentitiesOnly:            "Host with explicit keys does not set IdentitiesOnly",
+	ruleKeyExpiry:                 "Key has expired or expires soon",
+	ruleCertificateExpiry:         "Certificate has expired or expires soon",
+	ruleGitSigning:                "Git commit signing is misconfigured",
+	rulePermissions:               "File permissions are too open",
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+// writeSARIFReport writes the findings of doc as a SARIF 2.1.0 log, the
+// format GitHub code scanning and other security dashboards import.
+func writeSARIFReport(w io.Writer, doc auditDocument) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "keyman",
+			InformationURI: "https://github.com/donuts-are-good/keyman",
+		}},
+		Results: []sarifResult{},
+	}
+
+	used := make(map[string]bool)
+	for _, finding := range doc.Findings {
+		used[finding.Rule] = true
+
+		var location sarifLocation
+		location.PhysicalLocation.ArtifactLocation.URI = fileURI(findingPath(finding, doc))
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    finding.Rule,
+			Level:     sarifLevel(finding.Severity),
+			Message:   sarifMessage{Text: finding.Subject + ": " + finding.Message},
+			Locations: []sarifLocation{location},
+		})
+	}
+
+	var rules []string
+	for rule := range used {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		description := ruleDescriptions[rule]
+		if description == "" {
+			description = rule
+		}
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: rule, ShortDescription: sarifMessage{Text: description}})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{Schema: sarifSchema, Version: "2.1.0", Runs: []sarifRun{run}})
+}
+
+func sarifLevel(severity keyman.Severity) string {
+	switch severity {
+	case keyman.SeverityError:
+		return "error"
+	case keyman.SeverityWarning:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+// findingPath returns the file a finding is about: the key file for key
+// findings, the ssh or sshd config for host and server findings,
+// known_hosts for host key findings, or the ssh directory.
+func findingPath(finding keyman.Finding, doc auditDocument) string {
+	switch finding.Rule {
+	case rulePermissions:
+		return finding.Subject
+	case keyman.RuleHostKeyChanged:
+		if path, err := getKnownHostsPath(); err == nil {
+			return path
+		}
+	case ruleIdentitiesOnly, ruleSameKeyHost, keyman.RuleSSHDRootLogin, keyman.RuleSSHDPasswords, keyman.RuleSSHDWeakAlgorithms, keyman.RuleSSHDAuthorizedKeys:
+		return doc.ConfigPath
+	}
+
+	// Duplicate key findings name several keys; point at the first.
+	name, _, _ := strings.Cut(finding.Subject, ", ")
+	for _, key := range doc.Keys {
+		if key.Name == name {
+			return key.Path
+		}
+	}
+	return doc.SSHDir
+}
+
+// fileURI turns an absolute path into a file:// URI.
+func fileURI(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
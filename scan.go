@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// strayKeyView is a private key found outside the ssh directory, as scan
+// --json shows it.
+type strayKeyView struct {
+	Path        string `json:"path"`
+	Line        int    `json:"line,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Encrypted   bool   `json:"encrypted"`
+	Type        string `json:"type,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	CopyOf      string `json:"copy_of,omitempty"`
+	GitRepo     string `json:"git_repo,omitempty"`
+	GitTracked  bool   `json:"git_tracked,omitempty"`
+}
+
+// scanStrayKeys searches directory trees for private keys left outside the
+// ssh directory, such as in cloned repositories or Downloads, and reports
+// them so they can be moved or destroyed.
+func scanStrayKeys(args []string) {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	maxSize := flags.Int64("max-size", 1<<20, "do not read files larger than this many bytes, including those named as arguments; ones named like a key are still listed")
+	includeSSHDir := flags.Bool("include-ssh-dir", false, "search the ssh directory as well")
+	asJSON := flags.Bool("json", settings.Output == "json", "print the keys found as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	args = parseFlags(flags, args)
+	if len(args) == 0 {
+		fatalUsage("Usage: keyman scan [--max-size bytes] [--include-ssh-dir] [--json] [--plain] <dir|file>...")
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+	var skip []string
+	if !*includeSSHDir {
+		skip = append(skip, sshPath)
+	}
+	// Keys in the ssh directory, to tell copies of them from keys found
+	// nowhere else.
+	known := make(map[string]string)
+	if keys, err := getKeys(); err == nil {
+		for _, key := range keys {
+			if key.Public != nil {
+				known[key.Public.FingerprintSHA256()] = key.Name
+			}
+		}
+	}
+
+	var views []strayKeyView
+	unreadable := 0
+	for _, dir := range args {
+		root, err := keyman.ExpandPath(dir)
+		if err != nil {
+			fatal(err)
+		}
+		found, skipped, err := keyman.FindStrayKeys(root, skip, *maxSize)
+		if err != nil {
+			fatal(err)
+		}
+		unreadable += skipped
+		for _, key := range found {
+			views = append(views, newStrayKeyView(key, known, sshPath))
+		}
+	}
+
+	if *asJSON {
+		if views == nil {
+			views = []strayKeyView{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(views); err != nil {
+			fatal(err)
+		}
+	} else if len(views) == 0 {
+		fmt.Println("No private keys found")
+	} else {
+		color := useColor(*plain)
+		var rows [][]tableCell
+		for _, view := range views {
+			path := view.Path
+			if view.Line > 1 {
+				path += ":" + strconv.Itoa(view.Line)
+			}
+			kind := tableCell{text: orDefault(view.Format, "named like a key"), color: colorYellow}
+			if view.Format != "" && !view.Encrypted {
+				kind = tableCell{text: view.Format + ", no passphrase", color: colorRed}
+			} else if view.Format != "" {
+				kind.text = view.Format + ", encrypted"
+			}
+			rows = append(rows, []tableCell{
+				{text: path},
+				kind,
+				{text: view.Type},
+				{text: view.Fingerprint},
+				{text: strayKeyNote(view)},
+			})
+		}
+		writeTable(os.Stdout, []string{"file", "format", "type", "fingerprint", "note"}, rows, color)
+		fmt.Printf("\nFound %d private key(s). Move the ones still needed into %s with mode 0600, destroy the rest with\nshred -u, and rotate any that were committed or shared.\n", len(views), sshPath)
+	}
+
+	if unreadable > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d file(s) or directories could not be read\n", unreadable)
+	}
+	if len(views) > 0 {
+		os.Exit(exitFindings)
+	}
+}
+
+func newStrayKeyView(key keyman.StrayKey, known map[string]string, sshPath string) strayKeyView {
+	view := strayKeyView{Path: key.Path, Line: key.Line, Format: key.Format, Encrypted: key.Encrypted}
+	if key.Public != nil {
+		view.Type = fmt.Sprintf("%s %d", key.Public.TypeName(), key.Public.Bits())
+		view.Fingerprint = key.Public.FingerprintSHA256()
+		if name := known[view.Fingerprint]; name != "" && key.Path != filepath.Join(sshPath, name) {
+			view.CopyOf = name
+		}
+	}
+	view.GitRepo, view.GitTracked = gitRepoOf(key.Path)
+	return view
+}
+
+func strayKeyNote(view strayKeyView) string {
+	note := ""
+	if view.CopyOf != "" {
+		note = "copy of " + view.CopyOf
+	}
+	if view.GitRepo != "" {
+		if note != "" {
+			note += ", "
+		}
+		if view.GitTracked {
+			note += "committed to " + view.GitRepo
+		} else {
+			note += "inside " + view.GitRepo
+		}
+	}
+	return note
+}
+
+// gitRepoOf returns the git work tree path is in, if any, and whether git
+// tracks the file.
+func gitRepoOf(path string) (string, bool) {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			tracked := exec.Command("git", "-C", dir, "ls-files", "--error-unmatch", "--", path).Run() == nil
+			return dir, tracked
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return "", false
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// Secrets managers backup --backend can keep backups in. Each is driven
+// through its own command line tool, so the credentials and region or
+// project it is already set up with apply.
+const (
+	backendAWS   = "aws-sm"
+	backendGCP   = "gcp-sm"
+	backendVault = "vault"
+)
+
+// unsafeSecretName matches what GCP Secret Manager, the strictest of the
+// backends, does not allow in a secret's name.
+var unsafeSecretName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// checkBackend accepts the built-in backends and plugins with the secrets
+// capability.
+func checkBackend(backend string) error {
+	switch backend {
+	case backendAWS, backendGCP, backendVault:
+		return nil
+	}
+	if p, err := findPlugin(backend); err != nil {
+		return err
+	} else if p != nil && p.info.Can(keyman.CapabilitySecrets) {
+		return nil
+	}
+	return fmt.Errorf("unknown backend %q, use %s, %s, %s or a secrets plugin", backend, backendAWS, backendGCP, backendVault)
+}
+
+// defaultSecretName names a machine's backup after its hostname.
+func defaultSecretName() string {
+	hostname, _ := os.Hostname()
+	return "keyman-" + strings.Trim(unsafeSecretName.ReplaceAllString(hostname, "-"), "-")
+}
+
+// storeBackup saves a sealed backup as the secret name, adding a version
+// to the secret when it exists and creating it when it does not. The
+// backup is stored base64 encoded, since not every backend takes binary.
+func storeBackup(backend, vaultMount, name string, sealed []byte) error {
+	value := []byte(base64.StdEncoding.EncodeToString(sealed))
+	switch backend {
+	case backendAWS:
+		// aws reads the value from a file, keeping it off the command line.
+		dir, err := os.MkdirTemp("", "keyman-secret-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "backup")
+		if err := os.WriteFile(path, value, 0600); err != nil {
+			return err
+		}
+		secret := "file://" + path
+		_, err = runCloudTool(nil, "aws", "secretsmanager", "put-secret-value", "--secret-id", name, "--secret-string", secret)
+		if err != nil && strings.Contains(err.Error(), "ResourceNotFoundException") {
+			_, err = runCloudTool(nil, "aws", "secretsmanager", "create-secret", "--name", name, "--description", "keyman backup", "--secret-string", secret)
+		}
+		return err
+	case backendGCP:
+		_, err := runCloudTool(value, "gcloud", "secrets", "versions", "add", name, "--data-file=-")
+		if err != nil && strings.Contains(err.Error(), "NOT_FOUND") {
+			_, err = runCloudTool(value, "gcloud", "secrets", "create", name, "--replication-policy=automatic", "--data-file=-")
+		}
+		return err
+	case backendVault:
+		_, err := runCloudTool(value, "vault", "kv", "put", "-mount="+vaultMount, name, "backup=-")
+		return err
+	}
+	p, err := secretsPlugin(backend)
+	if err != nil {
+		return err
+	}
+	return p.call(keyman.PluginStoreSecret, keyman.PluginSecret{Name: name, Value: string(value)}, nil)
+}
+
+// fetchBackup reads the latest version of a backup stored by storeBackup.
+func fetchBackup(backend, vaultMount, name string) ([]byte, error) {
+	var value []byte
+	var err error
+	switch backend {
+	case backendAWS:
+		value, err = runCloudTool(nil, "aws", "secretsmanager", "get-secret-value", "--secret-id", name, "--query", "SecretString", "--output", "text")
+	case backendGCP:
+		value, err = runCloudTool(nil, "gcloud", "secrets", "versions", "access", "latest", "--secret="+name)
+	case backendVault:
+		value, err = runCloudTool(nil, "vault", "kv", "get", "-mount="+vaultMount, "-field=backup", name)
+	default:
+		var p *plugin
+		if p, err = secretsPlugin(backend); err == nil {
+			var secret keyman.PluginSecret
+			err = p.call(keyman.PluginFetchSecret, keyman.PluginSecret{Name: name}, &secret)
+			value = []byte(secret.Value)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(value)))
+	if err != nil {
+		return nil, fmt.Errorf("secret %s is not a keyman backup", name)
+	}
+	return sealed, nil
+}
+
+// secretsPlugin finds the plugin a backend that is not built in names.
+func secretsPlugin(backend string) (*plugin, error) {
+	p, err := findPlugin(backend)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil || !p.info.Can(keyman.CapabilitySecrets) {
+		return nil, checkBackend(backend)
+	}
+	return p, nil
+}
+
+// runCloudTool runs a cloud provider's or secrets manager's command line
+// tool with input on its stdin, returning its output, or its error message
+// on failure.
+func runCloudTool(input []byte, tool string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf("%s not found: install it and log in first", tool)
+	}
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v: %s", tool, strings.Join(args[:2], " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// apiServer answers the REST API. Writes hold mu so two requests never
+// edit the ssh config at once. allowedHosts are the Host headers requests
+// may carry, or nil for any.
+type apiServer struct {
+	token        string
+	allowedHosts map[string]bool
+	mu           sync.Mutex
+}
+
+// hostJSON is a host and the keys mapped to it.
+type hostJSON struct {
+	Host string   `json:"host"`
+	Keys []string `json:"keys"`
+}
+
+type findingJSON struct {
+	Severity string `json:"severity"`
+	Rule     string `json:"rule"`
+	Subject  string `json:"subject"`
+	Message  string `json:"message"`
+}
+
+type auditJSON struct {
+	Generated time.Time     `json:"generated"`
+	Keys      int           `json:"keys"`
+	Findings  []findingJSON `json:"findings"`
+}
+
+type mapRequest struct {
+	Key  string `json:"key"`
+	Host string `json:"host"`
+	Add  bool   `json:"add"`
+}
+
+type rotateRequest struct {
+	Key        string `json:"key"`
+	Passphrase string `json:"passphrase"`
+	KeepOld    bool   `json:"keep_old"`
+}
+
+// fleetJSON is a fleet from the settings and the keys mapped to each of
+// its hosts.
+type fleetJSON struct {
+	Name  string     `json:"name"`
+	Hosts []hostJSON `json:"hosts"`
+}
+
+type generateRequest struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Bits       int    `json:"bits"`
+	Comment    string `json:"comment"`
+	Passphrase string `json:"passphrase"`
+}
+
+// serve runs the REST API and the dashboard on top of it. Every API request
+// needs the token as a bearer token, one made up for the session when none
+// is given, so a web page the browser has open cannot read or change keys
+// through it. Requests must also name the address served in their Host
+// header, which stops pages that point their own domain at 127.0.0.1.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:7070", "address to listen on")
+	token := flags.String("token", os.Getenv("KEYMAN_API_TOKEN"), "bearer token for the API (default $KEYMAN_API_TOKEN, or a new one)")
+	tokenFile := flags.String("token-file", "", "read the bearer token from a file")
+	parseFlagSet(flags, args)
+
+	if *tokenFile != "" {
+		content, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fatal(err)
+		}
+		*token = strings.TrimSpace(string(content))
+	}
+
+	generated := *token == ""
+	if generated {
+		secret := make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			fatal(err)
+		}
+		*token = hex.EncodeToString(secret)
+	}
+
+	server := &apiServer{token: *token}
+	host, port, err := net.SplitHostPort(*listen)
+	if err != nil {
+		fatalUsagef("Invalid --listen address: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		server.allowedHosts = map[string]bool{
+			strings.ToLower(*listen): true,
+			"localhost:" + port:      true,
+			"127.0.0.1:" + port:      true,
+			"[::1]:" + port:          true,
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/keys", server.get(server.keys))
+	mux.HandleFunc("/api/hosts", server.get(server.hosts))
+	mux.HandleFunc("/api/audit", server.get(server.audit))
+	mux.HandleFunc("/api/fleets", server.get(server.fleets))
+	mux.HandleFunc("/api/map", server.post(server.mapKey))
+	mux.HandleFunc("/api/unmap", server.post(server.unmapKey))
+	mux.HandleFunc("/api/generate", server.post(server.generate))
+	mux.HandleFunc("/api/rotate", server.post(server.rotate))
+	mux.Handle("/", dashboardHandler())
+
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		fmt.Fprintf(os.Stderr, "Warning: %s is reachable from other machines\n", *listen)
+	}
+	fmt.Printf("Serving the keyman dashboard on http://%s/ and the API on http://%s/api/\n", *listen, *listen)
+	if generated {
+		fmt.Printf("Token for this session: %s\nOpen http://%s/#token=%s to use the dashboard with it\n", *token, *listen, *token)
+	}
+	fatal(http.ListenAndServe(*listen, server.checkHost(mux)))
+}
+
+// checkHost wraps next, refusing requests whose Host header is not one
+// of s.allowedHosts.
+func (s *apiServer) checkHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.allowedHosts != nil && !s.allowedHosts[strings.ToLower(r.Host)] {
+			writeAPIError(w, http.StatusForbidden, fmt.Errorf("unexpected Host %q", r.Host))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether r carries the token, answering it with an
+// error when it does not.
+func (s *apiServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("missing or wrong bearer token"))
+		return false
+	}
+	return true
+}
+
+// get wraps a read handler, which returns the value to send as JSON.
+func (s *apiServer) get(handler func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("use GET"))
+			return
+		}
+		if !s.authorized(w, r) {
+			return
+		}
+		value, err := handler(r)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, value)
+	}
+}
+
+// post wraps a write handler, which decodes the request body itself and
+// returns the status and value to send as JSON.
+func (s *apiServer) post(handler func(*json.Decoder) (interface{}, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+			return
+		}
+		if !s.authorized(w, r) {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		decoder.DisallowUnknownFields()
+		value, status, err := handler(decoder)
+		if err != nil {
+			writeAPIError(w, status, err)
+			return
+		}
+		writeJSON(w, status, value)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *apiServer) keys(r *http.Request) (interface{}, error) {
+	keys, err := getKeys()
+	if err != nil {
+		return nil, err
+	}
+	return keysJSON(keys), nil
+}
+
+func (s *apiServer) hosts(r *http.Request) (interface{}, error) {
+	config, err := parseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []hostJSON{}
+	for host, keys := range config {
+		hosts = append(hosts, hostJSON{Host: host, Keys: keys})
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts, nil
+}
+
+// fleets shows, for each host in each fleet, the keys mapped to it, so
+// hosts that were never set up stand out.
+func (s *apiServer) fleets(r *http.Request) (interface{}, error) {
+	config, err := parseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	fleets := []fleetJSON{}
+	for _, name := range settings.FleetNames() {
+		fleet := fleetJSON{Name: name, Hosts: []hostJSON{}}
+		for _, host := range settings.Fleets[name] {
+			keys := config[host]
+			if keys == nil {
+				keys = []string{}
+			}
+			fleet.Hosts = append(fleet.Hosts, hostJSON{Host: host, Keys: keys})
+		}
+		fleets = append(fleets, fleet)
+	}
+	return fleets, nil
+}
+
+// audit runs the same checks as keyman audit with its default windows.
+func (s *apiServer) audit(r *http.Request) (interface{}, error) {
+	keys, err := getKeys()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := auditPolicy("")
+	if err != nil {
+		return nil, err
+	}
+	sshConfig, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	config, err := sshConfig.Mappings()
+	if err != nil {
+		return nil, err
+	}
+
+	expiryWindow := settings.ExpiryWindow
+	if expiryWindow == 0 {
+		expiryWindow = 30 * 24 * time.Hour
+	}
+	report := keyman.Audit(keys, config, 90*24*time.Hour)
+	var policyFindings []keyman.Finding
+	if policy != nil {
+		policyFindings = policy.Evaluate(keys)
+	}
+	findings, err := auditFindings(report, sshConfig, expiryWindow, false, keyman.CheckStrength(keys), policyFindings)
+	if err != nil {
+		return nil, err
+	}
+
+	out := auditJSON{Generated: time.Now(), Keys: len(report.Keys), Findings: []findingJSON{}}
+	for _, finding := range findings {
+		out.Findings = append(out.Findings, findingJSON{
+			Severity: finding.Severity.String(),
+			Rule:     finding.Rule,
+			Subject:  finding.Subject,
+			Message:  finding.Message,
+		})
+	}
+	return out, nil
+}
+
+func (s *apiServer) mapKey(decoder *json.Decoder) (interface{}, int, error) {
+	var req mapRequest
+	if err := decodeRequest(decoder, &req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := checkArgs(req.Key, req.Host); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	args := []string{"map"}
+	if req.Add {
+		args = append(args, "--add")
+	}
+	return runSelf("", append(args, req.Key, req.Host)...)
+}
+
+func (s *apiServer) unmapKey(decoder *json.Decoder) (interface{}, int, error) {
+	var req mapRequest
+	if err := decodeRequest(decoder, &req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := checkArgs(req.Key, req.Host); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return runSelf("", "unmap", req.Key, req.Host)
+}
+
+// rotate replaces a key on every host it is mapped to, as keyman rotate
+// does, which can take a while with many hosts.
+func (s *apiServer) rotate(decoder *json.Decoder) (interface{}, int, error) {
+	var req rotateRequest
+	if err := decodeRequest(decoder, &req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if req.Key == "" || strings.HasPrefix(req.Key, "-") {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid key %q", req.Key)
+	}
+
+	args := []string{"rotate", "--passphrase-file", "-"}
+	if req.KeepOld {
+		args = append(args, "--keep-old")
+	}
+	return runSelf(req.Passphrase+"\n", append(args, req.Key)...)
+}
+
+func (s *apiServer) generate(decoder *json.Decoder) (interface{}, int, error) {
+	var req generateRequest
+	if err := decodeRequest(decoder, &req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if req.Type == "" {
+		req.Type = defaultKeyType()
+	}
+	if isSecurityKeyType(req.Type) {
+		return nil, http.StatusBadRequest, fmt.Errorf("security keys need someone to touch them, generate them with keyman generate")
+	}
+	if strings.ContainsAny(req.Name, `/\`) || strings.HasPrefix(req.Name, ".") {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid key name %q", req.Name)
+	}
+
+	spec := keySpec{keyType: req.Type, name: req.Name, comment: req.Comment, bits: req.Bits, passphrase: &req.Passphrase}
+	if spec.bits == 0 && spec.keyType == settings.KeyType {
+		spec.bits = settings.KeyBits
+	}
+	keyPath, err := createKey(spec)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	keys, err := getKeys()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	for _, key := range keysJSON(keys) {
+		if key.Name == filepath.Base(keyPath) {
+			return key, http.StatusCreated, nil
+		}
+	}
+	return map[string]string{"path": keyPath}, http.StatusCreated, nil
+}
+
+func decodeRequest(decoder *json.Decoder, req interface{}) error {
+	if err := decoder.Decode(req); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// checkArgs rejects key and host values keyman would misread as flags.
+func checkArgs(key, host string) error {
+	if key == "" || host == "" {
+		return fmt.Errorf("key and host are required")
+	}
+	if strings.HasPrefix(key, "-") || strings.HasPrefix(host, "-") {
+		return fmt.Errorf("key and host cannot start with -")
+	}
+	return nil
+}
+
+// runSelf runs keyman with args and the global flags it was started with,
+// so a command that stops with an error does not take the server down.
+// stdin is given to the command as its input.
+func runSelf(stdin string, args ...string) (interface{}, int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	cmdArgs := append([]string{}, globalArgs...)
+	cmdArgs = append(cmdArgs, "--errors=json")
+	cmd := exec.Command(self, append(cmdArgs, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	output := strings.TrimSpace(stdout.String())
+	if err == nil {
+		return map[string]string{"output": output}, http.StatusOK, nil
+	}
+
+	// The error is the last line, after any warnings.
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	var failure struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal([]byte(lines[len(lines)-1]), &failure) != nil || failure.Error == "" {
+		return nil, http.StatusInternalServerError, fmt.Errorf("keyman %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil, http.StatusBadRequest, fmt.Errorf("%s", failure.Error)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+func server(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman server audit|hostkeys")
+	}
+
+	switch args[0] {
+	case "audit":
+		auditServer(args[1:])
+	case "hostkeys":
+		serverHostKeys(args[1:])
+	default:
+		fatalUsage("Unknown server command")
+	}
+}
+
+// auditServer checks the local sshd configuration, drop-ins included, for
+// weak settings and reports them as audit does, on the terminal or as a
+// Markdown, HTML or SARIF report.
+func auditServer(args []string) {
+	flags := flag.NewFlagSet("server audit", flag.ExitOnError)
+	file := flags.String("file", keyman.DefaultSSHDConfig, "sshd_config to audit")
+	failOnFlag := flags.String("fail-on", "error", "exit non-zero on findings of this severity or worse: info, warning or error")
+	reportFormat := flags.String("report", "", "write a report in this format instead: md, html or sarif")
+	reportPath := flags.String("o", "", "file to write the report to (default stdout)")
+	plain := flags.Bool("plain", false, "print without color")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman server audit [--file path] [--fail-on severity] [--report md|html|sarif] [-o file] [--plain]")
+	}
+	failOn, err := keyman.ParseSeverity(*failOnFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+
+	if _, err := os.Stat(*file); err != nil {
+		fatalf("Reading %s: %v", *file, err)
+	}
+	sshdConfig, err := keyman.LoadSSHDConfig(*file)
+	if err != nil {
+		fatal(err)
+	}
+	findings := keyman.AuditSSHD(sshdConfig)
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+
+	failed := false
+	for _, finding := range findings {
+		if finding.Severity >= failOn {
+			failed = true
+		}
+	}
+
+	if *reportFormat != "" {
+		hostname, _ := os.Hostname()
+		err := writeAuditReport(*reportFormat, *reportPath, auditDocument{
+			Generated:  time.Now(),
+			Host:       hostname,
+			ConfigPath: *file,
+			Server:     true,
+			Findings:   findings,
+		})
+		if err != nil {
+			fatal(err)
+		}
+		if *reportPath != "" {
+			fmt.Printf("Wrote audit report to %s\n", *reportPath)
+		}
+	} else {
+		fmt.Println("SSH Server Audit:")
+		fmt.Println("=================")
+		fmt.Printf("Config: %s\n\n", *file)
+		if len(findings) == 0 {
+			fmt.Println("No weak sshd settings found")
+		}
+		for _, finding := range findings {
+			printFinding(finding, useColor(*plain))
+		}
+	}
+
+	if failed {
+		os.Exit(exitFindings)
+	}
+}
+
+func serverHostKeys(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman server hostkeys list|rotate")
+	}
+
+	switch args[0] {
+	case "list":
+		listServerHostKeys(args[1:])
+	case "rotate":
+		rotateServerHostKeys(args[1:])
+	default:
+		fatalUsage("Unknown server hostkeys command")
+	}
+}
+
+// serverHostKey is a host key of the local sshd as list --json shows it,
+// with Reason saying why it should be rotated, if it should.
+type serverHostKey struct {
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Type        string    `json:"type"`
+	Bits        int       `json:"bits"`
+	Fingerprint string    `json:"fingerprint"`
+	Created     time.Time `json:"created"`
+	Reason      string    `json:"rotate_reason,omitempty"`
+	severity    keyman.Severity
+	key         keyman.Key
+}
+
+// loadServerHostKeys returns the host keys in dir, marking the weak ones
+// and those older than maxAge.
+func loadServerHostKeys(dir string, maxAge time.Duration) []serverHostKey {
+	keys, err := keyman.ListHostKeys(dir)
+	if err != nil {
+		fatal(err)
+	}
+	if len(keys) == 0 {
+		fatalf("No host keys in %s", dir)
+	}
+	weak := make(map[string]keyman.Finding)
+	for _, finding := range keyman.CheckStrength(keys) {
+		weak[finding.Subject] = finding
+	}
+
+	var hostKeys []serverHostKey
+	for _, key := range keys {
+		if key.Public == nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s, its public key is unreadable\n", key.Name)
+			continue
+		}
+		hostKey := serverHostKey{
+			Name:        key.Name,
+			Path:        key.PrivatePath(),
+			Type:        key.Public.TypeName(),
+			Bits:        key.Public.Bits(),
+			Fingerprint: key.Public.FingerprintSHA256(),
+			Created:     key.Created,
+			key:         key,
+		}
+		if finding, ok := weak[key.Name]; ok {
+			hostKey.Reason, hostKey.severity = finding.Message, finding.Severity
+		} else if age := time.Since(key.Created); maxAge > 0 && age > maxAge {
+			hostKey.Reason, hostKey.severity = fmt.Sprintf("%s old, older than %s", ageString(age), ageString(maxAge)), keyman.SeverityWarning
+		}
+		hostKeys = append(hostKeys, hostKey)
+	}
+	return hostKeys
+}
+
+// listServerHostKeys shows the local sshd's host keys with their type,
+// age and fingerprint, and which of them are due for rotation.
+func listServerHostKeys(args []string) {
+	flags := flag.NewFlagSet("server hostkeys list", flag.ExitOnError)
+	dir := flags.String("dir", keyman.DefaultHostKeyDir, "directory holding the ssh_host_*_key files")
+	maxAgeFlag := flags.String("max-age", "5y", "flag keys older than this for rotation")
+	asJSON := flags.Bool("json", settings.Output == "json", "print the keys as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman server hostkeys list [--dir path] [--max-age d] [--json] [--plain]")
+	}
+	maxAge, err := keyman.ParseAge(*maxAgeFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+
+	hostKeys := loadServerHostKeys(*dir, maxAge)
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(hostKeys); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	var rows [][]tableCell
+	for _, hostKey := range hostKeys {
+		status := tableCell{text: "ok", color: colorGreen}
+		if hostKey.Reason != "" {
+			status = tableCell{text: "rotate: " + hostKey.Reason, color: severityColor(hostKey.severity)}
+		}
+		rows = append(rows, []tableCell{
+			{text: hostKey.Name},
+			{text: fmt.Sprintf("%s %d", hostKey.Type, hostKey.Bits)},
+			{text: ageString(time.Since(hostKey.Created))},
+			{text: hostKey.Fingerprint},
+			status,
+		})
+	}
+	writeTable(os.Stdout, []string{"key", "type", "age", "fingerprint", "status"}, rows, useColor(*plain))
+}
+
+// hostKeyBackup is a host key file moved aside during a rotation.
+type hostKeyBackup struct {
+	path   string
+	backup string
+}
+
+// rotateServerHostKeys replaces the weak and old host keys of the local
+// sshd, or those of the types given, with new ones, keeping the old files
+// with an .old suffix, and refuses if those are already there from an
+// earlier rotation. sshd must accept the result, otherwise the old keys
+// are put back, and is then reloaded so new connections use the new keys.
+func rotateServerHostKeys(args []string) {
+	flags := flag.NewFlagSet("server hostkeys rotate", flag.ExitOnError)
+	dir := flags.String("dir", keyman.DefaultHostKeyDir, "directory holding the ssh_host_*_key files")
+	maxAgeFlag := flags.String("max-age", "5y", "rotate keys older than this")
+	types := flags.String("type", "", "comma separated key types to rotate regardless, such as rsa,ecdsa")
+	sshdConfig := flags.String("sshd-config", keyman.DefaultSSHDConfig, "sshd_config to check the new keys against")
+	noReload := flags.Bool("no-reload", false, "do not reload sshd afterwards")
+	yes := flags.Bool("yes", false, "rotate without asking")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman server hostkeys rotate [--dir path] [--max-age d] [--type t,t] [--sshd-config path] [--no-reload] [--yes]")
+	}
+	maxAge, err := keyman.ParseAge(*maxAgeFlag)
+	if err != nil {
+		fatalUsage(err)
+	}
+
+	var rotate []serverHostKey
+	for _, hostKey := range loadServerHostKeys(*dir, maxAge) {
+		keyType, _ := keyman.HostKeyReplacement(hostKey.key.Public)
+		if *types != "" && containsString(strings.Split(*types, ","), orDefault(keyType, "dsa")) && hostKey.Reason == "" {
+			hostKey.Reason = "asked for"
+		}
+		if hostKey.Reason != "" {
+			rotate = append(rotate, hostKey)
+		}
+	}
+	if len(rotate) == 0 {
+		fmt.Println("No host keys need rotating")
+		return
+	}
+
+	for _, hostKey := range rotate {
+		if keyType, bits := keyman.HostKeyReplacement(hostKey.key.Public); keyType == "" {
+			fmt.Printf("%s: %s; it will be removed, not replaced\n", hostKey.Name, hostKey.Reason)
+		} else if bits > 0 {
+			fmt.Printf("%s: %s; it will be replaced with a new %s %d key\n", hostKey.Name, hostKey.Reason, keyType, bits)
+		} else {
+			fmt.Printf("%s: %s; it will be replaced with a new %s key\n", hostKey.Name, hostKey.Reason, keyType)
+		}
+	}
+	// The .old files of an earlier rotation may be the only copy of keys
+	// clients still trust, so they are never overwritten.
+	for _, hostKey := range rotate {
+		for _, path := range []string{hostKey.Path, hostKey.Path + keyman.PublicKeyExt} {
+			if _, err := os.Stat(path + ".old"); err == nil {
+				fatalf("%s.old is left from an earlier rotation; move it away before rotating %s again", path, hostKey.Name)
+			}
+		}
+	}
+	if dryRun {
+		fmt.Printf("Would rotate %d host key(s) in %s\n", len(rotate), *dir)
+		return
+	}
+	if !*yes {
+		fmt.Printf("Clients will see changed host keys until they accept the new ones. Rotate %d host key(s)? [y/N]: ", len(rotate))
+		answer, _ := stdin.ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			fmt.Println("Nothing rotated")
+			return
+		}
+	}
+
+	var backups []hostKeyBackup
+	for _, hostKey := range rotate {
+		moved, err := rotateHostKey(hostKey)
+		backups = append(backups, moved...)
+		if err != nil {
+			restoreHostKeys(backups)
+			fatalf("Rotating %s: %v; the old keys were put back", hostKey.Name, err)
+		}
+	}
+
+	if sshd := sshdPath(); sshd == "" {
+		fmt.Fprintln(os.Stderr, "Warning: sshd not found, so the new keys were not checked against its configuration")
+	} else if output, err := exec.Command(sshd, "-t", "-f", *sshdConfig).CombinedOutput(); err != nil {
+		restoreHostKeys(backups)
+		fatalf("sshd rejected the new keys, the old keys were put back: %s", strings.TrimSpace(string(output)))
+	}
+
+	var rows [][]tableCell
+	for _, hostKey := range rotate {
+		newFingerprint := "removed"
+		if content, err := os.ReadFile(hostKey.Path + keyman.PublicKeyExt); err == nil {
+			if pub, err := keyman.ParsePublicKey(string(content)); err == nil {
+				newFingerprint = pub.FingerprintSHA256()
+			}
+		}
+		journal("server hostkeys rotate", hostKey.Path, hostKey.Fingerprint, newFingerprint)
+		rows = append(rows, []tableCell{{text: hostKey.Name}, {text: hostKey.Fingerprint}, {text: newFingerprint}})
+	}
+	writeTable(os.Stdout, []string{"key", "old fingerprint", "new fingerprint"}, rows, false)
+	fmt.Printf("Rotated %d host key(s); the old ones are kept with an .old suffix\n", len(rotate))
+
+	if !*noReload {
+		how, err := reloadSSHD()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not reload sshd, reload it to use the new keys: %v\n", err)
+		} else {
+			fmt.Printf("Reloaded sshd with %s; open connections are unaffected\n", how)
+		}
+	}
+	fmt.Println("Give users the new fingerprints to check: keyman known-hosts replace <host> updates their known_hosts, and keyman sshfp <host> --scan prints new SSHFP records")
+}
+
+// rotateHostKey moves a host key aside and generates its replacement with
+// the same name, returning the files it moved.
+func rotateHostKey(hostKey serverHostKey) ([]hostKeyBackup, error) {
+	var moved []hostKeyBackup
+	for _, path := range []string{hostKey.Path, hostKey.Path + keyman.PublicKeyExt} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Rename(path, path+".old"); err != nil {
+			return moved, err
+		}
+		moved = append(moved, hostKeyBackup{path: path, backup: path + ".old"})
+	}
+
+	keyType, bits := keyman.HostKeyReplacement(hostKey.key.Public)
+	if keyType == "" {
+		return moved, nil
+	}
+	hostname, _ := os.Hostname()
+	args := []string{"-q", "-t", keyType, "-N", "", "-C", "root@" + hostname, "-f", hostKey.Path}
+	if bits > 0 && keyType != "ed25519" {
+		args = append(args, "-b", strconv.Itoa(bits))
+	}
+	if output, err := exec.Command(toolPath("ssh-keygen"), args...).CombinedOutput(); err != nil {
+		return moved, fmt.Errorf("ssh-keygen: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return moved, nil
+}
+
+// restoreHostKeys puts moved host keys back, replacing any new key
+// generated in their place.
+func restoreHostKeys(backups []hostKeyBackup) {
+	for _, moved := range backups {
+		if err := os.Rename(moved.backup, moved.path); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not restore %s from %s: %v\n", moved.path, moved.backup, err)
+		}
+	}
+}
+
+// sshdPath returns the sshd binary, which is often outside the PATH of
+// ordinary users, or "" if there is none.
+func sshdPath() string {
+	if path, err := exec.LookPath("sshd"); err == nil {
+		return path
+	}
+	for _, path := range []string{"/usr/sbin/sshd", "/usr/local/sbin/sshd"} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// reloadSSHD tells the running sshd to reread its configuration and host
+// keys, through systemd where it runs sshd, otherwise with a SIGHUP to the
+// pid in sshd's pid file, and says how it did.
+func reloadSSHD() (string, error) {
+	if _, err := exec.LookPath("systemctl"); err == nil {
+		for _, unit := range []string{"ssh.service", "sshd.service"} {
+			if exec.Command("systemctl", "is-active", "--quiet", unit).Run() != nil {
+				continue
+			}
+			if output, err := exec.Command("systemctl", "reload", unit).CombinedOutput(); err != nil {
+				return "", fmt.Errorf("systemctl reload %s: %v: %s", unit, err, strings.TrimSpace(string(output)))
+			}
+			return "systemctl reload " + unit, nil
+		}
+	}
+	for _, pidFile := range []string{"/run/sshd.pid", "/var/run/sshd.pid"} {
+		content, err := os.ReadFile(pidFile)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			continue
+		}
+		process, err := os.FindProcess(pid)
+		if err == nil {
+			err = process.Signal(syscall.SIGHUP)
+		}
+		if err != nil {
+			return "", fmt.Errorf("signalling sshd (pid %d): %v", pid, err)
+		}
+		return fmt.Sprintf("SIGHUP to pid %d", pid), nil
+	}
+	return "", errors.New("no running sshd found")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+const settingsFile = "config.toml"
+
+// settings holds keyman's defaults from config.toml, with any environment
+// overrides applied.
+var settings = &keyman.Settings{Fleets: make(map[string][]string), Templates: make(map[string]keyman.HostTemplate)}
+
+func getSettingsPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "keyman", settingsFile), nil
+}
+
+// loadSettings reads config.toml and applies the environment variables
+// that override it.
+func loadSettings() (*keyman.Settings, error) {
+	path, err := getSettingsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	loaded, err := keyman.LoadSettings(path)
+	if err != nil {
+		return nil, err
+	}
+
+	strs := []struct {
+		env     []string
+		setting *string
+	}{
+		{[]string{"KEYMAN_KEY_TYPE"}, &loaded.KeyType},
+		{[]string{"KEYMAN_COMMENT"}, &loaded.CommentTemplate},
+		{[]string{"KEYMAN_OUTPUT"}, &loaded.Output},
+		{[]string{"KEYMAN_COLOR"}, &loaded.Color},
+		{[]string{"KEYMAN_WEBHOOK"}, &loaded.NotifyWebhook},
+		{[]string{"KEYMAN_GITHUB_TOKEN", "GITHUB_TOKEN"}, &loaded.GitHubToken},
+		{[]string{"GITHUB_URL"}, &loaded.GitHubURL},
+		{[]string{"GITHUB_API_URL"}, &loaded.GitHubAPIURL},
+		{[]string{"KEYMAN_GITLAB_TOKEN", "GITLAB_TOKEN"}, &loaded.GitLabToken},
+		{[]string{"GITLAB_URL"}, &loaded.GitLabURL},
+		{[]string{"KEYMAN_GITEA_TOKEN", "GITEA_TOKEN", "FORGEJO_TOKEN"}, &loaded.GiteaToken},
+		{[]string{"GITEA_URL", "FORGEJO_URL"}, &loaded.GiteaURL},
+		{[]string{"BITBUCKET_USERNAME"}, &loaded.BitbucketUsername},
+		{[]string{"KEYMAN_BITBUCKET_TOKEN", "BITBUCKET_TOKEN", "BITBUCKET_APP_PASSWORD"}, &loaded.BitbucketToken},
+		{[]string{"KEYMAN_DIGITALOCEAN_TOKEN", "DIGITALOCEAN_TOKEN", "DIGITALOCEAN_ACCESS_TOKEN"}, &loaded.DigitalOceanToken},
+		{[]string{"KEYMAN_HETZNER_TOKEN", "HCLOUD_TOKEN"}, &loaded.HetznerToken},
+	}
+	for _, override := range strs {
+		for _, env := range override.env {
+			if value := os.Getenv(env); value != "" {
+				*override.setting = value
+				break
+			}
+		}
+	}
+	if os.Getenv("NO_COLOR") != "" && os.Getenv("KEYMAN_COLOR") == "" {
+		loaded.Color = "never"
+	}
+
+	if bits := os.Getenv("KEYMAN_KEY_BITS"); bits != "" {
+		loaded.KeyBits, err = strconv.Atoi(bits)
+		if err != nil {
+			return nil, fmt.Errorf("KEYMAN_KEY_BITS: invalid number %q", bits)
+		}
+	}
+	ages := []struct {
+		env     string
+		setting *time.Duration
+	}{
+		{"KEYMAN_EXPIRY_WINDOW", &loaded.ExpiryWindow},
+		{"KEYMAN_MAX_KEY_AGE", &loaded.MaxKeyAge},
+	}
+	for _, override := range ages {
+		if value := os.Getenv(override.env); value != "" {
+			*override.setting, err = keyman.ParseAge(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", override.env, err)
+			}
+		}
+	}
+
+	if err := loaded.Validate(); err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// defaultKeyType is the key type generate uses when none is given.
+func defaultKeyType() string {
+	if settings.KeyType != "" {
+		return settings.KeyType
+	}
+	return "ed25519"
+}
+
+// expandCommentTemplate fills in the comment template for a new key.
+func expandCommentTemplate(spec keySpec) string {
+	userName := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		userName = current.Username
+	}
+	hostname, _ := os.Hostname()
+	return keyman.ExpandComment(settings.CommentTemplate, userName, hostname, spec.name, spec.keyType, time.Now())
+}
+
+func showSettings() {
+	path, err := getSettingsPath()
+	if err != nil {
+		fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		fmt.Printf("Settings file: %s (not found)\n", path)
+	} else {
+		fmt.Printf("Settings file: %s\n", path)
+	}
+
+	fmt.Printf("Key Type: %s\n", defaultKeyType())
+	if settings.KeyBits > 0 {
+		fmt.Printf("Key Bits: %d\n", settings.KeyBits)
+	}
+	if settings.CommentTemplate != "" {
+		fmt.Printf("Comment Template: %s\n", settings.CommentTemplate)
+	}
+	if settings.ExpiryWindow > 0 {
+		fmt.Printf("Expiry Window: %.0f days\n", settings.ExpiryWindow.Hours()/24)
+	}
+	if settings.MaxKeyAge > 0 {
+		fmt.Printf("Max Key Age: %.0f days\n", settings.MaxKeyAge.Hours()/24)
+	}
+	if len(settings.AuditPlugins) > 0 {
+		fmt.Printf("Audit Plugins: %s\n", strings.Join(settings.AuditPlugins, ", "))
+	}
+	fmt.Printf("Map IdentitiesOnly: %t\n", settings.MapIdentitiesOnly)
+	fmt.Printf("Map AddKeysToAgent: %t\n", settings.MapAddKeysToAgent)
+	fmt.Printf("Map UseKeychain: %t\n", settings.MapUseKeychain)
+	fmt.Printf("Output: %s\n", orDefault(settings.Output, "text"))
+	fmt.Printf("Color: %s\n", orDefault(settings.Color, "auto"))
+	fmt.Printf("Webhook: %s\n", maskToken(settings.NotifyWebhook))
+	if settings.NotifyWebhook != "" {
+		fmt.Printf("Webhook Format: %s\n", orDefault(settings.NotifyFormat, "json"))
+		fmt.Printf("Webhook Min Severity: %s\n", orDefault(settings.NotifyMinSeverity, "warning"))
+	}
+	fmt.Printf("GitHub Token: %s\n", maskToken(settings.GitHubToken))
+	fmt.Printf("GitLab Token: %s\n", maskToken(settings.GitLabToken))
+	if settings.GitLabURL != "" {
+		fmt.Printf("GitLab URL: %s\n", settings.GitLabURL)
+	}
+	fmt.Printf("Gitea Token: %s\n", maskToken(settings.GiteaToken))
+	if settings.GiteaURL != "" {
+		fmt.Printf("Gitea URL: %s\n", settings.GiteaURL)
+	}
+	fmt.Printf("Bitbucket Token: %s\n", maskToken(settings.BitbucketToken))
+	if settings.BitbucketUsername != "" {
+		fmt.Printf("Bitbucket Username: %s\n", settings.BitbucketUsername)
+	}
+	fmt.Printf("DigitalOcean Token: %s\n", maskToken(settings.DigitalOceanToken))
+	fmt.Printf("Hetzner Token: %s\n", maskToken(settings.HetznerToken))
+
+	for _, name := range settings.HookNames() {
+		for _, command := range settings.Hooks[name] {
+			fmt.Printf("Hook %s: %s\n", name, command)
+		}
+	}
+	for _, name := range settings.FleetNames() {
+		fmt.Printf("Fleet %s: %s\n", name, strings.Join(settings.Fleets[name], ", "))
+	}
+	for _, name := range settings.TemplateNames() {
+		usage := strings.TrimSpace("<host> " + settings.Templates[name].Usage())
+		fmt.Printf("Template %s: keyman host add --template %s %s\n", name, name, usage)
+	}
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// maskToken shows only enough of a token to tell which one is set.
+func maskToken(token string) string {
+	switch {
+	case token == "":
+		return "not set"
+	case len(token) <= 8:
+		return "set"
+	default:
+		return token[:4] + strings.Repeat("*", 8) + token[len(token)-4:]
+	}
+}
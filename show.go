@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// showJSON is what show --json prints: the list --json fields plus what
+// show looks up about the key.
+type showJSON struct {
+	keyJSON
+	PrivatePath string     `json:"private_path,omitempty"`
+	PublicPath  string     `json:"public_path,omitempty"`
+	MD5         string     `json:"md5,omitempty"`
+	Encrypted   *bool      `json:"encrypted,omitempty"`
+	InAgent     *bool      `json:"in_agent,omitempty"`
+	Hosts       []string   `json:"hosts"`
+	Status      string     `json:"status"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+}
+
+// showKey prints everything keyman knows about one key.
+func showKey(args []string) {
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the key as JSON")
+	args = parseFlags(flags, args)
+	if len(args) != 1 {
+		fatalUsage("Usage: keyman show [--json] <key>")
+	}
+
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(args[0], keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+	name := filepath.Base(keyPath)
+	keys, err := getKeys()
+	if err != nil {
+		fatal(err)
+	}
+	statuses, weak, err := keyStatuses(keys)
+	if err != nil {
+		fatal(err)
+	}
+	var key *keyman.KeyStatus
+	for i := range statuses {
+		if statuses[i].Name == name {
+			key = &statuses[i]
+		}
+	}
+	if key == nil {
+		fatalf("Key %s not found", args[0])
+	}
+
+	hosts, err := keyHosts()
+	if err != nil {
+		fatal(err)
+	}
+	weakKeys := make(map[string]bool)
+	for _, finding := range weak {
+		weakKeys[finding.Subject] = true
+	}
+
+	view := showJSON{
+		keyJSON: keysJSON([]keyman.Key{key.Key})[0],
+		Hosts:   append([]string{}, hosts[key.Name]...),
+		Status:  keyStatus(*key, weakKeys, time.Now()).text,
+	}
+	sort.Strings(view.Hosts)
+	if !key.MissingPrivate {
+		view.PrivatePath = key.PrivatePath()
+		if encrypted, err := keyman.IsEncrypted(view.PrivatePath); err == nil {
+			view.Encrypted = &encrypted
+		}
+	}
+	agent := "unknown, no public key file"
+	if !key.MissingPublic {
+		view.PublicPath = key.PrivatePath() + keyFileExt
+		inAgent, err := agentHasKey(key.PrivatePath())
+		switch {
+		case err != nil:
+			agent = "unknown, " + err.Error()
+		case inAgent:
+			agent = "loaded"
+		default:
+			agent = "not loaded, run ssh-add " + view.PrivatePath
+		}
+		if err == nil {
+			view.InAgent = &inAgent
+		}
+	}
+	if key.Public != nil {
+		view.MD5 = key.Public.FingerprintMD5()
+	}
+	if key.Metadata != nil {
+		view.LastUsed = key.Metadata.LastUsed
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(view); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	fmt.Printf("Key: %s\n", key.Name)
+	if view.PrivatePath != "" {
+		fmt.Printf("Private Key: %s\n", view.PrivatePath)
+	}
+	if view.PublicPath != "" {
+		fmt.Printf("Public Key: %s\n", view.PublicPath)
+	}
+	if key.Certificate != nil {
+		fmt.Printf("Certificate File: %s\n", key.PrivatePath()+keyman.CertificateSuffix)
+	}
+	if key.Public != nil {
+		fmt.Printf("Type: %s %d", key.Public.TypeName(), key.Public.Bits())
+		if key.Public.IsSecurityKey() {
+			fmt.Print(" (security key)")
+		}
+		fmt.Printf("\nAlgorithm: %s\n", key.Public.Algorithm)
+		fmt.Printf("Fingerprint: %s\n", key.Public.FingerprintSHA256())
+		fmt.Printf("Fingerprint: %s\n", view.MD5)
+	}
+	if view.Comment != "" {
+		fmt.Printf("Comment: %s\n", view.Comment)
+	}
+	fmt.Printf("Created: %s (%s ago)\n", key.Created.Format(time.RFC3339), ageString(key.Age))
+	if !key.Modified.Equal(key.Created) {
+		fmt.Printf("Modified: %s\n", key.Modified.Format(time.RFC3339))
+	}
+	fmt.Printf("Passphrase: %s\n", passphraseString(key.Key, view.Encrypted))
+	fmt.Printf("Agent: %s\n", agent)
+	if len(view.Hosts) > 0 {
+		fmt.Printf("Hosts: %s\n", strings.Join(view.Hosts, ", "))
+	} else {
+		fmt.Println("Hosts: (none)")
+	}
+	fmt.Printf("Status: %s\n", view.Status)
+	printCertificate(key.Certificate)
+	printKeyMetadata(key.Metadata)
+	printMissingHalf(key.Key)
+}
+
+func passphraseString(key keyman.Key, encrypted *bool) string {
+	switch {
+	case key.MissingPrivate:
+		return "unknown, no private key file"
+	case encrypted == nil:
+		return "unknown"
+	case *encrypted:
+		return "yes"
+	case key.Public != nil && key.Public.IsSecurityKey():
+		return "no, the security key guards it"
+	}
+	return "no"
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+type allowedSigner struct {
+	line       int
+	principals string
+	options    string
+	pub        *keyman.PublicKey
+}
+
+func signers(args []string) {
+	flags := flag.NewFlagSet("signers", flag.ExitOnError)
+	file := flags.String("file", "", "allowed_signers file to manage (default ~/.ssh/allowed_signers)")
+	namespaces := flags.String("namespaces", "", "comma separated namespaces the key may sign for, e.g. git,file")
+	validAfter := flags.String("valid-after", "", "date the key becomes trusted, YYYYMMDD[HHMM[SS]]")
+	validBefore := flags.String("valid-before", "", "date the key stops being trusted, YYYYMMDD[HHMM[SS]]")
+	certAuthority := flags.Bool("cert-authority", false, "trust certificates signed by the key rather than the key itself")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman signers list|add|remove")
+	}
+
+	path := *file
+	if path == "" {
+		sshPath, err := getSSHPath()
+		if err != nil {
+			fatal(err)
+		}
+		path = filepath.Join(sshPath, allowedSignersFile)
+	}
+
+	switch args[0] {
+	case "list":
+		listAllowedSigners(path)
+	case "add":
+		if len(args) < 3 {
+			fatalUsage("Usage: keyman signers add [--namespaces n] [--valid-after d] [--valid-before d] [--cert-authority] <principal> <key|pubfile|url|github:user|gitlab:user>")
+		}
+
+		var options []string
+		if *certAuthority {
+			options = append(options, "cert-authority")
+		}
+		if *namespaces != "" {
+			options = append(options, fmt.Sprintf("namespaces=%q", *namespaces))
+		}
+		if *validAfter != "" {
+			options = append(options, fmt.Sprintf("valid-after=%q", *validAfter))
+		}
+		if *validBefore != "" {
+			options = append(options, fmt.Sprintf("valid-before=%q", *validBefore))
+		}
+		addAllowedSigners(path, args[1], strings.Join(options, ","), args[2])
+	case "remove":
+		if len(args) < 2 {
+			fatalUsage("Usage: keyman signers remove <principal> [fingerprint]")
+		}
+		fingerprint := ""
+		if len(args) > 2 {
+			fingerprint = args[2]
+		}
+		removeAllowedSigners(path, args[1], fingerprint)
+	default:
+		fatalUsage("Unknown signers command")
+	}
+}
+
+func parseAllowedSigners(lines []string) []allowedSigner {
+	var entries []allowedSigner
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		principals, rest := splitAuthorizedOptions(line)
+		options := ""
+		if fields := strings.Fields(rest); len(fields) > 0 && !isKeyAlgorithm(fields[0]) {
+			options, rest = splitAuthorizedOptions(rest)
+		}
+
+		pub, err := keyman.ParsePublicKey(rest)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, allowedSigner{line: i + 1, principals: principals, options: options, pub: pub})
+	}
+	return entries
+}
+
+func listAllowedSigners(path string) {
+	lines, err := readLines(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	entries := parseAllowedSigners(lines)
+	if len(entries) == 0 {
+		fmt.Printf("No allowed signers in %s\n", path)
+		return
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("Principals: %s\nType: %s %d\nFingerprint: %s\n", entry.principals, entry.pub.TypeName(), entry.pub.Bits(), entry.pub.FingerprintSHA256())
+		if entry.options != "" {
+			fmt.Printf("Options: %s\n", entry.options)
+		}
+		if entry.pub.Comment != "" {
+			fmt.Printf("Comment: %s\n", entry.pub.Comment)
+		}
+		fmt.Println()
+	}
+}
+
+// addAllowedSigners trusts every key found at source for principal.
+func addAllowedSigners(path, principal, options, source string) {
+	keys, err := fetchPublicKeys(source)
+	if err != nil {
+		fatal(err)
+	}
+	if len(keys) == 0 {
+		fatalf("No public keys found at %s", source)
+	}
+
+	for _, key := range keys {
+		added, err := addAllowedSigner(path, principal, options, key)
+		if err != nil {
+			fatal(err)
+		}
+		pub, _ := keyman.ParsePublicKey(key)
+		if added {
+			journal("allow signer", principal, "", pub.FingerprintSHA256())
+			fmt.Printf("Added %s %s\n", principal, pub.FingerprintSHA256())
+		} else {
+			fmt.Printf("%s already has %s\n", principal, pub.FingerprintSHA256())
+		}
+	}
+}
+
+// addAllowedSigner appends an entry to an allowed_signers file unless the
+// principal already has that key.
+func addAllowedSigner(path, principal, options, pubKey string) (bool, error) {
+	pub, err := keyman.ParsePublicKey(pubKey)
+	if err != nil {
+		return false, err
+	}
+
+	lines, err := readLines(path)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range parseAllowedSigners(lines) {
+		if entry.principals == principal && entry.pub.FingerprintSHA256() == pub.FingerprintSHA256() {
+			return false, nil
+		}
+	}
+
+	entry := principal
+	if options != "" {
+		entry += " " + options
+	}
+	lines = append(lines, entry+" "+pub.Algorithm+" "+strings.Fields(pubKey)[1])
+	return true, writeLines(path, lines)
+}
+
+// removeAllowedSigners drops a principal's entries, or only the one with
+// the given fingerprint.
+func removeAllowedSigners(path, principal, fingerprint string) {
+	lines, err := readLines(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	remove := make(map[int]bool)
+	var removed []string
+	for _, entry := range parseAllowedSigners(lines) {
+		if entry.principals != principal || (fingerprint != "" && !keyman.FingerprintMatches(entry.pub, fingerprint)) {
+			continue
+		}
+		remove[entry.line] = true
+		removed = append(removed, entry.pub.FingerprintSHA256())
+		fmt.Printf("Removing %s %s\n", entry.principals, entry.pub.FingerprintSHA256())
+	}
+
+	if len(remove) == 0 {
+		fatalf("No allowed signer matches %s", principal)
+	}
+
+	var kept []string
+	for i, line := range lines {
+		if !remove[i+1] {
+			kept = append(kept, line)
+		}
+	}
+
+	err = writeLines(path, kept)
+	if err != nil {
+		fatal(err)
+	}
+	for _, fingerprint := range removed {
+		journal("disallow signer", principal, fingerprint, "")
+	}
+}
+
+// fetchPublicKeys returns the public key lines found at source: a GitHub
+// or GitLab user as github:name or gitlab:name, an http(s) URL, a file of
+// keys, or a local key.
+func fetchPublicKeys(source string) ([]string, error) {
+	switch {
+	case strings.HasPrefix(source, "github:"):
+		base := orDefault(settings.GitHubURL, defaultGitHubURL)
+		return fetchKeysURL(strings.TrimSuffix(base, "/") + "/" + url.PathEscape(strings.TrimPrefix(source, "github:")) + ".keys")
+	case strings.HasPrefix(source, "gitlab:"):
+		base := orDefault(settings.GitLabURL, defaultGitLabURL)
+		return fetchKeysURL(strings.TrimSuffix(base, "/") + "/" + url.PathEscape(strings.TrimPrefix(source, "gitlab:")) + ".keys")
+	case strings.HasPrefix(source, "https://"), strings.HasPrefix(source, "http://"):
+		return fetchKeysURL(source)
+	}
+
+	if info, err := os.Stat(source); err == nil && !info.IsDir() {
+		lines, err := readLines(source)
+		if err != nil {
+			return nil, err
+		}
+		if keys := publicKeyLines(lines); len(keys) > 0 {
+			return keys, nil
+		}
+	}
+
+	key, err := resolvePublicKey(source)
+	if err != nil {
+		return nil, err
+	}
+	return []string{key}, nil
+}
+
+// fetchKeysURL downloads a list of public keys, one per line.
+func fetchKeysURL(keysURL string) ([]string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(keysURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", keysURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return publicKeyLines(strings.Split(string(data), "\n")), nil
+}
+
+// publicKeyLines returns the lines that parse as public keys.
+func publicKeyLines(lines []string) []string {
+	var keys []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if _, err := keyman.ParsePublicKey(line); err == nil {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
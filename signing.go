@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// allowedSignersFile maps identities to the keys trusted to sign for
+	// them, in the format ssh-keygen -Y verify reads.
+	allowedSignersFile = "allowed_signers"
+
+	defaultNamespace = "file"
+	signatureExt     = ".sig"
+)
+
+// signFile writes an SSH signature for a file next to it.
+func signFile(args []string) {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	key := flags.String("key", "", "key to sign with")
+	namespace := flags.String("namespace", defaultNamespace, "signature namespace; verify must use the same one")
+	args = parseFlags(flags, args)
+	if len(args) < 1 || *key == "" {
+		fatalUsage("Usage: keyman sign --key <key> [--namespace n] <file>...")
+	}
+
+	keyPath, err := getFullKeyPath(strings.TrimSuffix(*key, keyFileExt))
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, file := range args {
+		// ssh-keygen refuses to overwrite an existing signature.
+		os.Remove(file + signatureExt)
+
+		err = runCommand("ssh-keygen", "-q", "-Y", "sign", "-f", keyPath, "-n", *namespace, file)
+		if err != nil {
+			fatalf("Signing %s failed: %v", file, err)
+		}
+		fmt.Printf("Signed %s as %s\n", file, file+signatureExt)
+	}
+}
+
+// verifyFile checks a file's signature against an allowed_signers file.
+func verifyFile(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	sig := flags.String("sig", "", "signature file (default <file>.sig)")
+	signers := flags.String("signer", "", "allowed_signers file (default ~/.ssh/allowed_signers)")
+	identity := flags.String("identity", "", "identity the signature must belong to (default any allowed signer)")
+	namespace := flags.String("namespace", defaultNamespace, "signature namespace used when signing")
+	args = parseFlags(flags, args)
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman verify [--sig s] [--signer allowed_signers] [--identity i] [--namespace n] <file>")
+	}
+	file := args[0]
+
+	if *sig == "" {
+		*sig = file + signatureExt
+	}
+	if *signers == "" {
+		sshPath, err := getSSHPath()
+		if err != nil {
+			fatal(err)
+		}
+		*signers = filepath.Join(sshPath, allowedSignersFile)
+	}
+
+	principals := []string{*identity}
+	if *identity == "" {
+		found, err := findPrincipals(*signers, *sig)
+		if err != nil {
+			fatal(err)
+		}
+		principals = found
+	}
+
+	for _, principal := range principals {
+		content, err := os.Open(file)
+		if err != nil {
+			fatal(err)
+		}
+
+		cmd := exec.Command(toolPath("ssh-keygen"), "-Y", "verify", "-f", *signers, "-I", principal, "-n", *namespace, "-s", *sig)
+		cmd.Stdin = content
+		output, err := cmd.CombinedOutput()
+		content.Close()
+		if err == nil {
+			fmt.Printf("Good signature on %s from %s\n", file, principal)
+			return
+		}
+		if len(principals) == 1 {
+			fatalf("Bad signature on %s: %s", file, strings.TrimSpace(string(output)))
+		}
+	}
+
+	fatalf("Bad signature on %s", file)
+}
+
+// findPrincipals returns the identities in an allowed_signers file whose key
+// made the signature.
+func findPrincipals(signers, sig string) ([]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(toolPath("ssh-keygen"), "-Y", "find-principals", "-f", signers, "-s", sig)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("no allowed signer made this signature: %s", strings.TrimSpace(stderr.String()))
+	}
+	return strings.Fields(string(output)), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// sshfp prints SSHFP records for a host's keys, taken from known_hosts or
+// scanned, or with --verify checks them against the records in DNS.
+func sshfp(args []string) {
+	flags := flag.NewFlagSet("sshfp", flag.ExitOnError)
+	scan := flags.Bool("scan", false, "fetch the host keys with ssh-keyscan even if known_hosts has them")
+	port := flags.String("port", "", "port to scan (default from the ssh config, or 22)")
+	withSHA1 := flags.Bool("sha1", false, "also give SHA-1 records, which only old clients need")
+	verify := flags.Bool("verify", false, "check the records published in DNS against the host keys")
+	server := flags.String("dns-server", "", "DNS server to ask with --verify, as host[:port] (default the first in /etc/resolv.conf)")
+	timeout := flags.Int("timeout", 5, "seconds to wait for the host and the DNS server")
+	plain := flags.Bool("plain", false, "print without color")
+	args = parseFlags(flags, args)
+	if len(args) != 1 {
+		fatalUsage("Usage: keyman sshfp [--scan] [--port p] [--sha1] [--verify [--dns-server addr]] <host>")
+	}
+	target := resolveHostKeyTarget(args[0], *port)
+	if net.ParseIP(target.address) != nil {
+		fatalf("%s connects to %s, an address; SSHFP records are published under a host name", args[0], target.address)
+	}
+
+	keys, source := knownHostKeys(target.name), "known_hosts"
+	if *scan || len(keys) == 0 {
+		var err error
+		keys, err = keyscan(target.address, target.port, "", *timeout)
+		if err != nil {
+			fatalf("Scanning %s: %v", target.address, err)
+		}
+		source = "ssh-keyscan"
+	}
+
+	types := []int{keyman.SSHFPSHA256}
+	if *withSHA1 {
+		types = append(types, keyman.SSHFPSHA1)
+	}
+	var records []keyman.SSHFP
+	for _, key := range keys {
+		if keyman.SSHFPAlgorithm(key) == 0 {
+			fmt.Fprintf(os.Stderr, "Warning: skipping the %s host key, SSHFP has no algorithm number for it\n", key.TypeName())
+			continue
+		}
+		for _, fingerprintType := range types {
+			record, err := keyman.SSHFPRecord(key, fingerprintType)
+			if err != nil {
+				fatal(err)
+			}
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 {
+		fatalf("No host keys of %s have SSHFP records", target.address)
+	}
+
+	name := strings.TrimSuffix(target.address, ".") + "."
+	if !*verify {
+		fmt.Printf("; SSHFP records for the host keys of %s from %s\n", target.address, source)
+		for _, record := range records {
+			fmt.Printf("%s IN SSHFP %s\n", name, record)
+		}
+		return
+	}
+
+	dnsServer := *server
+	if dnsServer == "" {
+		var err error
+		if dnsServer, err = keyman.DefaultDNSServer(); err != nil {
+			fatal(err)
+		}
+	} else if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+		dnsServer = net.JoinHostPort(dnsServer, "53")
+	}
+	published, authenticated, err := keyman.LookupSSHFP(name, dnsServer, time.Duration(*timeout)*time.Second)
+	if err != nil {
+		fatalf("Looking up the SSHFP records of %s: %v", name, err)
+	}
+
+	// Records in DNS count as current if they match a host key with any
+	// fingerprint type, not just the ones asked for.
+	current := make(map[string]bool)
+	for _, key := range keys {
+		for _, fingerprintType := range []int{keyman.SSHFPSHA1, keyman.SSHFPSHA256} {
+			if record, err := keyman.SSHFPRecord(key, fingerprintType); err == nil {
+				current[record.String()] = true
+			}
+		}
+	}
+	inDNS := make(map[string]bool)
+	for _, record := range published {
+		inDNS[strings.ToLower(record.String())] = true
+	}
+
+	problems := 0
+	var rows [][]tableCell
+	for _, record := range records {
+		status := tableCell{text: "published", color: colorGreen}
+		if !inDNS[record.String()] {
+			status = tableCell{text: "missing", color: colorRed}
+			problems++
+		}
+		rows = append(rows, []tableCell{{text: name}, {text: record.String()}, status})
+	}
+	for _, record := range published {
+		if !current[strings.ToLower(record.String())] {
+			rows = append(rows, []tableCell{{text: name}, {text: record.String()}, {text: "matches no host key", color: colorRed}})
+			problems++
+		}
+	}
+	writeTable(os.Stdout, []string{"name", "sshfp", "status"}, rows, useColor(*plain))
+
+	if len(published) > 0 && !authenticated {
+		fmt.Fprintf(os.Stderr, "Warning: %s did not validate the answer with DNSSEC; ssh only trusts SSHFP records from a signed zone\n", dnsServer)
+	}
+	if problems > 0 {
+		os.Exit(exitFindings)
+	}
+}
+
+// knownHostKeys returns the keys known_hosts has for name.
+func knownHostKeys(name string) []*keyman.PublicKey {
+	path, err := getKnownHostsPath()
+	if err != nil {
+		return nil
+	}
+	known, err := keyman.LoadKnownHosts(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: reading %s: %v\n", path, err)
+		return nil
+	}
+	var keys []*keyman.PublicKey
+	for _, entry := range known {
+		if entry.Marker == "" && entry.Matches(name) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	return keys
+}
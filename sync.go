@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/internal/textdiff"
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// The sync repo keeps the SSH config as config and the files it includes
+// under include, by their path from the config's directory. Once keys are
+// synced, keys holds each public key and its private key encrypted like a
+// backup. syncSumsFile, in the repo's .git directory, records what each
+// private key file this machine sealed or took from the repo last held.
+const (
+	syncConfigFile = "config"
+	syncIncludeDir = "include"
+	syncKeysDir    = "keys"
+	syncSealedExt  = ".kmb"
+	syncSumsFile   = "keyman-sums.json"
+)
+
+// syncOptions are what a sync commits and how it unlocks private keys.
+type syncOptions struct {
+	keys           bool
+	private        bool
+	passphraseFile string
+	passphrase     string
+}
+
+// syncCommand keeps the SSH config, and optionally the keys, in a git repo
+// shared between machines.
+func syncCommand(args []string) {
+	if len(args) < 1 {
+		fatalUsage("Usage: keyman sync init|push|pull|status")
+	}
+
+	switch args[0] {
+	case "init":
+		syncInit(args[1:])
+	case "push":
+		syncPush(args[1:])
+	case "pull":
+		syncPull(args[1:])
+	case "status":
+		syncStatus(args[1:])
+	default:
+		fatalUsage("Unknown sync command")
+	}
+}
+
+// getSyncDir returns where the sync repo is checked out.
+func getSyncDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "keyman", "sync"), nil
+}
+
+// openSyncDir returns the sync repo, exiting if there is none yet.
+func openSyncDir() string {
+	dir, err := getSyncDir()
+	if err != nil {
+		fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		fatal("No sync repo yet, set one up with keyman sync init [<remote>]")
+	}
+	return dir
+}
+
+func syncInit(args []string) {
+	flags := flag.NewFlagSet("sync init", flag.ExitOnError)
+	opts := syncFlags(flags)
+	args = parseFlags(flags, args)
+	if len(args) > 1 {
+		fatalUsage("Usage: keyman sync init [--keys] [--private] [--passphrase-file f] [<remote>]")
+	}
+
+	dir, err := getSyncDir()
+	if err != nil {
+		fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		fatalf("%s is already a sync repo", dir)
+	}
+	remote := ""
+	if len(args) == 1 {
+		remote = args[0]
+	}
+	if dryRun {
+		fmt.Printf("Would set up a sync repo in %s\n", dir)
+		return
+	}
+
+	if remote != "" {
+		_, err = runGit("", "clone", "--quiet", remote, dir)
+	} else {
+		_, err = runGit("", "init", "--quiet", dir)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	journal("sync init", dir, "", remote)
+
+	if _, err := os.Stat(filepath.Join(dir, syncConfigFile)); err == nil {
+		// This machine has synced nothing yet, so the clone is not where it
+		// left off: start the branch over, and the first pull merges this
+		// machine's config with the repo's as if they were set up apart.
+		for _, args := range [][]string{{"update-ref", "-d", "HEAD"}, {"rm", "-r", "--quiet", "--cached", "."}, {"clean", "-d", "--force", "--quiet"}} {
+			if _, err := runGit(dir, args...); err != nil {
+				fatal(err)
+			}
+		}
+		fmt.Printf("Cloned %s into %s, keyman sync pull brings in its config\n", remote, dir)
+		return
+	}
+	if !syncCommit(dir, opts) {
+		fmt.Printf("Set up an empty sync repo in %s\n", dir)
+		return
+	}
+	if remote != "" {
+		syncPushRemote(dir)
+	}
+	fmt.Printf("Set up a sync repo in %s\n", dir)
+}
+
+func syncPush(args []string) {
+	flags := flag.NewFlagSet("sync push", flag.ExitOnError)
+	opts := syncFlags(flags)
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman sync push [--keys] [--private] [--passphrase-file f]")
+	}
+	dir := openSyncDir()
+
+	committed := syncCommit(dir, opts)
+	if dryRun {
+		return
+	}
+	if hasSyncRemote(dir) {
+		syncPushRemote(dir)
+		fmt.Println("Pushed to the sync repo")
+	} else if committed {
+		fmt.Println("Committed to the sync repo")
+	} else {
+		fmt.Println("Nothing to sync")
+	}
+}
+
+func syncPull(args []string) {
+	flags := flag.NewFlagSet("sync pull", flag.ExitOnError)
+	ours := flags.Bool("ours", false, "settle conflicts with this machine's config")
+	theirs := flags.Bool("theirs", false, "settle conflicts with the sync repo's config")
+	passphraseFile := flags.String("passphrase-file", "", "passphrase for the synced private keys, from a file or - for stdin")
+	if args = parseFlags(flags, args); len(args) != 0 || (*ours && *theirs) {
+		fatalUsage("Usage: keyman sync pull [--ours | --theirs] [--passphrase-file f]")
+	}
+	dir := openSyncDir()
+	opts := &syncOptions{passphraseFile: *passphraseFile}
+
+	// Commit this machine's changes first, so the merge has them.
+	syncCommit(dir, opts)
+	if hasSyncRemote(dir) {
+		if _, err := runGit(dir, "fetch", "--quiet"); err != nil {
+			fatal(err)
+		}
+	}
+	if _, err := runGit(dir, "rev-parse", "--verify", "--quiet", "@{u}"); err != nil {
+		fmt.Println("The sync repo has no upstream to pull from")
+		return
+	}
+	behind := syncCount(dir, "HEAD..@{u}")
+	if behind == 0 {
+		fmt.Println("Already up to date")
+		return
+	}
+
+	// Each config file merges on its own. Repos set up apart have no commit
+	// in common, and merge as if from empty configs.
+	local, names := localConfigFiles()
+	var base map[string]*keyman.Config
+	if mergeBase, err := runGit(dir, "merge-base", "HEAD", "@{u}"); err == nil {
+		base, _ = syncConfigsAt(dir, strings.TrimSpace(string(mergeBase)))
+	}
+	upstream, upstreamNames := syncConfigsAt(dir, "@{u}")
+	for _, name := range upstreamNames {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	merged := make(map[string]*keyman.Config)
+	var conflicts []keyman.ConfigConflict
+	for _, name := range names {
+		file, found := keyman.MergeConfigs(syncConfigOr(base, name), syncConfigOr(local, name), syncConfigOr(upstream, name), *theirs)
+		for _, conflict := range found {
+			if name != syncConfigFile {
+				conflict.Host = fmt.Sprintf("%s (%s)", conflict.Host, strings.TrimPrefix(name, syncIncludeDir+"/"))
+			}
+			conflicts = append(conflicts, conflict)
+		}
+		// A file that one side stopped including and the other left alone
+		// merges empty, and is dropped.
+		_, inLocal := local[name]
+		_, inUpstream := upstream[name]
+		if len(file.Lines) == 0 && (!inLocal || !inUpstream) {
+			file = nil
+		}
+		merged[name] = file
+	}
+	if len(conflicts) > 0 {
+		printConflicts(conflicts)
+		if !*ours && !*theirs {
+			fatalf("%d conflict(s), nothing pulled: make the configs agree and pull again, or pass --ours or --theirs", len(conflicts))
+		}
+	}
+	if dryRun {
+		for _, name := range names {
+			path := syncLocalPath(name)
+			after := []byte(nil)
+			if merged[name] != nil {
+				after = merged[name].Bytes()
+			}
+			fmt.Print(textdiff.Unified(path, path, syncConfigOr(local, name).Bytes(), after))
+		}
+		fmt.Printf("Would pull %d commit(s) from the sync repo\n", behind)
+		return
+	}
+
+	var err error
+	if syncCount(dir, "@{u}..HEAD") == 0 {
+		_, err = runGit(dir, "merge", "--quiet", "--ff-only", "@{u}")
+	} else {
+		err = syncMerge(dir, merged)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	syncApply(dir, opts)
+	fmt.Printf("Pulled %d commit(s) from the sync repo\n", behind)
+}
+
+// syncMerge merges the upstream branch into the sync repo, with the config
+// files merged host by host rather than by git, and those merged away
+// removed. Any other file git cannot merge stops the pull with the repo as
+// it was.
+func syncMerge(dir string, merged map[string]*keyman.Config) error {
+	// git leaves the conflicts it finds in the worktree for below.
+	runGit(dir, "merge", "--quiet", "--no-ff", "--no-commit", "--allow-unrelated-histories", "@{u}")
+
+	var err error
+	for name, file := range merged {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if file == nil {
+			_, err = runGit(dir, "rm", "--quiet", "--force", "--ignore-unmatch", "--", name)
+		} else {
+			err = writeSyncFile(path, file.Bytes())
+			if err == nil {
+				_, err = runGit(dir, "add", "--", name)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		var unmerged []byte
+		unmerged, err = runGit(dir, "diff", "--name-only", "--diff-filter=U")
+		if files := strings.Fields(string(unmerged)); err == nil && len(files) > 0 {
+			err = fmt.Errorf("could not merge %s in the sync repo, nothing pulled", strings.Join(files, ", "))
+		}
+	}
+	if err != nil {
+		runGit(dir, "merge", "--abort")
+		return err
+	}
+	_, err = runGit(dir, "commit", "--quiet", "--no-edit")
+	return err
+}
+
+func syncStatus(args []string) {
+	flags := flag.NewFlagSet("sync status", flag.ExitOnError)
+	plain := flags.Bool("plain", false, "print without color")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman sync status [--plain]")
+	}
+	dir := openSyncDir()
+
+	fmt.Printf("Sync repo: %s\n", dir)
+	if remote, err := runGit(dir, "remote", "get-url", "origin"); err == nil {
+		fmt.Printf("Remote: %s\n", strings.TrimSpace(string(remote)))
+	}
+	if last, err := runGit(dir, "log", "-1", "--format=%h %s (%cr)"); err == nil && len(last) > 0 {
+		fmt.Printf("Last sync: %s\n", strings.TrimSpace(string(last)))
+	}
+	if _, err := runGit(dir, "rev-parse", "--verify", "--quiet", "@{u}"); err == nil {
+		fmt.Printf("Ahead: %d, behind: %d commit(s) as of the last fetch\n", syncCount(dir, "@{u}..HEAD"), syncCount(dir, "HEAD..@{u}"))
+	}
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		fatal(err)
+	}
+	changes := keyman.DiffConfigs(syncConfigList(syncConfigsAt(dir, "HEAD")), syncConfigList(localConfigFiles()))
+	if len(changes) == 0 {
+		fmt.Println("The config is in sync")
+		return
+	}
+	fmt.Println()
+	printConfigChanges(changes, "synced", configPath, useColor(*plain))
+}
+
+// syncFlags adds the flags that choose what a sync commits.
+func syncFlags(flags *flag.FlagSet) *syncOptions {
+	opts := &syncOptions{}
+	flags.BoolVar(&opts.keys, "keys", false, "also sync the public keys, from now on")
+	flags.BoolVar(&opts.private, "private", false, "also sync the private keys, encrypted with a passphrase, from now on")
+	flags.StringVar(&opts.passphraseFile, "passphrase-file", "", "passphrase for the synced private keys, from a file or - for stdin")
+	return opts
+}
+
+// syncCommit copies the config, the files it includes and the synced keys
+// into the sync repo and commits them if anything changed. Keys are synced
+// once the repo has any, and private keys once it has any of those.
+func syncCommit(dir string, opts *syncOptions) bool {
+	configPath, err := getConfigPath()
+	if err != nil {
+		fatal(err)
+	}
+	local, names := localConfigFiles()
+
+	if dryRun {
+		changes := keyman.DiffConfigs(syncConfigList(syncConfigsAt(dir, "HEAD")), syncConfigList(local, names))
+		if len(changes) > 0 {
+			printConfigChanges(changes, "synced", configPath, useColor(false))
+			fmt.Printf("Would commit %d config change(s) to the sync repo\n", len(changes))
+		}
+		return false
+	}
+
+	// Included files are written afresh, so those no longer included go.
+	if err := os.RemoveAll(filepath.Join(dir, syncIncludeDir)); err != nil {
+		fatal(err)
+	}
+	for _, name := range names {
+		if err := writeSyncFile(filepath.Join(dir, filepath.FromSlash(name)), local[name].Bytes()); err != nil {
+			fatal(err)
+		}
+	}
+	keysDir := filepath.Join(dir, syncKeysDir)
+	sealed, _ := filepath.Glob(filepath.Join(keysDir, "*"+syncSealedExt))
+	opts.private = opts.private || len(sealed) > 0
+	if _, err := os.Stat(keysDir); err == nil || opts.keys || opts.private {
+		if err := syncKeys(dir, opts); err != nil {
+			fatal(err)
+		}
+	}
+
+	if _, err := runGit(dir, "add", "--all"); err != nil {
+		fatal(err)
+	}
+	status, err := runGit(dir, "status", "--porcelain")
+	if err != nil {
+		fatal(err)
+	}
+	if len(bytes.TrimSpace(status)) == 0 {
+		return false
+	}
+	hostname, _ := os.Hostname()
+	if _, err := runGit(dir, "commit", "--quiet", "-m", "Sync from "+orDefault(hostname, "keyman")); err != nil {
+		fatal(err)
+	}
+	head, _ := runGit(dir, "rev-parse", "--short", "HEAD")
+	journal("sync commit", dir, "", strings.TrimSpace(string(head)))
+	return true
+}
+
+// syncKeys copies the public key of every local key into the repo's keys,
+// along with its private key sealed with the sync passphrase when private
+// keys are synced, and drops the keys that are gone. A sealed private key
+// is kept for a key whose private key is not on this machine. A private
+// key is only sealed again when its file changed here since this machine
+// last sealed or took it, as a new passphrase or format changes it, so
+// unchanged keys do not show up as changes and an older copy of a key
+// changed elsewhere is not sealed over the newer one.
+func syncKeys(dir string, opts *syncOptions) error {
+	keysDir := filepath.Join(dir, syncKeysDir)
+	keys, err := getKeys()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		return err
+	}
+	sums := loadSyncSums(dir)
+
+	synced := make(map[string]bool)
+	for _, key := range keys {
+		if key.Token != "" || key.MissingPublic {
+			continue
+		}
+		pub, err := os.ReadFile(key.Path)
+		if err != nil {
+			return err
+		}
+		pubPath := filepath.Join(keysDir, key.Name+keyFileExt)
+		sealedPath := filepath.Join(keysDir, key.Name+syncSealedExt)
+		synced[key.Name+keyFileExt] = true
+		if err := os.WriteFile(pubPath, pub, 0644); err != nil {
+			return err
+		}
+		if !opts.private {
+			continue
+		}
+		synced[key.Name+syncSealedExt] = true
+		if key.MissingPrivate {
+			// Only the public key is here, so the private key sealed by
+			// another machine stays as it is.
+			continue
+		}
+		privatePath := strings.TrimSuffix(key.Path, keyFileExt)
+		private, err := os.ReadFile(privatePath)
+		if err != nil {
+			return err
+		}
+		sum := fmt.Sprintf("%x", sha256.Sum256(private))
+		if _, err := os.Stat(sealedPath); err == nil {
+			// A key sealed before this machine kept sums is taken as synced.
+			if previous, ok := sums[key.Name]; !ok || previous == sum {
+				sums[key.Name] = sum
+				continue
+			}
+		}
+		archive, err := archiveFiles(filepath.Dir(privatePath), []string{privatePath})
+		if err != nil {
+			return err
+		}
+		if err := opts.unlock(true); err != nil {
+			return err
+		}
+		sealed, err := encryptBackup(archive, opts.passphrase)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(sealedPath, sealed, 0600); err != nil {
+			return err
+		}
+		sums[key.Name] = sum
+	}
+	if err := saveSyncSums(dir, sums); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(keysDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !synced[entry.Name()] {
+			if err := os.Remove(filepath.Join(keysDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncApply brings the sync repo's config files and keys into the ssh
+// directory. Keys are only ever added: one this machine already has is
+// left alone, with a warning if it differs.
+func syncApply(dir string, opts *syncOptions) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		fatal(err)
+	}
+	synced, names := syncConfigsAt(dir, "HEAD")
+	var changed []*keyman.Config
+	var paths []string
+	for _, name := range names {
+		file := synced[name]
+		original, err := os.ReadFile(file.Path)
+		if err != nil && !os.IsNotExist(err) {
+			fatal(err)
+		}
+		if err == nil && bytes.Equal(original, file.Bytes()) {
+			continue
+		}
+		if showDiff {
+			fmt.Print(textdiff.Unified(file.Path, file.Path, original, file.Bytes()))
+		}
+		changed = append(changed, file)
+		paths = append(paths, file.Path)
+	}
+	if len(changed) > 0 {
+		if err := snapshotConfigs(changed); err != nil {
+			fatal(err)
+		}
+		for _, file := range changed {
+			if err := writeSyncFile(file.Path, file.Bytes()); err != nil {
+				fatal(err)
+			}
+		}
+		head, _ := runGit(dir, "rev-parse", "--short", "HEAD")
+		journal("sync pull", configPath, "", strings.TrimSpace(string(head)))
+		fmt.Printf("Updated %s, keyman undo restores the previous config\n", strings.Join(paths, ", "))
+	}
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, syncKeysDir))
+	if err != nil && !os.IsNotExist(err) {
+		fatal(err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		synced := filepath.Join(dir, syncKeysDir, name)
+		switch filepath.Ext(name) {
+		case keyFileExt:
+			if syncKeyFile(synced, filepath.Join(sshPath, name)) {
+				fmt.Printf("Added public key %s\n", name)
+			}
+		case syncSealedExt:
+			keyName := strings.TrimSuffix(name, syncSealedExt)
+			if _, err := os.Stat(filepath.Join(sshPath, keyName)); err == nil {
+				continue
+			}
+			sealed, err := os.ReadFile(synced)
+			if err != nil {
+				fatal(err)
+			}
+			if err := opts.unlock(false); err != nil {
+				fatal(err)
+			}
+			archive, err := decryptBackup(sealed, opts.passphrase)
+			if err != nil {
+				fatalf("%s: %v", name, err)
+			}
+			if _, err := extractArchive(archive, sshPath, false); err != nil {
+				fatal(err)
+			}
+			if private, err := os.ReadFile(filepath.Join(sshPath, keyName)); err == nil {
+				sums := loadSyncSums(dir)
+				sums[keyName] = fmt.Sprintf("%x", sha256.Sum256(private))
+				if err := saveSyncSums(dir, sums); err != nil {
+					fatal(err)
+				}
+			}
+			journal("sync pull", filepath.Join(sshPath, keyName), "", keyFingerprint(filepath.Join(sshPath, keyName)))
+			fmt.Printf("Added private key %s\n", keyName)
+		}
+	}
+}
+
+// syncKeyFile copies a synced public key into place unless there is one
+// already, and reports whether it did.
+func syncKeyFile(synced, local string) bool {
+	content, err := os.ReadFile(synced)
+	if err != nil {
+		fatal(err)
+	}
+	existing, err := os.ReadFile(local)
+	if err == nil {
+		if !bytes.Equal(existing, content) {
+			fmt.Fprintf(os.Stderr, "Warning: %s differs from the synced copy, keeping this machine's\n", local)
+		}
+		return false
+	}
+	if err := os.WriteFile(local, content, 0644); err != nil {
+		fatal(err)
+	}
+	return true
+}
+
+// loadSyncSums reads the sums of the private key files this machine last
+// sealed or took from the sync repo, by key name.
+func loadSyncSums(dir string) map[string]string {
+	sums := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(dir, ".git", syncSumsFile))
+	if err == nil {
+		err = json.Unmarshal(data, &sums)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	return sums
+}
+
+func saveSyncSums(dir string, sums map[string]string) error {
+	data, err := json.MarshalIndent(sums, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ".git", syncSumsFile), data, 0600)
+}
+
+// unlock asks for the sync passphrase the first time a private key needs
+// it.
+func (o *syncOptions) unlock(confirm bool) error {
+	if o.passphrase != "" {
+		return nil
+	}
+	passphrase, err := getPassphrase(o.passphraseFile, "Sync passphrase: ", confirm)
+	o.passphrase = passphrase
+	return err
+}
+
+// localConfigFiles returns this machine's config and the files it
+// includes, keyed by where the sync repo keeps them, and those keys in
+// order. Included files outside the config's directory are left out with
+// a warning, as there is no telling where they belong on another machine.
+func localConfigFiles() (map[string]*keyman.Config, []string) {
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	baseDir := filepath.Dir(config.Path)
+
+	files := make(map[string]*keyman.Config)
+	var names []string
+	for i, file := range config.Files() {
+		name := syncConfigFile
+		if i > 0 {
+			rel, err := filepath.Rel(baseDir, file.Path)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				fmt.Fprintf(os.Stderr, "Warning: not syncing %s, it is outside %s\n", file.Path, baseDir)
+				continue
+			}
+			name = syncIncludeDir + "/" + filepath.ToSlash(rel)
+		}
+		if _, ok := files[name]; !ok {
+			files[name] = file
+			names = append(names, name)
+		}
+	}
+	return files, names
+}
+
+// syncLocalPath returns where the config file the sync repo keeps as name
+// goes on this machine.
+func syncLocalPath(name string) string {
+	configPath, err := getConfigPath()
+	if err != nil {
+		fatal(err)
+	}
+	if name == syncConfigFile {
+		return configPath
+	}
+	rel := strings.TrimPrefix(name, syncIncludeDir+"/")
+	return filepath.Join(filepath.Dir(configPath), filepath.FromSlash(rel))
+}
+
+// syncConfigsAt returns the config files the sync repo had at rev, keyed
+// like localConfigFiles and parsed as the files they are on this machine,
+// and those keys in order. A rev that does not exist yet has none.
+func syncConfigsAt(dir, rev string) (map[string]*keyman.Config, []string) {
+	files := make(map[string]*keyman.Config)
+	listing, err := runGit(dir, "ls-tree", "-r", "--name-only", rev, "--", syncConfigFile, syncIncludeDir)
+	if err != nil {
+		return files, nil
+	}
+	names := strings.Fields(string(listing))
+	for _, name := range names {
+		content, err := runGit(dir, "show", rev+":"+name)
+		if err != nil {
+			fatal(err)
+		}
+		files[name] = keyman.ParseConfigBytes(syncLocalPath(name), content)
+	}
+	return files, names
+}
+
+// syncConfigOr returns the config file kept as name, or an empty one.
+func syncConfigOr(files map[string]*keyman.Config, name string) *keyman.Config {
+	if file, ok := files[name]; ok {
+		return file
+	}
+	return keyman.ParseConfigBytes(syncLocalPath(name), nil)
+}
+
+// syncConfigList returns files in order, as DiffConfigs takes them.
+func syncConfigList(files map[string]*keyman.Config, names []string) []*keyman.Config {
+	var list []*keyman.Config
+	for _, name := range names {
+		list = append(list, files[name])
+	}
+	return list
+}
+
+// writeSyncFile writes a config file, creating the directory it goes in.
+func writeSyncFile(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0600)
+}
+
+// syncCount counts the commits in a git revision range.
+func syncCount(dir, revisions string) int {
+	output, err := runGit(dir, "rev-list", "--count", revisions)
+	if err != nil {
+		fatal(err)
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(string(output)))
+	return count
+}
+
+func hasSyncRemote(dir string) bool {
+	remotes, err := runGit(dir, "remote")
+	return err == nil && len(bytes.TrimSpace(remotes)) > 0
+}
+
+// syncPushRemote pushes the sync repo's branch, which git refuses when the
+// remote has commits this machine has not pulled yet.
+func syncPushRemote(dir string) {
+	_, err := runGit(dir, "push", "--quiet", "--set-upstream", "origin", "HEAD")
+	if err != nil && strings.Contains(err.Error(), "[rejected]") {
+		fatal("The sync repo has changes from elsewhere, keyman sync pull merges them first")
+	}
+	if err != nil {
+		fatal(err)
+	}
+	head, _ := runGit(dir, "rev-parse", "--short", "HEAD")
+	journal("sync push", dir, "", strings.TrimSpace(string(head)))
+}
+
+// printConflicts lists the hosts and options a pull could not merge.
+func printConflicts(conflicts []keyman.ConfigConflict) {
+	var rows [][]tableCell
+	for _, conflict := range conflicts {
+		rows = append(rows, []tableCell{
+			{text: conflict.Host},
+			{text: conflict.Keyword},
+			{text: conflict.Ours, color: colorYellow},
+			{text: conflict.Theirs, color: colorYellow},
+		})
+	}
+	writeTable(os.Stderr, []string{"host", "option", "this machine", "sync repo"}, rows, useColor(false))
+}
+
+// runGit runs git in dir, or in the current directory when dir is empty,
+// returning its output, or its error message on failure.
+func runGit(dir string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git not found: install it to sync")
+	}
+	command := args[0]
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// ANSI colors for table cells.
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+	colorBold   = "1"
+)
+
+const defaultKeyColumns = "name,type,fingerprint,created,last-used,status,comment"
+
+// tableOptions are the flags shared by the commands that print key tables.
+type tableOptions struct {
+	plain   *bool
+	sortBy  *string
+	columns *string
+	format  *string
+}
+
+func addTableFlags(flags *flag.FlagSet) tableOptions {
+	return tableOptions{
+		plain:   flags.Bool("plain", false, "print without color"),
+		sortBy:  flags.String("sort", "name", "sort by name, type, age, created, last-used, status or expires; prefix with - to reverse"),
+		columns: flags.String("columns", defaultKeyColumns, "comma separated columns: name, type, fingerprint, md5, created, modified, age, last-used, status, comment, tags, owner, expires, cert"),
+		format:  flags.String("format", "", `print each key through a Go template instead, such as '{{.Name}} {{.Fingerprint}} {{join .Hosts ","}}'`),
+	}
+}
+
+// useColor reports whether output should be colored, following the color
+// setting, which NO_COLOR turns off, and whether stdout is a terminal.
+func useColor(plain bool) bool {
+	switch {
+	case plain || settings.Color == "never":
+		return false
+	case settings.Color == "always":
+		return true
+	}
+	return isTerminal(os.Stdout) && os.Getenv("TERM") != "dumb"
+}
+
+func paint(text, color string, enabled bool) string {
+	if !enabled || color == "" || text == "" {
+		return text
+	}
+	return "\x1b[" + color + "m" + text + "\x1b[0m"
+}
+
+// severityColor is the color findings of a severity are shown in.
+func severityColor(severity keyman.Severity) string {
+	switch severity {
+	case keyman.SeverityError:
+		return colorRed
+	case keyman.SeverityWarning:
+		return colorYellow
+	}
+	return ""
+}
+
+type tableCell struct {
+	text  string
+	color string
+}
+
+// writeTable writes rows as aligned columns under headers.
+func writeTable(w io.Writer, headers []string, rows [][]tableCell, color bool) {
+	widths := make([]int, len(headers))
+	for i, header := range headers {
+		widths[i] = len([]rune(header))
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := len([]rune(cell.text)); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	line := func(cells []tableCell) {
+		var b strings.Builder
+		for i, cell := range cells {
+			b.WriteString(paint(cell.text, cell.color, color))
+			if i < len(cells)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-len([]rune(cell.text))+2))
+			}
+		}
+		fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+	}
+
+	headerCells := make([]tableCell, len(headers))
+	for i, header := range headers {
+		headerCells[i] = tableCell{strings.ToUpper(header), colorBold}
+	}
+	line(headerCells)
+	for _, row := range rows {
+		line(row)
+	}
+}
+
+// keyStatus sums up how a key stands, worst first: expired, weak,
+// incomplete, unused, expiring or ok.
+func keyStatus(key keyman.KeyStatus, weak map[string]bool, now time.Time) tableCell {
+	cert := key.Certificate
+	switch {
+	case key.Metadata.Expired(now) || (cert != nil && cert.Expired(now)):
+		return tableCell{"expired", colorRed}
+	case weak[key.Name]:
+		return tableCell{"weak", colorRed}
+	case key.MissingPublic || key.MissingPrivate:
+		return tableCell{"incomplete", colorYellow}
+	case !key.InUse:
+		return tableCell{"unused", colorYellow}
+	case key.Metadata.ExpiresWithin(now, expiryWarningWindow) || (cert != nil && cert.ExpiresWithin(now, expiryWarningWindow)):
+		return tableCell{"expiring", colorYellow}
+	}
+	return tableCell{"ok", colorGreen}
+}
+
+// keyColumn returns a column's value for key.
+func keyColumn(column string, key keyman.KeyStatus, status tableCell) (tableCell, bool) {
+	meta := key.Metadata
+	switch column {
+	case "name":
+		return tableCell{text: key.Name}, true
+	case "type":
+		keyType := "unknown"
+		if key.Public != nil {
+			keyType = fmt.Sprintf("%s %d", key.Public.TypeName(), key.Public.Bits())
+			if key.Public.IsSecurityKey() {
+				keyType += " sk"
+			}
+		}
+		return tableCell{text: keyType}, true
+	case "fingerprint":
+		return tableCell{text: reportFingerprint(key)}, true
+	case "md5":
+		if key.Public == nil {
+			return tableCell{}, true
+		}
+		return tableCell{text: key.Public.FingerprintMD5()}, true
+	case "created":
+		if key.Token != "" {
+			return tableCell{}, true
+		}
+		return tableCell{text: key.Created.Format("2006-01-02")}, true
+	case "modified":
+		if key.Token != "" {
+			return tableCell{}, true
+		}
+		return tableCell{text: key.Modified.Format("2006-01-02")}, true
+	case "age":
+		if key.Token != "" {
+			return tableCell{}, true
+		}
+		return tableCell{text: ageString(key.Age)}, true
+	case "last-used":
+		if meta == nil || meta.LastUsed == nil {
+			return tableCell{text: "never"}, true
+		}
+		return tableCell{text: meta.LastUsed.Format("2006-01-02")}, true
+	case "status":
+		return status, true
+	case "comment":
+		return tableCell{text: key.Comment}, true
+	case "tags":
+		if meta == nil {
+			return tableCell{}, true
+		}
+		return tableCell{text: strings.Join(meta.Tags, ",")}, true
+	case "owner":
+		if meta == nil {
+			return tableCell{}, true
+		}
+		return tableCell{text: meta.Owner}, true
+	case "expires":
+		at := expires(key)
+		if at.Equal(never) {
+			return tableCell{}, true
+		}
+		return tableCell{text: at.Format("2006-01-02")}, true
+	case "cert":
+		return certCell(key.Certificate, time.Now()), true
+	}
+	return tableCell{}, false
+}
+
+// certCell sums up a key's certificate for the cert column: its
+// principals, when it stops being valid and the CA that signed it, colored
+// like the status column when it has expired or is about to.
+func certCell(cert *keyman.Certificate, now time.Time) tableCell {
+	if cert == nil {
+		return tableCell{}
+	}
+	principals := strings.Join(cert.Principals, ",")
+	if principals == "" {
+		principals = "any principal"
+	}
+	until := "forever"
+	if !cert.Forever() {
+		until = "until " + cert.ValidBefore.Format("2006-01-02")
+	}
+	cell := tableCell{text: fmt.Sprintf("%s %s, CA %s", principals, until, cert.SignatureKey.FingerprintSHA256())}
+	switch {
+	case cert.Expired(now):
+		cell.color = colorRed
+	case cert.ExpiresWithin(now, expiryWarningWindow):
+		cell.color = colorYellow
+	}
+	return cell
+}
+
+// ageString shows a duration in the largest whole unit that fits.
+func ageString(age time.Duration) string {
+	days := int(age.Hours() / 24)
+	switch {
+	case days >= 365:
+		return fmt.Sprintf("%dy", days/365)
+	case days >= 1:
+		return fmt.Sprintf("%dd", days)
+	}
+	return fmt.Sprintf("%dh", int(age.Hours()))
+}
+
+// sortKeys orders keys by a column, or in reverse with a leading -.
+func sortKeys(keys []keyman.KeyStatus, by string, statuses map[string]tableCell) error {
+	reverse := strings.HasPrefix(by, "-")
+	by = strings.TrimPrefix(by, "-")
+
+	var less func(a, b keyman.KeyStatus) bool
+	switch by {
+	case "name":
+		less = func(a, b keyman.KeyStatus) bool { return a.Name < b.Name }
+	case "type":
+		less = func(a, b keyman.KeyStatus) bool {
+			ta, _ := keyColumn("type", a, tableCell{})
+			tb, _ := keyColumn("type", b, tableCell{})
+			return ta.text < tb.text
+		}
+	case "age":
+		less = func(a, b keyman.KeyStatus) bool { return a.Age < b.Age }
+	case "created":
+		less = func(a, b keyman.KeyStatus) bool { return a.Created.Before(b.Created) }
+	case "last-used":
+		less = func(a, b keyman.KeyStatus) bool { return lastUsed(a).Before(lastUsed(b)) }
+	case "status":
+		less = func(a, b keyman.KeyStatus) bool { return statuses[a.Name].text < statuses[b.Name].text }
+	case "expires":
+		less = func(a, b keyman.KeyStatus) bool { return expires(a).Before(expires(b)) }
+	default:
+		return fmt.Errorf("unknown sort column %q", by)
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		if reverse {
+			return less(keys[j], keys[i])
+		}
+		return less(keys[i], keys[j])
+	})
+	return nil
+}
+
+func lastUsed(key keyman.KeyStatus) time.Time {
+	if key.Metadata == nil || key.Metadata.LastUsed == nil {
+		return time.Time{}
+	}
+	return *key.Metadata.LastUsed
+}
+
+// never is when keys that do not expire expire, so they sort last.
+var never = time.Unix(1<<62, 0)
+
+// expires returns when a key expires, by its metadata or its certificate,
+// whichever is first, or never.
+func expires(key keyman.KeyStatus) time.Time {
+	at := never
+	if key.Metadata != nil && key.Metadata.Expires != nil {
+		at = *key.Metadata.Expires
+	}
+	if cert := key.Certificate; cert != nil && !cert.Forever() && cert.ValidBefore.Before(at) {
+		at = cert.ValidBefore
+	}
+	return at
+}
+
+// printKeyTable prints keys as a table with the columns and order chosen
+// in opts, coloring each key's status, or through the --format template,
+// which also sees the findings about each key.
+func printKeyTable(keys []keyman.KeyStatus, weak, findings []keyman.Finding, opts tableOptions) {
+	var tmpl *template.Template
+	if *opts.format != "" {
+		tmpl = parseFormat(*opts.format)
+	}
+	columns := strings.Split(*opts.columns, ",")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+		if _, ok := keyColumn(columns[i], keyman.KeyStatus{}, tableCell{}); !ok && tmpl == nil {
+			fatalUsagef("Unknown column %q", columns[i])
+		}
+	}
+
+	weakKeys := make(map[string]bool)
+	for _, finding := range weak {
+		weakKeys[finding.Subject] = true
+	}
+	now := time.Now()
+	statuses := make(map[string]tableCell)
+	for _, key := range keys {
+		statuses[key.Name] = keyStatus(key, weakKeys, now)
+	}
+
+	sorted := append([]keyman.KeyStatus{}, keys...)
+	if err := sortKeys(sorted, *opts.sortBy, statuses); err != nil {
+		fatalUsage(err)
+	}
+	if tmpl != nil {
+		printKeysFormat(tmpl, sorted, weak, findings)
+		return
+	}
+
+	var rows [][]tableCell
+	for _, key := range sorted {
+		var row []tableCell
+		for _, column := range columns {
+			cell, _ := keyColumn(column, key, statuses[key.Name])
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+	}
+	writeTable(os.Stdout, columns, rows, useColor(*opts.plain))
+}
+
+// keyStatuses audits keys against the ssh config for the table's status
+// column.
+func keyStatuses(keys []keyman.Key) ([]keyman.KeyStatus, []keyman.Finding, error) {
+	config, err := parseConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	report := keyman.Audit(keys, config, 90*24*time.Hour)
+	return report.Keys, keyman.CheckStrength(keys), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// Where a hardware-backed key was found, as tokens shows it.
+const (
+	tokenSourceAgent    = "ssh-agent"
+	tokenSourceResident = "resident"
+)
+
+// tokenKey is a key that lives only on a hardware token, with the hosts
+// that use it.
+type tokenKey struct {
+	key    keyman.Key
+	source string
+	hosts  []string
+	inUse  bool
+}
+
+// tokenJSON is the JSON form of a key printed by tokens --json.
+type tokenJSON struct {
+	Name        string   `json:"name"`
+	Token       string   `json:"token"`
+	Type        string   `json:"type"`
+	Algorithm   string   `json:"algorithm"`
+	Fingerprint string   `json:"fingerprint"`
+	Comment     string   `json:"comment,omitempty"`
+	Provider    string   `json:"provider,omitempty"`
+	Application string   `json:"application,omitempty"`
+	Source      string   `json:"source"`
+	Hosts       []string `json:"hosts"`
+}
+
+// addTokenFlags adds the flags that say where to look for hardware-backed
+// keys besides the ssh config's PKCS11Provider options and ssh-agent.
+func addTokenFlags(flags *flag.FlagSet) (*string, *bool) {
+	providers := flags.String("provider", "", "also list the keys of these PKCS#11 libraries, comma separated")
+	resident := flags.Bool("resident", false, "also list the resident keys on attached FIDO tokens, which asks for the PIN")
+	return providers, resident
+}
+
+// listTokens lists the keys on PKCS#11 tokens and FIDO security keys that
+// have no files in the ssh directory, with the hosts that use them.
+func listTokens(args []string) {
+	flags := flag.NewFlagSet("tokens", flag.ExitOnError)
+	providers, resident := addTokenFlags(flags)
+	asJSON := flags.Bool("json", settings.Output == "json", "print the keys as JSON")
+	plain := flags.Bool("plain", false, "print without color")
+	if args = parseFlags(flags, args); len(args) != 0 {
+		fatalUsage("Usage: keyman tokens [--provider lib,lib] [--resident] [--json] [--plain]")
+	}
+
+	tokens, err := findTokenKeys(*providers, *resident)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *asJSON {
+		out := []tokenJSON{}
+		for _, token := range tokens {
+			pub := token.key.Public
+			hosts := token.hosts
+			if hosts == nil {
+				hosts = []string{}
+			}
+			out = append(out, tokenJSON{
+				Name:        token.key.Name,
+				Token:       token.key.Token,
+				Type:        fmt.Sprintf("%s %d", pub.TypeName(), pub.Bits()),
+				Algorithm:   pub.Algorithm,
+				Fingerprint: pub.FingerprintSHA256(),
+				Comment:     token.key.Comment,
+				Provider:    token.key.Provider,
+				Application: pub.Application(),
+				Source:      token.source,
+				Hosts:       hosts,
+			})
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(out); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if len(tokens) == 0 {
+		fmt.Println("No hardware-backed keys found")
+		return
+	}
+	var rows [][]tableCell
+	for _, token := range tokens {
+		pub := token.key.Public
+		hosts := tableCell{text: strings.Join(token.hosts, ", ")}
+		if !token.inUse {
+			hosts = tableCell{text: "unused", color: colorYellow}
+		} else if len(token.hosts) == 0 {
+			hosts.text = "any, through ssh-agent"
+		}
+		rows = append(rows, []tableCell{
+			{text: token.key.Name},
+			{text: fmt.Sprintf("%s %d", pub.TypeName(), pub.Bits())},
+			{text: pub.FingerprintSHA256()},
+			{text: token.source},
+			hosts,
+		})
+	}
+	writeTable(os.Stdout, []string{"name", "type", "fingerprint", "source", "hosts"}, rows, useColor(*plain))
+}
+
+// findTokenKeys finds the keys that live only on hardware: those of each
+// PKCS#11 library in the comma separated providerList or named by a
+// PKCS11Provider option, read with ssh-keygen -D, and security keys held
+// by ssh-agent, such as resident keys loaded with ssh-add -K, that are not
+// in the ssh directory. With resident, the resident keys of attached FIDO
+// tokens are read with ssh-keygen -K as well. A library or agent that
+// cannot be read is warned about and skipped.
+func findTokenKeys(providerList string, resident bool) ([]tokenKey, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	var providers []string
+	for _, provider := range append(strings.Split(providerList, ","), config.PKCS11Providers()...) {
+		if provider = strings.TrimSpace(provider); provider == "" {
+			continue
+		}
+		if provider, err = keyman.ExpandPath(provider); err != nil {
+			return nil, err
+		}
+		if !containsString(providers, provider) {
+			providers = append(providers, provider)
+		}
+	}
+	fileKeys, err := getKeys()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, key := range fileKeys {
+		if key.Public != nil {
+			seen[string(key.Public.Blob)] = true
+		}
+	}
+
+	var tokens []tokenKey
+	for _, provider := range providers {
+		keys, err := readPKCS11Keys(provider)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: reading keys from %s: %v\n", provider, err)
+			continue
+		}
+		hosts := config.ProviderHosts(provider)
+		for _, key := range keys {
+			seen[string(key.Public.Blob)] = true
+			tokens = append(tokens, tokenKey{key: key, source: provider, hosts: hosts, inUse: len(hosts) > 0})
+		}
+	}
+
+	if agentAvailable() {
+		loaded, err := agentPublicKeys()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: listing ssh-agent keys: %v\n", err)
+		}
+		for _, pub := range loaded {
+			if pub.IsSecurityKey() && !seen[string(pub.Blob)] {
+				seen[string(pub.Blob)] = true
+				tokens = append(tokens, tokenKey{key: keyman.FIDOKey(pub), source: tokenSourceAgent, inUse: true})
+			}
+		}
+	}
+
+	if resident {
+		keys, err := readResidentKeys()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: reading resident keys: %v\n", err)
+		}
+		for _, pub := range keys {
+			if !seen[string(pub.Blob)] {
+				seen[string(pub.Blob)] = true
+				tokens = append(tokens, tokenKey{key: keyman.FIDOKey(pub), source: tokenSourceResident})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// readPKCS11Keys lists the keys on the tokens a PKCS#11 library gives
+// access to.
+func readPKCS11Keys(provider string) ([]keyman.Key, error) {
+	cmd := exec.Command(toolPath("ssh-keygen"), "-D", provider)
+	cmd.Stdin = os.Stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return keyman.ParsePKCS11Keys(provider, output), nil
+}
+
+// readResidentKeys reads the public halves of the resident keys on the
+// attached FIDO tokens. ssh-keygen -K asks for each token's PIN and writes
+// the key handles to a directory of its own, removed afterwards.
+func readResidentKeys() ([]*keyman.PublicKey, error) {
+	dir, err := os.MkdirTemp("", "keyman-resident-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(toolPath("ssh-keygen"), "-K", "-N", "")
+	cmd.Dir = dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	keys, err := keyman.ListKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	var pubs []*keyman.PublicKey
+	for _, key := range keys {
+		if key.Public != nil && key.Public.IsSecurityKey() {
+			pubs = append(pubs, key.Public)
+		}
+	}
+	return pubs, nil
+}
+
+// tokenStatuses turns hardware-backed keys into rows for the list table,
+// with the hosts each is used by for its --host filter.
+func tokenStatuses(tokens []tokenKey) ([]keyman.KeyStatus, map[string][]string) {
+	var statuses []keyman.KeyStatus
+	hosts := make(map[string][]string)
+	for _, token := range tokens {
+		statuses = append(statuses, keyman.KeyStatus{Key: token.key, InUse: token.inUse})
+		hosts[token.key.Name] = token.hosts
+	}
+	return statuses, hosts
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// sshLogFile is where keyman looks for ssh client logs by default, for
+// use with ssh -E ~/.ssh/.keyman/ssh.log -o LogLevel=DEBUG1.
+const sshLogFile = "ssh.log"
+
+// recordKeyUse notes that the key at keyPath just logged in to host.
+// Failing to record it is only reported.
+func recordKeyUse(keyPath, host string) {
+	if dryRun {
+		return
+	}
+
+	metadata, err := loadMetadata()
+	if err == nil && metadata.RecordUse(filepath.Base(keyPath), host, time.Now()) {
+		err = metadata.Save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not record the use of %s: %v\n", filepath.Base(keyPath), err)
+	}
+}
+
+func keyUsage(args []string) {
+	if len(args) > 0 && args[0] == "import" {
+		importUsage(args[1:])
+		return
+	}
+	if len(args) > 0 {
+		fatalUsage("Usage: keyman usage [import [<log>...]]")
+	}
+
+	keys, err := getKeys()
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, key := range keys {
+		fmt.Printf("Key: %s\nLast Used: %s\n\n", key.Name, lastUsedString(key.Metadata))
+	}
+}
+
+// importUsage records the key logins found in ssh client logs.
+func importUsage(args []string) {
+	flags := flag.NewFlagSet("usage import", flag.ExitOnError)
+	args = parseFlags(flags, args)
+
+	sshPath, err := getSSHPath()
+	if err != nil {
+		fatal(err)
+	}
+	if len(args) == 0 {
+		args = []string{filepath.Join(sshPath, keymanDir, sshLogFile)}
+	}
+
+	metadata, err := loadMetadata()
+	if err != nil {
+		fatal(err)
+	}
+
+	recorded := 0
+	for _, path := range args {
+		file, err := os.Open(path)
+		if err != nil {
+			fatal(err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			fatal(err)
+		}
+		uses, err := keyman.ParseSSHLog(file, info.ModTime())
+		file.Close()
+		if err != nil {
+			fatalf("Reading %s failed: %v", path, err)
+		}
+
+		for _, use := range uses {
+			// Only keys in the ssh directory are tracked.
+			keyPath, err := keyman.ExpandPath(use.KeyPath)
+			if err != nil || filepath.Dir(keyPath) != sshPath {
+				continue
+			}
+			if metadata.RecordUse(filepath.Base(keyPath), use.Host, use.Time) {
+				recorded++
+			}
+		}
+	}
+
+	if recorded == 0 {
+		fmt.Println("No new key logins found")
+		return
+	}
+	if dryRun {
+		fmt.Printf("Would record %d key login(s)\n", recorded)
+		return
+	}
+	if err := metadata.Save(); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("Recorded %d key login(s)\n", recorded)
+}
+
+func lastUsedString(meta *keyman.KeyMetadata) string {
+	if meta == nil || meta.LastUsed == nil {
+		return "never recorded"
+	}
+	used := meta.LastUsed.Format(time.RFC3339)
+	if meta.LastUsedHost != "" {
+		used += " (" + meta.LastUsedHost + ")"
+	}
+	return used
+}
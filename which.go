@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/donuts-are-good/keyman/pkg/keyman"
+)
+
+// which shows the identities ssh would offer when connecting to host, as
+// resolved by ssh -G so wildcards, Match blocks and defaults all apply,
+// along with the hosts it jumps through on the way and their identities.
+func which(host string) {
+	settings, err := resolveHost(host)
+	if err != nil {
+		fatal(err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("Host: %s\n", host)
+	fmt.Printf("Connects to: %s@%s:%s\n", first(settings["user"]), first(settings["hostname"]), first(settings["port"]))
+
+	var blocks []string
+	for _, block := range config.MatchingBlocks(host) {
+		blocks = append(blocks, block.Name())
+	}
+	if len(blocks) > 0 {
+		fmt.Printf("Matching blocks: %s\n", strings.Join(blocks, ", "))
+	}
+
+	chain, err := config.JumpChain(host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if len(chain) > 0 {
+		var hops []string
+		for _, hop := range chain {
+			hops = append(hops, hop.Host)
+		}
+		fmt.Printf("Jump chain: %s -> %s\n", strings.Join(hops, " -> "), host)
+	}
+
+	identitiesOnly := first(settings["identitiesonly"]) == "yes"
+	fmt.Printf("IdentitiesOnly: %t\n", identitiesOnly)
+
+	fmt.Println("\n--- Identities ---")
+	for _, identity := range settings["identityfile"] {
+		printIdentity(identity)
+	}
+
+	if !identitiesOnly {
+		fmt.Println("\nKeys loaded in ssh-agent are offered before these, since IdentitiesOnly is not set")
+	}
+
+	if len(chain) > 0 {
+		fmt.Println("\n--- Jump Hosts ---")
+		for i, hop := range chain {
+			if i > 0 {
+				fmt.Println()
+			}
+			address := orDefault(hop.HostName, hop.Host) + ":" + orDefault(hop.Port, "22")
+			if hop.User != "" {
+				address = hop.User + "@" + address
+			}
+			fmt.Printf("%s (via %s): %s\n", hop.Host, hop.Via, address)
+			if len(hop.Identities) == 0 {
+				fmt.Println("No IdentityFile, keys in ssh-agent and the default keys are offered")
+			}
+			for _, identity := range hop.Identities {
+				printIdentity(identity)
+			}
+		}
+	}
+}
+
+// printIdentity prints the expanded path of an IdentityFile and whether it
+// exists.
+func printIdentity(identity string) {
+	path, err := keyman.ExpandPath(identity)
+	if err != nil {
+		path = identity
+	}
+	status := "missing"
+	if _, err := os.Stat(path); err == nil {
+		status = "exists"
+	}
+	fmt.Printf("%s (%s)\n", path, status)
+}
+
+// resolveHost returns the effective client settings for host from ssh -G,
+// keyed by lowercased option name. Options such as IdentityFile can have
+// several values.
+func resolveHost(host string) (map[string][]string, error) {
+	args := []string{"-G"}
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(configPath); err == nil {
+		args = append(args, "-F", configPath)
+	}
+	args = append(args, "--", host)
+
+	cmd := exec.Command(toolPath("ssh"), args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ssh -G %s: %v: %s", host, err, strings.TrimSpace(stderr.String()))
+	}
+
+	settings := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		settings[key] = append(settings[key], value)
+	}
+	return settings, scanner.Err()
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}